@@ -0,0 +1,138 @@
+package addrmgr
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+)
+
+// KnownAddress is an address together with what we learned from connecting
+// to it.
+type KnownAddress struct {
+	Addr        netaddr.NetAddr
+	Attempts    int
+	LastAttempt time.Time
+	LastSuccess time.Time
+}
+
+// GroupFunc returns the bucket key of an address. Addresses with the same
+// key are assumed to be run by the same operator.
+type GroupFunc func(netaddr.NetAddr) string
+
+// AddrManager keeps the addresses we know about and hands out candidates for
+// outbound connections. Addresses are bucketed by network group so that a
+// single operator announcing many addresses is not picked more often.
+type AddrManager struct {
+	mu      sync.Mutex
+	addrs   map[string]*KnownAddress
+	groups  map[string][]string
+	groupOf GroupFunc
+	rand    *rand.Rand
+}
+
+// New returns an empty address manager bucketing addresses by NetGroup.
+func New() *AddrManager {
+	return NewWithGroups(netaddr.NetAddr.NetGroup)
+}
+
+// NewWithGroups returns an empty address manager bucketing addresses by the
+// key returned by groupOf, for example their ASN.
+func NewWithGroups(groupOf GroupFunc) *AddrManager {
+	return &AddrManager{
+		addrs:   make(map[string]*KnownAddress),
+		groups:  make(map[string][]string),
+		groupOf: groupOf,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Group returns the bucket key of addr.
+func (a *AddrManager) Group(addr netaddr.NetAddr) string {
+	return a.groupOf(addr)
+}
+
+// Add records addrs and returns how many of them were new.
+func (a *AddrManager) Add(addrs ...netaddr.NetAddr) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		key := addr.String()
+		if known, ok := a.addrs[key]; ok {
+			known.Addr.Services |= addr.Services
+			continue
+		}
+		a.addrs[key] = &KnownAddress{Addr: addr}
+		group := a.groupOf(addr)
+		a.groups[group] = append(a.groups[group], key)
+		added++
+	}
+	return added
+}
+
+// Len returns the number of known addresses.
+func (a *AddrManager) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.addrs)
+}
+
+// Candidate picks a random address for an outbound connection. A random
+// group is chosen first and then a random address within it. Addresses for
+// which skip returns true are never returned.
+func (a *AddrManager) Candidate(skip func(netaddr.NetAddr) bool) (netaddr.NetAddr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	groups := make([]string, 0, len(a.groups))
+	for group := range a.groups {
+		groups = append(groups, group)
+	}
+	a.rand.Shuffle(len(groups), func(i, j int) { groups[i], groups[j] = groups[j], groups[i] })
+
+	for _, group := range groups {
+		keys := a.groups[group]
+		start := a.rand.Intn(len(keys))
+		for i := range keys {
+			known := a.addrs[keys[(start+i)%len(keys)]]
+			if skip == nil || !skip(known.Addr) {
+				return known.Addr, true
+			}
+		}
+	}
+	return netaddr.NetAddr{}, false
+}
+
+// Attempt records a connection attempt to addr.
+func (a *AddrManager) Attempt(addr netaddr.NetAddr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if known, ok := a.addrs[addr.String()]; ok {
+		known.Attempts++
+		known.LastAttempt = time.Now()
+	}
+}
+
+// Good records a successful handshake with addr.
+func (a *AddrManager) Good(addr netaddr.NetAddr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if known, ok := a.addrs[addr.String()]; ok {
+		known.Attempts = 0
+		known.LastSuccess = time.Now()
+	}
+}
+
+// Lookup returns what we know about addr.
+func (a *AddrManager) Lookup(addr netaddr.NetAddr) (KnownAddress, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	known, ok := a.addrs[addr.String()]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *known, true
+}
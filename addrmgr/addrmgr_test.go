@@ -0,0 +1,72 @@
+package addrmgr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdd(t *testing.T) {
+	a := New()
+	assert.Equal(t, 2, a.Add(netaddr.NewNetAddr("1.2.3.4", 8333, 1), netaddr.NewNetAddr("5.6.7.8", 8333, 1)))
+	assert.Equal(t, 0, a.Add(netaddr.NewNetAddr("1.2.3.4", 8333, 8)))
+	assert.Equal(t, 2, a.Len())
+
+	known, ok := a.Lookup(netaddr.NewNetAddr("1.2.3.4", 8333, 0))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(9), known.Addr.Services, "services should be merged")
+}
+
+func TestCandidate(t *testing.T) {
+	a := New()
+	_, ok := a.Candidate(nil)
+	assert.False(t, ok, "empty manager should have no candidates")
+
+	a.Add(netaddr.NewNetAddr("1.2.3.4", 8333, 1), netaddr.NewNetAddr("1.2.9.9", 8333, 1), netaddr.NewNetAddr("5.6.7.8", 8333, 1))
+
+	skipGroup := func(addr netaddr.NetAddr) bool { return addr.NetGroup() == "1.2" }
+	for i := 0; i < 20; i++ {
+		addr, ok := a.Candidate(skipGroup)
+		assert.True(t, ok)
+		assert.Equal(t, "5.6.7.8:8333", addr.String())
+	}
+
+	_, ok = a.Candidate(func(netaddr.NetAddr) bool { return true })
+	assert.False(t, ok)
+}
+
+func TestAttemptAndGood(t *testing.T) {
+	a := New()
+	addr := netaddr.NewNetAddr("1.2.3.4", 8333, 1)
+	a.Add(addr)
+
+	a.Attempt(addr)
+	a.Attempt(addr)
+	known, _ := a.Lookup(addr)
+	assert.Equal(t, 2, known.Attempts)
+	assert.False(t, known.LastAttempt.IsZero())
+	assert.True(t, known.LastSuccess.IsZero())
+
+	a.Good(addr)
+	known, _ = a.Lookup(addr)
+	assert.Equal(t, 0, known.Attempts)
+	assert.False(t, known.LastSuccess.IsZero())
+}
+
+func TestCustomGroups(t *testing.T) {
+	// Two /16s announced from the same AS share a bucket.
+	asn := map[string]string{"1.2.3.4": "AS1", "5.6.7.8": "AS1", "9.9.9.9": "AS2"}
+	a := NewWithGroups(func(addr netaddr.NetAddr) string { return asn[net.IP(addr.IP[:]).String()] })
+	a.Add(netaddr.NewNetAddr("1.2.3.4", 8333, 1), netaddr.NewNetAddr("5.6.7.8", 8333, 1), netaddr.NewNetAddr("9.9.9.9", 8333, 1))
+
+	assert.Equal(t, "AS1", a.Group(netaddr.NewNetAddr("5.6.7.8", 8333, 0)))
+
+	skipAS1 := func(addr netaddr.NetAddr) bool { return a.Group(addr) == "AS1" }
+	for i := 0; i < 20; i++ {
+		addr, ok := a.Candidate(skipAS1)
+		assert.True(t, ok)
+		assert.Equal(t, "9.9.9.9:8333", addr.String())
+	}
+}
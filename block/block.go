@@ -0,0 +1,212 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+const (
+	// MaxBlockWeight is the consensus limit on block weight (BIP141).
+	MaxBlockWeight = 4_000_000
+	// MaxBlockSize bounds a serialized block, witness data included.
+	MaxBlockSize = MaxBlockWeight
+
+	// minTxSize is the size of the smallest serializable transaction, used to
+	// reject absurd transaction counts before allocating.
+	minTxSize = 60
+)
+
+// witnessCommitmentHeader starts the coinbase output holding the witness
+// commitment: OP_RETURN, a 36-byte push and the 0xaa21a9ed tag (BIP141).
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+var (
+	// ErrBadMerkleRoot is returned when the header does not commit to the
+	// block's transactions.
+	ErrBadMerkleRoot = errors.New("merkle root mismatch")
+	// ErrMutatedMerkleRoot is returned for a transaction list that repeats
+	// transactions so that it hashes to the merkle root of a different list
+	// (CVE-2012-2459).
+	ErrMutatedMerkleRoot = errors.New("duplicate transaction in merkle tree")
+	// ErrBadWitnessCommitment is returned when the coinbase does not commit
+	// to the witness data of the block's transactions.
+	ErrBadWitnessCommitment = errors.New("witness commitment mismatch")
+)
+
+// Block is a block header and its transactions.
+type Block struct {
+	Header       Header
+	Transactions []*transaction.Tx
+}
+
+// Hash returns the block hash.
+func (b *Block) Hash() utils.Hash {
+	return b.Header.Hash()
+}
+
+// TxHashes returns the txids of the block's transactions in order.
+func (b *Block) TxHashes() []utils.Hash {
+	hashes := make([]utils.Hash, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		hashes[i] = tx.TxID()
+	}
+	return hashes
+}
+
+// CheckMerkleRoot verifies that the header commits to the transactions and
+// that the transaction list is not a CVE-2012-2459 mutation.
+func (b *Block) CheckMerkleRoot() error {
+	root, mutated := MerkleRoot(b.TxHashes())
+	if root != b.Header.MerkleRoot {
+		return fmt.Errorf("%w: header has %s, transactions hash to %s", ErrBadMerkleRoot, b.Header.MerkleRoot, root)
+	}
+	if mutated {
+		return ErrMutatedMerkleRoot
+	}
+	return nil
+}
+
+// CheckWitnessCommitment verifies that the coinbase commits to the witness
+// data of the transactions, which the merkle root does not cover (BIP141).
+// A block without a commitment must not carry witness data.
+func (b *Block) CheckWitnessCommitment() error {
+	if len(b.Transactions) == 0 || len(b.Transactions[0].TxIn) == 0 {
+		return nil
+	}
+	coinbase := b.Transactions[0]
+	// The last output matching the header holds the commitment.
+	var commitment []byte
+	for _, out := range coinbase.TxOut {
+		if len(out.PkScript) >= len(witnessCommitmentHeader)+utils.HashSize && bytes.HasPrefix(out.PkScript, witnessCommitmentHeader) {
+			commitment = out.PkScript[len(witnessCommitmentHeader) : len(witnessCommitmentHeader)+utils.HashSize]
+		}
+	}
+	if commitment == nil {
+		for _, tx := range b.Transactions {
+			if tx.HasWitness() {
+				return fmt.Errorf("%w: witness data without a commitment", ErrBadWitnessCommitment)
+			}
+		}
+		return nil
+	}
+
+	reserved := coinbase.TxIn[0].Witness
+	if len(reserved) != 1 || len(reserved[0]) != utils.HashSize {
+		return fmt.Errorf("%w: the coinbase witness is not a 32-byte reserved value", ErrBadWitnessCommitment)
+	}
+	// The coinbase counts with a zero wtxid.
+	wtxids := make([]utils.Hash, len(b.Transactions))
+	for i, tx := range b.Transactions[1:] {
+		wtxids[i+1] = tx.WTxID()
+	}
+	root, _ := MerkleRoot(wtxids)
+	if want := utils.DoubleSHA256(append(root[:], reserved[0]...)); !bytes.Equal(commitment, want[:]) {
+		return fmt.Errorf("%w: coinbase has %x, witnesses hash to %x", ErrBadWitnessCommitment, commitment, want[:])
+	}
+	return nil
+}
+
+// Bytes returns the serialization of the block with witness data.
+func (b *Block) Bytes() []byte {
+	var buf bytes.Buffer
+	b.Serialize(&buf)
+	return buf.Bytes()
+}
+
+// Serialize writes the block, with the witness data of its transactions.
+func (b *Block) Serialize(w io.Writer) error {
+	return b.serialize(w, true)
+}
+
+// SerializeNoWitness writes the block with every transaction in the legacy
+// format, as sent to peers that do not support segwit.
+func (b *Block) SerializeNoWitness(w io.Writer) error {
+	return b.serialize(w, false)
+}
+
+func (b *Block) serialize(w io.Writer, witness bool) error {
+	if err := b.Header.Serialize(w); err != nil {
+		return err
+	}
+	if err := utils.WriteVarInt(w, uint64(len(b.Transactions))); err != nil {
+		return err
+	}
+	for _, tx := range b.Transactions {
+		var err error
+		if witness {
+			err = tx.Serialize(w)
+		} else {
+			err = tx.SerializeNoWitness(w)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BaseSize returns the size of the block without witness data.
+func (b *Block) BaseSize() int {
+	var buf bytes.Buffer
+	b.SerializeNoWitness(&buf)
+	return buf.Len()
+}
+
+// TotalSize returns the size of the block including witness data.
+func (b *Block) TotalSize() int {
+	return len(b.Bytes())
+}
+
+// Weight returns the BIP141 block weight.
+func (b *Block) Weight() int {
+	return b.BaseSize()*(transaction.WitnessScaleFactor-1) + b.TotalSize()
+}
+
+// ReadBlock reads a block.
+func ReadBlock(r io.Reader) (*Block, error) {
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxBlockSize/minTxSize {
+		return nil, fmt.Errorf("too many transactions in block: %d", count)
+	}
+
+	b := &Block{Header: *header, Transactions: make([]*transaction.Tx, count)}
+	for i := range b.Transactions {
+		if b.Transactions[i], err = transaction.ReadTx(r); err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+	return b, nil
+}
+
+// EncodeBlockMessage returns the payload of a block message.
+func EncodeBlockMessage(b *Block) []byte {
+	return b.Bytes()
+}
+
+// DecodeBlockMessage parses the payload of a block message.
+func DecodeBlockMessage(payload []byte) (*Block, error) {
+	if len(payload) > MaxBlockSize {
+		return nil, fmt.Errorf("block too large: %d bytes", len(payload))
+	}
+	r := bytes.NewReader(payload)
+	b, err := ReadBlock(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after block", r.Len())
+	}
+	return b, nil
+}
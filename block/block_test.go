@@ -0,0 +1,176 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHash(t *testing.T, s string) utils.Hash {
+	t.Helper()
+	h, err := utils.NewHashFromString(s)
+	require.NoError(t, err)
+	return h
+}
+
+func TestGenesisBlocks(t *testing.T) {
+	genesisMerkleRoot := "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+	tests := []struct {
+		params     *config.ChainParams
+		merkleRoot string
+		timestamp  uint32
+		bits       uint32
+		nonce      uint32
+	}{
+		{&config.MainNetParams, genesisMerkleRoot, 1231006505, 0x1d00ffff, 2083236893},
+		{&config.TestNet3Params, genesisMerkleRoot, 1296688602, 0x1d00ffff, 414098458},
+		{&config.TestNet4Params, "7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e", 1714777860, 0x1d00ffff, 393743547},
+		{&config.SigNetParams, genesisMerkleRoot, 1598918400, 0x1e0377ae, 52613770},
+		{&config.RegTestParams, genesisMerkleRoot, 1296688602, 0x207fffff, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.params.Name, func(t *testing.T) {
+			b, err := DecodeBlockMessage(tt.params.GenesisBlock)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.params.GenesisHash, b.Hash())
+			assert.Equal(t, int32(1), b.Header.Version)
+			assert.Equal(t, utils.Hash{}, b.Header.PrevBlock)
+			assert.Equal(t, tt.merkleRoot, b.Header.MerkleRoot.String())
+			assert.Equal(t, tt.timestamp, b.Header.Timestamp)
+			assert.Equal(t, tt.bits, b.Header.Bits)
+			assert.Equal(t, tt.nonce, b.Header.Nonce)
+			assert.True(t, b.Header.CheckProofOfWork())
+
+			require.Len(t, b.Transactions, 1)
+			assert.True(t, b.Transactions[0].IsCoinBase())
+			assert.Equal(t, b.Header.MerkleRoot, b.Transactions[0].TxID(), "single transaction is its own root")
+			assert.NoError(t, b.CheckMerkleRoot())
+
+			assert.Equal(t, tt.params.GenesisBlock, EncodeBlockMessage(b))
+			assert.Equal(t, len(tt.params.GenesisBlock), b.TotalSize())
+			assert.Equal(t, b.TotalSize(), b.BaseSize())
+			assert.Equal(t, 4*b.TotalSize(), b.Weight())
+		})
+	}
+}
+
+func TestMainnetMerkleRoot(t *testing.T) {
+	// Block 100000.
+	txids := []utils.Hash{
+		mustHash(t, "8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87"),
+		mustHash(t, "fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4"),
+		mustHash(t, "6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4"),
+		mustHash(t, "e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d"),
+	}
+	root, mutated := MerkleRoot(txids)
+	assert.Equal(t, "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766", root.String())
+	assert.False(t, mutated)
+
+	// Three transactions: the third is paired with itself, which is not a
+	// mutation.
+	root3, mutated := MerkleRoot(txids[:3])
+	assert.False(t, mutated)
+
+	// Appending a copy of the third transaction gives the same root: the
+	// CVE-2012-2459 mutation, which must be flagged.
+	mutatedRoot, mutated := MerkleRoot(append(txids[:3:3], txids[2]))
+	assert.Equal(t, root3, mutatedRoot)
+	assert.True(t, mutated)
+
+	empty, mutated := MerkleRoot(nil)
+	assert.Equal(t, utils.Hash{}, empty)
+	assert.False(t, mutated)
+}
+
+func testBlock(t *testing.T, txCount int) *Block {
+	t.Helper()
+	b := &Block{Header: Header{Version: 4, Timestamp: 1700000000, Bits: 0x207fffff}}
+	for i := 0; i < txCount; i++ {
+		b.Transactions = append(b.Transactions, &transaction.Tx{
+			Version:  2,
+			TxIn:     []transaction.TxIn{{PreviousOutPoint: transaction.OutPoint{Index: uint32(i)}, SignatureScript: []byte{byte(i)}}},
+			TxOut:    []transaction.TxOut{{Value: int64(i), PkScript: []byte{0x51}}},
+			LockTime: 0,
+		})
+	}
+	b.Header.MerkleRoot, _ = MerkleRoot(b.TxHashes())
+	return b
+}
+
+func TestCheckMerkleRoot(t *testing.T) {
+	b := testBlock(t, 3)
+	require.NoError(t, b.CheckMerkleRoot())
+
+	decoded, err := DecodeBlockMessage(EncodeBlockMessage(b))
+	require.NoError(t, err)
+	assert.Equal(t, b.Hash(), decoded.Hash())
+	assert.NoError(t, decoded.CheckMerkleRoot())
+
+	// Same header, last transaction duplicated.
+	mutated := &Block{Header: b.Header, Transactions: append(b.Transactions[:3:3], b.Transactions[2])}
+	assert.ErrorIs(t, mutated.CheckMerkleRoot(), ErrMutatedMerkleRoot)
+	assert.Equal(t, b.Hash(), mutated.Hash(), "the mutation leaves the block hash unchanged")
+
+	tampered := testBlock(t, 3)
+	tampered.Transactions[1].LockTime = 1
+	assert.ErrorIs(t, tampered.CheckMerkleRoot(), ErrBadMerkleRoot)
+}
+
+// commit adds a witness commitment to the coinbase of b, the first
+// transaction, and updates the merkle root.
+func commit(b *Block) {
+	coinbase := b.Transactions[0]
+	coinbase.TxIn[0].Witness = [][]byte{make([]byte, utils.HashSize)}
+	wtxids := make([]utils.Hash, len(b.Transactions))
+	for i, tx := range b.Transactions[1:] {
+		wtxids[i+1] = tx.WTxID()
+	}
+	root, _ := MerkleRoot(wtxids)
+	commitment := utils.DoubleSHA256(append(root[:], coinbase.TxIn[0].Witness[0]...))
+	coinbase.TxOut = append(coinbase.TxOut, transaction.TxOut{PkScript: append(bytes.Clone(witnessCommitmentHeader), commitment[:]...)})
+	b.Header.MerkleRoot, _ = MerkleRoot(b.TxHashes())
+}
+
+func TestCheckWitnessCommitment(t *testing.T) {
+	genesis, err := DecodeBlockMessage(config.MainNetParams.GenesisBlock)
+	require.NoError(t, err)
+	assert.NoError(t, genesis.CheckWitnessCommitment(), "no witness, no commitment")
+
+	b := testBlock(t, 3)
+	b.Transactions[1].TxIn[0].Witness = [][]byte{{1, 2, 3}}
+	assert.ErrorIs(t, b.CheckWitnessCommitment(), ErrBadWitnessCommitment, "witness without a commitment")
+
+	commit(b)
+	require.NoError(t, b.CheckMerkleRoot())
+	assert.NoError(t, b.CheckWitnessCommitment())
+
+	// Altered witnesses leave the merkle root valid but break the
+	// commitment.
+	b.Transactions[1].TxIn[0].Witness = [][]byte{{4, 5, 6}}
+	assert.NoError(t, b.CheckMerkleRoot())
+	assert.ErrorIs(t, b.CheckWitnessCommitment(), ErrBadWitnessCommitment)
+
+	b.Transactions[1].TxIn[0].Witness = [][]byte{{1, 2, 3}}
+	b.Transactions[0].TxIn[0].Witness = nil
+	assert.ErrorIs(t, b.CheckWitnessCommitment(), ErrBadWitnessCommitment, "missing reserved value")
+}
+
+func TestDecodeBlockErrors(t *testing.T) {
+	genesis := config.MainNetParams.GenesisBlock
+
+	_, err := DecodeBlockMessage(genesis[:len(genesis)-1])
+	assert.Error(t, err)
+
+	_, err = DecodeBlockMessage(append(bytes.Clone(genesis), 0x00))
+	assert.ErrorContains(t, err, "trailing")
+
+	hugeCount := append(bytes.Clone(genesis[:HeaderSize]), 0xfe, 0xff, 0xff, 0xff, 0x00)
+	_, err = DecodeBlockMessage(hugeCount)
+	assert.ErrorContains(t, err, "too many transactions")
+}
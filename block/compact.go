@@ -0,0 +1,278 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// ShortIDSize is the size of the short transaction IDs of a compact block
+// (BIP152).
+const ShortIDSize = 6
+
+// CompactBlock is the body of a cmpctblock message (BIP152): a header, the
+// short IDs of the transactions the receiver is expected to have and the
+// transactions sent in full, such as the coinbase.
+type CompactBlock struct {
+	Header Header
+	// Nonce keys the short IDs together with the header.
+	Nonce     uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+// PrefilledTx is a transaction of a compact block sent in full.
+type PrefilledTx struct {
+	// Index is the position of the transaction in the block.
+	Index uint32
+	Tx    *transaction.Tx
+}
+
+// TxCount returns the number of transactions of the block.
+func (cb *CompactBlock) TxCount() int {
+	return len(cb.ShortIDs) + len(cb.Prefilled)
+}
+
+// ShortIDKeys returns the SipHash keys of the block's short IDs: the first
+// two little-endian uint64s of SHA256(header || nonce).
+func (cb *CompactBlock) ShortIDKeys() (k0, k1 uint64) {
+	data := binary.LittleEndian.AppendUint64(cb.Header.Bytes(), cb.Nonce)
+	key := sha256.Sum256(data)
+	return binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:16])
+}
+
+// ShortID returns the short ID of the transaction with the given wtxid
+// under the keys of a compact block. Version 2 compact blocks use wtxids,
+// version 1 ones txids.
+func ShortID(k0, k1 uint64, wtxid utils.Hash) uint64 {
+	return utils.SipHash(k0, k1, wtxid[:]) & (1<<(8*ShortIDSize) - 1)
+}
+
+// NewCompactBlock returns the version 2 compact block of b keyed with nonce.
+// Only the coinbase is prefilled.
+func NewCompactBlock(b *Block, nonce uint64) *CompactBlock {
+	cb := &CompactBlock{Header: b.Header, Nonce: nonce}
+	if len(b.Transactions) == 0 {
+		return cb
+	}
+	cb.Prefilled = []PrefilledTx{{Index: 0, Tx: b.Transactions[0]}}
+	k0, k1 := cb.ShortIDKeys()
+	for _, tx := range b.Transactions[1:] {
+		cb.ShortIDs = append(cb.ShortIDs, ShortID(k0, k1, tx.WTxID()))
+	}
+	return cb
+}
+
+// EncodeCompactBlockMessage returns the payload of a cmpctblock message.
+// Prefilled transactions must be ordered by index.
+func EncodeCompactBlockMessage(cb *CompactBlock) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := cb.Header.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	binary.Write(&buf, binary.LittleEndian, cb.Nonce)
+	if err := utils.WriteVarInt(&buf, uint64(len(cb.ShortIDs))); err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	for _, shortID := range cb.ShortIDs {
+		binary.LittleEndian.PutUint64(id[:], shortID)
+		buf.Write(id[:ShortIDSize])
+	}
+
+	if err := utils.WriteVarInt(&buf, uint64(len(cb.Prefilled))); err != nil {
+		return nil, err
+	}
+	// Indexes are sent as the difference to the previous one, minus one.
+	next := uint32(0)
+	for _, p := range cb.Prefilled {
+		if p.Index < next {
+			return nil, fmt.Errorf("prefilled transaction index %d out of order", p.Index)
+		}
+		if err := utils.WriteVarInt(&buf, uint64(p.Index-next)); err != nil {
+			return nil, err
+		}
+		if err := p.Tx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+		next = p.Index + 1
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeCompactBlockMessage parses the payload of a cmpctblock message.
+func DecodeCompactBlockMessage(payload []byte) (*CompactBlock, error) {
+	r := bytes.NewReader(payload)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	cb := &CompactBlock{Header: *header}
+	if err := binary.Read(r, binary.LittleEndian, &cb.Nonce); err != nil {
+		return nil, err
+	}
+
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()/ShortIDSize) {
+		return nil, fmt.Errorf("too many short IDs: %d", count)
+	}
+	cb.ShortIDs = make([]uint64, count)
+	var id [8]byte
+	for i := range cb.ShortIDs {
+		if _, err := io.ReadFull(r, id[:ShortIDSize]); err != nil {
+			return nil, err
+		}
+		cb.ShortIDs[i] = binary.LittleEndian.Uint64(id[:])
+	}
+
+	count, err = utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxBlockSize/minTxSize {
+		return nil, fmt.Errorf("too many prefilled transactions: %d", count)
+	}
+	next := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		diff, err := utils.ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		index := next + diff
+		if index > 0xffff {
+			return nil, fmt.Errorf("prefilled transaction index %d out of range", index)
+		}
+		tx, err := transaction.ReadTx(r)
+		if err != nil {
+			return nil, fmt.Errorf("prefilled transaction %d: %w", index, err)
+		}
+		cb.Prefilled = append(cb.Prefilled, PrefilledTx{Index: uint32(index), Tx: tx})
+		next = index + 1
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after compact block", r.Len())
+	}
+	return cb, nil
+}
+
+// BlockTxnRequest is the body of a getblocktxn message: the indexes of the
+// transactions of a compact block the receiver could not rebuild.
+type BlockTxnRequest struct {
+	BlockHash utils.Hash
+	// Indexes are the positions of the transactions in the block, in
+	// increasing order.
+	Indexes []uint32
+}
+
+// EncodeGetBlockTxnMessage returns the payload of a getblocktxn message.
+func EncodeGetBlockTxnMessage(req *BlockTxnRequest) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(req.BlockHash[:])
+	if err := utils.WriteVarInt(&buf, uint64(len(req.Indexes))); err != nil {
+		return nil, err
+	}
+	// Indexes are encoded differentially, as those of prefilled
+	// transactions.
+	next := uint32(0)
+	for _, index := range req.Indexes {
+		if index < next {
+			return nil, fmt.Errorf("requested transaction index %d out of order", index)
+		}
+		if err := utils.WriteVarInt(&buf, uint64(index-next)); err != nil {
+			return nil, err
+		}
+		next = index + 1
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeGetBlockTxnMessage parses the payload of a getblocktxn message.
+func DecodeGetBlockTxnMessage(payload []byte) (*BlockTxnRequest, error) {
+	r := bytes.NewReader(payload)
+	req := &BlockTxnRequest{}
+	if _, err := io.ReadFull(r, req.BlockHash[:]); err != nil {
+		return nil, err
+	}
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("too many requested transactions: %d", count)
+	}
+	req.Indexes = make([]uint32, count)
+	next := uint64(0)
+	for i := range req.Indexes {
+		diff, err := utils.ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		index := next + diff
+		if index > 0xffff {
+			return nil, fmt.Errorf("requested transaction index %d out of range", index)
+		}
+		req.Indexes[i] = uint32(index)
+		next = index + 1
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after getblocktxn", r.Len())
+	}
+	return req, nil
+}
+
+// BlockTxns is the body of a blocktxn message: the transactions of a
+// getblocktxn request, in the order they were asked for.
+type BlockTxns struct {
+	BlockHash    utils.Hash
+	Transactions []*transaction.Tx
+}
+
+// EncodeBlockTxnMessage returns the payload of a blocktxn message.
+func EncodeBlockTxnMessage(bt *BlockTxns) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(bt.BlockHash[:])
+	if err := utils.WriteVarInt(&buf, uint64(len(bt.Transactions))); err != nil {
+		return nil, err
+	}
+	for _, tx := range bt.Transactions {
+		if err := tx.Serialize(&buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBlockTxnMessage parses the payload of a blocktxn message.
+func DecodeBlockTxnMessage(payload []byte) (*BlockTxns, error) {
+	r := bytes.NewReader(payload)
+	bt := &BlockTxns{}
+	if _, err := io.ReadFull(r, bt.BlockHash[:]); err != nil {
+		return nil, err
+	}
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxBlockSize/minTxSize {
+		return nil, fmt.Errorf("too many transactions: %d", count)
+	}
+	for i := uint64(0); i < count; i++ {
+		tx, err := transaction.ReadTx(r)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		bt.Transactions = append(bt.Transactions, tx)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after blocktxn", r.Len())
+	}
+	return bt, nil
+}
@@ -0,0 +1,88 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactBlockMessage(t *testing.T) {
+	b := testBlock(t, 4)
+	cb := &CompactBlock{
+		Header:   b.Header,
+		Nonce:    0x0102030405060708,
+		ShortIDs: []uint64{0xffffffffffff, 0x010203040506},
+		Prefilled: []PrefilledTx{
+			{Index: 0, Tx: b.Transactions[0]},
+			{Index: 3, Tx: b.Transactions[3]},
+		},
+	}
+	payload, err := EncodeCompactBlockMessage(cb)
+	require.NoError(t, err)
+	// The second prefilled index is sent as 3-(0+1).
+	offset := HeaderSize + 8 + 1 + 2*ShortIDSize + 1
+	assert.Equal(t, byte(0), payload[offset])
+	assert.Equal(t, byte(2), payload[offset+1+len(b.Transactions[0].Bytes())])
+
+	decoded, err := DecodeCompactBlockMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, cb.Header, decoded.Header)
+	assert.Equal(t, cb.Nonce, decoded.Nonce)
+	assert.Equal(t, cb.ShortIDs, decoded.ShortIDs)
+	require.Len(t, decoded.Prefilled, 2)
+	assert.Equal(t, uint32(3), decoded.Prefilled[1].Index)
+	assert.Equal(t, b.Transactions[3].TxID(), decoded.Prefilled[1].Tx.TxID())
+	assert.Equal(t, 4, decoded.TxCount())
+
+	_, err = DecodeCompactBlockMessage(payload[:len(payload)-1])
+	assert.Error(t, err)
+	_, err = DecodeCompactBlockMessage(append(payload, 0))
+	assert.ErrorContains(t, err, "trailing")
+
+	cb.Prefilled[0], cb.Prefilled[1] = cb.Prefilled[1], cb.Prefilled[0]
+	_, err = EncodeCompactBlockMessage(cb)
+	assert.ErrorContains(t, err, "out of order")
+}
+
+func TestNewCompactBlock(t *testing.T) {
+	b := testBlock(t, 3)
+	cb := NewCompactBlock(b, 42)
+	require.Len(t, cb.Prefilled, 1)
+	assert.Equal(t, b.Transactions[0], cb.Prefilled[0].Tx)
+	require.Len(t, cb.ShortIDs, 2)
+
+	k0, k1 := cb.ShortIDKeys()
+	assert.Equal(t, ShortID(k0, k1, b.Transactions[2].WTxID()), cb.ShortIDs[1])
+	assert.Zero(t, cb.ShortIDs[0]>>(8*ShortIDSize), "short IDs are 6 bytes")
+
+	other := NewCompactBlock(b, 43)
+	assert.NotEqual(t, cb.ShortIDs, other.ShortIDs, "the nonce keys the short IDs")
+}
+
+func TestBlockTxnMessages(t *testing.T) {
+	req := &BlockTxnRequest{BlockHash: utils.Hash{1}, Indexes: []uint32{1, 2, 300}}
+	payload, err := EncodeGetBlockTxnMessage(req)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 1, 0, 0xfd, 0x29, 0x01}, payload[32:], "indexes are differentially encoded")
+	decoded, err := DecodeGetBlockTxnMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, req, decoded)
+	_, err = DecodeGetBlockTxnMessage(append(payload, 0))
+	assert.ErrorContains(t, err, "trailing")
+	_, err = EncodeGetBlockTxnMessage(&BlockTxnRequest{Indexes: []uint32{2, 1}})
+	assert.ErrorContains(t, err, "out of order")
+
+	b := testBlock(t, 2)
+	bt := &BlockTxns{BlockHash: b.Hash(), Transactions: b.Transactions}
+	payload, err = EncodeBlockTxnMessage(bt)
+	require.NoError(t, err)
+	decodedTxs, err := DecodeBlockTxnMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, bt.BlockHash, decodedTxs.BlockHash)
+	require.Len(t, decodedTxs.Transactions, 2)
+	assert.Equal(t, b.Transactions[1].TxID(), decodedTxs.Transactions[1].TxID())
+	_, err = DecodeBlockTxnMessage(payload[:len(payload)-1])
+	assert.Error(t, err)
+}
@@ -0,0 +1,145 @@
+// Package block implements block headers, blocks, merkle roots and the
+// block, headers, getheaders and getblocks messages.
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// HeaderSize is the size of a serialized block header.
+const HeaderSize = 80
+
+// Header is a block header.
+type Header struct {
+	Version    int32
+	PrevBlock  utils.Hash
+	MerkleRoot utils.Hash
+	Timestamp  uint32
+	Bits       uint32
+	Nonce      uint32
+}
+
+// Time returns the header timestamp.
+func (h *Header) Time() time.Time {
+	return time.Unix(int64(h.Timestamp), 0)
+}
+
+// Hash returns the block hash, the double-SHA256 of the header.
+func (h *Header) Hash() utils.Hash {
+	return utils.DoubleSHA256(h.Bytes())
+}
+
+// Bytes returns the 80-byte serialization of the header.
+func (h *Header) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(HeaderSize)
+	h.Serialize(&buf)
+	return buf.Bytes()
+}
+
+// Serialize writes the header to w.
+func (h *Header) Serialize(w io.Writer) error {
+	var b [HeaderSize]byte
+	binary.LittleEndian.PutUint32(b[0:4], uint32(h.Version))
+	copy(b[4:36], h.PrevBlock[:])
+	copy(b[36:68], h.MerkleRoot[:])
+	binary.LittleEndian.PutUint32(b[68:72], h.Timestamp)
+	binary.LittleEndian.PutUint32(b[72:76], h.Bits)
+	binary.LittleEndian.PutUint32(b[76:80], h.Nonce)
+	_, err := w.Write(b[:])
+	return err
+}
+
+// ReadHeader reads an 80-byte block header.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	h := &Header{
+		Version:   int32(binary.LittleEndian.Uint32(b[0:4])),
+		Timestamp: binary.LittleEndian.Uint32(b[68:72]),
+		Bits:      binary.LittleEndian.Uint32(b[72:76]),
+		Nonce:     binary.LittleEndian.Uint32(b[76:80]),
+	}
+	copy(h.PrevBlock[:], b[4:36])
+	copy(h.MerkleRoot[:], b[36:68])
+	return h, nil
+}
+
+// Target returns the proof-of-work target encoded in Bits.
+func (h *Header) Target() *big.Int {
+	return CompactToBig(h.Bits)
+}
+
+// CheckProofOfWork reports whether the block hash is at or below the target.
+// A negative or zero target never passes.
+func (h *Header) CheckProofOfWork() bool {
+	target := h.Target()
+	if target.Sign() <= 0 {
+		return false
+	}
+	return HashToBig(h.Hash()).Cmp(target) <= 0
+}
+
+// HashToBig interprets a hash as the little-endian 256-bit number that is
+// compared against targets.
+func HashToBig(hash utils.Hash) *big.Int {
+	var reversed utils.Hash
+	for i := range hash {
+		reversed[utils.HashSize-1-i] = hash[i]
+	}
+	return new(big.Int).SetBytes(reversed[:])
+}
+
+// CompactToBig decodes the compact nBits representation of a target: an
+// exponent byte followed by a 23-bit mantissa and a sign bit.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	n := big.NewInt(mantissa)
+	if exponent <= 3 {
+		n.Rsh(n, 8*(3-exponent))
+	} else {
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if negative {
+		n.Neg(n)
+	}
+	return n
+}
+
+// BigToCompact encodes n in the compact nBits representation, losing the
+// precision beyond the 23-bit mantissa.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+	exponent := uint((n.BitLen() + 7) / 8)
+	abs := new(big.Int).Abs(n)
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(abs.Uint64() << (8 * (3 - exponent)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(abs, 8*(exponent-3)).Uint64())
+	}
+	// The mantissa is signed: shift it down a byte rather than set the
+	// sign bit of a positive number.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
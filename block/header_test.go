@@ -0,0 +1,62 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Header of mainnet block 100000.
+const block100000 = "0100000050120119172a610421a6c3011dd330d9df07b63616c2cc1f1cd00200000000006657a9252aacd5c0b2940996ecff952228c3067cc38d4885efb5a4ac4247e9f337221b4d4c86041b0f2b5710"
+
+func TestHeader(t *testing.T) {
+	raw, err := hex.DecodeString(block100000)
+	require.NoError(t, err)
+
+	h, err := ReadHeader(bytes.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "000000000003ba27aa200b1cecaad478d2b00432346c3f1f3986da1afd33e506", h.Hash().String())
+	assert.Equal(t, "000000000002d01c1fccc21636b607dfd930d31d01c3a62104612a1719011250", h.PrevBlock.String())
+	assert.Equal(t, "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766", h.MerkleRoot.String())
+	assert.Equal(t, int64(1293623863), h.Time().Unix())
+	assert.Equal(t, uint32(0x1b04864c), h.Bits)
+	assert.Equal(t, uint32(274148111), h.Nonce)
+	assert.Equal(t, raw, h.Bytes())
+	assert.True(t, h.CheckProofOfWork())
+
+	h.Nonce++
+	assert.False(t, h.CheckProofOfWork())
+
+	_, err = ReadHeader(bytes.NewReader(raw[:HeaderSize-1]))
+	assert.Error(t, err)
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		compact uint32
+		target  string
+	}{
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{0x1b04864c, "4864c000000000000000000000000000000000000000000000000"},
+		{0x207fffff, "7fffff0000000000000000000000000000000000000000000000000000000000"},
+		{0x03123456, "123456"},
+		{0x02123400, "1234"},
+		{0x01120000, "12"},
+		{0x05009234, "92340000"},
+	}
+	for _, tt := range tests {
+		target := CompactToBig(tt.compact)
+		assert.Equal(t, tt.target, target.Text(16), "%#x", tt.compact)
+		assert.Equal(t, tt.compact, BigToCompact(target), "%#x", tt.compact)
+	}
+
+	assert.Equal(t, "-123456", CompactToBig(0x03923456).Text(16))
+	assert.Equal(t, uint32(0x03923456), BigToCompact(big.NewInt(-0x123456)))
+	assert.Equal(t, uint32(0), BigToCompact(new(big.Int)))
+	// Precision beyond the mantissa is dropped.
+	assert.Equal(t, uint32(0x04123456), BigToCompact(big.NewInt(0x12345678)))
+}
@@ -0,0 +1,37 @@
+package block
+
+import "github.com/safwentrabelsi/bitcoin-handshake/utils"
+
+// MerkleRoot computes the merkle root of hashes the way Bitcoin Core does,
+// duplicating the last hash of levels with an odd count.
+//
+// Because of the duplication, a transaction list ending in a repeated run of
+// transactions has the same root as the list without the repetition
+// (CVE-2012-2459). mutated reports whether any level hashes two identical
+// siblings, which is how such lists are recognised; a block whose merkle
+// root only matches a mutated list must be rejected without marking the
+// block hash invalid.
+func MerkleRoot(hashes []utils.Hash) (root utils.Hash, mutated bool) {
+	if len(hashes) == 0 {
+		return utils.Hash{}, false
+	}
+	level := append([]utils.Hash(nil), hashes...)
+	var pair [2 * utils.HashSize]byte
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		for i := 0; i < len(level); i += 2 {
+			copy(pair[:utils.HashSize], level[i][:])
+			copy(pair[utils.HashSize:], level[i+1][:])
+			level[i/2] = utils.DoubleSHA256(pair[:])
+		}
+		level = level[:len(level)/2]
+	}
+	return level[0], mutated
+}
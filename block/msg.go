@@ -0,0 +1,123 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+const (
+	// MaxHeadersResults is the largest number of headers a headers message
+	// may carry.
+	MaxHeadersResults = 2000
+	// MaxLocatorHashes is the largest block locator Bitcoin Core accepts in
+	// getheaders and getblocks.
+	MaxLocatorHashes = 101
+)
+
+// EncodeHeadersMessage returns the payload of a headers message. Each
+// header is followed by a transaction count, which is always zero.
+func EncodeHeadersMessage(headers []Header) ([]byte, error) {
+	if len(headers) > MaxHeadersResults {
+		return nil, fmt.Errorf("too many headers: %d", len(headers))
+	}
+	var buf bytes.Buffer
+	buf.Grow(3 + len(headers)*(HeaderSize+1))
+	if err := utils.WriteVarInt(&buf, uint64(len(headers))); err != nil {
+		return nil, err
+	}
+	for i := range headers {
+		if err := headers[i].Serialize(&buf); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeHeadersMessage parses the payload of a headers message.
+func DecodeHeadersMessage(payload []byte) ([]Header, error) {
+	r := bytes.NewReader(payload)
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxHeadersResults {
+		return nil, fmt.Errorf("too many headers: %d", count)
+	}
+
+	headers := make([]Header, 0, count)
+	for i := uint64(0); i < count; i++ {
+		h, err := ReadHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		txCount, err := utils.ReadVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		if txCount != 0 {
+			return nil, fmt.Errorf("header %s has a transaction count of %d", h.Hash(), txCount)
+		}
+		headers = append(headers, *h)
+	}
+	return headers, nil
+}
+
+// Locator is the body of a getheaders or getblocks message: block hashes
+// from our tip back towards genesis, which the peer uses to find the last
+// block we have in common, and the hash to stop at. A zero HashStop asks
+// for as many blocks as the peer will send.
+type Locator struct {
+	ProtocolVersion uint32
+	Hashes          []utils.Hash
+	HashStop        utils.Hash
+}
+
+// EncodeLocatorMessage returns the payload of a getheaders or getblocks
+// message, which share the same layout.
+func EncodeLocatorMessage(l Locator) ([]byte, error) {
+	if len(l.Hashes) > MaxLocatorHashes {
+		return nil, fmt.Errorf("too many locator hashes: %d", len(l.Hashes))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, l.ProtocolVersion)
+	if err := utils.WriteVarInt(&buf, uint64(len(l.Hashes))); err != nil {
+		return nil, err
+	}
+	for _, h := range l.Hashes {
+		buf.Write(h[:])
+	}
+	buf.Write(l.HashStop[:])
+	return buf.Bytes(), nil
+}
+
+// DecodeLocatorMessage parses the payload of a getheaders or getblocks
+// message.
+func DecodeLocatorMessage(payload []byte) (Locator, error) {
+	var l Locator
+	r := bytes.NewReader(payload)
+	if err := binary.Read(r, binary.LittleEndian, &l.ProtocolVersion); err != nil {
+		return l, err
+	}
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return l, err
+	}
+	if count > MaxLocatorHashes {
+		return l, fmt.Errorf("too many locator hashes: %d", count)
+	}
+	l.Hashes = make([]utils.Hash, count)
+	for i := range l.Hashes {
+		if _, err := io.ReadFull(r, l.Hashes[i][:]); err != nil {
+			return l, err
+		}
+	}
+	if _, err := io.ReadFull(r, l.HashStop[:]); err != nil {
+		return l, err
+	}
+	return l, nil
+}
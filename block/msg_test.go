@@ -0,0 +1,65 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadersMessage(t *testing.T) {
+	genesis, err := DecodeBlockMessage(config.MainNetParams.GenesisBlock)
+	require.NoError(t, err)
+	next := testBlock(t, 2).Header
+	next.PrevBlock = genesis.Hash()
+
+	payload, err := EncodeHeadersMessage([]Header{genesis.Header, next})
+	require.NoError(t, err)
+	assert.Len(t, payload, 1+2*(HeaderSize+1))
+
+	headers, err := DecodeHeadersMessage(payload)
+	require.NoError(t, err)
+	require.Len(t, headers, 2)
+	assert.Equal(t, config.MainNetParams.GenesisHash, headers[0].Hash())
+	assert.Equal(t, next, headers[1])
+
+	empty, err := EncodeHeadersMessage(nil)
+	require.NoError(t, err)
+	headers, err = DecodeHeadersMessage(empty)
+	require.NoError(t, err)
+	assert.Empty(t, headers)
+
+	_, err = EncodeHeadersMessage(make([]Header, MaxHeadersResults+1))
+	assert.Error(t, err)
+
+	// A headers message must not carry transactions.
+	withTx := append([]byte(nil), payload...)
+	withTx[1+HeaderSize] = 1
+	_, err = DecodeHeadersMessage(withTx)
+	assert.ErrorContains(t, err, "transaction count")
+
+	_, err = DecodeHeadersMessage(payload[:len(payload)-1])
+	assert.Error(t, err)
+}
+
+func TestLocatorMessage(t *testing.T) {
+	l := Locator{
+		ProtocolVersion: 70016,
+		Hashes:          []utils.Hash{utils.DoubleSHA256([]byte("tip")), config.MainNetParams.GenesisHash},
+	}
+	payload, err := EncodeLocatorMessage(l)
+	require.NoError(t, err)
+	assert.Len(t, payload, 4+1+3*utils.HashSize)
+
+	decoded, err := DecodeLocatorMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, l, decoded)
+
+	_, err = EncodeLocatorMessage(Locator{Hashes: make([]utils.Hash, MaxLocatorHashes+1)})
+	assert.Error(t, err)
+
+	_, err = DecodeLocatorMessage(payload[:len(payload)-1])
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// ErrShortIDCollision is returned for a compact block in which two
+// transactions share a short ID. Such a block has to be downloaded in full.
+var ErrShortIDCollision = errors.New("short ID collision in compact block")
+
+// PartialBlock is a block being rebuilt from a compact block (BIP152).
+type PartialBlock struct {
+	Header Header
+	// Prefilled counts the transactions sent in the compact block and
+	// FromPool those found among the candidate transactions.
+	Prefilled int
+	FromPool  int
+
+	txs []*transaction.Tx
+}
+
+// NewPartialBlock places the prefilled transactions of cb and those of
+// candidates, such as the mempool, whose short IDs match. A short ID matched
+// by several candidates is left missing.
+func NewPartialBlock(cb *CompactBlock, candidates []*transaction.Tx) (*PartialBlock, error) {
+	count := cb.TxCount()
+	if count == 0 || count > MaxBlockSize/minTxSize {
+		return nil, fmt.Errorf("invalid compact block transaction count: %d", count)
+	}
+	pb := &PartialBlock{Header: cb.Header, txs: make([]*transaction.Tx, count)}
+	for _, p := range cb.Prefilled {
+		if int(p.Index) >= count || pb.txs[p.Index] != nil {
+			return nil, fmt.Errorf("invalid prefilled transaction index %d", p.Index)
+		}
+		pb.txs[p.Index] = p.Tx
+		pb.Prefilled++
+	}
+
+	// The short IDs fill the positions left by the prefilled transactions
+	// in order.
+	slots := make(map[uint64]int, len(cb.ShortIDs))
+	i := 0
+	for _, id := range cb.ShortIDs {
+		for pb.txs[i] != nil {
+			i++
+		}
+		if _, ok := slots[id]; ok {
+			return nil, ErrShortIDCollision
+		}
+		slots[id] = i
+		i++
+	}
+
+	k0, k1 := cb.ShortIDKeys()
+	collided := make(map[int]bool)
+	for _, tx := range candidates {
+		slot, ok := slots[ShortID(k0, k1, tx.WTxID())]
+		if !ok || collided[slot] {
+			continue
+		}
+		if pb.txs[slot] != nil {
+			pb.txs[slot] = nil
+			pb.FromPool--
+			collided[slot] = true
+			continue
+		}
+		pb.txs[slot] = tx
+		pb.FromPool++
+	}
+	return pb, nil
+}
+
+// Hash returns the block hash.
+func (pb *PartialBlock) Hash() utils.Hash {
+	return pb.Header.Hash()
+}
+
+// Missing returns the indexes of the transactions still missing, in
+// increasing order.
+func (pb *PartialBlock) Missing() []uint32 {
+	var missing []uint32
+	for i, tx := range pb.txs {
+		if tx == nil {
+			missing = append(missing, uint32(i))
+		}
+	}
+	return missing
+}
+
+// Fill completes the block with the missing transactions, given in the
+// order of Missing, and checks it against the merkle root of the header. A
+// mismatch, wrapping ErrBadMerkleRoot, means that a candidate transaction
+// shared the short ID of a different one and the block has to be
+// downloaded in full.
+func (pb *PartialBlock) Fill(missing []*transaction.Tx) (*Block, error) {
+	b := &Block{Header: pb.Header, Transactions: make([]*transaction.Tx, len(pb.txs))}
+	n := 0
+	for i, tx := range pb.txs {
+		if tx == nil {
+			if n == len(missing) {
+				return nil, fmt.Errorf("expected more than %d missing transactions", len(missing))
+			}
+			tx = missing[n]
+			n++
+		}
+		b.Transactions[i] = tx
+	}
+	if n != len(missing) {
+		return nil, fmt.Errorf("expected %d missing transactions, got %d", n, len(missing))
+	}
+	if err := b.CheckMerkleRoot(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,52 @@
+package block
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartialBlock(t *testing.T) {
+	b := testBlock(t, 5)
+	cb := NewCompactBlock(b, 7)
+
+	// The pool knows two of the four transactions and one unrelated.
+	unrelated := testBlock(t, 7).Transactions[6]
+	pb, err := NewPartialBlock(cb, []*transaction.Tx{b.Transactions[3], unrelated, b.Transactions[1]})
+	require.NoError(t, err)
+	assert.Equal(t, b.Hash(), pb.Hash())
+	assert.Equal(t, 1, pb.Prefilled)
+	assert.Equal(t, 2, pb.FromPool)
+	assert.Equal(t, []uint32{2, 4}, pb.Missing())
+
+	_, err = pb.Fill([]*transaction.Tx{b.Transactions[2]})
+	assert.Error(t, err)
+	_, err = pb.Fill([]*transaction.Tx{b.Transactions[4], b.Transactions[2]})
+	assert.ErrorIs(t, err, ErrBadMerkleRoot)
+
+	full, err := pb.Fill([]*transaction.Tx{b.Transactions[2], b.Transactions[4]})
+	require.NoError(t, err)
+	assert.Equal(t, b.TxHashes(), full.TxHashes())
+}
+
+func TestPartialBlockCollisions(t *testing.T) {
+	b := testBlock(t, 3)
+	cb := NewCompactBlock(b, 7)
+
+	cb.ShortIDs[0] = cb.ShortIDs[1]
+	_, err := NewPartialBlock(cb, nil)
+	assert.ErrorIs(t, err, ErrShortIDCollision)
+
+	// Two candidates matching the same short ID are both distrusted.
+	cb = NewCompactBlock(b, 7)
+	pb, err := NewPartialBlock(cb, []*transaction.Tx{b.Transactions[1], b.Transactions[1], b.Transactions[2]})
+	require.NoError(t, err)
+	assert.Equal(t, 1, pb.FromPool)
+	assert.Equal(t, []uint32{1}, pb.Missing())
+
+	cb.Prefilled[0].Index = 3
+	_, err = NewPartialBlock(cb, nil)
+	assert.ErrorContains(t, err, "prefilled transaction index")
+}
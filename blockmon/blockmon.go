@@ -0,0 +1,445 @@
+// Package blockmon watches the block announcements of our peers: it times
+// every inv, headers and cmpctblock announcement, measures how far behind
+// the first one each peer is and reports competing blocks at the same
+// height.
+package blockmon
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLongDelay is the default Config.LongDelay.
+	DefaultLongDelay = 30 * time.Second
+	// DefaultKeepDepth is the default Config.KeepDepth.
+	DefaultKeepDepth = 100
+
+	// maxAnnouncedHeaders is the largest headers message counted as an
+	// announcement, as MAX_BLOCKS_TO_ANNOUNCE in Bitcoin Core. Longer ones
+	// answer our getheaders.
+	maxAnnouncedHeaders = 8
+	// unresolvedExpiry is how long blocks whose header never arrives are
+	// remembered.
+	unresolvedExpiry = time.Hour
+	// maxUnresolved is how many blocks of unknown height are remembered;
+	// beyond it the oldest one is forgotten.
+	maxUnresolved = 1000
+)
+
+// Source is the message a block was announced with.
+type Source int
+
+// Announcement sources.
+const (
+	SourceInv Source = iota
+	SourceHeaders
+	SourceCompactBlock
+)
+
+// String returns the command of the source message.
+func (s Source) String() string {
+	switch s {
+	case SourceInv:
+		return "inv"
+	case SourceHeaders:
+		return "headers"
+	case SourceCompactBlock:
+		return "cmpctblock"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// Announcement is the first announcement of a block by a peer.
+type Announcement struct {
+	Peer   string
+	Source Source
+	Time   time.Time
+	// Delay is how long after the first announcement of the block, by any
+	// peer, this one arrived.
+	Delay time.Duration
+}
+
+// Block is an announced block.
+type Block struct {
+	Hash utils.Hash
+	// Height is -1 until the header of the block is known.
+	Height    int32
+	FirstSeen time.Time
+	// Announcements holds the first announcement by every peer, in order
+	// of arrival.
+	Announcements []Announcement
+	// Stale is set once another block at the same height is part of the
+	// active chain and has been built upon.
+	Stale bool
+}
+
+// EventType is the kind of observation an Event reports.
+type EventType int
+
+// Event types.
+const (
+	// Fork is emitted when a block is announced at a height where another
+	// block was already seen.
+	Fork EventType = iota
+	// Stale is emitted when a block loses the race for its height: another
+	// block at that height is in the active chain and has been built upon.
+	Stale
+	// LongDelay is emitted for an announcement that arrived more than
+	// Config.LongDelay after the first announcement of the block.
+	LongDelay
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case Fork:
+		return "Fork"
+	case Stale:
+		return "Stale"
+	case LongDelay:
+		return "LongDelay"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is an observation of the monitor.
+type Event struct {
+	Type  EventType
+	Block Block
+	// Competing holds, for Fork and Stale events, the other blocks seen at
+	// the same height.
+	Competing []utils.Hash
+	// Announcement is, for LongDelay events, the late announcement.
+	Announcement Announcement
+}
+
+// EventHandler receives monitor events.
+type EventHandler func(Event)
+
+// Config holds the settings of a Monitor.
+type Config struct {
+	// Chain provides the heights of announced blocks and the active chain
+	// that decides which of competing blocks are stale.
+	Chain *chain.Chain
+	// LongDelay is the delay behind the first announcement of a block
+	// above which an announcement raises a LongDelay event. It defaults to
+	// DefaultLongDelay.
+	LongDelay time.Duration
+	// KeepDepth is how many blocks below the tip are remembered. It
+	// defaults to DefaultKeepDepth.
+	KeepDepth int32
+	// HighBandwidth asks every peer to announce new blocks with
+	// cmpctblock messages (BIP152), the fastest announcement there is.
+	HighBandwidth bool
+}
+
+// Monitor records the block announcements of the peers it is set up on.
+type Monitor struct {
+	cfg Config
+
+	// notifyMu is held while the blocks change and the resulting events
+	// are dispatched, so that handlers see events in order.
+	notifyMu sync.Mutex
+	handlers []EventHandler
+
+	mu       sync.Mutex
+	blocks   map[utils.Hash]*Block
+	byHeight map[int32][]*Block
+	// unresolved counts the blocks of unknown height.
+	unresolved int
+}
+
+// New returns a monitor following cfg.Chain.
+func New(cfg Config) *Monitor {
+	if cfg.LongDelay == 0 {
+		cfg.LongDelay = DefaultLongDelay
+	}
+	if cfg.KeepDepth == 0 {
+		cfg.KeepDepth = DefaultKeepDepth
+	}
+	m := &Monitor{
+		cfg:      cfg,
+		blocks:   make(map[utils.Hash]*Block),
+		byHeight: make(map[int32][]*Block),
+	}
+	cfg.Chain.Subscribe(m.handleChainEvent)
+	return m
+}
+
+// Subscribe registers h for every later event. Handlers are called in
+// registration order, synchronously and outside the monitor's lock.
+func (m *Monitor) Subscribe(h EventHandler) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.handlers = append(m.handlers, h)
+}
+
+func (m *Monitor) notify(events []Event) {
+	for _, e := range events {
+		for _, h := range m.handlers {
+			h(e)
+		}
+	}
+}
+
+// SetupPeer registers the monitor's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (m *Monitor) SetupPeer(p *network.Peer) {
+	p.OnInv(m.handleInv)
+	p.OnHeaders(m.handleHeaders)
+	p.OnCmpctBlock(m.handleCmpctBlock)
+}
+
+// AddPeer asks p for high-bandwidth compact block announcements when the
+// monitor is configured to. It fits connmgr.Config.PeerConnected.
+func (m *Monitor) AddPeer(p *network.Peer) {
+	if !m.cfg.HighBandwidth {
+		return
+	}
+	if err := p.SendCmpct(true); err != nil {
+		log.Debugf("Failed to send sendcmpct to %s: %v", p.Addr(), err)
+	}
+}
+
+// Block returns what the monitor knows about the block with the given hash.
+func (m *Monitor) Block(hash utils.Hash) (Block, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blocks[hash]
+	if !ok {
+		return Block{}, false
+	}
+	return b.snapshot(), true
+}
+
+// Blocks returns the remembered blocks ordered by height, unknown heights
+// last, and then by first announcement.
+func (m *Monitor) Blocks() []Block {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blocks := make([]Block, 0, len(m.blocks))
+	for _, b := range m.blocks {
+		blocks = append(blocks, b.snapshot())
+	}
+	slices.SortFunc(blocks, func(a, b Block) int {
+		if a.Height != b.Height {
+			if a.Height < 0 || b.Height < 0 {
+				return cmp.Compare(b.Height, a.Height)
+			}
+			return cmp.Compare(a.Height, b.Height)
+		}
+		return a.FirstSeen.Compare(b.FirstSeen)
+	})
+	return blocks
+}
+
+func (b *Block) snapshot() Block {
+	s := *b
+	s.Announcements = slices.Clone(b.Announcements)
+	return s
+}
+
+func (m *Monitor) handleInv(p *network.Peer, vects []inv.InvVect) error {
+	now := time.Now()
+	for _, v := range vects {
+		if v.Type.IsBlock() {
+			m.record(p.Addr(), SourceInv, now, v.Hash, nil)
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) handleHeaders(p *network.Peer, headers []block.Header) error {
+	if len(headers) > maxAnnouncedHeaders {
+		return nil
+	}
+	now := time.Now()
+	for i := range headers {
+		m.record(p.Addr(), SourceHeaders, now, headers[i].Hash(), &headers[i])
+	}
+	return nil
+}
+
+func (m *Monitor) handleCmpctBlock(p *network.Peer, cb *block.CompactBlock) error {
+	m.record(p.Addr(), SourceCompactBlock, time.Now(), cb.Header.Hash(), &cb.Header)
+	return nil
+}
+
+// record notes the announcement of hash by peer at t. The header, when
+// the announcement carries it and passes the chain's checks, gives the
+// height of blocks not yet in the chain.
+func (m *Monitor) record(peer string, source Source, t time.Time, hash utils.Hash, header *block.Header) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	b, ok := m.blocks[hash]
+	if !ok {
+		if m.unresolved >= maxUnresolved {
+			m.forgetOldestUnresolved()
+		}
+		b = &Block{Hash: hash, Height: -1, FirstSeen: t}
+		m.blocks[hash] = b
+		m.unresolved++
+	}
+	for _, a := range b.Announcements {
+		if a.Peer == peer {
+			m.mu.Unlock()
+			return
+		}
+	}
+	a := Announcement{Peer: peer, Source: source, Time: t, Delay: t.Sub(b.FirstSeen)}
+	b.Announcements = append(b.Announcements, a)
+
+	var events []Event
+	if b.Height < 0 {
+		if node := m.cfg.Chain.Lookup(hash); node != nil {
+			events = m.index(b, node.Height, events)
+		} else if header != nil {
+			if parent := m.cfg.Chain.Lookup(header.PrevBlock); parent != nil {
+				if err := m.cfg.Chain.CheckHeader(header, parent); err != nil {
+					log.Debugf("Not indexing block %s announced by %s: %v", hash, peer, err)
+				} else {
+					events = m.index(b, parent.Height+1, events)
+				}
+			}
+		}
+	}
+	if a.Delay > m.cfg.LongDelay {
+		events = append(events, Event{Type: LongDelay, Block: b.snapshot(), Announcement: a})
+	}
+	m.mu.Unlock()
+
+	for _, e := range events {
+		logEvent(e)
+	}
+	m.notify(events)
+}
+
+// index files b under its height, now known, and reports a fork if other
+// blocks were seen at that height. It must be called with m.mu held.
+func (m *Monitor) index(b *Block, height int32, events []Event) []Event {
+	b.Height = height
+	m.unresolved--
+	others := m.byHeight[height]
+	m.byHeight[height] = append(others, b)
+	if len(others) > 0 {
+		events = append(events, Event{Type: Fork, Block: b.snapshot(), Competing: hashes(others)})
+	}
+	return m.checkStale(height, events)
+}
+
+// checkStale marks the blocks at height that lost to the block of the
+// active chain, once that block has been built upon. It must be called
+// with m.mu held.
+func (m *Monitor) checkStale(height int32, events []Event) []Event {
+	blocks := m.byHeight[height]
+	if len(blocks) < 2 || m.cfg.Chain.Height() <= height {
+		return events
+	}
+	active := m.cfg.Chain.NodeAtHeight(height)
+	for _, b := range blocks {
+		stale := active == nil || active.Hash != b.Hash
+		if stale && !b.Stale {
+			var competing []*Block
+			for _, other := range blocks {
+				if other != b {
+					competing = append(competing, other)
+				}
+			}
+			events = append(events, Event{Type: Stale, Block: b.snapshot(), Competing: hashes(competing)})
+		}
+		b.Stale = stale
+	}
+	return events
+}
+
+// handleChainEvent learns the height of blocks announced before their
+// header arrived, settles competing blocks below the new tip and forgets
+// old blocks.
+func (m *Monitor) handleChainEvent(e chain.Event) {
+	if e.Type != chain.BlockConnected {
+		return
+	}
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var events []Event
+	if b, ok := m.blocks[e.Node.Hash]; ok && b.Height < 0 {
+		events = m.index(b, e.Node.Height, events)
+	}
+	events = m.checkStale(e.Node.Height-1, events)
+	m.prune(e.Node.Height)
+	m.mu.Unlock()
+
+	for _, e := range events {
+		logEvent(e)
+	}
+	m.notify(events)
+}
+
+// prune forgets the blocks more than KeepDepth below tipHeight and those
+// whose height stayed unknown for too long. It must be called with m.mu
+// held.
+func (m *Monitor) prune(tipHeight int32) {
+	now := time.Now()
+	for hash, b := range m.blocks {
+		if b.Height >= 0 && b.Height < tipHeight-m.cfg.KeepDepth {
+			delete(m.blocks, hash)
+		} else if b.Height < 0 && now.Sub(b.FirstSeen) > unresolvedExpiry {
+			delete(m.blocks, hash)
+			m.unresolved--
+		}
+	}
+	for height := range m.byHeight {
+		if height < tipHeight-m.cfg.KeepDepth {
+			delete(m.byHeight, height)
+		}
+	}
+}
+
+// forgetOldestUnresolved forgets the first announced block of unknown
+// height. It must be called with m.mu held.
+func (m *Monitor) forgetOldestUnresolved() {
+	var oldest *Block
+	for _, b := range m.blocks {
+		if b.Height < 0 && (oldest == nil || b.FirstSeen.Before(oldest.FirstSeen)) {
+			oldest = b
+		}
+	}
+	if oldest != nil {
+		delete(m.blocks, oldest.Hash)
+		m.unresolved--
+	}
+}
+
+func hashes(blocks []*Block) []utils.Hash {
+	hashes := make([]utils.Hash, len(blocks))
+	for i, b := range blocks {
+		hashes[i] = b.Hash
+	}
+	return hashes
+}
+
+func logEvent(e Event) {
+	switch e.Type {
+	case Fork:
+		log.Warnf("Competing block %s at height %d (also seen: %v)", e.Block.Hash, e.Block.Height, e.Competing)
+	case Stale:
+		log.Warnf("Block %s at height %d is stale", e.Block.Hash, e.Block.Height)
+	case LongDelay:
+		log.Infof("%s announced block %s %s after the first peer", e.Announcement.Peer, e.Block.Hash, e.Announcement.Delay.Round(time.Millisecond))
+	}
+}
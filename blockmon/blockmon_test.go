@@ -0,0 +1,226 @@
+package blockmon
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mine returns a valid regtest header on top of parent; tag tells
+// competing headers apart.
+func mine(parent block.Header, tag string) block.Header {
+	h := block.Header{
+		Version:    4,
+		PrevBlock:  parent.Hash(),
+		MerkleRoot: utils.DoubleSHA256([]byte(tag)),
+		Timestamp:  parent.Timestamp + chain.TargetSpacing,
+		Bits:       parent.Bits,
+	}
+	for !h.CheckProofOfWork() {
+		h.Nonce++
+	}
+	return h
+}
+
+// recorder collects monitor events.
+type recorder []Event
+
+func (r *recorder) handle(e Event) { *r = append(*r, e) }
+
+func (r *recorder) ofType(t EventType) []Event {
+	var events []Event
+	for _, e := range *r {
+		if e.Type == t {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func setup(t *testing.T, n int) (*Monitor, *chain.Chain, []block.Header, *recorder) {
+	t.Helper()
+	c, err := chain.New(&config.RegTestParams)
+	require.NoError(t, err)
+	headers := []block.Header{c.Genesis().Header}
+	for i := 0; i < n; i++ {
+		headers = append(headers, mine(headers[i], "main"))
+	}
+	_, err = c.AddHeaders(headers[1:])
+	require.NoError(t, err)
+
+	m := New(Config{Chain: c})
+	events := &recorder{}
+	m.Subscribe(events.handle)
+	return m, c, headers, events
+}
+
+func TestMonitorForkAndStale(t *testing.T) {
+	m, c, headers, events := setup(t, 3)
+	start := time.Now()
+
+	// The block at height 4 is announced by inv before its header arrives.
+	main4 := mine(headers[3], "main")
+	m.record("a", SourceInv, start, main4.Hash(), nil)
+	b, ok := m.Block(main4.Hash())
+	require.True(t, ok)
+	assert.Equal(t, int32(-1), b.Height)
+
+	m.record("b", SourceHeaders, start.Add(time.Second), main4.Hash(), &main4)
+	m.record("b", SourceInv, start.Add(2*time.Second), main4.Hash(), nil)
+	_, err := c.AddHeader(main4)
+	require.NoError(t, err)
+
+	b, _ = m.Block(main4.Hash())
+	assert.Equal(t, int32(4), b.Height)
+	assert.Equal(t, []Announcement{
+		{Peer: "a", Source: SourceInv, Time: start},
+		{Peer: "b", Source: SourceHeaders, Time: start.Add(time.Second), Delay: time.Second},
+	}, b.Announcements, "only the first announcement of every peer counts")
+
+	// A competing block at the same height.
+	other4 := mine(headers[3], "other")
+	m.record("c", SourceCompactBlock, start.Add(3*time.Second), other4.Hash(), &other4)
+	forks := events.ofType(Fork)
+	require.Len(t, forks, 1)
+	assert.Equal(t, other4.Hash(), forks[0].Block.Hash)
+	assert.Equal(t, []utils.Hash{main4.Hash()}, forks[0].Competing)
+	assert.Empty(t, events.ofType(Stale), "the race is not decided yet")
+
+	// The next block settles it.
+	main5 := mine(main4, "main")
+	_, err = c.AddHeader(main5)
+	require.NoError(t, err)
+	stale := events.ofType(Stale)
+	require.Len(t, stale, 1)
+	assert.Equal(t, other4.Hash(), stale[0].Block.Hash)
+	b, _ = m.Block(other4.Hash())
+	assert.True(t, b.Stale)
+
+	// Until the other branch overtakes it.
+	other5 := mine(other4, "other")
+	other6 := mine(other5, "other")
+	_, err = c.AddHeaders([]block.Header{other4, other5, other6})
+	require.NoError(t, err)
+	stale = events.ofType(Stale)
+	require.Len(t, stale, 2)
+	assert.Equal(t, main4.Hash(), stale[1].Block.Hash)
+	b, _ = m.Block(other4.Hash())
+	assert.False(t, b.Stale)
+
+	blocks := m.Blocks()
+	require.Len(t, blocks, 2)
+	assert.Equal(t, main4.Hash(), blocks[0].Hash, "ordered by first announcement at the same height")
+}
+
+func TestMonitorLongDelay(t *testing.T) {
+	m, _, headers, events := setup(t, 3)
+	start := time.Now()
+	next := mine(headers[3], "main")
+
+	m.record("a", SourceHeaders, start, next.Hash(), &next)
+	m.record("b", SourceInv, start.Add(DefaultLongDelay), next.Hash(), nil)
+	assert.Empty(t, events.ofType(LongDelay))
+	m.record("c", SourceInv, start.Add(DefaultLongDelay+time.Second), next.Hash(), nil)
+
+	late := events.ofType(LongDelay)
+	require.Len(t, late, 1)
+	assert.Equal(t, "c", late[0].Announcement.Peer)
+	assert.Equal(t, DefaultLongDelay+time.Second, late[0].Announcement.Delay)
+}
+
+func TestMonitorPrunes(t *testing.T) {
+	m, c, headers, _ := setup(t, 3)
+	m.record("a", SourceInv, time.Now(), headers[1].Hash(), nil)
+	m.record("a", SourceInv, time.Now().Add(-2*unresolvedExpiry), utils.Hash{1}, nil)
+	require.Len(t, m.Blocks(), 2)
+
+	tip := headers[3]
+	var more []block.Header
+	for i := 0; i < DefaultKeepDepth; i++ {
+		tip = mine(tip, "main")
+		more = append(more, tip)
+	}
+	_, err := c.AddHeaders(more)
+	require.NoError(t, err)
+	assert.Empty(t, m.Blocks())
+}
+
+func TestMonitorChecksHeaders(t *testing.T) {
+	m, _, headers, events := setup(t, 3)
+	main4 := mine(headers[3], "main")
+	m.record("a", SourceHeaders, time.Now(), main4.Hash(), &main4)
+
+	// A competing header without proof of work is not indexed.
+	fake := mine(headers[3], "fake")
+	for fake.CheckProofOfWork() {
+		fake.Nonce++
+	}
+	m.record("b", SourceHeaders, time.Now(), fake.Hash(), &fake)
+	b, ok := m.Block(fake.Hash())
+	require.True(t, ok)
+	assert.Equal(t, int32(-1), b.Height)
+	assert.Empty(t, events.ofType(Fork))
+}
+
+func TestMonitorCapsUnresolved(t *testing.T) {
+	m, _, _, _ := setup(t, 3)
+	start := time.Now()
+	for i := 0; i <= maxUnresolved; i++ {
+		m.record("a", SourceInv, start.Add(time.Duration(i)), utils.DoubleSHA256([]byte{byte(i), byte(i >> 8)}), nil)
+	}
+	assert.Len(t, m.Blocks(), maxUnresolved)
+	_, ok := m.Block(utils.DoubleSHA256([]byte{0, 0}))
+	assert.False(t, ok, "the oldest block is forgotten")
+}
+
+func TestMonitorPeer(t *testing.T) {
+	m, _, headers, _ := setup(t, 3)
+	m.cfg.HighBandwidth = true
+
+	a, b := net.Pipe()
+	local := network.NewPeer(a, "remote", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	remote := network.NewPeer(b, "local", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	m.SetupPeer(local)
+	sendCmpct := make(chan struct{}, 1)
+	remote.Handle("sendcmpct", func(p *network.Peer, payload []byte) error {
+		sendCmpct <- struct{}{}
+		return nil
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	defer local.Disconnect()
+	m.AddPeer(local)
+
+	select {
+	case <-sendCmpct:
+	case <-time.After(time.Second):
+		t.Fatal("high-bandwidth compact blocks were not requested")
+	}
+
+	next := mine(headers[3], "main")
+	require.NoError(t, remote.SendCmpctBlock(&block.CompactBlock{Header: next}))
+	require.NoError(t, remote.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: next.Hash()}))
+	// Long headers messages answer getheaders and are no announcements.
+	require.NoError(t, remote.SendHeaders(make([]block.Header, maxAnnouncedHeaders+1)))
+	require.Eventually(t, func() bool {
+		b, ok := m.Block(next.Hash())
+		return ok && b.Height == 4
+	}, time.Second, 10*time.Millisecond)
+	b2, _ := m.Block(next.Hash())
+	assert.Equal(t, SourceCompactBlock, b2.Announcements[0].Source)
+	assert.Len(t, m.Blocks(), 1)
+}
@@ -0,0 +1,463 @@
+// Package blockstore keeps full blocks in flat files laid out like Bitcoin
+// Core's blocks directory, so that it can also serve the blocks of an
+// existing Core data directory.
+package blockstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MaxFileSize is the size at which Bitcoin Core starts a new block file
+// (MAX_BLOCKFILE_SIZE).
+const MaxFileSize = 0x8000000
+
+// recordHeaderSize is the magic and length prefix of every block.
+const recordHeaderSize = 8
+
+// xorKeyFile holds the key Bitcoin Core 28 and later obfuscate block files
+// with. Without it the files are stored in the clear.
+const xorKeyFile = "xor.dat"
+
+var (
+	// ErrNotFound is returned for blocks that are not in the store.
+	ErrNotFound = errors.New("block not found")
+	// ErrReadOnly is returned when writing to a store opened read-only.
+	ErrReadOnly = errors.New("block store is read-only")
+	// ErrCorrupt is returned when a block file does not hold the block the
+	// index points to.
+	ErrCorrupt = errors.New("block file corrupt")
+)
+
+var (
+	// blocksBucket maps a block hash to its Location.
+	blocksBucket = []byte("blocks")
+	metaBucket   = []byte("meta")
+
+	magicKey = []byte("magic")
+	// endKey records the end of the indexed data: new blocks are written
+	// there and Reindex resumes scanning from it.
+	endKey = []byte("end")
+)
+
+// Location is where a block is stored.
+type Location struct {
+	File int
+	// Offset is the position of the serialized block in the file, after
+	// its magic and length prefix.
+	Offset int64
+	Size   uint32
+}
+
+func (l Location) bytes() []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b, uint32(l.File))
+	binary.LittleEndian.PutUint64(b[4:], uint64(l.Offset))
+	binary.LittleEndian.PutUint32(b[12:], l.Size)
+	return b
+}
+
+func readLocation(b []byte) Location {
+	return Location{
+		File:   int(binary.LittleEndian.Uint32(b)),
+		Offset: int64(binary.LittleEndian.Uint64(b[4:])),
+		Size:   binary.LittleEndian.Uint32(b[12:]),
+	}
+}
+
+// Config configures a Store.
+type Config struct {
+	// Dir holds the blk?????.dat files.
+	Dir string
+	// Index is the path of the index database. It defaults to index.db in
+	// Dir; a read-only store usually needs it elsewhere.
+	Index string
+	// Magic prefixes every block, as in the network messages of the chain.
+	Magic [4]byte
+	// ReadOnly never writes to the block files, for example those of a
+	// running Bitcoin Core node. Use Reindex to index them.
+	ReadOnly bool
+	// MaxFileSize defaults to MaxFileSize.
+	MaxFileSize int64
+}
+
+// Store is a set of block files and an index from block hash to location.
+type Store struct {
+	cfg   Config
+	xor   []byte
+	index *bolt.DB
+
+	mu    sync.Mutex
+	end   Location
+	files map[int]*os.File
+}
+
+// Open opens the block files in cfg.Dir, creating the directory unless the
+// store is read-only.
+func Open(cfg Config) (*Store, error) {
+	if cfg.Index == "" {
+		cfg.Index = filepath.Join(cfg.Dir, "index.db")
+	}
+	if cfg.MaxFileSize == 0 {
+		cfg.MaxFileSize = MaxFileSize
+	}
+	if !cfg.ReadOnly {
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	xor, err := readXORKey(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := bolt.Open(cfg.Index, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{cfg: cfg, xor: xor, index: index, files: make(map[int]*os.File)}
+	err = index.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		if stored := meta.Get(magicKey); stored == nil {
+			if err := meta.Put(magicKey, cfg.Magic[:]); err != nil {
+				return err
+			}
+		} else if !bytes.Equal(stored, cfg.Magic[:]) {
+			return fmt.Errorf("block index belongs to the network with magic %x", stored)
+		}
+		if end := meta.Get(endKey); end != nil {
+			s.end = readLocation(end)
+		}
+		return nil
+	})
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// CoreBlocksDir returns the blocks directory of a Bitcoin Core data
+// directory for the chain.
+func CoreBlocksDir(dataDir string, params *config.ChainParams) string {
+	if params.Name == config.MainNetParams.Name {
+		return filepath.Join(dataDir, "blocks")
+	}
+	return filepath.Join(dataDir, params.Name, "blocks")
+}
+
+func readXORKey(dir string) ([]byte, error) {
+	key, err := os.ReadFile(filepath.Join(dir, xorKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 8 {
+		return nil, fmt.Errorf("%s: key of %d bytes, want 8", xorKeyFile, len(key))
+	}
+	if bytes.Equal(key, make([]byte, 8)) {
+		return nil, nil
+	}
+	return key, nil
+}
+
+// xorAt applies the obfuscation key to data read from or written to the
+// given file offset.
+func (s *Store) xorAt(data []byte, offset int64) {
+	if s.xor == nil {
+		return
+	}
+	for i := range data {
+		data[i] ^= s.xor[(offset+int64(i))%8]
+	}
+}
+
+func (s *Store) fileName(n int) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("blk%05d.dat", n))
+}
+
+// file returns the open block file n. It must be called with s.mu held.
+func (s *Store) file(n int) (*os.File, error) {
+	if f, ok := s.files[n]; ok {
+		return f, nil
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if s.cfg.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(s.fileName(n), flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.files[n] = f
+	return f, nil
+}
+
+// Close closes the block files and the index.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for n, f := range s.files {
+		errs = append(errs, f.Close())
+		delete(s.files, n)
+	}
+	errs = append(errs, s.index.Close())
+	return errors.Join(errs...)
+}
+
+// Lookup returns where the block with the given hash is stored.
+func (s *Store) Lookup(hash utils.Hash) (Location, bool) {
+	var loc Location
+	var ok bool
+	s.index.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(blocksBucket).Get(hash[:]); v != nil {
+			loc, ok = readLocation(v), true
+		}
+		return nil
+	})
+	return loc, ok
+}
+
+// Has reports whether the block with the given hash is stored.
+func (s *Store) Has(hash utils.Hash) bool {
+	_, ok := s.Lookup(hash)
+	return ok
+}
+
+// Len returns the number of indexed blocks.
+func (s *Store) Len() int {
+	var n int
+	s.index.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(blocksBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// RawBlock returns the serialized block with the given hash, as it is sent
+// in a block message.
+func (s *Store) RawBlock(hash utils.Hash) ([]byte, error) {
+	loc, ok := s.Lookup(hash)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s.mu.Lock()
+	f, err := s.file(loc.File)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, loc.Size)
+	if _, err := f.ReadAt(raw, loc.Offset); err != nil {
+		return nil, fmt.Errorf("reading block %s: %w", hash, err)
+	}
+	s.xorAt(raw, loc.Offset)
+	if got, ok := blockHash(raw); !ok || got != hash {
+		return nil, fmt.Errorf("%w: %s does not hold block %s at offset %d", ErrCorrupt, s.fileName(loc.File), hash, loc.Offset)
+	}
+	return raw, nil
+}
+
+// Block returns the block with the given hash.
+func (s *Store) Block(hash utils.Hash) (*block.Block, error) {
+	raw, err := s.RawBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	return block.DecodeBlockMessage(raw)
+}
+
+// blockHash returns the hash of the header the serialized block starts
+// with.
+func blockHash(raw []byte) (utils.Hash, bool) {
+	if len(raw) < block.HeaderSize {
+		return utils.Hash{}, false
+	}
+	return utils.DoubleSHA256(raw[:block.HeaderSize]), true
+}
+
+// Put appends b to the block files unless it is already stored.
+func (s *Store) Put(b *block.Block) (Location, error) {
+	if s.cfg.ReadOnly {
+		return Location{}, ErrReadOnly
+	}
+	hash := b.Hash()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if loc, ok := s.Lookup(hash); ok {
+		return loc, nil
+	}
+	raw := b.Bytes()
+
+	pos := s.end
+	if pos.Offset > 0 && pos.Offset+recordHeaderSize+int64(len(raw)) > s.cfg.MaxFileSize {
+		pos = Location{File: pos.File + 1}
+	}
+	f, err := s.file(pos.File)
+	if err != nil {
+		return Location{}, err
+	}
+
+	record := make([]byte, 0, recordHeaderSize+len(raw))
+	record = append(record, s.cfg.Magic[:]...)
+	record = binary.LittleEndian.AppendUint32(record, uint32(len(raw)))
+	record = append(record, raw...)
+	s.xorAt(record, pos.Offset)
+	if _, err := f.WriteAt(record, pos.Offset); err != nil {
+		return Location{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return Location{}, err
+	}
+
+	loc := Location{File: pos.File, Offset: pos.Offset + recordHeaderSize, Size: uint32(len(raw))}
+	end := Location{File: pos.File, Offset: loc.Offset + int64(loc.Size)}
+	err = s.index.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(blocksBucket).Put(hash[:], loc.bytes()); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(endKey, end.bytes())
+	})
+	if err != nil {
+		return Location{}, err
+	}
+	s.end = end
+	return loc, nil
+}
+
+// reindexBatch is the number of blocks indexed per index transaction.
+const reindexBatch = 1000
+
+// Reindex scans the block files from the end of the indexed data and
+// indexes the blocks it finds, returning how many were new. It imports the
+// blocks of a Bitcoin Core data directory, and can be called again to pick
+// up the blocks the node has written since.
+func (s *Store) Reindex() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added := 0
+	batch := make(map[utils.Hash]Location)
+	flush := func(end Location) error {
+		err := s.index.Update(func(tx *bolt.Tx) error {
+			blocks := tx.Bucket(blocksBucket)
+			for hash, loc := range batch {
+				if blocks.Get(hash[:]) != nil {
+					continue
+				}
+				if err := blocks.Put(hash[:], loc.bytes()); err != nil {
+					return err
+				}
+				added++
+			}
+			return tx.Bucket(metaBucket).Put(endKey, end.bytes())
+		})
+		if err != nil {
+			return err
+		}
+		clear(batch)
+		s.end = end
+		return nil
+	}
+
+	pos := s.end
+	for {
+		if _, err := os.Stat(s.fileName(pos.File)); errors.Is(err, os.ErrNotExist) {
+			return added, nil
+		}
+		f, err := s.file(pos.File)
+		if err != nil {
+			return added, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return added, err
+		}
+		end, err := s.scanFile(f, pos.Offset, info.Size(), func(loc Location, hash utils.Hash) error {
+			loc.File = pos.File
+			batch[hash] = loc
+			if len(batch) < reindexBatch {
+				return nil
+			}
+			return flush(Location{File: pos.File, Offset: loc.Offset + int64(loc.Size)})
+		})
+		if err != nil {
+			return added, fmt.Errorf("scanning %s: %w", s.fileName(pos.File), err)
+		}
+		pos.Offset = end
+		if err := flush(pos); err != nil {
+			return added, err
+		}
+		// The last file may still be appended to; stay on it until the
+		// next one appears.
+		if _, err := os.Stat(s.fileName(pos.File + 1)); err != nil {
+			return added, nil
+		}
+		pos = Location{File: pos.File + 1}
+	}
+}
+
+// scanFile calls fn for every block record in f from offset on and returns
+// the end of the last complete record. Like Bitcoin Core it skips over
+// garbage to the next magic, and stops at the zeros files are
+// preallocated with or at a record cut short.
+func (s *Store) scanFile(f *os.File, offset, size int64, fn func(loc Location, hash utils.Hash) error) (int64, error) {
+	r := io.NewSectionReader(f, 0, size)
+	end := offset
+	header := make([]byte, recordHeaderSize)
+	for offset+recordHeaderSize <= size {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return end, err
+		}
+		s.xorAt(header, offset)
+		if !bytes.Equal(header[:4], s.cfg.Magic[:]) {
+			if bytes.Equal(header, make([]byte, recordHeaderSize)) {
+				return end, nil
+			}
+			offset++
+			continue
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		if length < block.HeaderSize || length > block.MaxBlockSize {
+			offset++
+			continue
+		}
+		start := offset + recordHeaderSize
+		if start+length > size {
+			return end, nil
+		}
+		// Only the header is needed to index the block.
+		head := make([]byte, block.HeaderSize)
+		if _, err := r.ReadAt(head, start); err != nil {
+			return end, err
+		}
+		s.xorAt(head, start)
+		hash, _ := blockHash(head)
+		if err := fn(Location{Offset: start, Size: uint32(length)}, hash); err != nil {
+			return end, err
+		}
+		offset = start + length
+		end = offset
+	}
+	return end, nil
+}
@@ -0,0 +1,202 @@
+package blockstore
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var magic = config.RegTestParams.Magic
+
+// testBlocks returns n linked blocks, each with a coinbase transaction of
+// its own.
+func testBlocks(n int) []*block.Block {
+	blocks := make([]*block.Block, n)
+	prev := config.RegTestParams.GenesisHash
+	for i := range blocks {
+		b := &block.Block{
+			Header: block.Header{Version: 4, PrevBlock: prev, Timestamp: 1700000000 + uint32(i), Bits: 0x207fffff},
+			Transactions: []*transaction.Tx{{
+				Version: 1,
+				TxIn: []transaction.TxIn{{
+					PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff},
+					SignatureScript:  binary.LittleEndian.AppendUint32(nil, uint32(i+1)),
+					Witness:          [][]byte{make([]byte, 32)},
+					Sequence:         0xffffffff,
+				}},
+				TxOut: []transaction.TxOut{{Value: 50e8, PkScript: []byte{0x51}}},
+			}},
+		}
+		b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+		blocks[i] = b
+		prev = b.Hash()
+	}
+	return blocks
+}
+
+func record(b *block.Block) []byte {
+	raw := b.Bytes()
+	r := append(magic[:], binary.LittleEndian.AppendUint32(nil, uint32(len(raw)))...)
+	return append(r, raw...)
+}
+
+func TestPutAndRead(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Magic: magic, MaxFileSize: 1000})
+	require.NoError(t, err)
+	defer s.Close()
+
+	blocks := testBlocks(20)
+	var locs []Location
+	for _, b := range blocks {
+		loc, err := s.Put(b)
+		require.NoError(t, err)
+		locs = append(locs, loc)
+	}
+	assert.Equal(t, 20, s.Len())
+	assert.Greater(t, locs[19].File, 0, "blocks roll over to new files")
+
+	for i, b := range blocks {
+		got, err := s.Block(b.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, b, got)
+		raw, err := s.RawBlock(b.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, b.Bytes(), raw)
+
+		loc, ok := s.Lookup(b.Hash())
+		require.True(t, ok)
+		assert.Equal(t, locs[i], loc)
+	}
+
+	// The files hold the blocks the way Bitcoin Core writes them.
+	first, err := os.ReadFile(filepath.Join(dir, "blk00000.dat"))
+	require.NoError(t, err)
+	assert.Equal(t, record(blocks[0]), first[:len(record(blocks[0]))])
+	assert.LessOrEqual(t, len(first), 1000)
+
+	again, err := s.Put(blocks[3])
+	require.NoError(t, err)
+	assert.Equal(t, locs[3], again, "stored blocks are not written twice")
+
+	_, err = s.Block(utils.Hash{1})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.False(t, s.Has(utils.Hash{1}))
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	blocks := testBlocks(4)
+	s, err := Open(Config{Dir: dir, Magic: magic})
+	require.NoError(t, err)
+	last, err := s.Put(blocks[0])
+	require.NoError(t, err)
+	_, err = s.Put(blocks[1])
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = Open(Config{Dir: dir, Magic: magic})
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	loc, err := s.Put(blocks[2])
+	require.NoError(t, err)
+	assert.Greater(t, loc.Offset, last.Offset+int64(last.Size), "new blocks are appended")
+	for _, b := range blocks[:3] {
+		assert.True(t, s.Has(b.Hash()))
+	}
+	require.NoError(t, s.Close())
+
+	_, err = Open(Config{Dir: dir, Magic: config.MainNetParams.Magic})
+	assert.ErrorContains(t, err, "belongs to the network")
+}
+
+// writeCoreFile writes data to path obfuscated with key, the way Bitcoin
+// Core 28 does.
+func writeCoreFile(t *testing.T, path string, key []byte, data []byte) {
+	t.Helper()
+	obfuscated := append([]byte(nil), data...)
+	for i := range obfuscated {
+		obfuscated[i] ^= key[i%len(key)]
+	}
+	require.NoError(t, os.WriteFile(path, obfuscated, 0o644))
+}
+
+func TestReadCoreDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	dir := CoreBlocksDir(dataDir, &config.RegTestParams)
+	assert.Equal(t, filepath.Join(dataDir, "regtest", "blocks"), dir)
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	key := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "xor.dat"), key, 0o644))
+
+	blocks := testBlocks(6)
+	// The first file has garbage between two blocks and ends with the
+	// zeros Core preallocates files with.
+	var first []byte
+	first = append(first, record(blocks[0])...)
+	first = append(first, 0xde, 0xad, 0xbe, 0xef, 0x01)
+	first = append(first, record(blocks[1])...)
+	first = append(first, record(blocks[2])...)
+	first = append(first, make([]byte, 4096)...)
+	writeCoreFile(t, filepath.Join(dir, "blk00000.dat"), key, first)
+	// The second is being written: its last block is cut short.
+	var second []byte
+	second = append(second, record(blocks[3])...)
+	second = append(second, record(blocks[4])...)
+	complete := append(append([]byte(nil), second...), record(blocks[5])...)
+	second = append(second, record(blocks[5])[:100]...)
+	writeCoreFile(t, filepath.Join(dir, "blk00001.dat"), key, second)
+
+	s, err := Open(Config{Dir: dir, Index: filepath.Join(t.TempDir(), "index.db"), Magic: magic, ReadOnly: true})
+	require.NoError(t, err)
+	defer s.Close()
+
+	added, err := s.Reindex()
+	require.NoError(t, err)
+	assert.Equal(t, 5, added)
+	for _, b := range blocks[:5] {
+		got, err := s.Block(b.Hash())
+		require.NoError(t, err)
+		assert.Equal(t, b, got)
+	}
+	assert.False(t, s.Has(blocks[5].Hash()))
+
+	_, err = s.Put(blocks[5])
+	assert.ErrorIs(t, err, ErrReadOnly)
+
+	// The node finishes writing the block; scanning again picks it up.
+	writeCoreFile(t, filepath.Join(dir, "blk00001.dat"), key, complete)
+	added, err = s.Reindex()
+	require.NoError(t, err)
+	assert.Equal(t, 1, added)
+	got, err := s.Block(blocks[5].Hash())
+	require.NoError(t, err)
+	assert.Equal(t, blocks[5], got)
+}
+
+func TestCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Magic: magic})
+	require.NoError(t, err)
+	defer s.Close()
+	b := testBlocks(1)[0]
+	loc, err := s.Put(b)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(filepath.Join(dir, "blk00000.dat"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, loc.Offset+4)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Block(b.Hash())
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
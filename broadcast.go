@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/broadcast"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/connmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	log "github.com/sirupsen/logrus"
+)
+
+const broadcastUsage = "usage: broadcast [flags] <raw transaction hex>"
+
+// runBroadcast connects to the network, announces a raw transaction and
+// reports which peers fetched it and which announced it back.
+func runBroadcast(args []string) {
+	flags := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	addnode := flags.String("addnode", net.JoinHostPort(config.BTCNodeHost, strconv.Itoa(config.BTCNodePort)), "comma separated list of host:port addresses to connect to")
+	outbound := flags.Int("outbound", 2*broadcast.DefaultPeers, "number of outbound peers, of which those not announced to may announce the transaction back")
+	peers := flags.Int("peers", broadcast.DefaultPeers, "number of peers the transaction is announced to")
+	to := flags.String("to", "", "comma separated list of connected peers to announce to instead of random ones")
+	confirmations := flags.Int("confirmations", 1, "number of other peers that must announce the transaction back")
+	feeRate := flags.Float64("feerate", 0, "feerate of the transaction in sat/vB, checked against the peers' feefilter (unchecked when 0)")
+	wait := flags.Duration("wait", time.Minute, "time allowed to connect to the peers")
+	timeout := flags.Duration("timeout", 2*time.Minute, "time allowed for the transaction to be announced back")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	chainName := flags.String("chain", config.MainNetParams.Name, "network to broadcast to: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "query the chain's DNS seeds for peer addresses")
+	dnsServer := flags.String("dnsserver", "", "DNS server host:port used for the seed lookups (system resolver when empty)")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal(broadcastUsage)
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(flags.Arg(0)))
+	if err != nil {
+		log.Fatalf("Invalid transaction hex: %v", err)
+	}
+	tx, err := transaction.DecodeTxMessage(raw)
+	if err != nil {
+		log.Fatalf("Invalid transaction: %v", err)
+	}
+
+	params := chainParams(*chainName)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	addrs := addrmgr.New()
+	addNodes := parseAddNodes(*addnode)
+	if *dnsSeed {
+		resolver := dnsseed.Resolver{Server: *dnsServer}
+		added, err := resolver.Seed(ctx, addrs, params, config.Services)
+		if err != nil {
+			log.Errorf("DNS seeding failed: %v", err)
+		}
+		log.Infof("Added %d addresses from DNS seeds", added)
+	}
+
+	var manager *connmgr.ConnManager
+	broadcaster := broadcast.New(broadcast.Config{Peers: func() []*network.Peer { return manager.Peers() }})
+	manager = connmgr.New(connmgr.Config{
+		TargetOutbound:    *outbound,
+		DisableOutbound:   *outbound == 0,
+		DisableBlockRelay: true,
+		AddrManager:       addrs,
+		AddNodes:          addNodes,
+		Dialer:            newDialer(*proxy, true),
+		PeerConfig:        network.PeerConfig{Magic: params.Magic, Relay: true},
+		SetupPeer:         broadcaster.SetupPeer,
+	})
+	go manager.Run(ctx)
+
+	req := broadcast.Request{Tx: tx, Peers: *peers, FeeRate: *feeRate, Confirmations: *confirmations}
+	if *to != "" {
+		req.Addrs = strings.Split(*to, ",")
+	}
+	waitForPeers(ctx, manager, *outbound, *wait)
+
+	broadcastCtx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	result, err := broadcaster.Broadcast(broadcastCtx, req)
+	if err != nil && !errors.Is(err, broadcast.ErrNotConfirmed) {
+		log.Fatalf("Broadcast failed: %v", err)
+	}
+	if err != nil {
+		log.Warnf("Broadcast of %s: %v", tx.TxID(), err)
+	}
+
+	if *asJSON {
+		printJSON(result)
+		return
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+	fmt.Fprintf(out, "Transaction:\t%s\n", result.TxID)
+	fmt.Fprintf(out, "Announced to:\t%s\n\n", strings.Join(result.Announced, ", "))
+	fmt.Fprintln(out, "PEER\tEVENT\tAFTER")
+	for _, r := range result.Requested {
+		fmt.Fprintf(out, "%s\trequested\t%s\n", r.Addr, r.After.Round(time.Millisecond))
+	}
+	for _, c := range result.Confirmed {
+		fmt.Fprintf(out, "%s\tannounced back\t%s\n", c.Addr, c.After.Round(time.Millisecond))
+	}
+}
+
+// waitForPeers waits until want peers that accept transactions are
+// connected, or for at most timeout.
+func waitForPeers(ctx context.Context, manager *connmgr.ConnManager, want int, timeout time.Duration) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		relaying := 0
+		for _, p := range manager.Peers() {
+			if p.WantsTxs() {
+				relaying++
+			}
+		}
+		if relaying >= want {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Warnf("Only %d of %d peers connected after %s", relaying, want, timeout)
+			return
+		case <-ctx.Done():
+			log.Fatal(ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package broadcast pushes transactions to the network and confirms their
+// propagation by watching other peers announce them back.
+package broadcast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPeers is the number of peers a transaction is announced to when
+// Request.Peers is zero.
+const DefaultPeers = 8
+
+var (
+	// ErrNoPeers is returned when no connected peer accepts the
+	// transaction.
+	ErrNoPeers = errors.New("no peer accepts the transaction")
+	// ErrNotConfirmed is returned, along with the result so far, when the
+	// context ends before enough other peers announced the transaction.
+	ErrNotConfirmed = errors.New("transaction was not announced back")
+)
+
+// Config holds the settings of a Broadcaster.
+type Config struct {
+	// Peers returns the connected peers to announce transactions to, such
+	// as connmgr.ConnManager.Peers.
+	Peers func() []*network.Peer
+}
+
+// Request describes one broadcast.
+type Request struct {
+	Tx *transaction.Tx
+	// Peers is the number of peers, chosen at random, the transaction is
+	// announced to. It defaults to DefaultPeers.
+	Peers int
+	// Addrs chooses the peers by address instead.
+	Addrs []string
+	// FeeRate is the feerate of the transaction in satoshis per virtual
+	// byte. Peers whose feefilter is above it are not chosen; zero ignores
+	// feefilters.
+	FeeRate float64
+	// Confirmations is the number of other peers that must announce the
+	// transaction back. It defaults to 1.
+	Confirmations int
+}
+
+// PeerTiming is a peer and how long after the announcement it reacted.
+type PeerTiming struct {
+	Addr  string
+	After time.Duration
+}
+
+// Result reports how a broadcast went.
+type Result struct {
+	TxID  utils.Hash
+	WTxID utils.Hash
+	// Start is when the transaction was announced.
+	Start time.Time
+	// Announced lists the peers the transaction was announced to.
+	Announced []string
+	// Requested lists the peers that fetched the transaction from us.
+	Requested []PeerTiming
+	// Confirmed lists the other peers that announced it back.
+	Confirmed []PeerTiming
+}
+
+// Broadcaster announces transactions, serves them to the peers that ask
+// and collects the announcements of the others.
+type Broadcaster struct {
+	cfg Config
+
+	mu sync.Mutex
+	// pending holds the transactions being broadcast by txid and wtxid.
+	pending map[utils.Hash]*pending
+}
+
+type pending struct {
+	tx        *transaction.Tx
+	result    Result
+	announced map[*network.Peer]bool
+	requested map[*network.Peer]bool
+	confirmed map[*network.Peer]bool
+	want      int
+	done      chan struct{}
+}
+
+// New returns a broadcaster announcing to the peers of cfg.
+func New(cfg Config) *Broadcaster {
+	return &Broadcaster{cfg: cfg, pending: make(map[utils.Hash]*pending)}
+}
+
+// SetupPeer registers the broadcaster's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer. The broadcaster answers
+// every getdata of p, with notfound for what it is not broadcasting, so it
+// cannot share peers with a server.Server.
+func (b *Broadcaster) SetupPeer(p *network.Peer) {
+	p.OnInv(b.handleInv)
+	p.OnGetData(b.handleGetData)
+}
+
+// Broadcast announces req.Tx and waits until req.Confirmations other peers
+// announce it back or ctx is done. The transaction is only served while
+// Broadcast runs.
+func (b *Broadcaster) Broadcast(ctx context.Context, req Request) (*Result, error) {
+	peers := b.choose(req)
+	if len(peers) == 0 {
+		return nil, ErrNoPeers
+	}
+	want := req.Confirmations
+	if want == 0 {
+		want = 1
+	}
+
+	txid, wtxid := req.Tx.TxID(), req.Tx.WTxID()
+	pend := &pending{
+		tx:        req.Tx,
+		result:    Result{TxID: txid, WTxID: wtxid, Start: time.Now()},
+		announced: make(map[*network.Peer]bool),
+		requested: make(map[*network.Peer]bool),
+		confirmed: make(map[*network.Peer]bool),
+		want:      want,
+		done:      make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.pending[txid], b.pending[wtxid] = pend, pend
+	for _, p := range peers {
+		pend.announced[p] = true
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, txid)
+		delete(b.pending, wtxid)
+		b.mu.Unlock()
+	}()
+
+	// A feefilter received since the peers were chosen still applies,
+	// unless the request ignores them.
+	feeRate := req.FeeRate
+	if feeRate == 0 {
+		feeRate = math.Inf(1)
+	}
+	var sent []*network.Peer
+	for _, p := range peers {
+		v := inv.InvVect{Type: inv.InvTypeTx, Hash: txid}
+		if p.WTxIDRelay() {
+			v = inv.InvVect{Type: inv.InvTypeWTx, Hash: wtxid}
+		}
+		ok, err := p.AnnounceTx(v, feeRate)
+		if err != nil {
+			log.Debugf("Failed to announce %s to %s: %v", txid, p.Addr(), err)
+		}
+		if ok && err == nil {
+			sent = append(sent, p)
+		}
+	}
+	b.mu.Lock()
+	for _, p := range peers {
+		if slices.Contains(sent, p) {
+			pend.result.Announced = append(pend.result.Announced, p.Addr())
+		} else {
+			delete(pend.announced, p)
+		}
+	}
+	b.mu.Unlock()
+	if len(sent) == 0 {
+		return nil, ErrNoPeers
+	}
+	log.Infof("Announced transaction %s to %d peers", txid, len(sent))
+
+	select {
+	case <-pend.done:
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := pend.result
+	result.Announced = append([]string(nil), result.Announced...)
+	result.Requested = append([]PeerTiming(nil), result.Requested...)
+	result.Confirmed = append([]PeerTiming(nil), result.Confirmed...)
+	if len(result.Confirmed) < want {
+		return &result, ErrNotConfirmed
+	}
+	return &result, nil
+}
+
+// choose returns the peers to announce req.Tx to.
+func (b *Broadcaster) choose(req Request) []*network.Peer {
+	var candidates []*network.Peer
+	for _, p := range b.cfg.Peers() {
+		if !p.WantsTxs() || (req.FeeRate > 0 && req.FeeRate*1000 < float64(p.FeeFilter())) {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+
+	if len(req.Addrs) > 0 {
+		var chosen []*network.Peer
+		for _, addr := range req.Addrs {
+			for _, p := range candidates {
+				if p.Addr() == addr {
+					chosen = append(chosen, p)
+					break
+				}
+			}
+		}
+		return chosen
+	}
+
+	n := req.Peers
+	if n == 0 {
+		n = DefaultPeers
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	return candidates[:min(n, len(candidates))]
+}
+
+// handleInv counts the announcements of pending transactions by peers we
+// did not announce them to.
+func (b *Broadcaster) handleInv(p *network.Peer, vects []inv.InvVect) error {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, v := range vects {
+		pend, ok := b.pending[v.Hash]
+		if !ok || !v.Type.IsTx() || pend.announced[p] || pend.confirmed[p] {
+			continue
+		}
+		pend.confirmed[p] = true
+		pend.result.Confirmed = append(pend.result.Confirmed, PeerTiming{Addr: p.Addr(), After: now.Sub(pend.result.Start)})
+		log.Debugf("Transaction %s announced back by %s", pend.result.TxID, p.Addr())
+		if len(pend.result.Confirmed) == pend.want {
+			close(pend.done)
+		}
+	}
+	return nil
+}
+
+// handleGetData sends the pending transactions p asks for, with witness
+// data unless requested by txid without it, and notfound for the rest.
+func (b *Broadcaster) handleGetData(p *network.Peer, vects []inv.InvVect) error {
+	now := time.Now()
+	var found []inv.InvVect
+	var txs []*transaction.Tx
+	var missing []inv.InvVect
+	b.mu.Lock()
+	for _, v := range vects {
+		pend, ok := b.pending[v.Hash]
+		if !ok || !v.Type.IsTx() {
+			missing = append(missing, v)
+			continue
+		}
+		if !pend.requested[p] {
+			pend.requested[p] = true
+			pend.result.Requested = append(pend.result.Requested, PeerTiming{Addr: p.Addr(), After: now.Sub(pend.result.Start)})
+		}
+		found = append(found, v)
+		txs = append(txs, pend.tx)
+	}
+	b.mu.Unlock()
+
+	for i, tx := range txs {
+		if err := sendTx(p, tx, found[i].Type != inv.InvTypeTx); err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return p.SendNotFound(missing...)
+}
+
+// sendTx sends tx to p, with or without its witness data.
+func sendTx(p *network.Peer, tx *transaction.Tx, witness bool) error {
+	if witness {
+		return p.SendTx(tx)
+	}
+	var buf bytes.Buffer
+	if err := tx.SerializeNoWitness(&buf); err != nil {
+		return err
+	}
+	return p.Send(network.Message{Command: "tx", Payload: buf.Bytes()})
+}
@@ -0,0 +1,151 @@
+package broadcast
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// node is a remote peer that fetches the transactions announced to it.
+type node struct {
+	*network.Peer
+	txs chan *transaction.Tx
+}
+
+// peers is the set of peers a broadcaster is connected to.
+type peers struct {
+	mu    sync.Mutex
+	local []*network.Peer
+}
+
+func (ps *peers) all() []*network.Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]*network.Peer(nil), ps.local...)
+}
+
+func connect(t *testing.T, b *Broadcaster, ps *peers, addr string, remoteCfg network.PeerConfig) *node {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	local := network.NewPeer(c1, addr, network.PeerConfig{Relay: true})
+	n := &node{Peer: network.NewPeer(c2, "local", remoteCfg), txs: make(chan *transaction.Tx, 1)}
+	b.SetupPeer(local)
+	n.OnInv(func(p *network.Peer, vects []inv.InvVect) error {
+		return p.GetData(vects...)
+	})
+	n.OnTx(func(p *network.Peer, tx *transaction.Tx) error {
+		n.txs <- tx
+		return nil
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- n.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+
+	ps.mu.Lock()
+	ps.local = append(ps.local, local)
+	ps.mu.Unlock()
+	return n
+}
+
+func testTx() *transaction.Tx {
+	return &transaction.Tx{
+		Version: 2,
+		TxIn: []transaction.TxIn{{
+			PreviousOutPoint: transaction.OutPoint{Hash: utils.Hash{1}},
+			Witness:          [][]byte{{1, 2, 3}},
+			Sequence:         0xffffffff,
+		}},
+		TxOut: []transaction.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	ps := &peers{}
+	b := New(Config{Peers: ps.all})
+	a := connect(t, b, ps, "a", network.PeerConfig{Relay: true})
+	other := connect(t, b, ps, "other", network.PeerConfig{Relay: true})
+	tx := testTx()
+
+	// Once a has the transaction, it reaches other, which announces it
+	// back to us.
+	go func() {
+		got := <-a.txs
+		other.SendInv(inv.InvVect{Type: inv.InvTypeWTx, Hash: got.WTxID()})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := b.Broadcast(ctx, Request{Tx: tx, Addrs: []string{"a"}})
+	require.NoError(t, err)
+
+	assert.Equal(t, tx.TxID(), result.TxID)
+	assert.Equal(t, []string{"a"}, result.Announced)
+	require.Len(t, result.Requested, 1)
+	assert.Equal(t, "a", result.Requested[0].Addr)
+	require.Len(t, result.Confirmed, 1)
+	assert.Equal(t, "other", result.Confirmed[0].Addr)
+	assert.GreaterOrEqual(t, result.Confirmed[0].After, result.Requested[0].After)
+
+	select {
+	case <-other.txs:
+		t.Fatal("the transaction was only announced to a")
+	default:
+	}
+}
+
+func TestBroadcastNotConfirmed(t *testing.T) {
+	ps := &peers{}
+	b := New(Config{Peers: ps.all})
+	a := connect(t, b, ps, "a", network.PeerConfig{Relay: true})
+	tx := testTx()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := b.Broadcast(ctx, Request{Tx: tx})
+	assert.ErrorIs(t, err, ErrNotConfirmed)
+	require.NotNil(t, result)
+	assert.Equal(t, []string{"a"}, result.Announced)
+	got := <-a.txs
+	assert.Equal(t, tx.Bytes(), got.Bytes(), "the transaction is fetched by wtxid with its witness")
+
+	// It is no longer served once the broadcast is over.
+	notFound := make(chan []inv.InvVect, 1)
+	a.OnNotFound(func(p *network.Peer, vects []inv.InvVect) error {
+		notFound <- vects
+		return nil
+	})
+	require.NoError(t, a.GetData(inv.InvVect{Type: inv.InvTypeTx, Hash: tx.TxID()}))
+	select {
+	case vects := <-notFound:
+		assert.Equal(t, tx.TxID(), vects[0].Hash)
+	case <-time.After(time.Second):
+		t.Fatal("notfound was not received")
+	}
+}
+
+func TestBroadcastChoosesPeers(t *testing.T) {
+	ps := &peers{}
+	b := New(Config{Peers: ps.all})
+	connect(t, b, ps, "norelay", network.PeerConfig{})
+	connect(t, b, ps, "filter", network.PeerConfig{Relay: true, FeeFilter: 10000})
+
+	require.Eventually(t, func() bool { return ps.all()[1].FeeFilter() == 10000 }, time.Second, 10*time.Millisecond)
+
+	_, err := b.Broadcast(context.Background(), Request{Tx: testTx(), FeeRate: 5})
+	assert.ErrorIs(t, err, ErrNoPeers, "one peer wants no transactions, the other none below 10 sat/vB")
+	assert.Len(t, b.choose(Request{FeeRate: 10}), 1)
+	assert.Len(t, b.choose(Request{}), 1, "feefilters are ignored without a feerate")
+}
@@ -0,0 +1,57 @@
+package cfilter
+
+import (
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+const (
+	// BasicFilterType identifies basic filters in BIP157 messages.
+	BasicFilterType = 0
+	// BasicP and BasicM are the parameters of basic filters (BIP158).
+	BasicP = 19
+	BasicM = 784931
+
+	opReturn = 0x6a
+)
+
+// Key returns the key of the filters of the block with the given hash: the
+// first 16 bytes of the hash.
+func Key(blockHash utils.Hash) [16]byte {
+	return [16]byte(blockHash[:16])
+}
+
+// BasicFilter returns the basic filter of b. It holds the output scripts
+// of the block's transactions, except OP_RETURN ones, and prevScripts, the
+// scripts of the outputs spent by the block's inputs. Empty scripts are
+// left out.
+func BasicFilter(b *block.Block, prevScripts [][]byte) *Filter {
+	var items [][]byte
+	for _, tx := range b.Transactions {
+		for _, out := range tx.TxOut {
+			if len(out.PkScript) == 0 || out.PkScript[0] == opReturn {
+				continue
+			}
+			items = append(items, out.PkScript)
+		}
+	}
+	for _, script := range prevScripts {
+		if len(script) > 0 {
+			items = append(items, script)
+		}
+	}
+	return NewFilter(BasicP, BasicM, Key(b.Hash()), items)
+}
+
+// ParseBasicFilter reads the basic filter of the block with the given
+// hash.
+func ParseBasicFilter(blockHash utils.Hash, serialized []byte) (*Filter, error) {
+	return ParseFilter(BasicP, BasicM, Key(blockHash), serialized)
+}
+
+// FilterHeader returns the header of the filter with the given hash in the
+// filter header chain: the double-SHA256 of the hash and the previous
+// header, which is zero for the genesis block.
+func FilterHeader(filterHash, prev utils.Hash) utils.Hash {
+	return utils.DoubleSHA256(append(filterHash[:], prev[:]...))
+}
@@ -0,0 +1,42 @@
+package cfilter
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasicFilterGenesis(t *testing.T) {
+	// The first vector of BIP158: the testnet3 genesis block.
+	b, err := block.DecodeBlockMessage(config.TestNet3Params.GenesisBlock)
+	require.NoError(t, err)
+	f := BasicFilter(b, nil)
+	assert.Equal(t, "019dfca8", hex.EncodeToString(f.Bytes()))
+	header := FilterHeader(f.Hash(), utils.Hash{})
+	assert.Equal(t, "21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750", header.String())
+
+	parsed, err := ParseBasicFilter(b.Hash(), f.Bytes())
+	require.NoError(t, err)
+	assert.True(t, parsed.Match(b.Transactions[0].TxOut[0].PkScript))
+}
+
+func TestBasicFilterScripts(t *testing.T) {
+	out := []byte{0x00, 0x14, 1}
+	nullData := []byte{opReturn, 1, 2}
+	spent := []byte{0x51}
+	b := &block.Block{Transactions: []*transaction.Tx{{
+		TxOut: []transaction.TxOut{{PkScript: out}, {PkScript: nullData}, {PkScript: nil}},
+	}}}
+
+	f := BasicFilter(b, [][]byte{spent, nil})
+	assert.Equal(t, uint32(2), f.N())
+	assert.True(t, f.Match(out))
+	assert.True(t, f.Match(spent))
+	assert.False(t, f.Match(nullData))
+}
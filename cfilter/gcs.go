@@ -0,0 +1,206 @@
+// Package cfilter implements compact block filters: the Golomb-coded sets
+// of BIP158, the basic filter built from the scripts of a block, the
+// filter header chain and the messages of BIP157.
+package cfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// Filter is a Golomb-coded set (BIP158): the sorted hashes of its items,
+// mapped to [0, N*M), delta-encoded with Golomb-Rice coding of parameter
+// P. False positives occur at a rate of about 1/M.
+type Filter struct {
+	n      uint32
+	p      uint8
+	m      uint64
+	k0, k1 uint64
+	// data is the Golomb-Rice bitstream, without the item count.
+	data []byte
+}
+
+// NewFilter returns the filter of items keyed with key. Duplicate items
+// are only counted once.
+func NewFilter(p uint8, m uint64, key [16]byte, items [][]byte) *Filter {
+	unique := make(map[string]bool, len(items))
+	for _, item := range items {
+		unique[string(item)] = true
+	}
+	f := &Filter{n: uint32(len(unique)), p: p, m: m}
+	f.k0, f.k1 = keys(key)
+
+	values := make([]uint64, 0, len(unique))
+	for item := range unique {
+		values = append(values, f.hash([]byte(item)))
+	}
+	slices.Sort(values)
+
+	var w bitWriter
+	last := uint64(0)
+	for _, v := range values {
+		delta := v - last
+		// The quotient in unary, then the remainder in p bits.
+		for q := delta >> p; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, p)
+		last = v
+	}
+	f.data = w.bytes()
+	return f
+}
+
+// ParseFilter reads a filter serialized by Bytes.
+func ParseFilter(p uint8, m uint64, key [16]byte, serialized []byte) (*Filter, error) {
+	r := bytes.NewReader(serialized)
+	n, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	// Every item takes at least p+1 bits.
+	if n > uint64(r.Len())*8/uint64(p+1) {
+		return nil, fmt.Errorf("filter of %d bytes cannot hold %d items", len(serialized), n)
+	}
+	f := &Filter{n: uint32(n), p: p, m: m, data: serialized[len(serialized)-r.Len():]}
+	f.k0, f.k1 = keys(key)
+	return f, nil
+}
+
+func keys(key [16]byte) (k0, k1 uint64) {
+	return binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+}
+
+// hash maps item uniformly to [0, N*M).
+func (f *Filter) hash(item []byte) uint64 {
+	hi, _ := bits.Mul64(utils.SipHash(f.k0, f.k1, item), uint64(f.n)*f.m)
+	return hi
+}
+
+// N returns the number of items of the filter.
+func (f *Filter) N() uint32 {
+	return f.n
+}
+
+// Bytes returns the serialized filter: the item count followed by the
+// bitstream.
+func (f *Filter) Bytes() []byte {
+	var buf bytes.Buffer
+	utils.WriteVarInt(&buf, uint64(f.n))
+	buf.Write(f.data)
+	return buf.Bytes()
+}
+
+// Hash returns the double-SHA256 of the serialized filter.
+func (f *Filter) Hash() utils.Hash {
+	return utils.DoubleSHA256(f.Bytes())
+}
+
+// Match reports whether item may be in the filter.
+func (f *Filter) Match(item []byte) bool {
+	return f.MatchAny([][]byte{item})
+}
+
+// MatchAny reports whether any of items may be in the filter. The items
+// are hashed and sorted, and the filter is decoded once.
+func (f *Filter) MatchAny(items [][]byte) bool {
+	if f.n == 0 || len(items) == 0 {
+		return false
+	}
+	queries := make([]uint64, len(items))
+	for i, item := range items {
+		queries[i] = f.hash(item)
+	}
+	slices.Sort(queries)
+
+	r := bitReader{data: f.data}
+	value := uint64(0)
+	for i := uint32(0); i < f.n; i++ {
+		delta, ok := r.readGolombRice(f.p)
+		if !ok {
+			return false
+		}
+		value += delta
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false
+		}
+		if queries[0] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// bitWriter writes bits most significant first.
+type bitWriter struct {
+	buf  []byte
+	used uint8
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.used == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if bit != 0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> w.used
+	}
+	w.used = (w.used + 1) % 8
+}
+
+// writeBits writes the n low bits of v.
+func (w *bitWriter) writeBits(v uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(v >> i & 1)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// bitReader reads bits most significant first.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint64, bool) {
+	if r.pos >= 8*len(r.data) {
+		return 0, false
+	}
+	bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint64(bit), true
+}
+
+func (r *bitReader) readGolombRice(p uint8) (uint64, bool) {
+	q := uint64(0)
+	for {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		if bit == 0 {
+			break
+		}
+		q++
+	}
+	v := q << p
+	for i := int(p) - 1; i >= 0; i-- {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		v |= bit << i
+	}
+	return v, true
+}
@@ -0,0 +1,44 @@
+package cfilter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	key := [16]byte{1, 2, 3}
+	var items [][]byte
+	for i := 0; i < 100; i++ {
+		items = append(items, []byte(fmt.Sprintf("item %d", i)))
+	}
+	f := NewFilter(BasicP, BasicM, key, append(items, items[0]))
+	assert.Equal(t, uint32(100), f.N(), "duplicates are counted once")
+	for _, item := range items {
+		assert.True(t, f.Match(item))
+	}
+	assert.False(t, f.Match([]byte("missing")))
+	assert.False(t, f.MatchAny([][]byte{[]byte("missing"), []byte("other")}))
+	assert.True(t, f.MatchAny([][]byte{[]byte("missing"), items[42]}))
+
+	parsed, err := ParseFilter(BasicP, BasicM, key, f.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, f.Hash(), parsed.Hash())
+	assert.True(t, parsed.Match(items[99]))
+
+	// The key changes every hash.
+	other, err := ParseFilter(BasicP, BasicM, [16]byte{4}, f.Bytes())
+	require.NoError(t, err)
+	assert.False(t, other.MatchAny(items[:10]))
+
+	_, err = ParseFilter(BasicP, BasicM, key, f.Bytes()[:10])
+	assert.ErrorContains(t, err, "cannot hold")
+}
+
+func TestEmptyFilter(t *testing.T) {
+	f := NewFilter(BasicP, BasicM, [16]byte{}, nil)
+	assert.Equal(t, []byte{0}, f.Bytes())
+	assert.False(t, f.Match(nil))
+}
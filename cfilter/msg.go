@@ -0,0 +1,232 @@
+package cfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+const (
+	// MaxGetCFilters is the largest number of filters a getcfilters request
+	// may ask for (BIP157).
+	MaxGetCFilters = 1000
+	// MaxGetCFHeaders is the largest number of filter hashes a getcfheaders
+	// request may ask for.
+	MaxGetCFHeaders = 2000
+	// CheckpointInterval is the height interval between the filter headers
+	// of a cfcheckpt message.
+	CheckpointInterval = 1000
+)
+
+// Request is the body of a getcfilters or getcfheaders message: the
+// filters, or filter hashes, of the blocks from StartHeight up to the
+// block StopHash.
+type Request struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    utils.Hash
+}
+
+// EncodeRequestMessage returns the payload of a getcfilters or getcfheaders
+// message, which share the same layout.
+func EncodeRequestMessage(req Request) []byte {
+	payload := []byte{req.FilterType}
+	payload = binary.LittleEndian.AppendUint32(payload, req.StartHeight)
+	return append(payload, req.StopHash[:]...)
+}
+
+// DecodeRequestMessage parses the payload of a getcfilters or getcfheaders
+// message.
+func DecodeRequestMessage(payload []byte) (Request, error) {
+	var req Request
+	if len(payload) != 1+4+utils.HashSize {
+		return req, fmt.Errorf("invalid filter request length: %d", len(payload))
+	}
+	req.FilterType = payload[0]
+	req.StartHeight = binary.LittleEndian.Uint32(payload[1:5])
+	copy(req.StopHash[:], payload[5:])
+	return req, nil
+}
+
+// CFilter is the body of a cfilter message: the serialized filter of a
+// block.
+type CFilter struct {
+	FilterType uint8
+	BlockHash  utils.Hash
+	Filter     []byte
+}
+
+// EncodeCFilterMessage returns the payload of a cfilter message.
+func EncodeCFilterMessage(f *CFilter) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(f.FilterType)
+	buf.Write(f.BlockHash[:])
+	utils.WriteVarBytes(&buf, f.Filter)
+	return buf.Bytes()
+}
+
+// DecodeCFilterMessage parses the payload of a cfilter message.
+func DecodeCFilterMessage(payload []byte) (*CFilter, error) {
+	r := bytes.NewReader(payload)
+	f := &CFilter{}
+	if err := binary.Read(r, binary.LittleEndian, &f.FilterType); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, f.BlockHash[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if f.Filter, err = utils.ReadVarBytes(r, block.MaxBlockSize); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after cfilter", r.Len())
+	}
+	return f, nil
+}
+
+// CFHeaders is the body of a cfheaders message: the filter hashes of a
+// range of blocks ending at StopHash, and the filter header of the block
+// before the range.
+type CFHeaders struct {
+	FilterType   uint8
+	StopHash     utils.Hash
+	PrevHeader   utils.Hash
+	FilterHashes []utils.Hash
+}
+
+// Headers returns the filter headers of the range, derived from the
+// filter hashes.
+func (h *CFHeaders) Headers() []utils.Hash {
+	headers := make([]utils.Hash, len(h.FilterHashes))
+	prev := h.PrevHeader
+	for i, filterHash := range h.FilterHashes {
+		headers[i] = FilterHeader(filterHash, prev)
+		prev = headers[i]
+	}
+	return headers
+}
+
+// EncodeCFHeadersMessage returns the payload of a cfheaders message.
+func EncodeCFHeadersMessage(h *CFHeaders) ([]byte, error) {
+	if len(h.FilterHashes) > MaxGetCFHeaders {
+		return nil, fmt.Errorf("too many filter hashes: %d", len(h.FilterHashes))
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(h.FilterType)
+	buf.Write(h.StopHash[:])
+	buf.Write(h.PrevHeader[:])
+	writeHashes(&buf, h.FilterHashes)
+	return buf.Bytes(), nil
+}
+
+// DecodeCFHeadersMessage parses the payload of a cfheaders message.
+func DecodeCFHeadersMessage(payload []byte) (*CFHeaders, error) {
+	r := bytes.NewReader(payload)
+	h := &CFHeaders{}
+	if err := binary.Read(r, binary.LittleEndian, &h.FilterType); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, h.StopHash[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, h.PrevHeader[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.FilterHashes, err = readHashes(r, MaxGetCFHeaders); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after cfheaders", r.Len())
+	}
+	return h, nil
+}
+
+// CheckptRequest is the body of a getcfcheckpt message.
+type CheckptRequest struct {
+	FilterType uint8
+	StopHash   utils.Hash
+}
+
+// EncodeCheckptRequestMessage returns the payload of a getcfcheckpt message.
+func EncodeCheckptRequestMessage(req CheckptRequest) []byte {
+	return append([]byte{req.FilterType}, req.StopHash[:]...)
+}
+
+// DecodeCheckptRequestMessage parses the payload of a getcfcheckpt message.
+func DecodeCheckptRequestMessage(payload []byte) (CheckptRequest, error) {
+	var req CheckptRequest
+	if len(payload) != 1+utils.HashSize {
+		return req, fmt.Errorf("invalid getcfcheckpt length: %d", len(payload))
+	}
+	req.FilterType = payload[0]
+	copy(req.StopHash[:], payload[1:])
+	return req, nil
+}
+
+// CFCheckpt is the body of a cfcheckpt message: the filter headers at
+// every CheckpointInterval heights up to the block StopHash.
+type CFCheckpt struct {
+	FilterType uint8
+	StopHash   utils.Hash
+	Headers    []utils.Hash
+}
+
+// EncodeCFCheckptMessage returns the payload of a cfcheckpt message.
+func EncodeCFCheckptMessage(c *CFCheckpt) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(c.FilterType)
+	buf.Write(c.StopHash[:])
+	writeHashes(&buf, c.Headers)
+	return buf.Bytes()
+}
+
+// DecodeCFCheckptMessage parses the payload of a cfcheckpt message.
+func DecodeCFCheckptMessage(payload []byte) (*CFCheckpt, error) {
+	r := bytes.NewReader(payload)
+	c := &CFCheckpt{}
+	if err := binary.Read(r, binary.LittleEndian, &c.FilterType); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, c.StopHash[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if c.Headers, err = readHashes(r, uint64(r.Len()/utils.HashSize)); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after cfcheckpt", r.Len())
+	}
+	return c, nil
+}
+
+func writeHashes(buf *bytes.Buffer, hashes []utils.Hash) {
+	utils.WriteVarInt(buf, uint64(len(hashes)))
+	for _, h := range hashes {
+		buf.Write(h[:])
+	}
+}
+
+// readHashes reads a count-prefixed list of at most max hashes.
+func readHashes(r *bytes.Reader, max uint64) ([]utils.Hash, error) {
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > max {
+		return nil, fmt.Errorf("too many hashes: %d", count)
+	}
+	hashes := make([]utils.Hash, count)
+	for i := range hashes {
+		if _, err := io.ReadFull(r, hashes[i][:]); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
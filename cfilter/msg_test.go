@@ -0,0 +1,68 @@
+package cfilter
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestMessages(t *testing.T) {
+	req := Request{FilterType: BasicFilterType, StartHeight: 1000, StopHash: utils.Hash{1}}
+	payload := EncodeRequestMessage(req)
+	assert.Len(t, payload, 37)
+	decoded, err := DecodeRequestMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, req, decoded)
+	_, err = DecodeRequestMessage(payload[1:])
+	assert.Error(t, err)
+
+	checkpt := CheckptRequest{FilterType: BasicFilterType, StopHash: utils.Hash{2}}
+	decodedCheckpt, err := DecodeCheckptRequestMessage(EncodeCheckptRequestMessage(checkpt))
+	require.NoError(t, err)
+	assert.Equal(t, checkpt, decodedCheckpt)
+}
+
+func TestCFilterMessage(t *testing.T) {
+	f := &CFilter{FilterType: BasicFilterType, BlockHash: utils.Hash{1}, Filter: []byte{1, 2, 3}}
+	payload := EncodeCFilterMessage(f)
+	decoded, err := DecodeCFilterMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, f, decoded)
+	_, err = DecodeCFilterMessage(append(payload, 0))
+	assert.ErrorContains(t, err, "trailing")
+}
+
+func TestCFHeadersMessage(t *testing.T) {
+	h := &CFHeaders{
+		FilterType:   BasicFilterType,
+		StopHash:     utils.Hash{1},
+		PrevHeader:   utils.Hash{2},
+		FilterHashes: []utils.Hash{{3}, {4}},
+	}
+	payload, err := EncodeCFHeadersMessage(h)
+	require.NoError(t, err)
+	decoded, err := DecodeCFHeadersMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, h, decoded)
+
+	headers := h.Headers()
+	require.Len(t, headers, 2)
+	assert.Equal(t, FilterHeader(utils.Hash{3}, utils.Hash{2}), headers[0])
+	assert.Equal(t, FilterHeader(utils.Hash{4}, headers[0]), headers[1])
+
+	h.FilterHashes = make([]utils.Hash, MaxGetCFHeaders+1)
+	_, err = EncodeCFHeadersMessage(h)
+	assert.Error(t, err)
+}
+
+func TestCFCheckptMessage(t *testing.T) {
+	c := &CFCheckpt{FilterType: BasicFilterType, StopHash: utils.Hash{1}, Headers: []utils.Hash{{2}, {3}}}
+	payload := EncodeCFCheckptMessage(c)
+	decoded, err := DecodeCFCheckptMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, c, decoded)
+	_, err = DecodeCFCheckptMessage(payload[:len(payload)-1])
+	assert.Error(t, err)
+}
@@ -0,0 +1,390 @@
+// Package cfindex builds the basic compact filters (BIP158) of the blocks
+// in the block store along the active chain, with their filter header
+// chain, and serves them to peers (BIP157).
+package cfindex
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// retryInterval is how often the index looks for newly stored blocks when
+// no chain event woke it up.
+const retryInterval = 10 * time.Second
+
+const (
+	// outPointSize is the size of an outpoint key: txid and output index.
+	outPointSize = utils.HashSize + 4
+	// opReturn starts provably unspendable outputs, which are not recorded.
+	opReturn = 0x6a
+)
+
+// ErrMissingOutput is returned when a block spends an output the index
+// does not know, so that its filter cannot be built.
+var ErrMissingOutput = errors.New("spent output not found")
+
+var (
+	// filtersBucket maps a block hash to its serialized basic filter.
+	filtersBucket = []byte("filters")
+	// headersBucket maps a block hash to the hash of its filter followed
+	// by its filter header.
+	headersBucket = []byte("headers")
+	// outputsBucket maps the outpoints of the unspent outputs of the
+	// indexed chain to their scripts, which the filters of the blocks
+	// spending them hold.
+	outputsBucket = []byte("outputs")
+	// undoBucket maps a block hash to the outputs it spent and created, to
+	// roll them back when the block leaves the active chain.
+	undoBucket = []byte("undo")
+	metaBucket = []byte("meta")
+
+	genesisKey = []byte("genesis")
+	tipKey     = []byte("tip")
+)
+
+// Config configures an Index.
+type Config struct {
+	// Path is the index database.
+	Path   string
+	Chain  *chain.Chain
+	Blocks *blockstore.Store
+	// HeadersSynced, when set, reports whether the initial header sync has
+	// completed; until it has, the index is not Synced. It fits
+	// chain.Syncer.Synced.
+	HeadersSynced func() bool
+}
+
+// Index keeps the basic filters of the active chain up to the first block
+// missing from the block store.
+type Index struct {
+	cfg  Config
+	db   *bolt.DB
+	wake chan struct{}
+
+	mu sync.Mutex
+	// tip is the last indexed block, nil before the genesis block is.
+	tip *chain.Node
+}
+
+// Open opens the index database at cfg.Path. The index resumes from its
+// recorded tip, which must be a header of cfg.Chain.
+func Open(cfg Config) (*Index, error) {
+	db, err := bolt.Open(cfg.Path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	genesis := cfg.Chain.Genesis().Hash
+	x := &Index{cfg: cfg, db: db, wake: make(chan struct{}, 1)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filtersBucket, headersBucket, outputsBucket, undoBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		stored := meta.Get(genesisKey)
+		if stored == nil {
+			return meta.Put(genesisKey, genesis[:])
+		}
+		if !bytes.Equal(stored, genesis[:]) {
+			return fmt.Errorf("filter index belongs to the chain with genesis %s", utils.Hash(stored))
+		}
+		if tip := meta.Get(tipKey); tip != nil {
+			if x.tip = cfg.Chain.Lookup(utils.Hash(tip)); x.tip == nil {
+				return fmt.Errorf("filter index tip %s is not in the header chain", utils.Hash(tip))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	cfg.Chain.Subscribe(func(chain.Event) { x.notify() })
+	return x, nil
+}
+
+// Close closes the index database.
+func (x *Index) Close() error {
+	return x.db.Close()
+}
+
+// Tip returns the last indexed block, or nil if none is.
+func (x *Index) Tip() *chain.Node {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.tip
+}
+
+// Synced reports whether every block of the active chain is indexed, once
+// the header sync has completed: a chain still at its genesis block is
+// trivially indexed.
+func (x *Index) Synced() bool {
+	if x.cfg.HeadersSynced != nil && !x.cfg.HeadersSynced() {
+		return false
+	}
+	return x.Tip() == x.cfg.Chain.Tip()
+}
+
+// Filter returns the serialized basic filter of the block with the given
+// hash, if it was indexed.
+func (x *Index) Filter(hash utils.Hash) ([]byte, bool) {
+	var filter []byte
+	x.db.View(func(tx *bolt.Tx) error {
+		filter = bytes.Clone(tx.Bucket(filtersBucket).Get(hash[:]))
+		return nil
+	})
+	return filter, filter != nil
+}
+
+// FilterHeader returns the hash and the filter header of the basic filter
+// of the block with the given hash, if it was indexed.
+func (x *Index) FilterHeader(hash utils.Hash) (filterHash, header utils.Hash, ok bool) {
+	x.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(headersBucket).Get(hash[:]); v != nil {
+			filterHash, header, ok = utils.Hash(v[:utils.HashSize]), utils.Hash(v[utils.HashSize:]), true
+		}
+		return nil
+	})
+	return filterHash, header, ok
+}
+
+// indexed reports whether node is on the indexed chain.
+func (x *Index) indexed(node *chain.Node) bool {
+	tip := x.Tip()
+	return tip != nil && tip.Ancestor(node.Height) == node
+}
+
+// notify wakes Run up without blocking.
+func (x *Index) notify() {
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run indexes the stored blocks of the active chain, following its tip,
+// until ctx is done.
+func (x *Index) Run(ctx context.Context) error {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		if err := x.catchUp(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-x.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// catchUp rolls the index back to the active chain and indexes its blocks
+// up to the first one missing from the block store.
+func (x *Index) catchUp(ctx context.Context) error {
+	for ctx.Err() == nil {
+		tip := x.Tip()
+		if tip != nil && !x.cfg.Chain.Contains(tip) {
+			if err := x.disconnect(tip); err != nil {
+				return fmt.Errorf("disconnect block %s: %w", tip.Hash, err)
+			}
+			continue
+		}
+		var height int32
+		if tip != nil {
+			height = tip.Height + 1
+		}
+		node := x.cfg.Chain.NodeAtHeight(height)
+		if node == nil {
+			return nil
+		}
+		b, err := x.block(node)
+		if errors.Is(err, blockstore.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.connect(node, b); err != nil {
+			return fmt.Errorf("index block %s: %w", node.Hash, err)
+		}
+		if node.Height%10000 == 0 {
+			log.Infof("Indexed the filters of the blocks up to height %d", node.Height)
+		}
+	}
+	return nil
+}
+
+// block reads the block of node. The genesis block is not always stored.
+func (x *Index) block(node *chain.Node) (*block.Block, error) {
+	if node.Height == 0 {
+		return block.DecodeBlockMessage(x.cfg.Chain.Params().GenesisBlock)
+	}
+	return x.cfg.Blocks.Block(node.Hash)
+}
+
+func outPointKey(op transaction.OutPoint) []byte {
+	key := make([]byte, outPointSize)
+	copy(key, op.Hash[:])
+	binary.LittleEndian.PutUint32(key[utils.HashSize:], op.Index)
+	return key
+}
+
+// connect indexes b, the block of node, on top of the index tip. The
+// outputs of the genesis block cannot be spent and are not recorded.
+func (x *Index) connect(node *chain.Node, b *block.Block) error {
+	var prevHeader utils.Hash
+	if node.Parent != nil {
+		_, header, ok := x.FilterHeader(node.Parent.Hash)
+		if !ok {
+			return fmt.Errorf("filter header of the parent %s not found", node.Parent.Hash)
+		}
+		prevHeader = header
+	}
+
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		outputs := tx.Bucket(outputsBucket)
+		var prevScripts [][]byte
+		var undo bytes.Buffer
+		var spent, created int
+		var createdKeys bytes.Buffer
+		for _, t := range b.Transactions {
+			if !t.IsCoinBase() {
+				for _, in := range t.TxIn {
+					key := outPointKey(in.PreviousOutPoint)
+					script := bytes.Clone(outputs.Get(key))
+					if script == nil {
+						return fmt.Errorf("%w: %s", ErrMissingOutput, in.PreviousOutPoint)
+					}
+					if err := outputs.Delete(key); err != nil {
+						return err
+					}
+					prevScripts = append(prevScripts, script)
+					undo.Write(key)
+					utils.WriteVarBytes(&undo, script)
+					spent++
+				}
+			}
+			if node.Height == 0 {
+				continue
+			}
+			txid := t.TxID()
+			for i, out := range t.TxOut {
+				if len(out.PkScript) > 0 && out.PkScript[0] == opReturn {
+					continue
+				}
+				key := outPointKey(transaction.OutPoint{Hash: txid, Index: uint32(i)})
+				if err := outputs.Put(key, out.PkScript); err != nil {
+					return err
+				}
+				createdKeys.Write(key)
+				created++
+			}
+		}
+
+		// The undo record lists the spent outpoints with their scripts,
+		// then the created outpoints.
+		var record bytes.Buffer
+		utils.WriteVarInt(&record, uint64(spent))
+		record.Write(undo.Bytes())
+		utils.WriteVarInt(&record, uint64(created))
+		record.Write(createdKeys.Bytes())
+
+		filter := cfilter.BasicFilter(b, prevScripts)
+		filterHash := filter.Hash()
+		header := cfilter.FilterHeader(filterHash, prevHeader)
+		if err := tx.Bucket(filtersBucket).Put(node.Hash[:], filter.Bytes()); err != nil {
+			return err
+		}
+		if err := tx.Bucket(headersBucket).Put(node.Hash[:], append(filterHash[:], header[:]...)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(undoBucket).Put(node.Hash[:], record.Bytes()); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(tipKey, node.Hash[:])
+	})
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.tip = node
+	x.mu.Unlock()
+	return nil
+}
+
+// disconnect rolls back the outputs spent and created by node, the index
+// tip, and makes its parent the tip. Its filter is kept.
+func (x *Index) disconnect(node *chain.Node) error {
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(undoBucket).Get(node.Hash[:])
+		if v == nil {
+			return errors.New("undo record not found")
+		}
+		r := bytes.NewReader(v)
+		outputs := tx.Bucket(outputsBucket)
+		// Spent outputs are restored before the created ones are removed,
+		// which drops the outputs both created and spent by the block.
+		spent, err := utils.ReadVarInt(r)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < spent; i++ {
+			key := make([]byte, outPointSize)
+			if _, err := io.ReadFull(r, key); err != nil {
+				return err
+			}
+			script, err := utils.ReadVarBytes(r, uint64(r.Len()))
+			if err != nil {
+				return err
+			}
+			if err := outputs.Put(key, script); err != nil {
+				return err
+			}
+		}
+		created, err := utils.ReadVarInt(r)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < created; i++ {
+			key := make([]byte, outPointSize)
+			if _, err := io.ReadFull(r, key); err != nil {
+				return err
+			}
+			if err := outputs.Delete(key); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(undoBucket).Delete(node.Hash[:]); err != nil {
+			return err
+		}
+		if node.Parent == nil {
+			return tx.Bucket(metaBucket).Delete(tipKey)
+		}
+		return tx.Bucket(metaBucket).Put(tipKey, node.Parent.Hash[:])
+	})
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.tip = node.Parent
+	x.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,191 @@
+package cfindex
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spend returns a transaction spending op to script, with an OP_RETURN
+// output that no filter holds.
+func spend(op transaction.OutPoint, script []byte) *transaction.Tx {
+	return &transaction.Tx{
+		Version: 2,
+		TxIn:    []transaction.TxIn{{PreviousOutPoint: op}},
+		TxOut:   []transaction.TxOut{{Value: 1e8, PkScript: script}, {PkScript: []byte{0x6a, 1}}},
+	}
+}
+
+// mine returns a valid regtest block on top of parent holding a coinbase
+// paying to tag and txs.
+func mine(parent block.Header, tag string, txs ...*transaction.Tx) *block.Block {
+	coinbase := &transaction.Tx{
+		Version: 2,
+		TxIn: []transaction.TxIn{{
+			PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte(tag),
+		}},
+		TxOut: []transaction.TxOut{{Value: 50e8, PkScript: []byte(tag)}},
+	}
+	b := &block.Block{Transactions: append([]*transaction.Tx{coinbase}, txs...)}
+	b.Header = block.Header{
+		Version:   4,
+		PrevBlock: parent.Hash(),
+		Timestamp: parent.Timestamp + chain.TargetSpacing,
+		Bits:      parent.Bits,
+	}
+	b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+	for !b.Header.CheckProofOfWork() {
+		b.Header.Nonce++
+	}
+	return b
+}
+
+// coinbaseOut returns the output of the coinbase of b.
+func coinbaseOut(b *block.Block) transaction.OutPoint {
+	return transaction.OutPoint{Hash: b.Transactions[0].TxID()}
+}
+
+type testEnv struct {
+	chain   *chain.Chain
+	blocks  *blockstore.Store
+	index   *Index
+	path    string
+	genesis *block.Block
+}
+
+func setup(t *testing.T) *testEnv {
+	t.Helper()
+	dir := t.TempDir()
+	c, err := chain.New(&config.RegTestParams)
+	require.NoError(t, err)
+	blocks, err := blockstore.Open(blockstore.Config{Dir: filepath.Join(dir, "blocks"), Magic: config.RegTestParams.Magic})
+	require.NoError(t, err)
+	t.Cleanup(func() { blocks.Close() })
+	genesis, err := block.DecodeBlockMessage(config.RegTestParams.GenesisBlock)
+	require.NoError(t, err)
+
+	env := &testEnv{chain: c, blocks: blocks, path: filepath.Join(dir, "filters.db"), genesis: genesis}
+	env.open(t)
+	return env
+}
+
+func (env *testEnv) open(t *testing.T) {
+	t.Helper()
+	index, err := Open(Config{Path: env.path, Chain: env.chain, Blocks: env.blocks})
+	require.NoError(t, err)
+	t.Cleanup(func() { index.Close() })
+	env.index = index
+}
+
+// add stores bs and adds their headers to the chain.
+func (env *testEnv) add(t *testing.T, bs ...*block.Block) {
+	t.Helper()
+	headers := make([]block.Header, len(bs))
+	for i, b := range bs {
+		_, err := env.blocks.Put(b)
+		require.NoError(t, err)
+		headers[i] = b.Header
+	}
+	_, err := env.chain.AddHeaders(headers)
+	require.NoError(t, err)
+}
+
+func TestIndex(t *testing.T) {
+	env := setup(t)
+	ctx := context.Background()
+	b1 := mine(env.genesis.Header, "one")
+	b2 := mine(b1.Header, "two", spend(coinbaseOut(b1), []byte("alice")))
+	b3 := mine(b2.Header, "three")
+	env.add(t, b1, b2)
+	// The third block's header arrives before the block.
+	_, err := env.chain.AddHeader(b3.Header)
+	require.NoError(t, err)
+
+	require.NoError(t, env.index.catchUp(ctx))
+	assert.Equal(t, b2.Hash(), env.index.Tip().Hash)
+	assert.False(t, env.index.Synced())
+
+	raw, ok := env.index.Filter(b2.Hash())
+	require.True(t, ok)
+	filter, err := cfilter.ParseBasicFilter(b2.Hash(), raw)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), filter.N(), "two output scripts and a spent one, no OP_RETURN")
+	assert.True(t, filter.Match([]byte("one")), "the script of the spent output")
+	assert.True(t, filter.Match([]byte("alice")))
+
+	// The filter header chain starts from zero at the genesis block.
+	prev := utils.Hash{}
+	for _, b := range []*block.Block{env.genesis, b1, b2} {
+		raw, ok := env.index.Filter(b.Hash())
+		require.True(t, ok)
+		filterHash, header, ok := env.index.FilterHeader(b.Hash())
+		require.True(t, ok)
+		assert.Equal(t, utils.DoubleSHA256(raw), filterHash)
+		assert.Equal(t, cfilter.FilterHeader(filterHash, prev), header)
+		prev = header
+	}
+
+	_, err = env.blocks.Put(b3)
+	require.NoError(t, err)
+	require.NoError(t, env.index.catchUp(ctx))
+	assert.True(t, env.index.Synced())
+
+	// The index resumes from its tip.
+	require.NoError(t, env.index.Close())
+	env.open(t)
+	assert.Equal(t, b3.Hash(), env.index.Tip().Hash)
+}
+
+func TestIndexSyncedAfterHeaders(t *testing.T) {
+	env := setup(t)
+	synced := false
+	env.index.cfg.HeadersSynced = func() bool { return synced }
+	require.NoError(t, env.index.catchUp(context.Background()))
+	assert.Equal(t, env.genesis.Hash(), env.index.Tip().Hash)
+
+	// The genesis block alone is indexed before the header sync is over.
+	assert.False(t, env.index.Synced())
+	synced = true
+	assert.True(t, env.index.Synced())
+}
+
+func TestIndexReorg(t *testing.T) {
+	env := setup(t)
+	ctx := context.Background()
+	b1 := mine(env.genesis.Header, "one")
+	tx := spend(coinbaseOut(b1), []byte("alice"))
+	b2 := mine(b1.Header, "two", tx)
+	env.add(t, b1, b2)
+	require.NoError(t, env.index.catchUp(ctx))
+
+	// A longer branch spends the first coinbase again, which the reorg
+	// makes unspent.
+	other2 := mine(b1.Header, "other2", spend(coinbaseOut(b1), []byte("bob")))
+	other3 := mine(other2.Header, "other3")
+	env.add(t, other2, other3)
+	require.NoError(t, env.index.catchUp(ctx))
+	assert.True(t, env.index.Synced())
+	raw, ok := env.index.Filter(other2.Hash())
+	require.True(t, ok)
+	filter, err := cfilter.ParseBasicFilter(other2.Hash(), raw)
+	require.NoError(t, err)
+	assert.True(t, filter.Match([]byte("one")))
+	assert.False(t, env.index.indexed(env.chain.Lookup(b2.Hash())))
+
+	// The outputs of the disconnected block are gone.
+	other4 := mine(other3.Header, "other4", spend(transaction.OutPoint{Hash: tx.TxID()}, []byte("carol")))
+	env.add(t, other4)
+	assert.ErrorIs(t, env.index.catchUp(ctx), ErrMissingOutput)
+	assert.Equal(t, other3.Hash(), env.index.Tip().Hash)
+}
@@ -0,0 +1,119 @@
+package cfindex
+
+import (
+	"fmt"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetupPeer registers the index's handlers for the filter requests of p
+// before its handshake. It fits connmgr.Config.SetupPeer.
+func (x *Index) SetupPeer(p *network.Peer) {
+	p.OnGetCFilters(x.handleGetCFilters)
+	p.OnGetCFHeaders(x.handleGetCFHeaders)
+	p.OnGetCFCheckpt(x.handleGetCFCheckpt)
+}
+
+// stopNode returns the header a request stops at. Malformed requests are
+// an error, which disconnects the peer; a nil node without error means the
+// index does not cover it yet and the request is ignored. The handlers
+// likewise ignore requests our own index fails to answer.
+func (x *Index) stopNode(p *network.Peer, filterType uint8, stopHash utils.Hash) (*chain.Node, error) {
+	if filterType != cfilter.BasicFilterType {
+		return nil, fmt.Errorf("unsupported filter type %d", filterType)
+	}
+	stop := x.cfg.Chain.Lookup(stopHash)
+	if stop == nil {
+		return nil, fmt.Errorf("unknown stop block %s", stopHash)
+	}
+	if !x.indexed(stop) {
+		log.Debugf("Ignoring filter request from %s: block %s is not indexed", p.Addr(), stopHash)
+		return nil, nil
+	}
+	return stop, nil
+}
+
+// requestRange returns the headers from req.StartHeight up to the stop
+// block, at most max of them.
+func (x *Index) requestRange(p *network.Peer, req cfilter.Request, max int) ([]*chain.Node, error) {
+	stop, err := x.stopNode(p, req.FilterType, req.StopHash)
+	if stop == nil {
+		return nil, err
+	}
+	start := int64(req.StartHeight)
+	if start > int64(stop.Height) || int64(stop.Height)-start >= int64(max) {
+		return nil, fmt.Errorf("invalid filter range from height %d to %s at height %d", start, stop.Hash, stop.Height)
+	}
+	nodes := make([]*chain.Node, stop.Height-int32(start)+1)
+	node := stop
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i] = node
+		node = node.Parent
+	}
+	return nodes, nil
+}
+
+func (x *Index) handleGetCFilters(p *network.Peer, req cfilter.Request) error {
+	nodes, err := x.requestRange(p, req, cfilter.MaxGetCFilters)
+	if nodes == nil {
+		return err
+	}
+	for _, node := range nodes {
+		filter, ok := x.Filter(node.Hash)
+		if !ok {
+			log.Warnf("Ignoring getcfilters from %s: filter of block %s not found", p.Addr(), node.Hash)
+			return nil
+		}
+		if err := p.SendCFilter(&cfilter.CFilter{FilterType: req.FilterType, BlockHash: node.Hash, Filter: filter}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *Index) handleGetCFHeaders(p *network.Peer, req cfilter.Request) error {
+	nodes, err := x.requestRange(p, req, cfilter.MaxGetCFHeaders)
+	if nodes == nil {
+		return err
+	}
+	resp := &cfilter.CFHeaders{FilterType: req.FilterType, StopHash: req.StopHash}
+	if parent := nodes[0].Parent; parent != nil {
+		_, resp.PrevHeader, _ = x.FilterHeader(parent.Hash)
+	}
+	for _, node := range nodes {
+		filterHash, _, ok := x.FilterHeader(node.Hash)
+		if !ok {
+			log.Warnf("Ignoring getcfheaders from %s: filter header of block %s not found", p.Addr(), node.Hash)
+			return nil
+		}
+		resp.FilterHashes = append(resp.FilterHashes, filterHash)
+	}
+	return p.SendCFHeaders(resp)
+}
+
+func (x *Index) handleGetCFCheckpt(p *network.Peer, req cfilter.CheckptRequest) error {
+	stop, err := x.stopNode(p, req.FilterType, req.StopHash)
+	if stop == nil {
+		return err
+	}
+	resp := &cfilter.CFCheckpt{
+		FilterType: req.FilterType,
+		StopHash:   req.StopHash,
+		Headers:    make([]utils.Hash, stop.Height/cfilter.CheckpointInterval),
+	}
+	node := stop
+	for i := len(resp.Headers) - 1; i >= 0; i-- {
+		node = node.Ancestor(int32(i+1) * cfilter.CheckpointInterval)
+		_, header, ok := x.FilterHeader(node.Hash)
+		if !ok {
+			log.Warnf("Ignoring getcfcheckpt from %s: filter header of block %s not found", p.Addr(), node.Hash)
+			return nil
+		}
+		resp.Headers[i] = header
+	}
+	return p.SendCFCheckpt(resp)
+}
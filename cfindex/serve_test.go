@@ -0,0 +1,199 @@
+package cfindex
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/filterclient"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// connect returns a peer connected to another one served by index. setup
+// registers its handlers.
+func connect(t *testing.T, index *Index, addr string, setup func(*network.Peer)) *network.Peer {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	local := network.NewPeer(c1, addr, network.PeerConfig{Magic: config.RegTestParams.Magic})
+	setup(local)
+	remote := network.NewPeer(c2, "local", network.PeerConfig{
+		Magic:    config.RegTestParams.Magic,
+		Services: func() uint64 { return config.NodeCompactFilters },
+	})
+	index.SetupPeer(remote)
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+	return local
+}
+
+func TestRequestHandlers(t *testing.T) {
+	c1, c2 := net.Pipe()
+	local := network.NewPeer(c1, "remote", network.PeerConfig{})
+	remote := network.NewPeer(c2, "local", network.PeerConfig{Services: func() uint64 { return config.NodeCompactFilters }})
+
+	// The remote records the decoded requests.
+	requests := make(chan any, 3)
+	remote.OnGetCFCheckpt(func(p *network.Peer, req cfilter.CheckptRequest) error {
+		requests <- req
+		return nil
+	})
+	remote.OnGetCFHeaders(func(p *network.Peer, req cfilter.Request) error {
+		requests <- req
+		return nil
+	})
+	remote.OnGetCFilters(func(p *network.Peer, req cfilter.Request) error {
+		requests <- req
+		return nil
+	})
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+
+	checkpt := cfilter.CheckptRequest{StopHash: utils.Hash{1}}
+	headers := cfilter.Request{StartHeight: 2, StopHash: utils.Hash{2}}
+	filters := cfilter.Request{StartHeight: 3, StopHash: utils.Hash{3}}
+	require.NoError(t, local.GetCFCheckpt(checkpt))
+	require.NoError(t, local.GetCFHeaders(headers))
+	require.NoError(t, local.GetCFilters(filters))
+	for _, want := range []any{checkpt, headers, filters} {
+		select {
+		case req := <-requests:
+			assert.Equal(t, want, req)
+		case <-time.After(time.Second):
+			t.Fatalf("%T was not received", want)
+		}
+	}
+
+	// A malformed request disconnects the peer.
+	require.NoError(t, local.Send(network.Message{Command: "getcfilters", Payload: []byte{0}}))
+	select {
+	case <-remote.Done():
+	case <-time.After(time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+}
+
+func TestServe(t *testing.T) {
+	env := setup(t)
+	ctx := context.Background()
+	blocks := []*block.Block{env.genesis}
+	for _, tag := range []string{"one", "two", "three", "four", "five"} {
+		blocks = append(blocks, mine(blocks[len(blocks)-1].Header, tag))
+	}
+	env.add(t, blocks[1:]...)
+	require.NoError(t, env.index.catchUp(ctx))
+
+	// A filter client checks the headers and filters we serve.
+	client := filterclient.New(filterclient.Config{Chain: env.chain})
+	for _, addr := range []string{"a", "b"} {
+		client.AddPeer(connect(t, env.index, addr, client.SetupPeer))
+	}
+	require.NoError(t, client.SyncHeaders(ctx))
+	_, header, _ := env.index.FilterHeader(blocks[5].Hash())
+	clientHeader, ok := client.FilterHeader(5)
+	require.True(t, ok)
+	assert.Equal(t, header, clientHeader)
+
+	matches, err := client.Scan(ctx, 0, [][]byte{[]byte("two"), []byte("five")})
+	require.NoError(t, err)
+	assert.Equal(t, []filterclient.Match{
+		{Height: 2, Hash: blocks[2].Hash()},
+		{Height: 5, Hash: blocks[5].Hash()},
+	}, matches)
+}
+
+func TestServeRejects(t *testing.T) {
+	env := setup(t)
+	b1 := mine(env.genesis.Header, "one")
+	b2 := mine(b1.Header, "two")
+	env.add(t, b1)
+	require.NoError(t, env.index.catchUp(context.Background()))
+	_, err := env.chain.AddHeader(b2.Header)
+	require.NoError(t, err)
+
+	// Requests for blocks not indexed yet are ignored.
+	headers := make(chan *cfilter.CFHeaders, 2)
+	p := connect(t, env.index, "a", func(p *network.Peer) {
+		p.OnCFHeaders(func(p *network.Peer, h *cfilter.CFHeaders) error {
+			headers <- h
+			return nil
+		})
+	})
+	require.NoError(t, p.GetCFHeaders(cfilter.Request{StopHash: b2.Hash()}))
+	require.NoError(t, p.GetCFHeaders(cfilter.Request{StartHeight: 1, StopHash: b1.Hash()}))
+	select {
+	case h := <-headers:
+		assert.Equal(t, b1.Hash(), h.StopHash)
+		_, prev, _ := env.index.FilterHeader(env.genesis.Hash())
+		assert.Equal(t, prev, h.PrevHeader)
+		assert.Len(t, h.FilterHashes, 1)
+	case <-time.After(time.Second):
+		t.Fatal("cfheaders was not received")
+	}
+
+	for name, req := range map[string]cfilter.Request{
+		"unknown filter type": {FilterType: 1, StopHash: b1.Hash()},
+		"unknown stop block":  {StopHash: utils.Hash{1}},
+		"start after stop":    {StartHeight: 2, StopHash: b1.Hash()},
+	} {
+		p := connect(t, env.index, "b", func(*network.Peer) {})
+		require.NoError(t, p.GetCFilters(req))
+		select {
+		case <-p.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("%s: peer was not disconnected", name)
+		}
+	}
+}
+
+func TestServeMissingFilter(t *testing.T) {
+	env := setup(t)
+	b1 := mine(env.genesis.Header, "one")
+	env.add(t, b1)
+	require.NoError(t, env.index.catchUp(context.Background()))
+	hash := b1.Hash()
+	require.NoError(t, env.index.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filtersBucket).Delete(hash[:])
+	}))
+
+	// A filter our index lost is not the peer's fault: the request is
+	// skipped and the peer stays connected.
+	filters := make(chan *cfilter.CFilter, 2)
+	headers := make(chan *cfilter.CFHeaders, 1)
+	p := connect(t, env.index, "a", func(p *network.Peer) {
+		p.OnCFilter(func(p *network.Peer, f *cfilter.CFilter) error {
+			filters <- f
+			return nil
+		})
+		p.OnCFHeaders(func(p *network.Peer, h *cfilter.CFHeaders) error {
+			headers <- h
+			return nil
+		})
+	})
+	require.NoError(t, p.GetCFilters(cfilter.Request{StartHeight: 1, StopHash: b1.Hash()}))
+	require.NoError(t, p.GetCFHeaders(cfilter.Request{StopHash: b1.Hash()}))
+	select {
+	case <-headers:
+	case <-p.Done():
+		t.Fatal("peer was disconnected")
+	case <-time.After(time.Second):
+		t.Fatal("cfheaders was not received")
+	}
+	assert.Empty(t, filters)
+}
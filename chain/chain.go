@@ -0,0 +1,427 @@
+// Package chain keeps a tree of validated block headers and follows the
+// branch with the most cumulative proof of work.
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxFutureBlockTime is how far ahead of our clock a header may be
+	// timestamped.
+	MaxFutureBlockTime = 2 * time.Hour
+
+	// medianTimeBlocks is the number of blocks whose median timestamp a new
+	// block must exceed.
+	medianTimeBlocks = 11
+)
+
+var (
+	// ErrUnknownParent is returned for a header whose parent is not in the
+	// tree. It is not a sign of misbehaviour: the peer may be announcing a
+	// block on a branch we have not synced yet.
+	ErrUnknownParent = errors.New("previous block not found")
+	// ErrBadTarget is returned for a target that is not positive or is
+	// easier than the network's limit.
+	ErrBadTarget = errors.New("target out of range")
+	// ErrBadProofOfWork is returned for a hash that does not meet the target.
+	ErrBadProofOfWork = errors.New("hash does not meet target")
+	// ErrBadDiffBits is returned when the target differs from the one the
+	// retargeting rules require.
+	ErrBadDiffBits = errors.New("incorrect proof of work target")
+	// ErrTimeTooOld is returned for a timestamp not after the median time
+	// past of its parent.
+	ErrTimeTooOld = errors.New("block timestamp too old")
+	// ErrTimeTooNew is returned for a timestamp more than two hours ahead of
+	// our clock.
+	ErrTimeTooNew = errors.New("block timestamp too far in the future")
+	// ErrTimewarp is returned under BIP94 for the first block of a retarget
+	// period timestamped more than ten minutes before its parent.
+	ErrTimewarp = errors.New("block timestamp too early for a retarget block")
+	// ErrNonContinuous is returned for a batch of headers in which a header
+	// does not build on the one before it.
+	ErrNonContinuous = errors.New("non-continuous headers sequence")
+	// ErrCheckpointMismatch is returned for a header at a checkpoint height
+	// whose hash is not the checkpoint's.
+	ErrCheckpointMismatch = errors.New("header does not match checkpoint")
+	// ErrForkBeforeCheckpoint is returned for a header that forks off below
+	// the last checkpoint we have reached.
+	ErrForkBeforeCheckpoint = errors.New("fork before the last checkpoint")
+)
+
+// Node is a header in the tree.
+type Node struct {
+	Header block.Header
+	Hash   utils.Hash
+	Height int32
+	// ChainWork is the total work of the branch up to and including this
+	// header.
+	ChainWork *big.Int
+	Parent    *Node
+}
+
+// Ancestor returns the ancestor of n at the given height, or nil if height
+// is above n or negative.
+func (n *Node) Ancestor(height int32) *Node {
+	if height < 0 || height > n.Height {
+		return nil
+	}
+	node := n
+	for node.Height > height {
+		node = node.Parent
+	}
+	return node
+}
+
+// MedianTimePast returns the median timestamp of n and the ten headers
+// before it.
+func (n *Node) MedianTimePast() uint32 {
+	times := make([]uint32, 0, medianTimeBlocks)
+	for node := n; node != nil && len(times) < medianTimeBlocks; node = node.Parent {
+		times = append(times, node.Header.Timestamp)
+	}
+	slices.Sort(times)
+	return times[len(times)/2]
+}
+
+// Locator returns the block locator for n, built as Bitcoin Core does: the
+// most recent hashes one by one, then at exponentially growing distances,
+// ending with genesis.
+func (n *Node) Locator() []utils.Hash {
+	var hashes []utils.Hash
+	step := int32(1)
+	node := n
+	for node != nil {
+		hashes = append(hashes, node.Hash)
+		if node.Height == 0 {
+			break
+		}
+		height := max(node.Height-step, 0)
+		node = node.Ancestor(height)
+		if len(hashes) > 10 {
+			step *= 2
+		}
+	}
+	return hashes
+}
+
+// Chain is a tree of headers rooted at the genesis block. Every header is
+// validated before it is added and the tip is the header with the most
+// cumulative work, the first one seen winning ties. The headers from
+// genesis to the tip form the active chain. It is safe for concurrent use.
+type Chain struct {
+	params *config.ChainParams
+	store  *store
+
+	mu         sync.RWMutex
+	nodes      map[utils.Hash]*Node
+	genesis    *Node
+	tip        *Node
+	active     []*Node
+	checkpoint *Node
+
+	// notifyMu is held while a tip change is applied and its events are
+	// delivered, so that handlers see the changes in order.
+	notifyMu sync.Mutex
+	handlers []EventHandler
+}
+
+// New returns an in-memory chain holding the genesis header of params.
+func New(params *config.ChainParams) (*Chain, error) {
+	genesis, err := block.DecodeBlockMessage(params.GenesisBlock)
+	if err != nil {
+		return nil, fmt.Errorf("decoding genesis block: %w", err)
+	}
+	node := &Node{
+		Header:    genesis.Header,
+		Hash:      genesis.Hash(),
+		ChainWork: CalcWork(genesis.Header.Bits),
+	}
+	return &Chain{
+		params:  params,
+		nodes:   map[utils.Hash]*Node{node.Hash: node},
+		genesis: node,
+		tip:     node,
+		active:  []*Node{node},
+	}, nil
+}
+
+// Open returns a chain whose headers are kept in the database at path,
+// creating it if needed. The headers stored by earlier runs are loaded
+// without being validated again.
+func Open(params *config.ChainParams, path string) (*Chain, error) {
+	c, err := New(params)
+	if err != nil {
+		return nil, err
+	}
+	if c.store, err = openStore(path, c.genesis.Hash); err != nil {
+		return nil, err
+	}
+
+	tip, err := c.store.load(func(height int32, h *block.Header) error {
+		if height == 0 {
+			return nil
+		}
+		parent, ok := c.nodes[h.PrevBlock]
+		if !ok || parent.Height != height-1 {
+			return fmt.Errorf("stored header %s at height %d: %w", h.Hash(), height, ErrUnknownParent)
+		}
+		c.insert(*h, h.Hash(), parent)
+		return nil
+	})
+	if err != nil {
+		c.store.close()
+		return nil, err
+	}
+	// Restore the recorded tip, which may have won a tie against another
+	// branch with the same work.
+	if node, ok := c.nodes[tip]; ok && node.ChainWork.Cmp(c.tip.ChainWork) == 0 {
+		c.tip = node
+	}
+	c.activate(c.tip)
+	return c, nil
+}
+
+// Close closes the header database of a chain created with Open.
+func (c *Chain) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.close()
+}
+
+// Params returns the network parameters of the chain.
+func (c *Chain) Params() *config.ChainParams {
+	return c.params
+}
+
+// Genesis returns the genesis header.
+func (c *Chain) Genesis() *Node {
+	return c.genesis
+}
+
+// Tip returns the header with the most cumulative work.
+func (c *Chain) Tip() *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip
+}
+
+// Height returns the height of the tip.
+func (c *Chain) Height() int32 {
+	return c.Tip().Height
+}
+
+// Lookup returns the header with the given hash, or nil if it is not in
+// the tree.
+func (c *Chain) Lookup(hash utils.Hash) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes[hash]
+}
+
+// NodeAtHeight returns the header of the active chain at height, or nil if
+// the active chain is shorter.
+func (c *Chain) NodeAtHeight(height int32) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if height < 0 || int(height) >= len(c.active) {
+		return nil
+	}
+	return c.active[height]
+}
+
+// Contains reports whether node is part of the active chain.
+func (c *Chain) Contains(node *Node) bool {
+	return node != nil && c.NodeAtHeight(node.Height) == node
+}
+
+// Len returns the number of headers in the tree.
+func (c *Chain) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.nodes)
+}
+
+// Locator returns the block locator of the tip.
+func (c *Chain) Locator() []utils.Hash {
+	return c.Tip().Locator()
+}
+
+// FindFork returns the most recent header of the active chain listed in
+// locator, or genesis if there is none. This is where a peer that sent the
+// locator forked off our chain.
+func (c *Chain) FindFork(locator []utils.Hash) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, hash := range locator {
+		node, ok := c.nodes[hash]
+		if ok && int(node.Height) < len(c.active) && c.active[node.Height] == node {
+			return node
+		}
+	}
+	return c.genesis
+}
+
+// CheckHeader applies to h, whose parent is in the tree, the checks
+// AddHeader makes, without adding it.
+func (c *Chain) CheckHeader(h *block.Header, parent *Node) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.checkHeader(h, h.Hash(), parent, time.Now())
+}
+
+// AddHeader validates h and adds it to the tree. Adding a header that is
+// already known returns its node.
+func (c *Chain) AddHeader(h block.Header) (*Node, error) {
+	return c.AddHeaders([]block.Header{h})
+}
+
+// AddHeaders adds a batch of headers, as received in a headers message,
+// and returns the node of the last one. It stops at the first invalid
+// header; the ones before it stay in the tree. Subscribers are notified of
+// the resulting tip change before it returns.
+func (c *Chain) AddHeaders(headers []block.Header) (*Node, error) {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+
+	c.mu.Lock()
+	oldTip := c.tip
+	added, last, err := c.addHeaders(headers)
+	if len(added) > 0 && c.store != nil {
+		if storeErr := c.store.put(added, c.tip); storeErr != nil && err == nil {
+			err = fmt.Errorf("storing headers: %w", storeErr)
+		}
+	}
+	newTip := c.tip
+	var events []Event
+	if newTip != oldTip {
+		events = tipEvents(oldTip, newTip)
+		c.activate(newTip)
+	}
+	c.mu.Unlock()
+
+	if len(events) > 0 && events[0].ForkDepth > 0 {
+		log.Warnf("Reorganization of depth %d to %s at height %d", events[0].ForkDepth, newTip.Hash, newTip.Height)
+	}
+	for _, e := range events {
+		for _, h := range c.handlers {
+			h(e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return last, nil
+}
+
+// addHeaders validates and inserts headers, returning the new nodes and the
+// node of the last header.
+func (c *Chain) addHeaders(headers []block.Header) (added []*Node, last *Node, err error) {
+	now := time.Now()
+	for i := range headers {
+		h := headers[i]
+		if last != nil && h.PrevBlock != last.Hash {
+			return added, nil, ErrNonContinuous
+		}
+		hash := h.Hash()
+		if node, ok := c.nodes[hash]; ok {
+			last = node
+			continue
+		}
+		parent, ok := c.nodes[h.PrevBlock]
+		if !ok {
+			return added, nil, fmt.Errorf("header %s: %w: %s", hash, ErrUnknownParent, h.PrevBlock)
+		}
+		if err := c.checkHeader(&h, hash, parent, now); err != nil {
+			return added, nil, fmt.Errorf("header %s at height %d: %w", hash, parent.Height+1, err)
+		}
+		last = c.insert(h, hash, parent)
+		added = append(added, last)
+	}
+	return added, last, nil
+}
+
+// insert adds a validated header to the tree and makes it the tip if it has
+// more work.
+func (c *Chain) insert(h block.Header, hash utils.Hash, parent *Node) *Node {
+	node := &Node{
+		Header:    h,
+		Hash:      hash,
+		Height:    parent.Height + 1,
+		ChainWork: new(big.Int).Add(parent.ChainWork, CalcWork(h.Bits)),
+		Parent:    parent,
+	}
+	c.nodes[hash] = node
+	if node.ChainWork.Cmp(c.tip.ChainWork) > 0 {
+		c.tip = node
+	}
+	if c.isCheckpoint(node) && (c.checkpoint == nil || node.Height > c.checkpoint.Height) {
+		c.checkpoint = node
+	}
+	return node
+}
+
+// activate makes the active chain end at tip.
+func (c *Chain) activate(tip *Node) {
+	if int(tip.Height) < len(c.active) {
+		c.active = c.active[:tip.Height+1]
+	} else {
+		c.active = append(c.active, make([]*Node, int(tip.Height)+1-len(c.active))...)
+	}
+	for node := tip; node != nil && c.active[node.Height] != node; node = node.Parent {
+		c.active[node.Height] = node
+	}
+}
+
+func (c *Chain) isCheckpoint(node *Node) bool {
+	for _, cp := range c.params.Checkpoints {
+		if cp.Height == node.Height {
+			return cp.Hash == node.Hash
+		}
+	}
+	return false
+}
+
+// checkHeader applies the context-free and contextual header checks of
+// Bitcoin Core's CheckBlockHeader and ContextualCheckBlockHeader, and the
+// checkpoints.
+func (c *Chain) checkHeader(h *block.Header, hash utils.Hash, parent *Node, now time.Time) error {
+	height := parent.Height + 1
+	for _, cp := range c.params.Checkpoints {
+		if cp.Height == height && cp.Hash != hash {
+			return fmt.Errorf("%w: want %s", ErrCheckpointMismatch, cp.Hash)
+		}
+	}
+	if c.checkpoint != nil && height < c.checkpoint.Height {
+		return fmt.Errorf("%w at height %d", ErrForkBeforeCheckpoint, c.checkpoint.Height)
+	}
+
+	if err := checkProofOfWork(h, c.params); err != nil {
+		return err
+	}
+	if bits := nextWorkRequired(c.params, parent, h.Timestamp); h.Bits != bits {
+		return fmt.Errorf("%w: got %#08x, want %#08x", ErrBadDiffBits, h.Bits, bits)
+	}
+	if h.Timestamp <= parent.MedianTimePast() {
+		return ErrTimeTooOld
+	}
+	if c.params.EnforceBIP94 && height%RetargetInterval == 0 &&
+		int64(h.Timestamp) < int64(parent.Header.Timestamp)-maxTimewarp {
+		return ErrTimewarp
+	}
+	if h.Time().After(now.Add(MaxFutureBlockTime)) {
+		return ErrTimeTooNew
+	}
+	return nil
+}
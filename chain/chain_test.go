@@ -0,0 +1,218 @@
+package chain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mine returns a regtest header on top of parent with a valid proof of
+// work. tag changes the merkle root so that siblings differ.
+func mine(parent *block.Header, timestamp uint32, tag string) block.Header {
+	h := block.Header{
+		Version:    4,
+		PrevBlock:  parent.Hash(),
+		MerkleRoot: utils.DoubleSHA256([]byte(tag)),
+		Timestamp:  timestamp,
+		Bits:       parent.Bits,
+	}
+	for !h.CheckProofOfWork() {
+		h.Nonce++
+	}
+	return h
+}
+
+// mineHeaders returns n headers on top of parent, ten minutes apart.
+func mineHeaders(parent block.Header, n int, tag string) []block.Header {
+	headers := make([]block.Header, n)
+	for i := range headers {
+		headers[i] = mine(&parent, parent.Timestamp+TargetSpacing, tag)
+		parent = headers[i]
+	}
+	return headers
+}
+
+func newRegTestChain(t *testing.T) *Chain {
+	t.Helper()
+	c, err := New(&config.RegTestParams)
+	require.NoError(t, err)
+	return c
+}
+
+func TestChainExtends(t *testing.T) {
+	c := newRegTestChain(t)
+	genesis := c.Genesis()
+	assert.Equal(t, config.RegTestParams.GenesisHash, genesis.Hash)
+	assert.Equal(t, genesis, c.Tip())
+
+	headers := mineHeaders(genesis.Header, 30, "main")
+	last, err := c.AddHeaders(headers)
+	require.NoError(t, err)
+	assert.Equal(t, int32(30), last.Height)
+	assert.Equal(t, last, c.Tip())
+	assert.Equal(t, 31, c.Len())
+	assert.Equal(t, "3e", last.ChainWork.Text(16), "31 headers of work 2")
+	assert.Equal(t, headers[9].Hash(), last.Ancestor(10).Hash)
+	assert.Nil(t, last.Ancestor(31))
+
+	// Adding known headers again changes nothing.
+	again, err := c.AddHeaders(headers[:5])
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), again.Height)
+	assert.Equal(t, last, c.Tip())
+}
+
+func TestLocator(t *testing.T) {
+	c := newRegTestChain(t)
+	tip, err := c.AddHeaders(mineHeaders(c.Genesis().Header, 100, "main"))
+	require.NoError(t, err)
+
+	var heights []int32
+	for _, hash := range c.Locator() {
+		heights = append(heights, c.Lookup(hash).Height)
+	}
+	assert.Equal(t, []int32{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 90, 89, 87, 83, 75, 59, 27, 0}, heights)
+	assert.Equal(t, []utils.Hash{c.Genesis().Hash}, c.Genesis().Locator())
+	assert.Equal(t, tip.Hash, c.Locator()[0])
+}
+
+func TestMostWorkTip(t *testing.T) {
+	c := newRegTestChain(t)
+	main := mineHeaders(c.Genesis().Header, 10, "main")
+	_, err := c.AddHeaders(main)
+	require.NoError(t, err)
+
+	// A fork of equal length does not take over: the first seen wins.
+	fork := mineHeaders(main[4], 5, "fork")
+	forkTip, err := c.AddHeaders(fork)
+	require.NoError(t, err)
+	assert.Equal(t, int32(10), forkTip.Height)
+	assert.Equal(t, main[9].Hash(), c.Tip().Hash)
+
+	// One more header gives the fork more work.
+	longer, err := c.AddHeader(mine(&fork[4], fork[4].Timestamp+TargetSpacing, "fork"))
+	require.NoError(t, err)
+	assert.Equal(t, longer, c.Tip())
+	assert.Equal(t, main[4].Hash(), longer.Ancestor(5).Hash)
+	assert.Equal(t, 17, c.Len())
+}
+
+func TestHeaderValidation(t *testing.T) {
+	c := newRegTestChain(t)
+	headers := mineHeaders(c.Genesis().Header, 11, "main")
+	_, err := c.AddHeaders(headers)
+	require.NoError(t, err)
+	tip := headers[10]
+
+	t.Run("unknown parent", func(t *testing.T) {
+		orphan := mine(&block.Header{Bits: tip.Bits, Nonce: 1}, tip.Timestamp+TargetSpacing, "orphan")
+		_, err := c.AddHeader(orphan)
+		assert.ErrorIs(t, err, ErrUnknownParent)
+	})
+
+	t.Run("bad proof of work", func(t *testing.T) {
+		h := mine(&tip, tip.Timestamp+TargetSpacing, "bad pow")
+		for h.CheckProofOfWork() {
+			h.Nonce++
+		}
+		_, err := c.AddHeader(h)
+		assert.ErrorIs(t, err, ErrBadProofOfWork)
+	})
+
+	t.Run("target above the limit", func(t *testing.T) {
+		h := mine(&block.Header{Bits: 0x2100ffff}, tip.Timestamp+TargetSpacing, "easy")
+		h.PrevBlock = tip.Hash()
+		_, err := c.AddHeader(h)
+		assert.ErrorIs(t, err, ErrBadTarget)
+	})
+
+	t.Run("wrong bits", func(t *testing.T) {
+		harder := tip
+		harder.Bits = 0x2000ffff
+		h := mine(&harder, tip.Timestamp+TargetSpacing, "bits")
+		h.PrevBlock = tip.Hash()
+		for !h.CheckProofOfWork() {
+			h.Nonce++
+		}
+		_, err := c.AddHeader(h)
+		assert.ErrorIs(t, err, ErrBadDiffBits)
+	})
+
+	t.Run("not after median time past", func(t *testing.T) {
+		// The median of the last eleven timestamps is that of headers[5].
+		_, err := c.AddHeader(mine(&tip, headers[5].Timestamp, "old"))
+		assert.ErrorIs(t, err, ErrTimeTooOld)
+
+		_, err = c.AddHeader(mine(&tip, headers[5].Timestamp+1, "just after mtp"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("too far in the future", func(t *testing.T) {
+		future := uint32(time.Now().Add(MaxFutureBlockTime + time.Minute).Unix())
+		_, err := c.AddHeader(mine(&tip, future, "future"))
+		assert.ErrorIs(t, err, ErrTimeTooNew)
+	})
+
+	t.Run("non-continuous batch", func(t *testing.T) {
+		a := mine(&tip, tip.Timestamp+TargetSpacing, "a")
+		b := mine(&tip, tip.Timestamp+TargetSpacing, "b")
+		_, err := c.AddHeaders([]block.Header{a, b})
+		assert.ErrorIs(t, err, ErrNonContinuous)
+		assert.NotNil(t, c.Lookup(a.Hash()), "headers before the break are kept")
+		assert.Nil(t, c.Lookup(b.Hash()))
+	})
+}
+
+func TestTimewarp(t *testing.T) {
+	// BIP94 limits how far the first block of a period may go back in time.
+	params := config.RegTestParams
+	params.EnforceBIP94 = true
+	c, err := New(&params)
+	require.NoError(t, err)
+
+	headers := mineHeaders(c.Genesis().Header, RetargetInterval-1, "main")
+	tip, err := c.AddHeaders(headers)
+	require.NoError(t, err)
+	last := headers[len(headers)-1]
+
+	_, err = c.AddHeader(mine(&last, last.Timestamp-maxTimewarp-1, "warp"))
+	assert.ErrorIs(t, err, ErrTimewarp)
+
+	next, err := c.AddHeader(mine(&last, last.Timestamp-maxTimewarp, "allowed"))
+	require.NoError(t, err)
+	assert.Equal(t, tip.Height+1, next.Height)
+}
+
+func TestCheckpoints(t *testing.T) {
+	genesis := newRegTestChain(t).Genesis()
+	main := mineHeaders(genesis.Header, 10, "main")
+
+	params := config.RegTestParams
+	params.Checkpoints = []config.Checkpoint{{Height: 5, Hash: main[4].Hash()}}
+	c, err := New(&params)
+	require.NoError(t, err)
+
+	// A different header at the checkpoint height is rejected.
+	_, err = c.AddHeaders(main[:3])
+	require.NoError(t, err)
+	_, err = c.AddHeaders(mineHeaders(main[2], 3, "fork"))
+	assert.ErrorIs(t, err, ErrCheckpointMismatch)
+	assert.Equal(t, int32(4), c.Height(), "the fork is kept up to the checkpoint")
+
+	_, err = c.AddHeaders(main[3:])
+	require.NoError(t, err)
+
+	// Once the checkpoint is reached no fork below it is accepted, even
+	// one that does not touch the checkpoint height.
+	_, err = c.AddHeader(mine(&main[2], main[2].Timestamp+1, "fork"))
+	assert.ErrorIs(t, err, ErrForkBeforeCheckpoint)
+
+	// Forks above it are fine.
+	_, err = c.AddHeader(mine(&main[6], main[6].Timestamp+1, "fork"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,82 @@
+package chain
+
+import "fmt"
+
+// EventType is the kind of change to the active chain an Event describes.
+type EventType int
+
+// Event types.
+const (
+	// BlockConnected is emitted for every header that joins the active
+	// chain, in increasing height order.
+	BlockConnected EventType = iota
+	// BlockDisconnected is emitted for every header that leaves the active
+	// chain in a reorg, from the old tip down to the fork point.
+	BlockDisconnected
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case BlockConnected:
+		return "BlockConnected"
+	case BlockDisconnected:
+		return "BlockDisconnected"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change to the active chain.
+type Event struct {
+	Type EventType
+	Node *Node
+	// ForkDepth is the number of headers the tip change disconnected:
+	// zero when the tip was extended, the reorg depth otherwise. All events
+	// of one tip change carry the same depth.
+	ForkDepth int
+}
+
+// EventHandler receives chain events.
+type EventHandler func(Event)
+
+// Subscribe registers h for the events of every later tip change. Handlers
+// are called in registration order, synchronously and outside the chain's
+// lock, so they may read the chain but must not add headers to it.
+func (c *Chain) Subscribe(h EventHandler) {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+	c.handlers = append(c.handlers, h)
+}
+
+// tipEvents returns the events of moving the tip from oldTip to newTip.
+func tipEvents(oldTip, newTip *Node) []Event {
+	fork := findFork(oldTip, newTip)
+	depth := int(oldTip.Height - fork.Height)
+
+	events := make([]Event, 0, depth+int(newTip.Height-fork.Height))
+	for node := oldTip; node != fork; node = node.Parent {
+		events = append(events, Event{Type: BlockDisconnected, Node: node, ForkDepth: depth})
+	}
+	connected := len(events)
+	for node := newTip; node != fork; node = node.Parent {
+		events = append(events, Event{Type: BlockConnected, Node: node, ForkDepth: depth})
+	}
+	// The connected headers were collected from the tip down.
+	for i, j := connected, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// findFork returns the last common ancestor of a and b.
+func findFork(a, b *Node) *Node {
+	if a.Height > b.Height {
+		a = a.Ancestor(b.Height)
+	} else {
+		b = b.Ancestor(a.Height)
+	}
+	for a != b {
+		a, b = a.Parent, b.Parent
+	}
+	return a
+}
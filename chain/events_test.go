@@ -0,0 +1,82 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedEvent struct {
+	Type      EventType
+	Hash      utils.Hash
+	Height    int32
+	ForkDepth int
+}
+
+func recordEvents(c *Chain) *[]recordedEvent {
+	var events []recordedEvent
+	c.Subscribe(func(e Event) {
+		events = append(events, recordedEvent{e.Type, e.Node.Hash, e.Node.Height, e.ForkDepth})
+	})
+	return &events
+}
+
+func TestEvents(t *testing.T) {
+	c := newRegTestChain(t)
+	events := recordEvents(c)
+
+	main := mineHeaders(c.Genesis().Header, 5, "main")
+	_, err := c.AddHeaders(main)
+	require.NoError(t, err)
+	require.Len(t, *events, 5)
+	for i, e := range *events {
+		assert.Equal(t, recordedEvent{BlockConnected, main[i].Hash(), int32(i + 1), 0}, e)
+	}
+
+	// A fork from height 3 that stays behind emits nothing.
+	*events = nil
+	fork := mineHeaders(main[2], 2, "fork")
+	_, err = c.AddHeaders(fork)
+	require.NoError(t, err)
+	assert.Empty(t, *events)
+
+	// Its third header overtakes the main branch: heights 5 and 4 are
+	// disconnected, then 4, 5 and 6 of the fork connected.
+	fork = append(fork, mine(&fork[1], fork[1].Timestamp+TargetSpacing, "fork"))
+	_, err = c.AddHeader(fork[2])
+	require.NoError(t, err)
+	assert.Equal(t, []recordedEvent{
+		{BlockDisconnected, main[4].Hash(), 5, 2},
+		{BlockDisconnected, main[3].Hash(), 4, 2},
+		{BlockConnected, fork[0].Hash(), 4, 2},
+		{BlockConnected, fork[1].Hash(), 5, 2},
+		{BlockConnected, fork[2].Hash(), 6, 2},
+	}, *events)
+
+	assert.Equal(t, fork[0].Hash(), c.NodeAtHeight(4).Hash)
+	assert.Equal(t, main[2].Hash(), c.NodeAtHeight(3).Hash)
+	assert.Nil(t, c.NodeAtHeight(7))
+	assert.True(t, c.Contains(c.Lookup(fork[2].Hash())))
+	assert.False(t, c.Contains(c.Lookup(main[4].Hash())))
+	assert.Equal(t, "BlockDisconnected", BlockDisconnected.String())
+}
+
+func TestFindFork(t *testing.T) {
+	c := newRegTestChain(t)
+	main := mineHeaders(c.Genesis().Header, 20, "main")
+	_, err := c.AddHeaders(main)
+	require.NoError(t, err)
+
+	// A peer on a stale branch from height 15 sends its locator.
+	peer := newRegTestChain(t)
+	_, err = peer.AddHeaders(main[:15])
+	require.NoError(t, err)
+	_, err = peer.AddHeaders(mineHeaders(main[14], 3, "stale"))
+	require.NoError(t, err)
+
+	assert.Equal(t, main[14].Hash(), c.FindFork(peer.Locator()).Hash)
+	assert.Equal(t, c.Genesis(), c.FindFork(nil))
+	assert.Equal(t, c.Tip(), c.FindFork(c.Locator()))
+}
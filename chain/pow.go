@@ -0,0 +1,100 @@
+package chain
+
+import (
+	"math/big"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+)
+
+const (
+	// TargetTimespan is the time a retarget period should take.
+	TargetTimespan = 14 * 24 * 60 * 60
+	// TargetSpacing is the intended time between blocks.
+	TargetSpacing = 10 * 60
+	// RetargetInterval is the number of blocks between difficulty
+	// adjustments.
+	RetargetInterval = TargetTimespan / TargetSpacing
+
+	// maxTimewarp is how far before its parent the first block of a
+	// retarget period may be timestamped under BIP94.
+	maxTimewarp = 600
+)
+
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// CalcWork returns the expected number of hashes needed to find a block
+// with the given target: 2^256 / (target+1).
+func CalcWork(bits uint32) *big.Int {
+	target := block.CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(oneLsh256, target.Add(target, big.NewInt(1)))
+}
+
+// checkProofOfWork verifies that the header's target is within the
+// network's limit and that its hash meets the target.
+func checkProofOfWork(h *block.Header, params *config.ChainParams) error {
+	target := h.Target()
+	if target.Sign() <= 0 || target.Cmp(params.PowLimit) > 0 {
+		return ErrBadTarget
+	}
+	if !h.CheckProofOfWork() {
+		return ErrBadProofOfWork
+	}
+	return nil
+}
+
+// nextWorkRequired returns the bits a block with the given timestamp must
+// have on top of prev, following GetNextWorkRequired in Bitcoin Core.
+func nextWorkRequired(params *config.ChainParams, prev *Node, timestamp uint32) uint32 {
+	powLimitBits := block.BigToCompact(params.PowLimit)
+
+	if (prev.Height+1)%RetargetInterval != 0 {
+		if params.PowAllowMinDifficultyBlocks {
+			// A block more than twice the target spacing after its parent
+			// may use the minimum difficulty.
+			if int64(timestamp) > int64(prev.Header.Timestamp)+2*TargetSpacing {
+				return powLimitBits
+			}
+			// Otherwise it returns to the difficulty of the last block
+			// that was not mined at the minimum difficulty.
+			node := prev
+			for node.Parent != nil && node.Height%RetargetInterval != 0 && node.Header.Bits == powLimitBits {
+				node = node.Parent
+			}
+			return node.Header.Bits
+		}
+		return prev.Header.Bits
+	}
+
+	first := prev.Ancestor(prev.Height - (RetargetInterval - 1))
+	return calcNextWorkRequired(params, prev, first)
+}
+
+// calcNextWorkRequired scales the target by how long the period from first
+// to last took, limited to a factor of four either way.
+func calcNextWorkRequired(params *config.ChainParams, last, first *Node) uint32 {
+	if params.PowNoRetargeting {
+		return last.Header.Bits
+	}
+
+	timespan := int64(last.Header.Timestamp) - int64(first.Header.Timestamp)
+	timespan = max(timespan, TargetTimespan/4)
+	timespan = min(timespan, TargetTimespan*4)
+
+	// BIP94 retargets from the first block of the period, which cannot
+	// have been mined at the minimum difficulty.
+	bits := last.Header.Bits
+	if params.EnforceBIP94 {
+		bits = first.Header.Bits
+	}
+	target := block.CompactToBig(bits)
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(TargetTimespan))
+	if target.Cmp(params.PowLimit) > 0 {
+		target.Set(params.PowLimit)
+	}
+	return block.BigToCompact(target)
+}
@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// nodeChain links bare nodes, without proof of work, from the given
+// height with one header per (timestamp, bits) pair.
+func nodeChain(height int32, headers ...[2]uint32) *Node {
+	var node *Node
+	for _, h := range headers {
+		node = &Node{
+			Header: block.Header{Timestamp: h[0], Bits: h[1]},
+			Height: height,
+			Parent: node,
+		}
+		height++
+	}
+	return node
+}
+
+func TestCalcNextWorkRequired(t *testing.T) {
+	// The test vectors of Bitcoin Core's pow_tests.cpp, from mainnet.
+	tests := []struct {
+		name                string
+		height              int32
+		firstTime, lastTime uint32
+		bits, want          uint32
+	}{
+		{"first retarget", 32255, 1261130161, 1262152739, 0x1d00ffff, 0x1d00d86a},
+		{"limited by the pow limit", 2015, 1231006505, 1233061996, 0x1d00ffff, 0x1d00ffff},
+		{"lower timespan limit", 68543, 1279008237, 1279297671, 0x1c05a3f4, 0x1c0168fd},
+		{"upper timespan limit", 46367, 1263163443, 1269211443, 0x1c387f6f, 0x1d00e1fd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &Node{Header: block.Header{Timestamp: tt.firstTime, Bits: tt.bits}, Height: tt.height - (RetargetInterval - 1)}
+			last := &Node{Header: block.Header{Timestamp: tt.lastTime, Bits: tt.bits}, Height: tt.height}
+			assert.Equal(t, tt.want, calcNextWorkRequired(&config.MainNetParams, last, first))
+		})
+	}
+
+	// Regtest never retargets.
+	first := &Node{Header: block.Header{Timestamp: 0, Bits: 0x207fffff}}
+	last := &Node{Header: block.Header{Timestamp: 1, Bits: 0x207fffff}, Height: RetargetInterval - 1}
+	assert.Equal(t, uint32(0x207fffff), calcNextWorkRequired(&config.RegTestParams, last, first))
+}
+
+func TestNextWorkRequiredRetarget(t *testing.T) {
+	// A period mined at twice the intended rate about doubles the
+	// difficulty. The timespan covers only 2015 intervals, an off-by-one
+	// kept for consensus.
+	headers := make([][2]uint32, RetargetInterval)
+	for i := range headers {
+		headers[i] = [2]uint32{uint32(1_000_000 + i*TargetSpacing/2), 0x1c0ffff0}
+	}
+	last := nodeChain(0, headers...)
+	assert.Equal(t, uint32(0x1c07fef3), nextWorkRequired(&config.MainNetParams, last, last.Header.Timestamp+TargetSpacing))
+
+	// Anywhere else in the period the difficulty stays the same.
+	prev := last.Parent
+	assert.Equal(t, uint32(0x1c0ffff0), nextWorkRequired(&config.MainNetParams, prev, prev.Header.Timestamp+TargetSpacing))
+}
+
+func TestMinDifficultyBlocks(t *testing.T) {
+	const bits = 0x1c0ffff0
+	powLimit := block.BigToCompact(config.TestNet3Params.PowLimit)
+
+	// Height 2016 starts a period at a real difficulty, followed by a
+	// minimum difficulty block at 2018.
+	prev := nodeChain(RetargetInterval,
+		[2]uint32{1_000_000, bits},
+		[2]uint32{1_000_600, bits},
+		[2]uint32{1_002_000, powLimit},
+	)
+
+	// More than twenty minutes after its parent a block may use the
+	// minimum difficulty.
+	late := prev.Header.Timestamp + 2*TargetSpacing + 1
+	assert.Equal(t, powLimit, nextWorkRequired(&config.TestNet3Params, prev, late))
+
+	// Otherwise it returns to the last real difficulty, skipping the
+	// minimum difficulty blocks. Mainnet has no such rule and keeps the
+	// parent's target.
+	onTime := prev.Header.Timestamp + 2*TargetSpacing
+	assert.Equal(t, uint32(bits), nextWorkRequired(&config.TestNet3Params, prev, onTime))
+	assert.Equal(t, powLimit, nextWorkRequired(&config.MainNetParams, prev, onTime))
+
+	// The walk back stops at the start of the period.
+	allMin := nodeChain(RetargetInterval, [2]uint32{1_000_000, powLimit}, [2]uint32{1_000_600, powLimit})
+	assert.Equal(t, powLimit, nextWorkRequired(&config.TestNet3Params, allMin, allMin.Header.Timestamp+60))
+}
+
+func TestBIP94Retarget(t *testing.T) {
+	// The last block of the period was mined at the minimum difficulty.
+	// Testnet3 retargets from it, testnet4 from the first block of the
+	// period.
+	const bits = 0x1c0ffff0
+	powLimit := block.BigToCompact(config.TestNet4Params.PowLimit)
+	headers := make([][2]uint32, RetargetInterval)
+	for i := range headers {
+		headers[i] = [2]uint32{uint32(1_000_000 + i*TargetSpacing), bits}
+	}
+	headers[RetargetInterval-1][1] = powLimit
+	last := nodeChain(0, headers...)
+	next := last.Header.Timestamp + TargetSpacing
+
+	// Testnet3 stays near the minimum difficulty. The period took one
+	// spacing less than the target timespan.
+	assert.Equal(t, uint32(0x1d00ffde), nextWorkRequired(&config.TestNet3Params, last, next))
+	assert.Equal(t, uint32(0x1c0ffde7), nextWorkRequired(&config.TestNet4Params, last, next))
+}
+
+func TestCalcWork(t *testing.T) {
+	assert.Equal(t, "100010001", CalcWork(0x1d00ffff).Text(16))
+	assert.Equal(t, "2", CalcWork(0x207fffff).Text(16))
+	assert.Equal(t, "0", CalcWork(0).Text(16))
+}
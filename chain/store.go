@@ -0,0 +1,97 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// headersBucket maps height||hash to the serialized header, so that a
+	// cursor walks the headers parents first.
+	headersBucket = []byte("headers")
+	metaBucket    = []byte("meta")
+
+	genesisKey = []byte("genesis")
+	tipKey     = []byte("tip")
+)
+
+// store keeps every header of the tree, forks included, in an embedded
+// database. The tree is rebuilt from it in memory on startup.
+type store struct {
+	bolt *bolt.DB
+}
+
+func openStore(path string, genesis utils.Hash) (*store, error) {
+	b, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{headersBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		stored := meta.Get(genesisKey)
+		if stored == nil {
+			return meta.Put(genesisKey, genesis[:])
+		}
+		if !bytes.Equal(stored, genesis[:]) {
+			return fmt.Errorf("header store belongs to the chain with genesis %s", utils.Hash(stored))
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return &store{bolt: b}, nil
+}
+
+func (s *store) close() error {
+	return s.bolt.Close()
+}
+
+func headerKey(height int32, hash utils.Hash) []byte {
+	key := make([]byte, 4+utils.HashSize)
+	binary.BigEndian.PutUint32(key, uint32(height))
+	copy(key[4:], hash[:])
+	return key
+}
+
+// put saves nodes and records tip.
+func (s *store) put(nodes []*Node, tip *Node) error {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		headers := tx.Bucket(headersBucket)
+		for _, node := range nodes {
+			if err := headers.Put(headerKey(node.Height, node.Hash), node.Header.Bytes()); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(tipKey, tip.Hash[:])
+	})
+}
+
+// load calls fn for every stored header, parents before children, and
+// returns the recorded tip.
+func (s *store) load(fn func(height int32, h *block.Header) error) (utils.Hash, error) {
+	var tip utils.Hash
+	err := s.bolt.View(func(tx *bolt.Tx) error {
+		copy(tip[:], tx.Bucket(metaBucket).Get(tipKey))
+		return tx.Bucket(headersBucket).ForEach(func(k, v []byte) error {
+			h, err := block.ReadHeader(bytes.NewReader(v))
+			if err != nil {
+				return err
+			}
+			return fn(int32(binary.BigEndian.Uint32(k)), h)
+		})
+	})
+	return tip, err
+}
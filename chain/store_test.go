@@ -0,0 +1,52 @@
+package chain
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenPersistsHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers.db")
+	c, err := Open(&config.RegTestParams, path)
+	require.NoError(t, err)
+
+	main := mineHeaders(c.Genesis().Header, 10, "main")
+	_, err = c.AddHeaders(main)
+	require.NoError(t, err)
+	// A fork of equal work: the tip stays on the first branch seen.
+	fork := mineHeaders(main[4], 5, "fork")
+	_, err = c.AddHeaders(fork)
+	require.NoError(t, err)
+	tip := c.Tip()
+	require.NoError(t, c.Close())
+
+	c, err = Open(&config.RegTestParams, path)
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.Equal(t, 16, c.Len())
+	assert.Equal(t, tip.Hash, c.Tip().Hash)
+	assert.Equal(t, 0, tip.ChainWork.Cmp(c.Tip().ChainWork))
+	assert.Equal(t, main[5].Hash(), c.NodeAtHeight(6).Hash)
+	assert.Equal(t, int32(10), c.Lookup(fork[4].Hash()).Height)
+
+	// Syncing continues from the stored tip.
+	next := mine(&main[9], main[9].Timestamp+TargetSpacing, "main")
+	node, err := c.AddHeader(next)
+	require.NoError(t, err)
+	assert.Equal(t, int32(11), node.Height)
+}
+
+func TestOpenRejectsOtherChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers.db")
+	c, err := Open(&config.RegTestParams, path)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	_, err = Open(&config.SigNetParams, path)
+	assert.ErrorContains(t, err, "belongs to the chain with genesis "+config.RegTestParams.GenesisHash.String())
+}
@@ -0,0 +1,225 @@
+package chain
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// Syncer downloads headers from connected peers into a Chain and then
+// follows the blocks they announce.
+//
+// As in Bitcoin Core, the initial sync uses one peer at a time so that the
+// headers are not downloaded from every peer. Once that peer has no more
+// headers for us, every peer is asked for the headers we lack and new
+// blocks are picked up from their announcements, which we ask to receive
+// as headers messages (BIP130). A sync peer that leaves a getheaders
+// unanswered for HeadersTimeout is disconnected, and the sync continues
+// with another peer.
+type Syncer struct {
+	chain   *Chain
+	timeout time.Duration
+
+	mu       sync.Mutex
+	peers    map[*network.Peer]bool
+	syncPeer *network.Peer
+	synced   bool
+	// deadline fires when the sync peer takes too long to answer our
+	// last getheaders, numbered request.
+	deadline *time.Timer
+	request  int
+}
+
+// HeadersTimeout is how long the sync peer has to answer a getheaders
+// during the initial sync, as HEADERS_RESPONSE_TIME in Bitcoin Core.
+const HeadersTimeout = 2 * time.Minute
+
+// NewSyncer returns a syncer that adds headers to c.
+func NewSyncer(c *Chain) *Syncer {
+	return &Syncer{chain: c, timeout: HeadersTimeout, peers: make(map[*network.Peer]bool)}
+}
+
+// Synced reports whether the initial header sync has completed.
+func (s *Syncer) Synced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.synced
+}
+
+// SetupPeer registers the syncer's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (s *Syncer) SetupPeer(p *network.Peer) {
+	p.OnHeaders(s.handleHeaders)
+	p.OnInv(s.handleInv)
+	p.OnCmpctBlock(s.handleCmpctBlock)
+}
+
+// AddPeer starts syncing with p once its handshake has completed. It fits
+// connmgr.Config.PeerConnected.
+func (s *Syncer) AddPeer(p *network.Peer) {
+	if err := p.Send(network.Message{Command: "sendheaders", Payload: []byte{}}); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.peers[p] = true
+	request := s.synced || s.syncPeer == nil
+	if !s.synced && s.syncPeer == nil {
+		s.syncPeer = p
+	}
+	s.mu.Unlock()
+
+	if request {
+		s.requestHeaders(p, s.chain.Tip())
+	}
+	go func() {
+		<-p.Done()
+		s.removePeer(p)
+	}()
+}
+
+func (s *Syncer) removePeer(p *network.Peer) {
+	s.mu.Lock()
+	delete(s.peers, p)
+	var next *network.Peer
+	if s.syncPeer == p {
+		s.syncPeer = nil
+		s.stopDeadline()
+		for peer := range s.peers {
+			next = peer
+			break
+		}
+		s.syncPeer = next
+	}
+	s.mu.Unlock()
+
+	if next != nil {
+		log.Infof("Continuing header sync with %s", next.Addr())
+		s.requestHeaders(next, s.chain.Tip())
+	}
+}
+
+// requestHeaders asks p for the headers following from. During the initial
+// sync, the sync peer must answer before the deadline.
+func (s *Syncer) requestHeaders(p *network.Peer, from *Node) error {
+	s.mu.Lock()
+	if !s.synced && s.syncPeer == p {
+		s.stopDeadline()
+		s.request++
+		request := s.request
+		s.deadline = time.AfterFunc(s.timeout, func() { s.expire(p, request) })
+	}
+	s.mu.Unlock()
+	return p.GetHeaders(block.Locator{ProtocolVersion: config.ProtocolVersion, Hashes: from.Locator()})
+}
+
+// expire disconnects p if it is still the sync peer and has not answered
+// the given request, the last one. Its disconnection hands the sync to
+// another peer.
+func (s *Syncer) expire(p *network.Peer, request int) {
+	s.mu.Lock()
+	stalled := s.deadline != nil && s.request == request && s.syncPeer == p && !s.synced
+	if stalled {
+		s.deadline = nil
+	}
+	s.mu.Unlock()
+	if stalled {
+		log.Infof("Sync peer %s did not answer getheaders within %s, disconnecting", p.Addr(), s.timeout)
+		p.Disconnect()
+	}
+}
+
+// stopDeadline cancels the deadline of the sync peer. s.mu must be held.
+func (s *Syncer) stopDeadline() {
+	if s.deadline != nil {
+		s.deadline.Stop()
+		s.deadline = nil
+	}
+}
+
+func (s *Syncer) handleHeaders(p *network.Peer, headers []block.Header) error {
+	if len(headers) == 0 {
+		s.caughtUp(p)
+		return nil
+	}
+	// A header that does not connect is usually the announcement of a block
+	// on a branch we have not synced yet: ask for the headers leading to it.
+	if s.chain.Lookup(headers[0].PrevBlock) == nil {
+		log.Debugf("Headers from %s do not connect to our tree", p.Addr())
+		return s.requestHeaders(p, s.chain.Tip())
+	}
+
+	tip := s.chain.Tip()
+	last, err := s.chain.AddHeaders(headers)
+	if err != nil {
+		return err
+	}
+	if newTip := s.chain.Tip(); newTip != tip {
+		log.Infof("Header tip %s at height %d (%s) from %s", newTip.Hash, newTip.Height, newTip.Header.Time().UTC().Format("2006-01-02 15:04:05"), p.Addr())
+	}
+
+	if len(headers) == block.MaxHeadersResults {
+		return s.requestHeaders(p, last)
+	}
+	s.caughtUp(p)
+	return nil
+}
+
+// caughtUp ends the initial sync when the sync peer has no more headers
+// for us, and asks every other peer for the headers we may still lack.
+func (s *Syncer) caughtUp(p *network.Peer) {
+	s.mu.Lock()
+	if s.synced || s.syncPeer != p {
+		s.mu.Unlock()
+		return
+	}
+	s.synced = true
+	s.stopDeadline()
+	var others []*network.Peer
+	for peer := range s.peers {
+		if peer != p {
+			others = append(others, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	tip := s.chain.Tip()
+	log.Infof("Header sync completed at height %d (%s)", tip.Height, tip.Hash)
+	for _, peer := range others {
+		s.requestHeaders(peer, tip)
+	}
+}
+
+// handleInv asks for the headers of blocks announced by inv, which peers
+// that ignore sendheaders still use.
+func (s *Syncer) handleInv(p *network.Peer, vects []inv.InvVect) error {
+	if !s.Synced() {
+		return nil
+	}
+	for _, v := range vects {
+		if v.Type.IsBlock() && s.chain.Lookup(v.Hash) == nil {
+			err := s.requestHeaders(p, s.chain.Tip())
+			if errors.Is(err, network.ErrDisconnected) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// handleCmpctBlock adds the header of a compact block: peers we asked for
+// high-bandwidth compact block relay announce new blocks with them instead
+// of headers messages (BIP152).
+func (s *Syncer) handleCmpctBlock(p *network.Peer, cb *block.CompactBlock) error {
+	if !s.Synced() {
+		return nil
+	}
+	return s.handleHeaders(p, []block.Header{cb.Header})
+}
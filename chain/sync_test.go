@@ -0,0 +1,159 @@
+package chain
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// headerServer answers getheaders from a linear chain of headers, like a
+// full node would.
+type headerServer struct {
+	mu      sync.Mutex
+	headers []block.Header
+	index   map[utils.Hash]int
+	// stalled leaves getheaders unanswered.
+	stalled bool
+}
+
+func newHeaderServer(genesis block.Header, headers []block.Header) *headerServer {
+	s := &headerServer{index: make(map[utils.Hash]int)}
+	s.add(genesis)
+	for _, h := range headers {
+		s.add(h)
+	}
+	return s
+}
+
+func (s *headerServer) add(h block.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index[h.Hash()] = len(s.headers)
+	s.headers = append(s.headers, h)
+}
+
+func (s *headerServer) handleGetHeaders(p *network.Peer, l block.Locator) error {
+	s.mu.Lock()
+	if s.stalled {
+		s.mu.Unlock()
+		return nil
+	}
+	start := 0
+	for _, hash := range l.Hashes {
+		if i, ok := s.index[hash]; ok {
+			start = i + 1
+			break
+		}
+	}
+	end := min(start+block.MaxHeadersResults, len(s.headers))
+	headers := append([]block.Header(nil), s.headers[start:end]...)
+	s.mu.Unlock()
+	return p.SendHeaders(headers)
+}
+
+func connectSyncer(t *testing.T, syncer *Syncer, server *headerServer) (local, remote *network.Peer) {
+	t.Helper()
+	a, b := net.Pipe()
+	local = network.NewPeer(a, "remote", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	remote = network.NewPeer(b, "local", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	syncer.SetupPeer(local)
+	remote.OnGetHeaders(server.handleGetHeaders)
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	syncer.AddPeer(local)
+	return local, remote
+}
+
+func TestSyncer(t *testing.T) {
+	c := newRegTestChain(t)
+	// More than two headers messages' worth.
+	headers := mineHeaders(c.Genesis().Header, 2*block.MaxHeadersResults+500, "main")
+	server := newHeaderServer(c.Genesis().Header, headers)
+
+	syncer := NewSyncer(c)
+	local, remote := connectSyncer(t, syncer, server)
+	defer local.Disconnect()
+
+	require.Eventually(t, syncer.Synced, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, headers[len(headers)-1].Hash(), c.Tip().Hash)
+	assert.Equal(t, int32(len(headers)), c.Tip().Height)
+
+	// A new block announced with a headers message extends the tip.
+	next := mine(&headers[len(headers)-1], headers[len(headers)-1].Timestamp+TargetSpacing, "main")
+	server.add(next)
+	require.NoError(t, remote.SendHeaders([]block.Header{next}))
+	require.Eventually(t, func() bool { return c.Tip().Hash == next.Hash() }, time.Second, 10*time.Millisecond)
+
+	// Two blocks found in quick succession and announced with only the
+	// latest header do not connect; the syncer asks for the missing one.
+	skipped := mine(&next, next.Timestamp+TargetSpacing, "main")
+	latest := mine(&skipped, skipped.Timestamp+TargetSpacing, "main")
+	server.add(skipped)
+	server.add(latest)
+	require.NoError(t, remote.SendHeaders([]block.Header{latest}))
+	require.Eventually(t, func() bool { return c.Tip().Hash == latest.Hash() }, time.Second, 10*time.Millisecond)
+
+	// So does a block announced with a compact block.
+	compact := mine(&latest, latest.Timestamp+TargetSpacing, "main")
+	server.add(compact)
+	require.NoError(t, remote.SendCmpctBlock(&block.CompactBlock{Header: compact}))
+	require.Eventually(t, func() bool { return c.Tip().Hash == compact.Hash() }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, local.Err())
+}
+
+func TestSyncerDisconnectsOnInvalidHeaders(t *testing.T) {
+	c := newRegTestChain(t)
+	headers := mineHeaders(c.Genesis().Header, 10, "main")
+	headers[5].Nonce++
+	for headers[5].CheckProofOfWork() {
+		headers[5].Nonce++
+	}
+	server := newHeaderServer(c.Genesis().Header, headers)
+
+	syncer := NewSyncer(c)
+	local, _ := connectSyncer(t, syncer, server)
+
+	select {
+	case <-local.Done():
+		assert.ErrorIs(t, local.Err(), ErrBadProofOfWork)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer sending invalid headers was not disconnected")
+	}
+	assert.Equal(t, int32(5), c.Tip().Height)
+	assert.False(t, syncer.Synced())
+}
+
+func TestSyncerReplacesStalledSyncPeer(t *testing.T) {
+	c := newRegTestChain(t)
+	headers := mineHeaders(c.Genesis().Header, 10, "main")
+	server := newHeaderServer(c.Genesis().Header, headers)
+	stalled := newHeaderServer(c.Genesis().Header, headers)
+	stalled.stalled = true
+
+	syncer := NewSyncer(c)
+	syncer.timeout = 100 * time.Millisecond
+	first, _ := connectSyncer(t, syncer, stalled)
+	second, _ := connectSyncer(t, syncer, server)
+	defer second.Disconnect()
+
+	select {
+	case <-first.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled sync peer was not disconnected")
+	}
+	require.Eventually(t, syncer.Synced, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(10), c.Tip().Height)
+}
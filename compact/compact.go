@@ -0,0 +1,502 @@
+// Package compact relays new blocks as compact blocks (BIP152): blocks are
+// rebuilt from the transactions of the mempool and only the missing ones
+// are fetched from the announcing peer, and new blocks are pushed to the
+// peers that asked for high-bandwidth announcements.
+package compact
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/mempool"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultHighBandwidth is the default Config.HighBandwidth, as in
+	// Bitcoin Core.
+	DefaultHighBandwidth = 3
+	// DefaultTimeout is the default Config.Timeout.
+	DefaultTimeout = 10 * time.Second
+
+	// maxKnownBlocks bounds the block hashes remembered so that every
+	// block is requested and rebuilt once.
+	maxKnownBlocks = 1000
+)
+
+// Config configures a Relay.
+type Config struct {
+	// Pool provides the transactions blocks are rebuilt from.
+	Pool *mempool.Pool
+	// HighBandwidth is the number of peers asked to announce new blocks
+	// with cmpctblock messages: the last ones to give us a new block
+	// first. It defaults to DefaultHighBandwidth.
+	HighBandwidth int
+	// Blocks, when set, answers the getblocktxn requests of our peers.
+	Blocks *blockstore.Store
+	// Timeout is how long a peer has to answer our getblocktxn before the
+	// block is requested in full from another peer that announced it. It
+	// defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Deliver is called with every block rebuilt, or downloaded in full
+	// when it could not be rebuilt. It runs on the dispatch goroutine of
+	// the peer that sent the block.
+	Deliver func(p *network.Peer, b *block.Block)
+}
+
+// Stats counts the compact blocks the relay handled.
+type Stats struct {
+	// Blocks is the number of blocks rebuilt, FromPool the ones rebuilt
+	// from the mempool without a getblocktxn round trip, and Failed the
+	// ones downloaded in full after a short ID collision or an unanswered
+	// getblocktxn.
+	Blocks   int
+	FromPool int
+	Failed   int
+	// Txs counts the transactions of the rebuilt blocks that were not
+	// prefilled, PoolTxs those found in the mempool and RequestedTxs
+	// those fetched with getblocktxn.
+	Txs          int
+	PoolTxs      int
+	RequestedTxs int
+}
+
+// HitRate returns the share of the transactions that were not prefilled
+// and were found in the mempool, or 0 before the first block.
+func (s Stats) HitRate() float64 {
+	if s.Txs == 0 {
+		return 0
+	}
+	return float64(s.PoolTxs) / float64(s.Txs)
+}
+
+// Relay requests, rebuilds and serves compact blocks.
+type Relay struct {
+	cfg Config
+
+	mu sync.Mutex
+	// known maps the blocks we asked for or received to whether a compact
+	// block or the full block arrived. knownOrder bounds it and sources.
+	known      map[utils.Hash]bool
+	knownOrder []utils.Hash
+	// sources maps the blocks we received to the peer that sent them,
+	// which Announce skips.
+	sources map[utils.Hash]*network.Peer
+	// peers holds the connected peers we announce new blocks to.
+	peers []*network.Peer
+	// pending holds the blocks waiting for a blocktxn and full the ones
+	// requested in full, with the peer asked.
+	pending map[utils.Hash]*pendingBlock
+	full    map[utils.Hash]*network.Peer
+	// highBandwidth holds the high-bandwidth peers, the most recent last.
+	highBandwidth []*network.Peer
+	stats         Stats
+}
+
+type pendingBlock struct {
+	peer    *network.Peer
+	partial *block.PartialBlock
+	// others are the other peers that announced the block since, which
+	// may send it in full if peer does not answer in time.
+	others []*network.Peer
+	timer  *time.Timer
+}
+
+// New returns a relay rebuilding blocks from cfg.Pool.
+func New(cfg Config) *Relay {
+	if cfg.HighBandwidth == 0 {
+		cfg.HighBandwidth = DefaultHighBandwidth
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return &Relay{
+		cfg:     cfg,
+		known:   make(map[utils.Hash]bool),
+		sources: make(map[utils.Hash]*network.Peer),
+		pending: make(map[utils.Hash]*pendingBlock),
+		full:    make(map[utils.Hash]*network.Peer),
+	}
+}
+
+// SetupPeer registers the relay's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (r *Relay) SetupPeer(p *network.Peer) {
+	p.OnInv(r.handleInv)
+	p.OnHeaders(r.handleHeaders)
+	p.OnCmpctBlock(r.handleCmpctBlock)
+	p.OnBlockTxn(r.handleBlockTxn)
+	p.OnBlock(r.handleBlock)
+	if r.cfg.Blocks != nil {
+		p.OnGetBlockTxn(r.handleGetBlockTxn)
+	}
+}
+
+// AddPeer tells p that we understand compact blocks, in low-bandwidth
+// mode until it gives us a new block first. It fits
+// connmgr.Config.PeerConnected.
+func (r *Relay) AddPeer(p *network.Peer) {
+	if err := p.SendCmpct(false); err != nil {
+		log.Debugf("Failed to send sendcmpct to %s: %v", p.Addr(), err)
+		return
+	}
+	r.mu.Lock()
+	r.peers = append(r.peers, p)
+	r.mu.Unlock()
+	go func() {
+		<-p.Done()
+		r.removePeer(p)
+	}()
+}
+
+func (r *Relay) removePeer(p *network.Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.highBandwidth = slices.DeleteFunc(r.highBandwidth, func(hb *network.Peer) bool { return hb == p })
+	r.peers = slices.DeleteFunc(r.peers, func(other *network.Peer) bool { return other == p })
+	for hash, source := range r.sources {
+		if source == p {
+			delete(r.sources, hash)
+		}
+	}
+	// Blocks the peer still owed us may be requested from the next peer
+	// announcing them.
+	for hash, pb := range r.pending {
+		if pb.peer == p {
+			pb.timer.Stop()
+			delete(r.pending, hash)
+			delete(r.known, hash)
+		}
+	}
+	for hash, fp := range r.full {
+		if fp == p {
+			delete(r.full, hash)
+			delete(r.known, hash)
+		}
+	}
+}
+
+// Stats returns the reconstruction counters.
+func (r *Relay) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// HighBandwidthPeers returns the addresses of the high-bandwidth peers,
+// the most recent last.
+func (r *Relay) HighBandwidthPeers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := make([]string, len(r.highBandwidth))
+	for i, p := range r.highBandwidth {
+		addrs[i] = p.Addr()
+	}
+	return addrs
+}
+
+func (r *Relay) handleInv(p *network.Peer, vects []inv.InvVect) error {
+	for _, v := range vects {
+		if v.Type.IsBlock() {
+			if err := r.announced(p, v.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Relay) handleHeaders(p *network.Peer, headers []block.Header) error {
+	// Bitcoin Core only fetches compact blocks for a single new block;
+	// longer headers messages answer our getheaders.
+	if len(headers) != 1 {
+		return nil
+	}
+	return r.announced(p, headers[0].Hash())
+}
+
+// announced asks p for the compact block of an announced block we have
+// not seen yet.
+func (r *Relay) announced(p *network.Peer, hash utils.Hash) error {
+	if !p.CompactBlocks() || (r.cfg.Blocks != nil && r.cfg.Blocks.Has(hash)) {
+		return nil
+	}
+	r.mu.Lock()
+	_, known := r.known[hash]
+	if known {
+		r.announcedPending(p, hash)
+	} else {
+		r.remember(hash, false)
+	}
+	r.mu.Unlock()
+	if known {
+		return nil
+	}
+	return p.GetData(inv.InvVect{Type: inv.InvTypeCompactBlock, Hash: hash})
+}
+
+// announcedPending records that p announced the block with the given hash
+// if it is waiting for a blocktxn from another peer. r.mu must be held.
+func (r *Relay) announcedPending(p *network.Peer, hash utils.Hash) {
+	pb, ok := r.pending[hash]
+	if ok && pb.peer != p && !slices.Contains(pb.others, p) {
+		pb.others = append(pb.others, p)
+	}
+}
+
+// remember records hash in known, forgetting the oldest blocks beyond
+// maxKnownBlocks. r.mu must be held.
+func (r *Relay) remember(hash utils.Hash, received bool) {
+	if _, ok := r.known[hash]; !ok {
+		r.knownOrder = append(r.knownOrder, hash)
+		if len(r.knownOrder) > maxKnownBlocks {
+			delete(r.known, r.knownOrder[0])
+			delete(r.sources, r.knownOrder[0])
+			r.knownOrder = r.knownOrder[1:]
+		}
+	}
+	r.known[hash] = received
+}
+
+func (r *Relay) handleCmpctBlock(p *network.Peer, cb *block.CompactBlock) error {
+	hash := cb.Header.Hash()
+	r.mu.Lock()
+	received := r.known[hash]
+	if received {
+		r.announcedPending(p, hash)
+	} else {
+		r.remember(hash, true)
+	}
+	r.mu.Unlock()
+	if received {
+		return nil
+	}
+
+	partial, err := block.NewPartialBlock(cb, r.cfg.Pool.Txs())
+	if errors.Is(err, block.ErrShortIDCollision) {
+		return r.downloadFull(p, hash, err)
+	}
+	if err != nil {
+		return fmt.Errorf("compact block %s: %w", hash, err)
+	}
+	missing := partial.Missing()
+	if len(missing) == 0 {
+		return r.complete(p, partial, nil)
+	}
+
+	pb := &pendingBlock{peer: p, partial: partial}
+	r.mu.Lock()
+	r.pending[hash] = pb
+	pb.timer = time.AfterFunc(r.cfg.Timeout, func() { r.expire(hash, pb) })
+	r.mu.Unlock()
+	log.Debugf("Requesting %d of %d transactions of block %s from %s", len(missing), cb.TxCount(), hash, p.Addr())
+	return p.GetBlockTxn(&block.BlockTxnRequest{BlockHash: hash, Indexes: missing})
+}
+
+func (r *Relay) handleBlockTxn(p *network.Peer, bt *block.BlockTxns) error {
+	r.mu.Lock()
+	pb, ok := r.pending[bt.BlockHash]
+	if ok && pb.peer == p {
+		pb.timer.Stop()
+		delete(r.pending, bt.BlockHash)
+	}
+	r.mu.Unlock()
+	if !ok || pb.peer != p {
+		return nil
+	}
+	return r.complete(p, pb.partial, bt.Transactions)
+}
+
+// expire gives up on the blocktxn pb waits for: the block is requested in
+// full from the first connected peer that announced it since, or left to
+// the next announcement.
+func (r *Relay) expire(hash utils.Hash, pb *pendingBlock) {
+	r.mu.Lock()
+	if r.pending[hash] != pb {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.pending, hash)
+	var next *network.Peer
+	for _, p := range pb.others {
+		if !disconnected(p) {
+			next = p
+			break
+		}
+	}
+	if next == nil {
+		delete(r.known, hash)
+	}
+	r.mu.Unlock()
+
+	log.Infof("Peer %s did not send the missing transactions of block %s in time", pb.peer.Addr(), hash)
+	if next == nil {
+		return
+	}
+	if err := r.downloadFull(next, hash, errors.New("blocktxn timed out")); err != nil {
+		log.Debugf("Failed to request block %s from %s: %v", hash, next.Addr(), err)
+	}
+}
+
+func disconnected(p *network.Peer) bool {
+	select {
+	case <-p.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// complete fills the missing transactions of partial and delivers the
+// block. A merkle root or witness commitment mismatch means a mempool
+// transaction shared the short ID of a block transaction: the block is
+// then downloaded in full.
+func (r *Relay) complete(p *network.Peer, partial *block.PartialBlock, missing []*transaction.Tx) error {
+	hash := partial.Hash()
+	b, err := partial.Fill(missing)
+	if err == nil {
+		err = b.CheckWitnessCommitment()
+	}
+	if errors.Is(err, block.ErrBadMerkleRoot) || errors.Is(err, block.ErrMutatedMerkleRoot) || errors.Is(err, block.ErrBadWitnessCommitment) {
+		return r.downloadFull(p, hash, err)
+	}
+	if err != nil {
+		return fmt.Errorf("block %s: %w", hash, err)
+	}
+
+	txs := len(b.Transactions) - partial.Prefilled
+	r.mu.Lock()
+	r.stats.Blocks++
+	if len(missing) == 0 {
+		r.stats.FromPool++
+	}
+	r.stats.Txs += txs
+	r.stats.PoolTxs += partial.FromPool
+	r.stats.RequestedTxs += len(missing)
+	r.sources[hash] = p
+	r.mu.Unlock()
+	log.Infof("Rebuilt block %s from %s: %d of %d transactions from the mempool, %d requested",
+		hash, p.Addr(), partial.FromPool, txs, len(missing))
+
+	r.promote(p)
+	if r.cfg.Deliver != nil {
+		r.cfg.Deliver(p, b)
+	}
+	return nil
+}
+
+// downloadFull requests the block with the given hash in full from p after
+// its reconstruction failed because of err.
+func (r *Relay) downloadFull(p *network.Peer, hash utils.Hash, err error) error {
+	r.mu.Lock()
+	r.full[hash] = p
+	r.stats.Failed++
+	r.mu.Unlock()
+	log.Infof("Failed to rebuild block %s from %s, downloading it in full: %v", hash, p.Addr(), err)
+	return p.GetData(inv.InvVect{Type: inv.InvTypeWitnessBlock, Hash: hash})
+}
+
+func (r *Relay) handleBlock(p *network.Peer, b *block.Block) error {
+	hash := b.Hash()
+	r.mu.Lock()
+	fp, ok := r.full[hash]
+	if ok && fp == p {
+		delete(r.full, hash)
+		r.sources[hash] = p
+	}
+	r.mu.Unlock()
+	if !ok || fp != p {
+		return nil
+	}
+	if err := b.CheckMerkleRoot(); err != nil {
+		return fmt.Errorf("block %s: %w", hash, err)
+	}
+	if err := b.CheckWitnessCommitment(); err != nil {
+		return fmt.Errorf("block %s: %w", hash, err)
+	}
+	if r.cfg.Deliver != nil {
+		r.cfg.Deliver(p, b)
+	}
+	return nil
+}
+
+// promote makes p, which just gave us a new block first, a high-bandwidth
+// peer, demoting the oldest one beyond Config.HighBandwidth, as Bitcoin
+// Core does.
+func (r *Relay) promote(p *network.Peer) {
+	if !p.CompactBlocks() {
+		return
+	}
+	r.mu.Lock()
+	if i := slices.Index(r.highBandwidth, p); i >= 0 {
+		r.highBandwidth = append(slices.Delete(r.highBandwidth, i, i+1), p)
+		r.mu.Unlock()
+		return
+	}
+	r.highBandwidth = append(r.highBandwidth, p)
+	var demoted *network.Peer
+	if len(r.highBandwidth) > r.cfg.HighBandwidth {
+		demoted = r.highBandwidth[0]
+		r.highBandwidth = r.highBandwidth[1:]
+	}
+	r.mu.Unlock()
+
+	if demoted != nil {
+		if err := demoted.SendCmpct(false); err != nil {
+			log.Debugf("Failed to send sendcmpct to %s: %v", demoted.Addr(), err)
+		}
+	}
+	if err := p.SendCmpct(true); err != nil {
+		log.Debugf("Failed to send sendcmpct to %s: %v", p.Addr(), err)
+	}
+}
+
+// Announce pushes b, which just became our tip, as a compact block to the
+// peers that asked for high-bandwidth announcements, except the one it came
+// from.
+func (r *Relay) Announce(b *block.Block) {
+	hash := b.Hash()
+	r.mu.Lock()
+	source := r.sources[hash]
+	peers := slices.Clone(r.peers)
+	r.mu.Unlock()
+
+	var cb *block.CompactBlock
+	for _, p := range peers {
+		if p == source || !p.CompactBlocksHighBandwidth() {
+			continue
+		}
+		if cb == nil {
+			cb = block.NewCompactBlock(b, rand.Uint64())
+		}
+		if err := p.SendCmpctBlock(cb); err != nil {
+			log.Debugf("Failed to announce block %s to %s: %v", hash, p.Addr(), err)
+		}
+	}
+}
+
+func (r *Relay) handleGetBlockTxn(p *network.Peer, req *block.BlockTxnRequest) error {
+	b, err := r.cfg.Blocks.Block(req.BlockHash)
+	if err != nil {
+		log.Debugf("Ignoring getblocktxn for block %s from %s: %v", req.BlockHash, p.Addr(), err)
+		return nil
+	}
+	bt := &block.BlockTxns{BlockHash: req.BlockHash}
+	for _, i := range req.Indexes {
+		if int(i) >= len(b.Transactions) {
+			return fmt.Errorf("getblocktxn index %d out of range for block %s", i, req.BlockHash)
+		}
+		bt.Transactions = append(bt.Transactions, b.Transactions[i])
+	}
+	return p.SendBlockTxn(bt)
+}
@@ -0,0 +1,365 @@
+package compact
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/mempool"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTx(n byte) *transaction.Tx {
+	return &transaction.Tx{
+		Version: 2,
+		TxIn: []transaction.TxIn{{
+			PreviousOutPoint: transaction.OutPoint{Hash: utils.Hash{n}},
+			Witness:          [][]byte{{n}},
+			Sequence:         0xffffffff,
+		}},
+		TxOut: []transaction.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+	}
+}
+
+// testBlock returns a block of txs whose coinbase commits to their
+// witnesses.
+func testBlock(txs ...*transaction.Tx) *block.Block {
+	reserved := make([]byte, utils.HashSize)
+	wtxids := []utils.Hash{{}}
+	for _, tx := range txs {
+		wtxids = append(wtxids, tx.WTxID())
+	}
+	root, _ := block.MerkleRoot(wtxids)
+	commitment := utils.DoubleSHA256(append(root[:], reserved...))
+	coinbase := &transaction.Tx{
+		Version: 2,
+		TxIn: []transaction.TxIn{{
+			PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{byte(len(txs))},
+			Witness:          [][]byte{reserved},
+		}},
+		TxOut: []transaction.TxOut{
+			{Value: 50e8, PkScript: []byte{0x51}},
+			{PkScript: append([]byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}, commitment[:]...)},
+		},
+	}
+	b := &block.Block{Header: block.Header{Version: 4, Bits: 0x207fffff}, Transactions: append([]*transaction.Tx{coinbase}, txs...)}
+	b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+	return b
+}
+
+// remote is a peer serving compact blocks from its block store, with a
+// relay of its own answering getblocktxn.
+type remote struct {
+	*network.Peer
+	blocks *blockstore.Store
+
+	mu       sync.Mutex
+	compact  map[utils.Hash]*block.CompactBlock
+	requests []inv.InvVect
+	hb       chan bool
+	pong     chan struct{}
+	// announced receives the compact blocks the relay pushes to us.
+	announced chan *block.CompactBlock
+}
+
+func (n *remote) handleGetData(p *network.Peer, vects []inv.InvVect) error {
+	n.mu.Lock()
+	n.requests = append(n.requests, vects...)
+	n.mu.Unlock()
+	for _, v := range vects {
+		b, err := n.blocks.Block(v.Hash)
+		if err != nil {
+			return err
+		}
+		if v.Type == inv.InvTypeCompactBlock {
+			n.mu.Lock()
+			cb := n.compact[v.Hash]
+			n.mu.Unlock()
+			if cb == nil {
+				cb = block.NewCompactBlock(b, 1)
+			}
+			err = p.SendCmpctBlock(cb)
+		} else {
+			err = p.SendBlock(b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync returns once the relay handled the messages sent so far.
+func (n *remote) sync(t *testing.T) {
+	t.Helper()
+	require.NoError(t, n.Send(network.Message{Command: "ping", Payload: make([]byte, 8)}))
+	select {
+	case <-n.pong:
+	case <-time.After(time.Second):
+		t.Fatal("pong was not received")
+	}
+}
+
+func (n *remote) types() []inv.InvType {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var types []inv.InvType
+	for _, v := range n.requests {
+		types = append(types, v.Type)
+	}
+	return types
+}
+
+func connect(t *testing.T, r *Relay) *remote {
+	t.Helper()
+	blocks, err := blockstore.Open(blockstore.Config{Dir: t.TempDir(), Magic: config.RegTestParams.Magic})
+	require.NoError(t, err)
+	t.Cleanup(func() { blocks.Close() })
+
+	c1, c2 := net.Pipe()
+	local := network.NewPeer(c1, "remote", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	n := &remote{
+		Peer:      network.NewPeer(c2, "local", network.PeerConfig{Magic: config.RegTestParams.Magic}),
+		blocks:    blocks,
+		compact:   make(map[utils.Hash]*block.CompactBlock),
+		hb:        make(chan bool, 2),
+		pong:      make(chan struct{}, 1),
+		announced: make(chan *block.CompactBlock, 1),
+	}
+	r.SetupPeer(local)
+	New(Config{Pool: mempool.New(mempool.Config{}), Blocks: blocks}).SetupPeer(n.Peer)
+	n.OnGetData(n.handleGetData)
+	n.Handle("sendcmpct", func(p *network.Peer, payload []byte) error {
+		n.hb <- p.CompactBlocksHighBandwidth()
+		return nil
+	})
+	n.OnCmpctBlock(func(p *network.Peer, cb *block.CompactBlock) error {
+		n.announced <- cb
+		return nil
+	})
+	n.Handle("pong", func(p *network.Peer, payload []byte) error {
+		n.pong <- struct{}{}
+		return nil
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- n.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+
+	r.AddPeer(local)
+	assert.False(t, <-n.hb, "peers start in low-bandwidth mode")
+	require.NoError(t, n.SendCmpct(false))
+	require.Eventually(t, local.CompactBlocks, time.Second, time.Millisecond)
+	return n
+}
+
+// setup returns a relay whose pool holds the given transactions and a
+// channel of the blocks it delivers.
+func setup(t *testing.T, txs ...*transaction.Tx) (*Relay, chan *block.Block) {
+	t.Helper()
+	pool := mempool.New(mempool.Config{})
+	for _, tx := range txs {
+		pool.Add(tx, time.Now(), "peer")
+	}
+	delivered := make(chan *block.Block, 1)
+	r := New(Config{Pool: pool, Deliver: func(p *network.Peer, b *block.Block) {
+		delivered <- b
+	}})
+	return r, delivered
+}
+
+func receive(t *testing.T, delivered chan *block.Block, want *block.Block) {
+	t.Helper()
+	select {
+	case b := <-delivered:
+		assert.Equal(t, want.TxHashes(), b.TxHashes())
+	case <-time.After(time.Second):
+		t.Fatal("block was not delivered")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	r, delivered := setup(t, testTx(1), testTx(2), testTx(3))
+	n := connect(t, r)
+
+	// The first block misses a transaction of the pool.
+	first := testBlock(testTx(1), testTx(2), testTx(4))
+	_, err := n.blocks.Put(first)
+	require.NoError(t, err)
+	require.NoError(t, n.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: first.Hash()}))
+	receive(t, delivered, first)
+	assert.Equal(t, Stats{Blocks: 1, Txs: 3, PoolTxs: 2, RequestedTxs: 1}, r.Stats())
+	assert.InDelta(t, 2.0/3, r.Stats().HitRate(), 1e-9)
+
+	// Giving us a new block first makes the peer high-bandwidth.
+	select {
+	case hb := <-n.hb:
+		assert.True(t, hb)
+	case <-time.After(time.Second):
+		t.Fatal("the peer was not made high-bandwidth")
+	}
+	assert.Equal(t, []string{"remote"}, r.HighBandwidthPeers())
+
+	// The second block is announced with its compact block and rebuilt
+	// from the pool alone.
+	second := testBlock(testTx(3))
+	require.NoError(t, n.SendCmpctBlock(block.NewCompactBlock(second, 2)))
+	receive(t, delivered, second)
+	assert.Equal(t, Stats{Blocks: 2, FromPool: 1, Txs: 4, PoolTxs: 3, RequestedTxs: 1}, r.Stats())
+
+	// Announcements of blocks already handled are not requested again.
+	require.NoError(t, n.SendHeaders([]block.Header{first.Header}))
+	require.NoError(t, n.SendCmpctBlock(block.NewCompactBlock(second, 3)))
+	n.sync(t)
+	assert.Equal(t, []inv.InvType{inv.InvTypeCompactBlock}, n.types())
+	assert.Equal(t, 2, r.Stats().Blocks)
+}
+
+func TestRelayFallsBackToFullBlock(t *testing.T) {
+	r, delivered := setup(t, testTx(1))
+	n := connect(t, r)
+
+	// Short IDs colliding within the block.
+	b := testBlock(testTx(1), testTx(2))
+	_, err := n.blocks.Put(b)
+	require.NoError(t, err)
+	cb := block.NewCompactBlock(b, 1)
+	cb.ShortIDs[1] = cb.ShortIDs[0]
+	n.compact[b.Hash()] = cb
+	require.NoError(t, n.SendHeaders([]block.Header{b.Header}))
+	receive(t, delivered, b)
+	assert.Equal(t, []inv.InvType{inv.InvTypeCompactBlock, inv.InvTypeWitnessBlock}, n.types())
+
+	// A pool transaction sharing the short ID of a block transaction only
+	// shows in the merkle root.
+	other := testBlock(testTx(3), testTx(4))
+	_, err = n.blocks.Put(other)
+	require.NoError(t, err)
+	cb = block.NewCompactBlock(other, 1)
+	k0, k1 := cb.ShortIDKeys()
+	cb.ShortIDs[0] = block.ShortID(k0, k1, testTx(1).WTxID())
+	n.compact[other.Hash()] = cb
+	require.NoError(t, n.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: other.Hash()}))
+	receive(t, delivered, other)
+	assert.Equal(t, Stats{Failed: 2}, r.Stats())
+	assert.Empty(t, r.HighBandwidthPeers())
+}
+
+func TestRelayChecksWitnessCommitment(t *testing.T) {
+	// The pool holds a transaction of the block with another witness.
+	altered := testTx(1)
+	altered.TxIn[0].Witness = [][]byte{{9}}
+	r, delivered := setup(t, altered)
+	n := connect(t, r)
+
+	// Only the witness commitment shows the difference: the block is
+	// downloaded in full.
+	b := testBlock(testTx(1))
+	_, err := n.blocks.Put(b)
+	require.NoError(t, err)
+	cb := block.NewCompactBlock(b, 1)
+	k0, k1 := cb.ShortIDKeys()
+	cb.ShortIDs[0] = block.ShortID(k0, k1, altered.WTxID())
+	n.compact[b.Hash()] = cb
+	require.NoError(t, n.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: b.Hash()}))
+	select {
+	case got := <-delivered:
+		assert.Equal(t, b.Transactions[1].WTxID(), got.Transactions[1].WTxID())
+	case <-time.After(time.Second):
+		t.Fatal("block was not delivered")
+	}
+	assert.Equal(t, []inv.InvType{inv.InvTypeCompactBlock, inv.InvTypeWitnessBlock}, n.types())
+	assert.Equal(t, Stats{Failed: 1}, r.Stats())
+
+	// A peer whose full block does not match its commitment is
+	// disconnected.
+	bad := testBlock(testTx(2))
+	bad.Transactions[1] = testTx(2)
+	bad.Transactions[1].TxIn[0].Witness = [][]byte{{9}}
+	m := connect(t, r)
+	_, err = m.blocks.Put(bad)
+	require.NoError(t, err)
+	require.NoError(t, m.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: bad.Hash()}))
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+	assert.Empty(t, delivered)
+}
+
+func TestRelayTimesOutBlockTxn(t *testing.T) {
+	r, delivered := setup(t, testTx(1))
+	r.cfg.Timeout = 200 * time.Millisecond
+	n, m := connect(t, r), connect(t, r)
+
+	// n does not hold the block and leaves our getblocktxn unanswered:
+	// the block comes in full from m, which announced it meanwhile.
+	b := testBlock(testTx(1), testTx(2))
+	_, err := m.blocks.Put(b)
+	require.NoError(t, err)
+	require.NoError(t, n.SendCmpctBlock(block.NewCompactBlock(b, 1)))
+	n.sync(t)
+	require.NoError(t, m.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: b.Hash()}))
+	receive(t, delivered, b)
+	assert.Equal(t, []inv.InvType{inv.InvTypeWitnessBlock}, m.types())
+	assert.Equal(t, Stats{Failed: 1}, r.Stats())
+
+	// Without another announcer, the block is requested again when it
+	// is next announced.
+	other := testBlock(testTx(3))
+	_, err = m.blocks.Put(other)
+	require.NoError(t, err)
+	require.NoError(t, n.SendCmpctBlock(block.NewCompactBlock(other, 1)))
+	n.sync(t)
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, known := r.known[other.Hash()]
+		return !known
+	}, time.Second, time.Millisecond)
+	require.NoError(t, m.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: other.Hash()}))
+	receive(t, delivered, other)
+	assert.Equal(t, []inv.InvType{inv.InvTypeWitnessBlock, inv.InvTypeCompactBlock}, m.types())
+}
+
+func TestRelayAnnounce(t *testing.T) {
+	r, delivered := setup(t, testTx(1))
+	a := connect(t, r)
+	b := connect(t, r)
+	low := connect(t, r)
+	for _, n := range []*remote{a, b} {
+		require.NoError(t, n.SendCmpct(true))
+		n.sync(t)
+	}
+
+	// The block a gave us is pushed to the other high-bandwidth peer only.
+	first := testBlock(testTx(1))
+	require.NoError(t, a.SendCmpctBlock(block.NewCompactBlock(first, 1)))
+	receive(t, delivered, first)
+	r.Announce(first)
+	select {
+	case cb := <-b.announced:
+		assert.Equal(t, first.Header, cb.Header)
+	case <-time.After(time.Second):
+		t.Fatal("the block was not announced")
+	}
+	for _, n := range []*remote{a, low} {
+		n.sync(t)
+		assert.Empty(t, n.announced)
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// ChainParams describes a Bitcoin network.
+type ChainParams struct {
+	Name        string
+	Magic       [4]byte
+	DefaultPort uint16
+	// DNSSeeds are queried for peer addresses when bootstrapping. They
+	// support service-bit filtered subdomains such as x9.<seed>.
+	DNSSeeds []string
+	// GenesisBlock is the serialized genesis block and GenesisHash its
+	// header hash.
+	GenesisBlock []byte
+	GenesisHash  utils.Hash
+
+	// PowLimit is the easiest proof-of-work target a block may have.
+	PowLimit *big.Int
+	// PowAllowMinDifficultyBlocks lets a block that is more than twenty
+	// minutes younger than its parent use the PowLimit target (testnet).
+	PowAllowMinDifficultyBlocks bool
+	// PowNoRetargeting keeps the difficulty constant (regtest).
+	PowNoRetargeting bool
+	// EnforceBIP94 enables the testnet4 rules: retargeting from the first
+	// block of the period and the timewarp limit.
+	EnforceBIP94 bool
+
+	// Checkpoints are ordered by height.
+	Checkpoints []Checkpoint
+}
+
+var (
+	mainPowLimit    = mustParseBig("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+	sigNetPowLimit  = mustParseBig("00000377ae000000000000000000000000000000000000000000000000000000")
+	regTestPowLimit = mustParseBig("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+)
+
+var MainNetParams = ChainParams{
+	Name:        "mainnet",
+	Magic:       MainnetMagicBytes,
+	DefaultPort: 8333,
+	DNSSeeds: []string{
+		"seed.bitcoin.sipa.be",
+		"dnsseed.bluematt.me",
+		"dnsseed.bitcoin.dashjr-list-of-p2p-nodes.us",
+		"seed.bitcoinstats.com",
+		"seed.bitcoin.jonasschnelli.ch",
+		"seed.btc.petertodd.net",
+		"seed.bitcoin.sprovoost.nl",
+		"dnsseed.emzy.de",
+		"seed.bitcoin.wiz.biz",
+		"seed.mainnet.achownodes.xyz",
+	},
+	GenesisBlock: mainNetGenesisBlock,
+	GenesisHash:  mainNetGenesisHash,
+	PowLimit:     mainPowLimit,
+	Checkpoints:  mainNetCheckpoints,
+}
+
+var TestNet3Params = ChainParams{
+	Name:        "testnet3",
+	Magic:       [4]byte{0x0b, 0x11, 0x09, 0x07},
+	DefaultPort: 18333,
+	DNSSeeds: []string{
+		"testnet-seed.bitcoin.jonasschnelli.ch",
+		"seed.tbtc.petertodd.net",
+		"seed.testnet.bitcoin.sprovoost.nl",
+		"testnet-seed.bluematt.me",
+		"seed.testnet.achownodes.xyz",
+	},
+	GenesisBlock:                testNet3GenesisBlock,
+	GenesisHash:                 testNet3GenesisHash,
+	PowLimit:                    mainPowLimit,
+	PowAllowMinDifficultyBlocks: true,
+	Checkpoints:                 testNet3Checkpoints,
+}
+
+var TestNet4Params = ChainParams{
+	Name:        "testnet4",
+	Magic:       [4]byte{0x1c, 0x16, 0x3f, 0x28},
+	DefaultPort: 48333,
+	DNSSeeds: []string{
+		"seed.testnet4.bitcoin.sprovoost.nl",
+		"seed.testnet4.wiz.biz",
+	},
+	GenesisBlock:                testNet4GenesisBlock,
+	GenesisHash:                 testNet4GenesisHash,
+	PowLimit:                    mainPowLimit,
+	PowAllowMinDifficultyBlocks: true,
+	EnforceBIP94:                true,
+}
+
+var SigNetParams = ChainParams{
+	Name:        "signet",
+	Magic:       [4]byte{0x0a, 0x03, 0xcf, 0x40},
+	DefaultPort: 38333,
+	DNSSeeds: []string{
+		"seed.signet.bitcoin.sprovoost.nl",
+		"seed.signet.achownodes.xyz",
+	},
+	GenesisBlock: sigNetGenesisBlock,
+	GenesisHash:  sigNetGenesisHash,
+	PowLimit:     sigNetPowLimit,
+}
+
+var RegTestParams = ChainParams{
+	Name:                        "regtest",
+	Magic:                       [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+	DefaultPort:                 18444,
+	GenesisBlock:                regTestGenesisBlock,
+	GenesisHash:                 regTestGenesisHash,
+	PowLimit:                    regTestPowLimit,
+	PowAllowMinDifficultyBlocks: true,
+	PowNoRetargeting:            true,
+}
+
+// ParamsByName returns the parameters of the named network.
+func ParamsByName(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNet3Params, &TestNet4Params, &SigNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown chain %q", name)
+}
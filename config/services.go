@@ -0,0 +1,11 @@
+package config
+
+// Service flags advertised in the services field of the version message.
+const (
+	NodeNetwork        = 1 << 0
+	NodeBloom          = 1 << 2
+	NodeWitness        = 1 << 3
+	NodeCompactFilters = 1 << 6
+	NodeNetworkLimited = 1 << 10
+	NodeP2PV2          = 1 << 11
+)
@@ -0,0 +1,322 @@
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTargetOutbound and DefaultTargetBlockRelay are the outbound
+	// targets of Bitcoin Core.
+	DefaultTargetOutbound   = 8
+	DefaultTargetBlockRelay = 2
+
+	defaultRetryMin   = time.Second
+	defaultRetryMax   = 5 * time.Minute
+	defaultMaxInbound = 115
+)
+
+var errNoCandidates = errors.New("no address candidates available")
+
+// Config holds the settings of a ConnManager.
+type Config struct {
+	// TargetOutbound is the number of full-relay outbound peers to keep.
+	// It defaults to DefaultTargetOutbound.
+	TargetOutbound int
+	// TargetBlockRelay is the number of block-relay-only outbound peers to
+	// keep. It defaults to DefaultTargetBlockRelay.
+	TargetBlockRelay int
+	// DisableOutbound and DisableBlockRelay open no full-relay and no
+	// block-relay-only outbound slots, whatever the targets.
+	DisableOutbound   bool
+	DisableBlockRelay bool
+	// MaxInbound caps the number of peers accepted by Accept.
+	MaxInbound int
+	// AddrManager provides the candidates for outbound connections.
+	AddrManager *addrmgr.AddrManager
+	// AddNodes are host:port addresses we always stay connected to, on top
+	// of the outbound slots. Unlike the address manager they may be .onion
+	// hosts.
+	AddNodes []string
+	// Dialer opens the connections.
+	Dialer network.Dialer
+	// PeerConfig is used for every peer. BlockRelayOnly is set by the
+	// manager.
+	PeerConfig network.PeerConfig
+	// RetryMin and RetryMax bound the exponential backoff between failed
+	// connection attempts.
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// SetupPeer, when set, is called for every peer before its handshake so
+	// that message handlers can be registered.
+	SetupPeer func(p *network.Peer)
+	// PeerConnected, when set, is called for every peer whose handshake
+	// completed.
+	PeerConnected func(p *network.Peer)
+}
+
+type outboundPeer struct {
+	peer   *network.Peer
+	addr   string
+	known  netaddr.NetAddr
+	group  string
+	manual bool
+}
+
+// ConnManager keeps a target number of outbound peers connected. Each
+// outbound slot picks a candidate from the address manager, connects to it
+// and, once the peer goes away, replaces it with a new one. Only one
+// connection is made per group of the address manager.
+type ConnManager struct {
+	cfg Config
+
+	mu      sync.Mutex
+	peers   map[string]*outboundPeer
+	groups  map[string]bool
+	inbound map[*network.Peer]bool
+	// inboundSlots counts the inbound connections, those still in their
+	// handshake included, against MaxInbound.
+	inboundSlots int
+}
+
+// New returns a ConnManager for cfg.
+func New(cfg Config) *ConnManager {
+	if cfg.TargetOutbound == 0 {
+		cfg.TargetOutbound = DefaultTargetOutbound
+	}
+	if cfg.TargetBlockRelay == 0 {
+		cfg.TargetBlockRelay = DefaultTargetBlockRelay
+	}
+	if cfg.DisableOutbound {
+		cfg.TargetOutbound = 0
+	}
+	if cfg.DisableBlockRelay {
+		cfg.TargetBlockRelay = 0
+	}
+	if cfg.MaxInbound == 0 {
+		cfg.MaxInbound = defaultMaxInbound
+	}
+	if cfg.RetryMin == 0 {
+		cfg.RetryMin = defaultRetryMin
+	}
+	if cfg.RetryMax == 0 {
+		cfg.RetryMax = defaultRetryMax
+	}
+	return &ConnManager{
+		cfg:     cfg,
+		peers:   make(map[string]*outboundPeer),
+		groups:  make(map[string]bool),
+		inbound: make(map[*network.Peer]bool),
+	}
+}
+
+// Run fills the outbound slots and keeps them filled until ctx is done. It
+// returns once every peer has been disconnected.
+func (m *ConnManager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < m.cfg.TargetOutbound+m.cfg.TargetBlockRelay; i++ {
+		blockRelayOnly := i >= m.cfg.TargetOutbound
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runSlot(ctx, func() (*outboundPeer, error) {
+				op, err := m.reserve()
+				if err != nil {
+					return nil, err
+				}
+				return op, m.connect(ctx, op, blockRelayOnly)
+			})
+		}()
+	}
+	for _, addr := range m.cfg.AddNodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.runSlot(ctx, func() (*outboundPeer, error) {
+				op := &outboundPeer{addr: addr, manual: true}
+				return op, m.connect(ctx, op, false)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// Accept serves inbound connections from ln until ctx is done or ln fails.
+// Connections beyond MaxInbound are closed right away.
+func (m *ConnManager) Accept(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		m.mu.Lock()
+		full := m.inboundSlots >= m.cfg.MaxInbound
+		if !full {
+			m.inboundSlots++
+		}
+		m.mu.Unlock()
+		if full {
+			log.Debugf("Rejecting inbound connection from %s: too many inbound peers", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go m.serveInbound(ctx, conn)
+	}
+}
+
+// Peers returns the currently connected peers, outbound and inbound.
+func (m *ConnManager) Peers() []*network.Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers := make([]*network.Peer, 0, len(m.peers)+len(m.inbound))
+	for _, op := range m.peers {
+		peers = append(peers, op.peer)
+	}
+	for peer := range m.inbound {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// serveInbound runs an inbound connection, whose slot Accept reserved, and
+// releases the slot when it ends.
+func (m *ConnManager) serveInbound(ctx context.Context, conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		m.inboundSlots--
+		m.mu.Unlock()
+	}()
+	peerCfg := m.cfg.PeerConfig
+	peerCfg.Inbound = true
+	peer := network.NewPeer(conn, conn.RemoteAddr().String(), peerCfg)
+	if m.cfg.SetupPeer != nil {
+		m.cfg.SetupPeer(peer)
+	}
+	if err := peer.Start(ctx); err != nil {
+		log.Debugf("Inbound handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	m.mu.Lock()
+	m.inbound[peer] = true
+	m.mu.Unlock()
+	if m.cfg.PeerConnected != nil {
+		m.cfg.PeerConnected(peer)
+	}
+
+	<-peer.Done()
+
+	m.mu.Lock()
+	delete(m.inbound, peer)
+	m.mu.Unlock()
+	log.Infof("Inbound peer %s disconnected: %v", peer.Addr(), peer.Err())
+}
+
+// runSlot keeps one outbound connection made by connect alive, backing off
+// exponentially while attempts fail.
+func (m *ConnManager) runSlot(ctx context.Context, connect func() (*outboundPeer, error)) {
+	delay := m.cfg.RetryMin
+	for ctx.Err() == nil {
+		op, err := connect()
+		if err != nil {
+			if err != errNoCandidates {
+				log.Debugf("Outbound connection failed: %v", err)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, m.cfg.RetryMax)
+			continue
+		}
+		delay = m.cfg.RetryMin
+
+		<-op.peer.Done()
+		m.release(op)
+		log.Infof("Peer %s disconnected: %v", op.addr, op.peer.Err())
+	}
+}
+
+func (m *ConnManager) connect(ctx context.Context, op *outboundPeer, blockRelayOnly bool) error {
+	if !op.manual {
+		m.cfg.AddrManager.Attempt(op.known)
+	}
+	conn, err := m.cfg.Dialer.Dial(ctx, op.addr)
+	if err != nil {
+		m.release(op)
+		return err
+	}
+
+	peerCfg := m.cfg.PeerConfig
+	peerCfg.BlockRelayOnly = blockRelayOnly
+	op.peer = network.NewPeer(conn, op.addr, peerCfg)
+	if m.cfg.SetupPeer != nil {
+		m.cfg.SetupPeer(op.peer)
+	}
+	if err := op.peer.Start(ctx); err != nil {
+		m.release(op)
+		return err
+	}
+	if !op.manual {
+		m.cfg.AddrManager.Good(op.known)
+	}
+
+	m.mu.Lock()
+	m.peers[op.addr] = op
+	m.mu.Unlock()
+	if m.cfg.PeerConnected != nil {
+		m.cfg.PeerConnected(op.peer)
+	}
+	return nil
+}
+
+// reserve picks a candidate whose network group is not in use yet and
+// claims the group for it.
+func (m *ConnManager) reserve() (*outboundPeer, error) {
+	if m.cfg.AddrManager == nil {
+		return nil, errNoCandidates
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addr, ok := m.cfg.AddrManager.Candidate(func(addr netaddr.NetAddr) bool {
+		return m.groups[m.cfg.AddrManager.Group(addr)]
+	})
+	if !ok {
+		return nil, errNoCandidates
+	}
+	op := &outboundPeer{addr: addr.String(), known: addr, group: m.cfg.AddrManager.Group(addr)}
+	m.groups[op.group] = true
+	return op, nil
+}
+
+func (m *ConnManager) release(op *outboundPeer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op.group != "" {
+		delete(m.groups, op.group)
+	}
+	if current, ok := m.peers[op.addr]; ok && current == op {
+		delete(m.peers, op.addr)
+	}
+}
@@ -0,0 +1,288 @@
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dialFunc func(ctx context.Context, addr string) (network.Conn, error)
+
+func (f dialFunc) Dial(ctx context.Context, addr string) (network.Conn, error) {
+	return f(ctx, addr)
+}
+
+// pipeNetwork answers dials with in-memory peers that complete the
+// handshake.
+type pipeNetwork struct {
+	mu      sync.Mutex
+	remotes map[string]*network.Peer
+}
+
+func newPipeNetwork() *pipeNetwork {
+	return &pipeNetwork{remotes: make(map[string]*network.Peer)}
+}
+
+func (n *pipeNetwork) Dial(ctx context.Context, addr string) (network.Conn, error) {
+	return network.PipeDialer{Accept: n.accept}.Dial(ctx, addr)
+}
+
+func (n *pipeNetwork) accept(addr string, conn network.Conn) {
+	peer := network.NewPeer(conn, "local", network.PeerConfig{})
+	n.mu.Lock()
+	n.remotes[addr] = peer
+	n.mu.Unlock()
+	peer.Start(context.Background())
+}
+
+func (n *pipeNetwork) remote(addr string) *network.Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.remotes[addr]
+}
+
+func addresses(ips ...string) *addrmgr.AddrManager {
+	a := addrmgr.New()
+	for _, ip := range ips {
+		a.Add(netaddr.NewNetAddr(ip, 8333, 1))
+	}
+	return a
+}
+
+func countBlockRelay(peers []*network.Peer) int {
+	n := 0
+	for _, p := range peers {
+		if p.BlockRelayOnly() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConnManagerFillsTargets(t *testing.T) {
+	pn := newPipeNetwork()
+	m := New(Config{
+		TargetOutbound:   3,
+		TargetBlockRelay: 2,
+		AddrManager:      addresses("1.0.0.1", "2.0.0.1", "3.0.0.1", "4.0.0.1", "5.0.0.1", "6.0.0.1"),
+		Dialer:           pn,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return len(m.Peers()) == 5 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, countBlockRelay(m.Peers()))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
+
+func TestConnManagerZeroTarget(t *testing.T) {
+	pn := newPipeNetwork()
+	m := New(Config{
+		TargetOutbound:    2,
+		DisableBlockRelay: true,
+		AddrManager:       addresses("1.0.0.1", "2.0.0.1", "3.0.0.1", "4.0.0.1"),
+		Dialer:            pn,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// No block-relay-only slot is opened.
+	require.Eventually(t, func() bool { return len(m.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, m.Peers(), 2)
+	assert.Zero(t, countBlockRelay(m.Peers()))
+}
+
+func TestConnManagerOnePeerPerNetGroup(t *testing.T) {
+	pn := newPipeNetwork()
+	m := New(Config{
+		TargetOutbound:   4,
+		TargetBlockRelay: 1,
+		AddrManager:      addresses("1.2.0.1", "1.2.0.2", "1.2.3.3", "9.9.9.9"),
+		Dialer:           pn,
+		RetryMin:         10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	require.Eventually(t, func() bool { return len(m.Peers()) == 2 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	groups := make(map[string]bool)
+	for _, p := range m.Peers() {
+		host, _, err := net.SplitHostPort(p.Addr())
+		require.NoError(t, err)
+		group := netaddr.NewNetAddr(host, 8333, 0).NetGroup()
+		assert.False(t, groups[group], "duplicate netgroup %s", group)
+		groups[group] = true
+	}
+	assert.Len(t, m.Peers(), 2)
+}
+
+func TestConnManagerReplacesDroppedPeers(t *testing.T) {
+	pn := newPipeNetwork()
+	m := New(Config{
+		TargetOutbound:   2,
+		TargetBlockRelay: 1,
+		AddrManager:      addresses("1.0.0.1", "2.0.0.1", "3.0.0.1", "4.0.0.1"),
+		Dialer:           pn,
+		RetryMin:         10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	require.Eventually(t, func() bool { return len(m.Peers()) == 3 }, 2*time.Second, 10*time.Millisecond)
+
+	dropped := m.Peers()[0]
+	pn.remote(dropped.Addr()).Disconnect()
+
+	require.Eventually(t, func() bool {
+		peers := m.Peers()
+		if len(peers) != 3 {
+			return false
+		}
+		for _, p := range peers {
+			if p == dropped {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, countBlockRelay(m.Peers()))
+}
+
+func TestConnManagerBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+	m := New(Config{
+		TargetOutbound:   1,
+		TargetBlockRelay: 1,
+		AddrManager:      addresses("1.0.0.1"),
+		Dialer: dialFunc(func(ctx context.Context, addr string) (network.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, time.Now())
+			return nil, errors.New("connection refused")
+		}),
+		RetryMin: 20 * time.Millisecond,
+		RetryMax: 80 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	m.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 20+40+80+80+80 ms between attempts for each of the two slots.
+	assert.GreaterOrEqual(t, len(attempts), 4)
+	assert.LessOrEqual(t, len(attempts), 16)
+	assert.Empty(t, m.Peers())
+}
+
+func TestConnManagerAccept(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	m := New(Config{MaxInbound: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Accept(ctx, ln)
+
+	dial := func() *network.Peer {
+		conn, err := network.TCPDialer{}.Dial(ctx, ln.Addr().String())
+		require.NoError(t, err)
+		return network.NewPeer(conn, ln.Addr().String(), network.PeerConfig{HandshakeTimeout: 200 * time.Millisecond})
+	}
+
+	first := dial()
+	require.NoError(t, first.Start(ctx))
+	require.Eventually(t, func() bool { return len(m.Peers()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.True(t, m.Peers()[0].Inbound())
+
+	assert.Error(t, dial().Start(ctx), "connections beyond MaxInbound should be rejected")
+
+	first.Disconnect()
+	require.Eventually(t, func() bool { return len(m.Peers()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestConnManagerAcceptCountsHandshakes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	m := New(Config{MaxInbound: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Accept(ctx, ln)
+
+	dial := func() *network.Peer {
+		conn, err := network.TCPDialer{}.Dial(ctx, ln.Addr().String())
+		require.NoError(t, err)
+		return network.NewPeer(conn, ln.Addr().String(), network.PeerConfig{HandshakeTimeout: 200 * time.Millisecond})
+	}
+
+	// A connection that never completes its handshake holds the slot.
+	idle, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Error(t, dial().Start(ctx), "connections beyond MaxInbound should be rejected")
+
+	// The slot is released once its handshake fails.
+	idle.Close()
+	require.Eventually(t, func() bool {
+		p := dial()
+		defer p.Disconnect()
+		return p.Start(ctx) == nil
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestConnManagerAddNodes(t *testing.T) {
+	pn := newPipeNetwork()
+	onion := "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion:8333"
+	m := New(Config{
+		TargetOutbound:   1,
+		TargetBlockRelay: 1,
+		AddNodes:         []string{onion},
+		Dialer:           pn,
+		RetryMin:         10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	require.Eventually(t, func() bool { return len(m.Peers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, onion, m.Peers()[0].Addr())
+
+	pn.remote(onion).Disconnect()
+	require.Eventually(t, func() bool {
+		peers := m.Peers()
+		return len(peers) == 1 && peers[0].Err() == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawldb"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCrawl walks the network starting from the seed addresses and appends
+// one JSON line per visited node to the results file. Every crawl is also
+// recorded as a snapshot in the crawl database. Interrupting it saves the
+// queue and its snapshot so the next run continues the same crawl; once the
+// queue is exhausted the snapshot is finished and the queue deleted, so the
+// next run starts a new snapshot.
+func runCrawl(args []string) {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	seeds := flags.String("seeds", "", "comma separated list of host:port addresses to start from")
+	dir := flags.String("dir", "crawl", "directory holding the crawl queue and results")
+	concurrency := flags.Int("concurrency", 32, "number of nodes visited at the same time")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for a single node")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	onion := flags.Bool("onion", false, "also crawl .onion addresses (requires -proxy)")
+	chain := flags.String("chain", config.MainNetParams.Name, "network to crawl: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "add the addresses returned by the chain's DNS seeds to the queue")
+	dnsServer := flags.String("dnsserver", "", "DNS server host:port used for the seed lookups (system resolver when empty)")
+	dbPath := flags.String("db", "", "crawl database receiving a snapshot of this run (default <dir>/crawl.db)")
+	asmap := flags.String("asmap", "", "asmap file used to annotate nodes with their AS number")
+	mmdb := flags.String("mmdb", "", "comma separated list of .mmdb country and ASN databases used to annotate nodes")
+	flags.Parse(args)
+
+	params := chainParams(*chain)
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dir, err)
+	}
+	queue, err := crawler.OpenQueue(filepath.Join(*dir, "queue.json"))
+	if err != nil {
+		log.Fatalf("Failed to open crawl queue: %v", err)
+	}
+	if *seeds != "" {
+		queue.Push(strings.Split(*seeds, ",")...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *dnsSeed {
+		resolver := dnsseed.Resolver{Server: *dnsServer}
+		found, err := resolver.Lookup(ctx, params, 0)
+		if err != nil {
+			log.Errorf("DNS seeding failed: %v", err)
+		}
+		for _, addr := range found {
+			queue.Push(addr.String())
+		}
+	}
+
+	results, err := os.OpenFile(filepath.Join(*dir, "results.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Fatalf("Failed to open crawl results: %v", err)
+	}
+	defer results.Close()
+
+	if pending, inFlight := queue.Len(); pending+inFlight == 0 {
+		log.Fatalf("Crawl failed: %v", crawler.ErrEmptyQueue)
+	}
+	if *dbPath == "" {
+		*dbPath = filepath.Join(*dir, "crawl.db")
+	}
+	db, err := crawldb.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open crawl database: %v", err)
+	}
+	defer db.Close()
+	snapshot, err := db.Snapshot(queue.Snapshot())
+	switch {
+	case err == nil:
+		log.Infof("Resuming snapshot %d", snapshot.ID)
+	case errors.Is(err, crawldb.ErrUnknownSnapshot):
+		if snapshot, err = db.BeginSnapshot(params.Name, time.Now()); err != nil {
+			log.Fatalf("Failed to start snapshot: %v", err)
+		}
+		queue.SetSnapshot(snapshot.ID)
+		if err := queue.Save(); err != nil {
+			log.Fatalf("Failed to save crawl queue: %v", err)
+		}
+	default:
+		log.Fatalf("Failed to read snapshot %d: %v", queue.Snapshot(), err)
+	}
+
+	geo := openGeoIP(*asmap, *mmdb)
+	if geo != nil {
+		defer geo.Close()
+	}
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(results)
+
+	networks := []byte{netaddr.NetworkIPv4, netaddr.NetworkIPv6}
+	if *onion {
+		networks = append(networks, netaddr.NetworkTorV3)
+	}
+
+	c := crawler.New(crawler.Config{
+		Queue:       queue,
+		Dialer:      newDialer(*proxy, true),
+		PeerConfig:  network.PeerConfig{Magic: params.Magic, HandshakeTimeout: *timeout},
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+		Networks:    networks,
+		OnResult: func(r crawler.Result) {
+			if geo != nil {
+				if ip := hostIP(r.Addr); ip != nil {
+					info := geo.Lookup(ip)
+					r.Geo = &info
+				}
+			}
+			if err := db.Record(snapshot.ID, r); err != nil {
+				log.Errorf("Failed to store crawl result: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err := encoder.Encode(r); err != nil {
+				log.Errorf("Failed to write crawl result: %v", err)
+			}
+		},
+	})
+	err = c.Run(ctx)
+	if errors.Is(err, crawler.ErrInterrupted) {
+		log.Infof("Crawl interrupted, run it again to resume snapshot %d", snapshot.ID)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Crawl failed: %v", err)
+	}
+	if err := db.FinishSnapshot(snapshot.ID, time.Now()); err != nil {
+		log.Fatalf("Failed to finish snapshot: %v", err)
+	}
+	if err := queue.Reset(); err != nil {
+		log.Errorf("Failed to delete the crawl queue: %v", err)
+	}
+	log.Infof("Crawl finished, stored as snapshot %d", snapshot.ID)
+}
+
+// hostIP returns the IP of a host:port address, or nil for other hosts such
+// as .onion ones.
+func hostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
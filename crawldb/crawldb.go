@@ -0,0 +1,246 @@
+// Package crawldb stores crawl results in an embedded database, one snapshot
+// per crawl run, and answers questions about the history of the network.
+package crawldb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	snapshotsBucket = []byte("snapshots")
+	resultsBucket   = []byte("results")
+	historyBucket   = []byte("history")
+)
+
+// ErrUnknownSnapshot is returned for a snapshot ID that is not in the database.
+var ErrUnknownSnapshot = errors.New("unknown snapshot")
+
+// Snapshot describes one crawl run.
+type Snapshot struct {
+	ID        uint64    `json:"id"`
+	Chain     string    `json:"chain"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+	Nodes     int       `json:"nodes"`
+	Reachable int       `json:"reachable"`
+}
+
+// Observation is what a snapshot saw of a node.
+type Observation struct {
+	Snapshot    uint64    `json:"snapshot"`
+	Time        time.Time `json:"time"`
+	Success     bool      `json:"success"`
+	Version     int32     `json:"version,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Services    uint64    `json:"services,omitempty"`
+	StartHeight int32     `json:"start_height,omitempty"`
+}
+
+func observationOf(snapshot uint64, r crawler.Result) Observation {
+	o := Observation{Snapshot: snapshot, Time: r.Time, Success: r.Success}
+	if r.Success && r.Version != nil {
+		o.Version = r.Version.Version
+		o.UserAgent = r.Version.UserAgent
+		o.Services = r.Version.Services
+		o.StartHeight = r.Version.StartHeight
+	}
+	return o
+}
+
+// DB is a crawl history database.
+type DB struct {
+	bolt *bolt.DB
+}
+
+// Open opens or creates the database at path.
+func Open(path string) (*DB, error) {
+	b, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{snapshotsBucket, resultsBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return &DB{bolt: b}, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+func snapshotKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// BeginSnapshot starts a new snapshot for a crawl of chain.
+func (db *DB) BeginSnapshot(chain string, started time.Time) (Snapshot, error) {
+	var snapshot Snapshot
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(snapshotsBucket)
+		id, err := snapshots.NextSequence()
+		if err != nil {
+			return err
+		}
+		snapshot = Snapshot{ID: id, Chain: chain, Started: started}
+		if _, err := tx.Bucket(resultsBucket).CreateBucket(snapshotKey(id)); err != nil {
+			return err
+		}
+		return putJSON(snapshots, snapshotKey(id), snapshot)
+	})
+	return snapshot, err
+}
+
+// Record stores the result of a visit in a snapshot. It is safe to call
+// from several goroutines: concurrent calls are batched into one write.
+func (db *DB) Record(id uint64, r crawler.Result) error {
+	return db.bolt.Batch(func(tx *bolt.Tx) error {
+		snapshot, err := getSnapshot(tx, id)
+		if err != nil {
+			return err
+		}
+		results := tx.Bucket(resultsBucket).Bucket(snapshotKey(id))
+		if results.Get([]byte(r.Addr)) == nil {
+			snapshot.Nodes++
+			if r.Success {
+				snapshot.Reachable++
+			}
+		}
+		if err := putJSON(results, []byte(r.Addr), r); err != nil {
+			return err
+		}
+
+		history, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(r.Addr))
+		if err != nil {
+			return err
+		}
+		if err := putJSON(history, snapshotKey(id), observationOf(id, r)); err != nil {
+			return err
+		}
+		return putJSON(tx.Bucket(snapshotsBucket), snapshotKey(id), snapshot)
+	})
+}
+
+// FinishSnapshot marks a snapshot as complete.
+func (db *DB) FinishSnapshot(id uint64, finished time.Time) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		snapshot, err := getSnapshot(tx, id)
+		if err != nil {
+			return err
+		}
+		snapshot.Finished = finished
+		return putJSON(tx.Bucket(snapshotsBucket), snapshotKey(id), snapshot)
+	})
+}
+
+// Snapshot returns the snapshot with the given ID.
+func (db *DB) Snapshot(id uint64) (Snapshot, error) {
+	var snapshot Snapshot
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		var err error
+		snapshot, err = getSnapshot(tx, id)
+		return err
+	})
+	return snapshot, err
+}
+
+// Snapshots returns every snapshot, oldest first.
+func (db *DB) Snapshots() ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).ForEach(func(k, v []byte) error {
+			var s Snapshot
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, s)
+			return nil
+		})
+	})
+	return snapshots, err
+}
+
+// Results returns the results of a snapshot sorted by address.
+func (db *DB) Results(id uint64) ([]crawler.Result, error) {
+	var results []crawler.Result
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(resultsBucket).Bucket(snapshotKey(id))
+		if bucket == nil {
+			return fmt.Errorf("%w: %d", ErrUnknownSnapshot, id)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var r crawler.Result
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			results = append(results, r)
+			return nil
+		})
+	})
+	return results, err
+}
+
+// History returns every observation of addr, oldest first.
+func (db *DB) History(addr string) ([]Observation, error) {
+	var history []Observation
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(addr))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var o Observation
+			if err := json.Unmarshal(v, &o); err != nil {
+				return err
+			}
+			history = append(history, o)
+			return nil
+		})
+	})
+	return history, err
+}
+
+func getSnapshot(tx *bolt.Tx, id uint64) (Snapshot, error) {
+	var snapshot Snapshot
+	data := tx.Bucket(snapshotsBucket).Get(snapshotKey(id))
+	if data == nil {
+		return snapshot, fmt.Errorf("%w: %d", ErrUnknownSnapshot, id)
+	}
+	err := json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// sortedAddrs returns the keys of m in order.
+func sortedAddrs[V any](m map[string]V) []string {
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
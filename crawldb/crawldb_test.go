@@ -0,0 +1,161 @@
+package crawldb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var t0 = time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+
+func openDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "crawl.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func up(addr string, at time.Time, protocol int32, userAgent string) crawler.Result {
+	return crawler.Result{
+		Addr:    addr,
+		Time:    at,
+		Success: true,
+		Version: &version.VersionMessage{Version: protocol, UserAgent: userAgent, Services: 9},
+	}
+}
+
+func down(addr string, at time.Time) crawler.Result {
+	return crawler.Result{Addr: addr, Time: at, Error: "connection refused"}
+}
+
+// crawl records one snapshot with the given results.
+func crawl(t *testing.T, db *DB, at time.Time, results ...crawler.Result) uint64 {
+	t.Helper()
+	snapshot, err := db.BeginSnapshot("signet", at)
+	require.NoError(t, err)
+	for _, r := range results {
+		require.NoError(t, db.Record(snapshot.ID, r))
+	}
+	require.NoError(t, db.FinishSnapshot(snapshot.ID, at.Add(time.Minute)))
+	return snapshot.ID
+}
+
+func TestSnapshots(t *testing.T) {
+	db := openDB(t)
+	first := crawl(t, db, t0, up("1.0.0.1:38333", t0, 70016, "/Satoshi:26.0.0/"), down("1.0.0.2:38333", t0))
+	second := crawl(t, db, t0.Add(time.Hour), up("1.0.0.1:38333", t0.Add(time.Hour), 70016, "/Satoshi:26.0.0/"))
+	assert.Equal(t, uint64(1), first)
+	assert.Equal(t, uint64(2), second)
+
+	snapshots, err := db.Snapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "signet", snapshots[0].Chain)
+	assert.Equal(t, 2, snapshots[0].Nodes)
+	assert.Equal(t, 1, snapshots[0].Reachable)
+	assert.Equal(t, t0.Add(time.Minute), snapshots[0].Finished.UTC())
+
+	results, err := db.Results(first)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "1.0.0.1:38333", results[0].Addr)
+	assert.Equal(t, "/Satoshi:26.0.0/", results[0].Version.UserAgent)
+	assert.Equal(t, "connection refused", results[1].Error)
+
+	_, err = db.Results(42)
+	assert.ErrorIs(t, err, ErrUnknownSnapshot)
+	assert.ErrorIs(t, db.Record(42, down("1.0.0.1:38333", t0)), ErrUnknownSnapshot)
+}
+
+func TestConcurrentRecord(t *testing.T) {
+	db := openDB(t)
+	snapshot, err := db.BeginSnapshot("signet", t0)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addr := fmt.Sprintf("1.0.0.%d:38333", i)
+			assert.NoError(t, db.Record(snapshot.ID, up(addr, t0, 70016, "/Satoshi:27.0.0/")))
+		}(i)
+	}
+	wg.Wait()
+
+	snapshot, err = db.Snapshot(snapshot.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 50, snapshot.Nodes)
+	assert.Equal(t, 50, snapshot.Reachable)
+}
+
+func TestUptimeAndChanges(t *testing.T) {
+	db := openDB(t)
+	addr := "1.0.0.1:38333"
+	crawl(t, db, t0, up(addr, t0, 70015, "/Satoshi:0.20.1/"))
+	crawl(t, db, t0.Add(24*time.Hour), down(addr, t0.Add(24*time.Hour)))
+	crawl(t, db, t0.Add(48*time.Hour), up(addr, t0.Add(48*time.Hour), 70016, "/Satoshi:27.0.0/"))
+	crawl(t, db, t0.Add(72*time.Hour), up(addr, t0.Add(72*time.Hour), 70016, "/Satoshi:27.0.0/"))
+
+	uptime, err := db.Uptime(addr, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, uptime.Observations)
+	assert.Equal(t, 3, uptime.Successes)
+	assert.InDelta(t, 0.75, uptime.Ratio, 1e-9)
+	assert.Equal(t, t0, uptime.FirstSeen.UTC())
+	assert.Equal(t, t0.Add(72*time.Hour), uptime.LastSeen.UTC())
+
+	recent, err := db.Uptime(addr, t0.Add(36*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 2, recent.Observations)
+	assert.InDelta(t, 1.0, recent.Ratio, 1e-9)
+
+	changes, err := db.Changes(addr)
+	require.NoError(t, err)
+	require.Len(t, changes, 1, "the failed visit in between is not a change")
+	assert.Equal(t, uint64(3), changes[0].Snapshot)
+	assert.Equal(t, "/Satoshi:0.20.1/", changes[0].OldUserAgent)
+	assert.Equal(t, "/Satoshi:27.0.0/", changes[0].NewUserAgent)
+	assert.Equal(t, int32(70015), changes[0].OldVersion)
+	assert.Equal(t, int32(70016), changes[0].NewVersion)
+
+	unknown, err := db.Uptime("9.9.9.9:38333", time.Time{})
+	require.NoError(t, err)
+	assert.Zero(t, unknown.Observations)
+}
+
+func TestDiff(t *testing.T) {
+	db := openDB(t)
+	from := crawl(t, db, t0,
+		up("1.0.0.1:38333", t0, 70016, "/Satoshi:26.0.0/"),
+		up("1.0.0.2:38333", t0, 70016, "/Satoshi:26.0.0/"),
+		up("1.0.0.3:38333", t0, 70016, "/Satoshi:26.0.0/"),
+		down("1.0.0.4:38333", t0),
+	)
+	to := crawl(t, db, t0.Add(time.Hour),
+		up("1.0.0.1:38333", t0, 70016, "/Satoshi:26.0.0/"),
+		up("1.0.0.2:38333", t0, 70016, "/Satoshi:27.0.0/"),
+		down("1.0.0.3:38333", t0),
+		up("1.0.0.4:38333", t0, 70016, "/btcwire:0.5.0/btcd:0.24.2/"),
+		up("1.0.0.5:38333", t0, 70016, "/Satoshi:27.0.0/"),
+	)
+
+	diff, err := db.Diff(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0.4:38333", "1.0.0.5:38333"}, diff.Added)
+	assert.Equal(t, []string{"1.0.0.3:38333"}, diff.Removed)
+	require.Len(t, diff.Upgraded, 1)
+	assert.Equal(t, "1.0.0.2:38333", diff.Upgraded[0].Addr)
+	assert.Equal(t, "/Satoshi:27.0.0/", diff.Upgraded[0].NewUserAgent)
+
+	_, err = db.Diff(from, 99)
+	assert.ErrorIs(t, err, ErrUnknownSnapshot)
+}
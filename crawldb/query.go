@@ -0,0 +1,139 @@
+package crawldb
+
+import "time"
+
+// Uptime summarises how often a node answered.
+type Uptime struct {
+	Observations int       `json:"observations"`
+	Successes    int       `json:"successes"`
+	Ratio        float64   `json:"ratio"`
+	FirstSeen    time.Time `json:"first_seen,omitempty"`
+	LastSeen     time.Time `json:"last_seen,omitempty"`
+}
+
+// Change is a node that reported a different user agent or protocol version
+// than the last time it answered.
+type Change struct {
+	Addr         string    `json:"addr"`
+	Snapshot     uint64    `json:"snapshot"`
+	Time         time.Time `json:"time"`
+	OldUserAgent string    `json:"old_user_agent"`
+	NewUserAgent string    `json:"new_user_agent"`
+	OldVersion   int32     `json:"old_version"`
+	NewVersion   int32     `json:"new_version"`
+}
+
+// Diff lists the differences between the reachable nodes of two snapshots.
+type Diff struct {
+	From     uint64   `json:"from"`
+	To       uint64   `json:"to"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Upgraded []Change `json:"upgraded"`
+}
+
+// Uptime returns how often addr answered in the snapshots taken since the
+// given time. A zero since covers the whole history.
+func (db *DB) Uptime(addr string, since time.Time) (Uptime, error) {
+	var uptime Uptime
+	history, err := db.History(addr)
+	if err != nil {
+		return uptime, err
+	}
+	for _, o := range history {
+		if o.Time.Before(since) {
+			continue
+		}
+		uptime.Observations++
+		if o.Success {
+			uptime.Successes++
+			if uptime.FirstSeen.IsZero() {
+				uptime.FirstSeen = o.Time
+			}
+			uptime.LastSeen = o.Time
+		}
+	}
+	if uptime.Observations > 0 {
+		uptime.Ratio = float64(uptime.Successes) / float64(uptime.Observations)
+	}
+	return uptime, nil
+}
+
+// Changes returns when addr changed its user agent or protocol version.
+func (db *DB) Changes(addr string) ([]Change, error) {
+	history, err := db.History(addr)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	var last *Observation
+	for i := range history {
+		o := &history[i]
+		if !o.Success {
+			continue
+		}
+		if last != nil && (last.UserAgent != o.UserAgent || last.Version != o.Version) {
+			changes = append(changes, change(addr, *last, *o))
+		}
+		last = o
+	}
+	return changes, nil
+}
+
+func change(addr string, old, new Observation) Change {
+	return Change{
+		Addr:         addr,
+		Snapshot:     new.Snapshot,
+		Time:         new.Time,
+		OldUserAgent: old.UserAgent,
+		NewUserAgent: new.UserAgent,
+		OldVersion:   old.Version,
+		NewVersion:   new.Version,
+	}
+}
+
+// Diff compares the reachable nodes of two snapshots: the nodes only
+// reachable in to, the ones only reachable in from, and the ones whose user
+// agent or protocol version changed in between.
+func (db *DB) Diff(from, to uint64) (Diff, error) {
+	diff := Diff{From: from, To: to}
+	before, err := db.reachable(from)
+	if err != nil {
+		return diff, err
+	}
+	after, err := db.reachable(to)
+	if err != nil {
+		return diff, err
+	}
+
+	for _, addr := range sortedAddrs(after) {
+		old, ok := before[addr]
+		if !ok {
+			diff.Added = append(diff.Added, addr)
+			continue
+		}
+		if n := after[addr]; old.UserAgent != n.UserAgent || old.Version != n.Version {
+			diff.Upgraded = append(diff.Upgraded, change(addr, old, n))
+		}
+	}
+	for _, addr := range sortedAddrs(before) {
+		if _, ok := after[addr]; !ok {
+			diff.Removed = append(diff.Removed, addr)
+		}
+	}
+	return diff, nil
+}
+
+func (db *DB) reachable(id uint64) (map[string]Observation, error) {
+	results, err := db.Results(id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]Observation, len(results))
+	for _, r := range results {
+		if r.Success {
+			nodes[r.Addr] = observationOf(id, r)
+		}
+	}
+	return nodes, nil
+}
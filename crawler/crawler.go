@@ -0,0 +1,305 @@
+package crawler
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/geoip"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/version"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultConcurrency  = 32
+	defaultTimeout      = 30 * time.Second
+	defaultSaveInterval = 30 * time.Second
+	idleWait            = 100 * time.Millisecond
+)
+
+var (
+	// ErrEmptyQueue is returned when a crawl is started without any address.
+	ErrEmptyQueue = errors.New("crawl queue is empty: provide seed addresses")
+	// ErrInterrupted is returned when ctx is done before the queue is
+	// exhausted. The queue is saved so that the crawl can be resumed.
+	ErrInterrupted = errors.New("crawl interrupted")
+)
+
+// Result is what we learned about a node.
+type Result struct {
+	Addr      string                  `json:"addr"`
+	Network   byte                    `json:"network"`
+	Time      time.Time               `json:"time"`
+	Success   bool                    `json:"success"`
+	Error     string                  `json:"error,omitempty"`
+	Version   *version.VersionMessage `json:"version,omitempty"`
+	Latency   time.Duration           `json:"latency,omitempty"`
+	AddrCount int                     `json:"addr_count"`
+	// Geo is filled in by the caller when GeoIP databases are available.
+	Geo *geoip.Info `json:"geo,omitempty"`
+}
+
+// Config holds the settings of a Crawler.
+type Config struct {
+	// Queue holds the addresses to visit. Addresses learned from nodes are
+	// pushed to it.
+	Queue *Queue
+	// Dialer opens the connections.
+	Dialer network.Dialer
+	// PeerConfig is used for every connection.
+	PeerConfig network.PeerConfig
+	// Concurrency is the number of nodes visited at the same time.
+	Concurrency int
+	// Timeout bounds a whole visit: connecting, the handshake and waiting
+	// for addresses.
+	Timeout time.Duration
+	// Networks lists the BIP155 networks we can reach. Addresses on other
+	// networks are not queued. It defaults to IPv4 and IPv6.
+	Networks []byte
+	// SaveInterval is how often the queue is saved to disk.
+	SaveInterval time.Duration
+	// OnResult is called for every visited node.
+	OnResult func(Result)
+}
+
+// Crawler walks the network: it handshakes with every queued node, asks it
+// for addresses with getaddr and queues the addresses it returns.
+type Crawler struct {
+	cfg Config
+}
+
+// New returns a Crawler for cfg.
+func New(cfg Config) *Crawler {
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if len(cfg.Networks) == 0 {
+		cfg.Networks = []byte{netaddr.NetworkIPv4, netaddr.NetworkIPv6}
+	}
+	if cfg.SaveInterval == 0 {
+		cfg.SaveInterval = defaultSaveInterval
+	}
+	return &Crawler{cfg: cfg}
+}
+
+// Run crawls until the queue is exhausted or ctx is done, in which case it
+// returns ErrInterrupted. The queue is saved periodically and before Run
+// returns.
+func (c *Crawler) Run(ctx context.Context) error {
+	if pending, inFlight := c.cfg.Queue.Len(); pending+inFlight == 0 {
+		return ErrEmptyQueue
+	}
+
+	var wg sync.WaitGroup
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < c.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(workersCtx)
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(c.cfg.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pending, inFlight := c.cfg.Queue.Len()
+			log.Infof("Crawl progress: %d pending, %d in flight", pending, inFlight)
+			if err := c.cfg.Queue.Save(); err != nil {
+				log.Errorf("Failed to save crawl queue: %v", err)
+			}
+		case <-finished:
+			if err := c.cfg.Queue.Save(); err != nil {
+				return err
+			}
+			if pending, inFlight := c.cfg.Queue.Len(); pending+inFlight > 0 {
+				return ErrInterrupted
+			}
+			return nil
+		}
+	}
+}
+
+func (c *Crawler) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		addr, ok := c.cfg.Queue.Pop()
+		if !ok {
+			if _, inFlight := c.cfg.Queue.Len(); inFlight == 0 {
+				return
+			}
+			// Nodes still being visited may add more addresses.
+			select {
+			case <-time.After(idleWait):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		result := c.visit(ctx, addr)
+		if ctx.Err() != nil {
+			// Leave the address in flight so that Save puts it back.
+			return
+		}
+		c.cfg.Queue.Done(addr)
+		if c.cfg.OnResult != nil {
+			c.cfg.OnResult(result)
+		}
+	}
+}
+
+// visit handshakes with the node at addr, measures its ping latency and
+// asks it for addresses.
+func (c *Crawler) visit(ctx context.Context, addr string) Result {
+	result := Result{Addr: addr, Network: networkOf(addr), Time: time.Now()}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	conn, err := c.cfg.Dialer.Dial(ctx, addr)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	addrsReceived := make(chan []netaddr.AddrV2, 8)
+	pongs := make(chan []byte, 1)
+	onAddrs := func(addrs []netaddr.AddrV2) {
+		select {
+		case addrsReceived <- addrs:
+		default:
+		}
+	}
+
+	peer := network.NewPeer(conn, addr, c.cfg.PeerConfig)
+	peer.Handle("addr", func(p *network.Peer, payload []byte) error {
+		addrs, err := netaddr.DecodeAddrMessage(payload)
+		if err == nil {
+			onAddrs(addrs)
+		}
+		return err
+	})
+	peer.Handle("addrv2", func(p *network.Peer, payload []byte) error {
+		addrs, err := netaddr.DecodeAddrV2Message(payload)
+		if err == nil {
+			onAddrs(addrs)
+		}
+		return err
+	})
+	peer.Handle("pong", func(p *network.Peer, payload []byte) error {
+		select {
+		case pongs <- payload:
+		default:
+		}
+		return nil
+	})
+
+	if err := peer.Start(ctx); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer peer.Disconnect()
+
+	versionMsg := peer.Version()
+	result.Version = &versionMsg
+	result.Success = true
+
+	if latency, err := ping(ctx, peer, pongs); err == nil {
+		result.Latency = latency
+	}
+
+	if err := peer.Send(network.Message{Command: "getaddr", Payload: []byte{}}); err != nil {
+		return result
+	}
+
+	// Nodes usually announce themselves in a single-entry addr message
+	// before answering getaddr, so keep waiting until a larger one arrives.
+	for {
+		select {
+		case addrs := <-addrsReceived:
+			result.AddrCount += c.queue(addrs)
+			if len(addrs) > 1 {
+				return result
+			}
+		case <-peer.Done():
+			return result
+		case <-ctx.Done():
+			return result
+		}
+	}
+}
+
+func ping(ctx context.Context, peer *network.Peer, pongs <-chan []byte) (time.Duration, error) {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+
+	start := time.Now()
+	if err := peer.Send(network.Message{Command: "ping", Payload: nonce}); err != nil {
+		return 0, err
+	}
+	for {
+		select {
+		case payload := <-pongs:
+			if string(payload) == string(nonce) {
+				return time.Since(start), nil
+			}
+		case <-peer.Done():
+			return 0, peer.Err()
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// queue pushes the reachable addresses and returns how many were received.
+func (c *Crawler) queue(addrs []netaddr.AddrV2) int {
+	reachable := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if slices.Contains(c.cfg.Networks, a.Network) {
+			reachable = append(reachable, a.String())
+		}
+	}
+	c.cfg.Queue.Push(reachable...)
+	return len(addrs)
+}
+
+// networkOf returns the BIP155 network of a host:port address.
+func networkOf(addr string) byte {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	switch {
+	case strings.HasSuffix(host, ".onion"):
+		return netaddr.NetworkTorV3
+	case strings.HasSuffix(host, ".i2p"):
+		return netaddr.NetworkI2P
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return netaddr.NetworkIPv4
+	default:
+		return netaddr.NetworkIPv6
+	}
+}
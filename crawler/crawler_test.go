@@ -0,0 +1,221 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNetwork serves in-memory nodes that answer getaddr with their
+// neighbours from graph.
+type fakeNetwork struct {
+	graph   map[string][]string
+	useV2   bool
+	mu      sync.Mutex
+	visited map[string]int
+}
+
+func (n *fakeNetwork) Dial(ctx context.Context, addr string) (network.Conn, error) {
+	if _, ok := n.graph[addr]; !ok {
+		return nil, errors.New("connection refused")
+	}
+	return network.PipeDialer{Accept: n.serve}.Dial(ctx, addr)
+}
+
+func (n *fakeNetwork) serve(addr string, conn network.Conn) {
+	n.mu.Lock()
+	n.visited[addr]++
+	n.mu.Unlock()
+
+	peer := network.NewPeer(conn, "crawler", network.PeerConfig{Inbound: true})
+	peer.Handle("getaddr", func(p *network.Peer, payload []byte) error {
+		var addrs []netaddr.AddrV2
+		for _, neighbour := range n.graph[addr] {
+			addrs = append(addrs, neighbourAddr(neighbour))
+		}
+		// Self-announcement first, like Bitcoin Core does.
+		self, _ := netaddr.EncodeAddrMessage([]netaddr.AddrV2{neighbourAddr(addr)})
+		if err := p.Send(network.Message{Command: "addr", Payload: self}); err != nil {
+			return err
+		}
+		if n.useV2 {
+			payload, err := netaddr.EncodeAddrV2Message(addrs)
+			if err != nil {
+				return err
+			}
+			return p.Send(network.Message{Command: "addrv2", Payload: payload})
+		}
+		payload, err := netaddr.EncodeAddrMessage(addrs)
+		if err != nil {
+			return err
+		}
+		return p.Send(network.Message{Command: "addr", Payload: payload})
+	})
+	peer.Start(context.Background())
+}
+
+func neighbourAddr(addr string) netaddr.AddrV2 {
+	if addr == "onion" {
+		a, _ := netaddr.NewTorV3AddrV2("pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd", 8333, 1)
+		return a
+	}
+	return netaddr.NewAddrV2(netaddr.NewNetAddr(addr[:len(addr)-5], 8333, 1), uint32(time.Now().Unix()))
+}
+
+func newFakeNetwork(useV2 bool) *fakeNetwork {
+	return &fakeNetwork{
+		useV2: useV2,
+		graph: map[string][]string{
+			"1.0.0.1:8333": {"2.0.0.1:8333", "3.0.0.1:8333"},
+			"2.0.0.1:8333": {"1.0.0.1:8333", "4.0.0.1:8333", "9.9.9.9:8333"},
+			"3.0.0.1:8333": {"4.0.0.1:8333", "onion"},
+			"4.0.0.1:8333": {"1.0.0.1:8333", "2.0.0.1:8333"},
+		},
+		visited: make(map[string]int),
+	}
+}
+
+func runCrawl(t *testing.T, fn *fakeNetwork, queue *Queue) map[string]Result {
+	t.Helper()
+	var mu sync.Mutex
+	results := make(map[string]Result)
+	c := New(Config{
+		Queue:       queue,
+		Dialer:      fn,
+		Concurrency: 3,
+		Timeout:     time.Second,
+		OnResult: func(r Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			results[r.Addr] = r
+		},
+	})
+	require.NoError(t, c.Run(context.Background()))
+	return results
+}
+
+func TestCrawlerWalksNetwork(t *testing.T) {
+	for _, useV2 := range []bool{false, true} {
+		fn := newFakeNetwork(useV2)
+		queue, err := OpenQueue(filepath.Join(t.TempDir(), "queue.json"))
+		require.NoError(t, err)
+		queue.Push("1.0.0.1:8333")
+
+		results := runCrawl(t, fn, queue)
+
+		addrs := make([]string, 0, len(results))
+		for addr := range results {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		assert.Equal(t, []string{"1.0.0.1:8333", "2.0.0.1:8333", "3.0.0.1:8333", "4.0.0.1:8333", "9.9.9.9:8333"}, addrs,
+			"onion addresses are not reachable by default")
+
+		for addr, visits := range fn.visited {
+			assert.Equal(t, 1, visits, "%s visited more than once", addr)
+		}
+
+		ok := results["2.0.0.1:8333"]
+		assert.True(t, ok.Success)
+		require.NotNil(t, ok.Version)
+		assert.Equal(t, config.UserAgent, ok.Version.UserAgent)
+		assert.Equal(t, int32(config.StartHeight), ok.Version.StartHeight)
+		assert.Positive(t, ok.Latency)
+		assert.Equal(t, 4, ok.AddrCount)
+		assert.Equal(t, byte(netaddr.NetworkIPv4), ok.Network)
+
+		failed := results["9.9.9.9:8333"]
+		assert.False(t, failed.Success)
+		assert.Contains(t, failed.Error, "connection refused")
+	}
+}
+
+func TestCrawlerResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := OpenQueue(path)
+	require.NoError(t, err)
+	queue.Push("1.0.0.1:8333", "2.0.0.1:8333")
+
+	// Simulate an interrupted crawl: 1.0.0.1 was visited, 2.0.0.1 was in
+	// flight and 3.0.0.1 still pending.
+	addr, _ := queue.Pop()
+	queue.Done(addr)
+	queue.Pop()
+	queue.Push("3.0.0.1:8333")
+	require.NoError(t, queue.Save())
+
+	resumed, err := OpenQueue(path)
+	require.NoError(t, err)
+	pending, inFlight := resumed.Len()
+	assert.Equal(t, 2, pending)
+	assert.Equal(t, 0, inFlight)
+
+	fn := newFakeNetwork(false)
+	results := runCrawl(t, fn, resumed)
+	assert.NotContains(t, results, "1.0.0.1:8333", "visited nodes are not crawled again")
+	assert.Contains(t, results, "2.0.0.1:8333")
+	assert.Contains(t, results, "3.0.0.1:8333")
+	assert.Contains(t, results, "4.0.0.1:8333")
+
+	pending, inFlight = resumed.Len()
+	assert.Zero(t, pending+inFlight)
+}
+
+func TestCrawlerStopsOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := OpenQueue(path)
+	require.NoError(t, err)
+	queue.Push("1.0.0.1:8333")
+
+	hang := network.PipeDialer{Accept: func(addr string, conn network.Conn) {}}
+	c := New(Config{Queue: queue, Dialer: hang, Timeout: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Run(ctx), ErrInterrupted)
+
+	resumed, err := OpenQueue(path)
+	require.NoError(t, err)
+	pending, _ := resumed.Len()
+	assert.Equal(t, 1, pending, "the interrupted visit should be retried on resume")
+}
+
+func TestQueueSnapshotAndReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := OpenQueue(path)
+	require.NoError(t, err)
+	queue.Push("1.0.0.1:8333")
+	queue.SetSnapshot(7)
+	require.NoError(t, queue.Save())
+
+	resumed, err := OpenQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), resumed.Snapshot())
+
+	// A finished crawl forgets the addresses it saw, so the next one
+	// visits them again.
+	require.NoError(t, resumed.Reset())
+	assert.NoFileExists(t, path)
+	assert.Zero(t, resumed.Snapshot())
+	assert.Equal(t, 1, resumed.Push("1.0.0.1:8333"))
+	fresh, err := OpenQueue(path)
+	require.NoError(t, err)
+	pending, _ := fresh.Len()
+	assert.Zero(t, pending)
+}
+
+func TestCrawlerEmptyQueue(t *testing.T) {
+	queue, err := OpenQueue(filepath.Join(t.TempDir(), "queue.json"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, New(Config{Queue: queue}).Run(context.Background()), ErrEmptyQueue)
+}
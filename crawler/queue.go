@@ -0,0 +1,169 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Queue holds the addresses still to be crawled. It remembers every address
+// it has seen so each node is visited once, and it can be saved to disk so
+// that an interrupted crawl continues where it stopped.
+type Queue struct {
+	path string
+
+	mu       sync.Mutex
+	pending  []string
+	seen     map[string]bool
+	inFlight map[string]bool
+	// snapshot is the ID of the crawl database snapshot the crawl records
+	// its results in, zero if none was started.
+	snapshot uint64
+}
+
+type queueState struct {
+	Pending  []string `json:"pending"`
+	Seen     []string `json:"seen"`
+	Snapshot uint64   `json:"snapshot,omitempty"`
+}
+
+// OpenQueue loads the queue saved at path, or returns an empty one if the
+// file does not exist yet.
+func OpenQueue(path string) (*Queue, error) {
+	q := &Queue{
+		path:     path,
+		seen:     make(map[string]bool),
+		inFlight: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state queueState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	q.pending = state.Pending
+	q.snapshot = state.Snapshot
+	for _, addr := range state.Seen {
+		q.seen[addr] = true
+	}
+	for _, addr := range state.Pending {
+		q.seen[addr] = true
+	}
+	return q, nil
+}
+
+// Push queues the addresses that were never seen before and returns how
+// many were added.
+func (q *Queue) Push(addrs ...string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := 0
+	for _, addr := range addrs {
+		if q.seen[addr] {
+			continue
+		}
+		q.seen[addr] = true
+		q.pending = append(q.pending, addr)
+		added++
+	}
+	return added
+}
+
+// Pop takes the next address off the queue. It stays in flight until Done
+// is called.
+func (q *Queue) Pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	addr := q.pending[0]
+	q.pending = q.pending[1:]
+	q.inFlight[addr] = true
+	return addr, true
+}
+
+// Done marks addr as crawled.
+func (q *Queue) Done(addr string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inFlight, addr)
+}
+
+// Len returns the number of pending and in-flight addresses.
+func (q *Queue) Len() (pending, inFlight int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), len(q.inFlight)
+}
+
+// Snapshot returns the snapshot the crawl records its results in, zero if
+// none was set.
+func (q *Queue) Snapshot() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.snapshot
+}
+
+// SetSnapshot records the snapshot the crawl records its results in, so
+// that a resumed crawl keeps adding to it.
+func (q *Queue) SetSnapshot(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.snapshot = id
+}
+
+// Reset forgets every address and the snapshot and deletes the saved queue,
+// once a crawl is complete, so that the next crawl starts afresh.
+func (q *Queue) Reset() error {
+	q.mu.Lock()
+	q.pending = nil
+	q.seen = make(map[string]bool)
+	q.inFlight = make(map[string]bool)
+	q.snapshot = 0
+	q.mu.Unlock()
+
+	if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Save writes the queue to disk. Addresses in flight are saved as pending
+// so they are crawled again after a restart.
+func (q *Queue) Save() error {
+	q.mu.Lock()
+	state := queueState{
+		Pending:  make([]string, 0, len(q.inFlight)+len(q.pending)),
+		Seen:     make([]string, 0, len(q.seen)),
+		Snapshot: q.snapshot,
+	}
+	for addr := range q.inFlight {
+		state.Pending = append(state.Pending, addr)
+	}
+	state.Pending = append(state.Pending, q.pending...)
+	for addr := range q.seen {
+		state.Seen = append(state.Seen, addr)
+	}
+	q.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
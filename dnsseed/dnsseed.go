@@ -0,0 +1,119 @@
+package dnsseed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Resolver queries the DNS seeds of a chain for peer addresses.
+type Resolver struct {
+	// Server is the host:port of the DNS server to ask. When empty the
+	// system resolver is used.
+	Server string
+	// Timeout bounds the lookup of a single seed. It defaults to 10s.
+	Timeout time.Duration
+}
+
+// SeedHost returns the name to look up on seed for nodes offering
+// services. Seeds answer x<hex services>.<seed> with only the nodes that
+// signal those service bits.
+func SeedHost(seed string, services uint64) string {
+	if services == 0 {
+		return seed
+	}
+	return fmt.Sprintf("x%x.%s", services, seed)
+}
+
+// Lookup queries every DNS seed of params in parallel and returns the
+// addresses found, on the chain's default port. Seeds that fail are logged
+// and skipped; an error is only returned when none of them answered.
+func (r *Resolver) Lookup(ctx context.Context, params *config.ChainParams, services uint64) ([]netaddr.NetAddr, error) {
+	if len(params.DNSSeeds) == 0 {
+		return nil, fmt.Errorf("%s has no DNS seeds", params.Name)
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		addrs    []netaddr.NetAddr
+		lastErr  error
+		answered int
+	)
+	for _, seed := range params.DNSSeeds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			host := SeedHost(seed, services)
+			ips, err := r.lookupHost(ctx, host)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Warnf("DNS seed %s failed: %v", host, err)
+				lastErr = err
+				return
+			}
+			answered++
+			log.Debugf("DNS seed %s returned %d addresses", host, len(ips))
+			for _, ip := range ips {
+				addrs = append(addrs, netaddr.NewNetAddr(ip.String(), params.DefaultPort, services))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if answered == 0 {
+		return nil, fmt.Errorf("no DNS seed answered: %w", lastErr)
+	}
+	return addrs, nil
+}
+
+// Seed looks up the DNS seeds of params and adds the results to addrs. It
+// returns how many new addresses were added.
+func (r *Resolver) Seed(ctx context.Context, addrs *addrmgr.AddrManager, params *config.ChainParams, services uint64) (int, error) {
+	found, err := r.Lookup(ctx, params, services)
+	if err != nil {
+		return 0, err
+	}
+	return addrs.Add(found...), nil
+}
+
+func (r *Resolver) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resolver := net.DefaultResolver
+	if r.Server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, r.Server)
+			},
+		}
+	}
+
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(ipAddrs))
+	for i, ipAddr := range ipAddrs {
+		ips[i] = ipAddr.IP
+	}
+	return ips, nil
+}
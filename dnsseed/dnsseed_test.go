@@ -0,0 +1,133 @@
+package dnsseed
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startStubDNS answers A and AAAA queries from records, keyed by the
+// lower-case name without the trailing dot. Unknown names get NXDOMAIN.
+func startStubDNS(t *testing.T, records map[string][]string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			answer := stubAnswer(query, records)
+			reply, err := answer.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(reply, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func stubAnswer(query dnsmessage.Message, records map[string][]string) dnsmessage.Message {
+	q := query.Questions[0]
+	reply := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+	ips, ok := records[strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")]
+	if !ok {
+		reply.RCode = dnsmessage.RCodeNameError
+		return reply
+	}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			header.Type = dnsmessage.TypeA
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			header.Type = dnsmessage.TypeAAAA
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	}
+	return reply
+}
+
+var testParams = config.ChainParams{
+	Name:        "test",
+	DefaultPort: 38333,
+	DNSSeeds:    []string{"seed.example.org", "seed.example.net", "dead.example.com"},
+}
+
+func addrStrings(t *testing.T, r *Resolver, services uint64) []string {
+	t.Helper()
+	addrs, err := r.Lookup(context.Background(), &testParams, services)
+	require.NoError(t, err)
+	var out []string
+	for _, a := range addrs {
+		out = append(out, a.String())
+		assert.Equal(t, services, a.Services)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestSeedHost(t *testing.T) {
+	assert.Equal(t, "seed.bitcoin.sipa.be", SeedHost("seed.bitcoin.sipa.be", 0))
+	assert.Equal(t, "x9.seed.bitcoin.sipa.be", SeedHost("seed.bitcoin.sipa.be", 9))
+	assert.Equal(t, "x409.seed.bitcoin.sipa.be", SeedHost("seed.bitcoin.sipa.be", 0x409))
+}
+
+func TestLookup(t *testing.T) {
+	server := startStubDNS(t, map[string][]string{
+		"seed.example.org":    {"1.2.3.4", "2001:db8::1"},
+		"seed.example.net":    {"5.6.7.8"},
+		"x9.seed.example.org": {"1.2.3.4"},
+		"x9.seed.example.net": {"9.9.9.9"},
+	})
+	r := &Resolver{Server: server, Timeout: time.Second}
+
+	assert.Equal(t, []string{"1.2.3.4:38333", "5.6.7.8:38333", "[2001:db8::1]:38333"}, addrStrings(t, r, 0))
+	assert.Equal(t, []string{"1.2.3.4:38333", "9.9.9.9:38333"}, addrStrings(t, r, 9))
+}
+
+func TestLookupAllSeedsFail(t *testing.T) {
+	server := startStubDNS(t, map[string][]string{})
+	r := &Resolver{Server: server, Timeout: time.Second}
+	_, err := r.Lookup(context.Background(), &testParams, 0)
+	assert.Error(t, err)
+
+	_, err = r.Lookup(context.Background(), &config.RegTestParams, 0)
+	assert.ErrorContains(t, err, "no DNS seeds")
+}
+
+func TestSeedFeedsAddrManager(t *testing.T) {
+	server := startStubDNS(t, map[string][]string{
+		"x9.seed.example.org": {"1.2.3.4", "1.2.3.5"},
+		"x9.seed.example.net": {"1.2.3.4"},
+	})
+	r := &Resolver{Server: server, Timeout: time.Second}
+
+	addrs := addrmgr.New()
+	added, err := r.Seed(context.Background(), addrs, &testParams, 9)
+	require.NoError(t, err)
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 2, addrs.Len())
+}
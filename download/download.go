@@ -0,0 +1,343 @@
+// Package download fetches the blocks of the active header chain from
+// several peers in parallel and hands them to a consumer in height order.
+package download
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults from Bitcoin Core's net_processing.
+const (
+	DefaultWindow             = 1024
+	DefaultMaxInFlightPerPeer = 16
+	DefaultTimeout            = 30 * time.Second
+
+	// scheduleInterval is how often timeouts are checked when nothing else
+	// wakes the scheduler.
+	scheduleInterval = 100 * time.Millisecond
+)
+
+// Config configures a Scheduler.
+type Config struct {
+	// Chain provides the headers of the blocks to download.
+	Chain *chain.Chain
+	// StartHeight is the height of the first block to deliver.
+	StartHeight int32
+	// Window bounds how far past the next block to deliver blocks are
+	// requested, so that one slow peer cannot make us buffer the whole
+	// chain. It defaults to DefaultWindow.
+	Window int32
+	// MaxInFlightPerPeer caps the blocks requested from one peer and not
+	// received yet. It defaults to DefaultMaxInFlightPerPeer.
+	MaxInFlightPerPeer int
+	// Timeout is how long a peer has to deliver a requested block before it
+	// is disconnected and the block requested elsewhere. It defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+	// Deliver is called with every block of the active chain, in height
+	// order, from the goroutine running Run. After a reorg the blocks of
+	// the new branch are delivered from the fork point. An error stops Run.
+	Deliver func(node *chain.Node, b *block.Block) error
+}
+
+type request struct {
+	peer *network.Peer
+	sent time.Time
+}
+
+type peerState struct {
+	inFlight int
+	// missing holds the blocks the peer told us it does not have.
+	missing map[utils.Hash]bool
+}
+
+// Scheduler downloads blocks headers-first: the header chain decides which
+// blocks we want and the scheduler spreads getdata requests for them over
+// the connected peers.
+type Scheduler struct {
+	cfg Config
+
+	mu       sync.Mutex
+	next     int32
+	peers    map[*network.Peer]*peerState
+	inFlight map[utils.Hash]*request
+	received map[utils.Hash]*block.Block
+
+	wake chan struct{}
+}
+
+// New returns a scheduler for cfg. It subscribes to the chain's events to
+// follow new headers and reorgs.
+func New(cfg Config) *Scheduler {
+	if cfg.Window == 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.MaxInFlightPerPeer == 0 {
+		cfg.MaxInFlightPerPeer = DefaultMaxInFlightPerPeer
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	s := &Scheduler{
+		cfg:      cfg,
+		next:     cfg.StartHeight,
+		peers:    make(map[*network.Peer]*peerState),
+		inFlight: make(map[utils.Hash]*request),
+		received: make(map[utils.Hash]*block.Block),
+		wake:     make(chan struct{}, 1),
+	}
+	cfg.Chain.Subscribe(s.handleChainEvent)
+	return s
+}
+
+// Next returns the height of the next block to deliver.
+func (s *Scheduler) Next() int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// SetupPeer registers the scheduler's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (s *Scheduler) SetupPeer(p *network.Peer) {
+	p.OnBlock(s.handleBlock)
+	p.OnNotFound(s.handleNotFound)
+}
+
+// AddPeer makes p available for block requests once its handshake has
+// completed. Peers that do not serve the full chain are ignored.
+func (s *Scheduler) AddPeer(p *network.Peer) {
+	if p.Version().Services&config.NodeNetwork == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.peers[p] = &peerState{missing: make(map[utils.Hash]bool)}
+	s.mu.Unlock()
+	s.notify()
+
+	go func() {
+		<-p.Done()
+		s.removePeer(p)
+	}()
+}
+
+func (s *Scheduler) removePeer(p *network.Peer) {
+	s.mu.Lock()
+	delete(s.peers, p)
+	for hash, req := range s.inFlight {
+		if req.peer == p {
+			delete(s.inFlight, hash)
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run schedules requests and delivers blocks until ctx is done or Deliver
+// fails.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.deliver(); err != nil {
+			return err
+		}
+		s.schedule(time.Now())
+
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// deliver passes the received blocks that continue the delivered chain to
+// the consumer.
+func (s *Scheduler) deliver() error {
+	for {
+		s.mu.Lock()
+		node := s.cfg.Chain.NodeAtHeight(s.next)
+		var b *block.Block
+		if node != nil {
+			b = s.received[node.Hash]
+		}
+		if b == nil {
+			s.mu.Unlock()
+			return nil
+		}
+		delete(s.received, node.Hash)
+		s.next++
+		s.mu.Unlock()
+
+		if err := s.cfg.Deliver(node, b); err != nil {
+			return fmt.Errorf("delivering block %s at height %d: %w", node.Hash, node.Height, err)
+		}
+	}
+}
+
+// schedule disconnects peers that let a request time out and requests the
+// blocks of the window that are neither received nor in flight.
+func (s *Scheduler) schedule(now time.Time) {
+	s.mu.Lock()
+	var stalled []*network.Peer
+	for hash, req := range s.inFlight {
+		if now.Sub(req.sent) > s.cfg.Timeout {
+			delete(s.inFlight, hash)
+			if st, ok := s.peers[req.peer]; ok {
+				st.inFlight--
+				delete(s.peers, req.peer)
+				stalled = append(stalled, req.peer)
+			}
+		}
+	}
+
+	batches := make(map[*network.Peer][]inv.InvVect)
+	end := s.next + s.cfg.Window
+	for height := s.next; height < end; height++ {
+		node := s.cfg.Chain.NodeAtHeight(height)
+		if node == nil {
+			break
+		}
+		if s.received[node.Hash] != nil || s.inFlight[node.Hash] != nil {
+			continue
+		}
+		p := s.pickPeer(node.Hash)
+		if p == nil {
+			continue
+		}
+		s.inFlight[node.Hash] = &request{peer: p, sent: now}
+		s.peers[p].inFlight++
+		batches[p] = append(batches[p], inv.InvVect{Type: blockInvType(p), Hash: node.Hash})
+	}
+	s.mu.Unlock()
+
+	for _, p := range stalled {
+		log.Warnf("Peer %s stalled block download, disconnecting", p.Addr())
+		p.Disconnect()
+	}
+	for p, vects := range batches {
+		if err := p.GetData(vects...); err != nil {
+			log.Debugf("Failed to request blocks from %s: %v", p.Addr(), err)
+		}
+	}
+}
+
+// pickPeer returns the peer with the fewest blocks in flight that has room
+// for one more and has not told us it lacks hash.
+func (s *Scheduler) pickPeer(hash utils.Hash) *network.Peer {
+	var best *network.Peer
+	for p, st := range s.peers {
+		if st.inFlight >= s.cfg.MaxInFlightPerPeer || st.missing[hash] {
+			continue
+		}
+		if best == nil || st.inFlight < s.peers[best].inFlight {
+			best = p
+		}
+	}
+	return best
+}
+
+// blockInvType requests witness blocks from peers that have them.
+func blockInvType(p *network.Peer) inv.InvType {
+	if p.Version().Services&config.NodeWitness != 0 {
+		return inv.InvTypeWitnessBlock
+	}
+	return inv.InvTypeBlock
+}
+
+func (s *Scheduler) handleBlock(p *network.Peer, b *block.Block) error {
+	hash := b.Hash()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Blocks are accepted from any peer as long as we still want them,
+	// including late answers to requests that timed out.
+	if !s.settle(hash) {
+		return nil
+	}
+	if err := b.CheckMerkleRoot(); err != nil {
+		return fmt.Errorf("block %s: %w", hash, err)
+	}
+	if err := b.CheckWitnessCommitment(); err != nil {
+		return fmt.Errorf("block %s: %w", hash, err)
+	}
+	s.received[hash] = b
+	s.notify()
+	return nil
+}
+
+// Add hands the scheduler a block obtained elsewhere, such as one rebuilt
+// from a compact block, so that it is delivered in order without being
+// downloaded again. Its merkle root and witness commitment must have been
+// checked. Blocks we do not want are ignored.
+func (s *Scheduler) Add(b *block.Block) {
+	hash := b.Hash()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.settle(hash) {
+		s.received[hash] = b
+		s.notify()
+	}
+}
+
+// settle clears the request for the block with the given hash and reports
+// whether it is still to be delivered. s.mu must be held.
+func (s *Scheduler) settle(hash utils.Hash) bool {
+	if req, ok := s.inFlight[hash]; ok {
+		delete(s.inFlight, hash)
+		if st, ok := s.peers[req.peer]; ok {
+			st.inFlight--
+		}
+	}
+	node := s.cfg.Chain.Lookup(hash)
+	return node != nil && node.Height >= s.next && s.cfg.Chain.Contains(node)
+}
+
+func (s *Scheduler) handleNotFound(p *network.Peer, vects []inv.InvVect) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range vects {
+		req, ok := s.inFlight[v.Hash]
+		if !v.Type.IsBlock() || !ok || req.peer != p {
+			continue
+		}
+		delete(s.inFlight, v.Hash)
+		if st, ok := s.peers[p]; ok {
+			st.inFlight--
+			st.missing[v.Hash] = true
+		}
+	}
+	s.notify()
+	return nil
+}
+
+// handleChainEvent rewinds delivery to the fork point when a reorg
+// disconnects blocks that were already delivered.
+func (s *Scheduler) handleChainEvent(e chain.Event) {
+	s.mu.Lock()
+	if e.Type == chain.BlockDisconnected && e.Node.Height < s.next {
+		s.next = e.Node.Height
+	}
+	s.mu.Unlock()
+	s.notify()
+}
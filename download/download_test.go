@@ -0,0 +1,321 @@
+package download
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mineBlocks returns n regtest blocks on top of parent, each holding a
+// coinbase transaction that makes it unique to tag.
+func mineBlocks(parent block.Header, height int32, n int, tag string) []*block.Block {
+	blocks := make([]*block.Block, n)
+	for i := range blocks {
+		height++
+		script := binary.LittleEndian.AppendUint32(nil, uint32(height))
+		coinbase := &transaction.Tx{
+			Version: 1,
+			TxIn: []transaction.TxIn{{
+				PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff},
+				SignatureScript:  append(script, tag...),
+				Sequence:         0xffffffff,
+			}},
+			TxOut: []transaction.TxOut{{Value: 50e8, PkScript: []byte{0x51}}},
+		}
+		b := &block.Block{
+			Header: block.Header{
+				Version:   4,
+				PrevBlock: parent.Hash(),
+				Timestamp: parent.Timestamp + chain.TargetSpacing,
+				Bits:      parent.Bits,
+			},
+			Transactions: []*transaction.Tx{coinbase},
+		}
+		b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+		for !b.Header.CheckProofOfWork() {
+			b.Header.Nonce++
+		}
+		blocks[i] = b
+		parent = b.Header
+	}
+	return blocks
+}
+
+func headersOf(blocks []*block.Block) []block.Header {
+	headers := make([]block.Header, len(blocks))
+	for i, b := range blocks {
+		headers[i] = b.Header
+	}
+	return headers
+}
+
+// blockServer answers getdata from a set of blocks, like a full node would.
+// A stalling server records the requests and never answers.
+type blockServer struct {
+	mu       sync.Mutex
+	blocks   map[utils.Hash]*block.Block
+	stall    bool
+	pending  int
+	maxQueue int
+	requests int
+	queue    chan *block.Block
+}
+
+func newBlockServer(blocks ...[]*block.Block) *blockServer {
+	s := &blockServer{blocks: make(map[utils.Hash]*block.Block), queue: make(chan *block.Block, 1024)}
+	for _, list := range blocks {
+		for _, b := range list {
+			s.blocks[b.Hash()] = b
+		}
+	}
+	return s
+}
+
+func (s *blockServer) handleGetData(p *network.Peer, vects []inv.InvVect) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests += len(vects)
+	if s.stall {
+		return nil
+	}
+	var missing []inv.InvVect
+	for _, v := range vects {
+		b, ok := s.blocks[v.Hash]
+		if !ok {
+			missing = append(missing, v)
+			continue
+		}
+		s.pending++
+		s.maxQueue = max(s.maxQueue, s.pending)
+		s.queue <- b
+	}
+	if len(missing) > 0 {
+		return p.SendNotFound(missing...)
+	}
+	return nil
+}
+
+// serve sends the requested blocks one at a time, so that requests pile up
+// and the in-flight cap is exercised.
+func (s *blockServer) serve(p *network.Peer) {
+	for {
+		select {
+		case b := <-s.queue:
+			time.Sleep(time.Millisecond)
+			s.mu.Lock()
+			s.pending--
+			s.mu.Unlock()
+			if p.SendBlock(b) != nil {
+				return
+			}
+		case <-p.Done():
+			return
+		}
+	}
+}
+
+func connect(t *testing.T, s *Scheduler, server *blockServer) *network.Peer {
+	t.Helper()
+	a, b := net.Pipe()
+	local := network.NewPeer(a, "remote", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	remote := network.NewPeer(b, "local", network.PeerConfig{Magic: config.RegTestParams.Magic})
+	s.SetupPeer(local)
+	remote.OnGetData(server.handleGetData)
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	go server.serve(remote)
+	s.AddPeer(local)
+	t.Cleanup(local.Disconnect)
+	return local
+}
+
+// collector records the delivered blocks.
+type collector struct {
+	mu     sync.Mutex
+	nodes  []*chain.Node
+	blocks []*block.Block
+}
+
+func (c *collector) deliver(node *chain.Node, b *block.Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nodes = append(c.nodes, node)
+	c.blocks = append(c.blocks, b)
+	return nil
+}
+
+func (c *collector) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.blocks)
+}
+
+func (c *collector) delivered() ([]*chain.Node, []*block.Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*chain.Node(nil), c.nodes...), append([]*block.Block(nil), c.blocks...)
+}
+
+func setup(t *testing.T, n int, cfg Config) (*chain.Chain, []*block.Block, *Scheduler, *collector) {
+	t.Helper()
+	c, err := chain.New(&config.RegTestParams)
+	require.NoError(t, err)
+	blocks := mineBlocks(c.Genesis().Header, 0, n, "main")
+	_, err = c.AddHeaders(headersOf(blocks))
+	require.NoError(t, err)
+
+	got := &collector{}
+	cfg.Chain = c
+	cfg.StartHeight = 1
+	cfg.Deliver = got.deliver
+	s := New(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+	return c, blocks, s, got
+}
+
+func TestDownloadInOrder(t *testing.T) {
+	_, blocks, s, got := setup(t, 300, Config{Window: 64, MaxInFlightPerPeer: 8})
+	servers := []*blockServer{newBlockServer(blocks), newBlockServer(blocks), newBlockServer(blocks)}
+	for _, server := range servers {
+		connect(t, s, server)
+	}
+
+	require.Eventually(t, func() bool { return got.count() == len(blocks) }, 10*time.Second, 10*time.Millisecond)
+	nodes, delivered := got.delivered()
+	for i, b := range delivered {
+		assert.Equal(t, int32(i+1), nodes[i].Height)
+		assert.Equal(t, blocks[i].Hash(), b.Hash())
+	}
+	assert.Equal(t, int32(len(blocks)+1), s.Next())
+
+	for _, server := range servers {
+		server.mu.Lock()
+		assert.Positive(t, server.requests, "every peer takes a share")
+		assert.LessOrEqual(t, server.maxQueue, 8)
+		server.mu.Unlock()
+	}
+}
+
+func TestDownloadReRequestsFromStalledPeer(t *testing.T) {
+	_, blocks, s, got := setup(t, 50, Config{MaxInFlightPerPeer: 4, Timeout: 200 * time.Millisecond})
+	stalling := newBlockServer(blocks)
+	stalling.stall = true
+	staller := connect(t, s, stalling)
+	connect(t, s, newBlockServer(blocks))
+
+	require.Eventually(t, func() bool { return got.count() == len(blocks) }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-staller.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalling peer was not disconnected")
+	}
+	stalling.mu.Lock()
+	defer stalling.mu.Unlock()
+	assert.Equal(t, 4, stalling.requests)
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	_, blocks, s, got := setup(t, 40, Config{})
+	partial := newBlockServer(blocks[:20])
+	p := connect(t, s, partial)
+	require.Eventually(t, func() bool { return got.count() == 20 }, 5*time.Second, 10*time.Millisecond)
+
+	// The rest comes from a peer that has it.
+	connect(t, s, newBlockServer(blocks))
+	require.Eventually(t, func() bool { return got.count() == len(blocks) }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, p.Err(), "notfound is not misbehavior")
+}
+
+func TestDownloadFollowsReorg(t *testing.T) {
+	c, blocks, s, got := setup(t, 10, Config{})
+	fork := mineBlocks(blocks[4].Header, 5, 8, "fork")
+	connect(t, s, newBlockServer(blocks, fork))
+	require.Eventually(t, func() bool { return got.count() == len(blocks) }, 5*time.Second, 10*time.Millisecond)
+
+	// The fork has more work; its blocks are delivered from the fork point.
+	_, err := c.AddHeaders(headersOf(fork))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return got.count() == len(blocks)+len(fork) }, 5*time.Second, 10*time.Millisecond)
+	nodes, delivered := got.delivered()
+	for i, b := range delivered[len(blocks):] {
+		assert.Equal(t, int32(6+i), nodes[len(blocks)+i].Height)
+		assert.Equal(t, fork[i].Hash(), b.Hash())
+	}
+}
+
+func TestDownloadDisconnectsOnBadMerkleRoot(t *testing.T) {
+	_, blocks, s, got := setup(t, 5, Config{})
+	bad := *blocks[2]
+	bad.Transactions = []*transaction.Tx{{Version: 2}}
+	corrupt := newBlockServer(blocks)
+	corrupt.blocks[bad.Hash()] = &bad
+	p := connect(t, s, corrupt)
+
+	select {
+	case <-p.Done():
+		assert.ErrorIs(t, p.Err(), block.ErrBadMerkleRoot)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer sending a corrupt block was not disconnected")
+	}
+	assert.LessOrEqual(t, got.count(), 2)
+}
+
+func TestDownloadDisconnectsOnBadWitness(t *testing.T) {
+	_, blocks, s, got := setup(t, 5, Config{})
+	// A witness the coinbase does not commit to leaves the merkle root
+	// valid.
+	coinbase := *blocks[2].Transactions[0]
+	coinbase.TxIn = []transaction.TxIn{coinbase.TxIn[0]}
+	coinbase.TxIn[0].Witness = [][]byte{{1}}
+	bad := *blocks[2]
+	bad.Transactions = []*transaction.Tx{&coinbase}
+	corrupt := newBlockServer(blocks)
+	corrupt.blocks[bad.Hash()] = &bad
+	p := connect(t, s, corrupt)
+
+	select {
+	case <-p.Done():
+		assert.ErrorIs(t, p.Err(), block.ErrBadWitnessCommitment)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer sending an altered witness was not disconnected")
+	}
+	assert.LessOrEqual(t, got.count(), 2)
+}
+
+func TestDownloadAdd(t *testing.T) {
+	c, blocks, s, got := setup(t, 3, Config{})
+	// Blocks rebuilt elsewhere are delivered in order without a peer.
+	for i := len(blocks) - 1; i >= 0; i-- {
+		s.Add(blocks[i])
+	}
+	s.Add(mineBlocks(c.Genesis().Header, 0, 1, "stale")[0])
+	require.Eventually(t, func() bool { return got.count() == len(blocks) }, time.Second, 10*time.Millisecond)
+	_, delivered := got.delivered()
+	for i, b := range delivered {
+		assert.Equal(t, blocks[i].Hash(), b.Hash())
+	}
+}
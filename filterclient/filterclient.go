@@ -0,0 +1,387 @@
+// Package filterclient fetches compact block filters (BIP157) from peers
+// that advertise NODE_COMPACT_FILTERS. The filter headers are checked
+// across several peers before any filter is downloaded, and every filter is
+// checked against its header before it is matched against the watched
+// scripts.
+package filterclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMinPeers is the default Config.MinPeers.
+	DefaultMinPeers = 2
+
+	// requestTimeout bounds the wait for the answer to a request.
+	requestTimeout = 30 * time.Second
+)
+
+var (
+	// ErrNotEnoughPeers is returned when fewer than Config.MinPeers peers
+	// serving filters are connected.
+	ErrNotEnoughPeers = errors.New("not enough compact filter peers")
+	// ErrHeaderMismatch is returned when peers disagree on the filter
+	// headers, or a peer sends headers that do not connect.
+	ErrHeaderMismatch = errors.New("filter headers differ between peers")
+	// ErrBadFilter is returned for a filter that does not hash to its
+	// filter header.
+	ErrBadFilter = errors.New("filter does not match its header")
+	// ErrNotSynced is returned by Scan before the filter headers are
+	// synced.
+	ErrNotSynced = errors.New("filter headers are not synced")
+)
+
+// Config configures a Client.
+type Config struct {
+	// Chain is the header chain whose blocks' filters are fetched.
+	Chain *chain.Chain
+	// MinPeers is the number of peers whose filter headers must agree. It
+	// defaults to DefaultMinPeers.
+	MinPeers int
+}
+
+// Match is a block whose filter matches a watched script. Filters have
+// false positives: the block itself tells whether it pays to the script.
+type Match struct {
+	Height int32
+	Hash   utils.Hash
+}
+
+// Client downloads and checks the basic filters of a header chain.
+type Client struct {
+	cfg Config
+
+	mu    sync.Mutex
+	peers []*network.Peer
+	// requests holds the outstanding request of every peer.
+	requests map[*network.Peer]*request
+	// headers holds the checked filter headers of the chain ending at tip,
+	// by height.
+	headers []utils.Hash
+	tip     *chain.Node
+}
+
+// request collects the answer to a request.
+type request struct {
+	msgs chan any
+	// done is closed once the requester stops waiting.
+	done chan struct{}
+}
+
+// New returns a client fetching the filters of cfg.Chain.
+func New(cfg Config) *Client {
+	if cfg.MinPeers == 0 {
+		cfg.MinPeers = DefaultMinPeers
+	}
+	return &Client{cfg: cfg, requests: make(map[*network.Peer]*request)}
+}
+
+// SetupPeer registers the client's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (c *Client) SetupPeer(p *network.Peer) {
+	p.OnCFilter(func(p *network.Peer, f *cfilter.CFilter) error {
+		c.deliver(p, f)
+		return nil
+	})
+	p.OnCFHeaders(func(p *network.Peer, h *cfilter.CFHeaders) error {
+		c.deliver(p, h)
+		return nil
+	})
+	p.OnCFCheckpt(func(p *network.Peer, cp *cfilter.CFCheckpt) error {
+		c.deliver(p, cp)
+		return nil
+	})
+}
+
+// AddPeer makes p available for requests once its handshake has completed.
+// Peers that do not serve filters are ignored. It fits
+// connmgr.Config.PeerConnected.
+func (c *Client) AddPeer(p *network.Peer) {
+	if !p.ServesCompactFilters() {
+		return
+	}
+	c.mu.Lock()
+	c.peers = append(c.peers, p)
+	c.mu.Unlock()
+
+	go func() {
+		<-p.Done()
+		c.mu.Lock()
+		c.peers = slices.DeleteFunc(c.peers, func(other *network.Peer) bool { return other == p })
+		c.mu.Unlock()
+	}()
+}
+
+// Peers returns the connected peers serving filters, in connection order.
+func (c *Client) Peers() []*network.Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.peers)
+}
+
+// deliver passes msg to the outstanding request of p. Unsolicited messages
+// are dropped.
+func (c *Client) deliver(p *network.Peer, msg any) {
+	c.mu.Lock()
+	req := c.requests[p]
+	c.mu.Unlock()
+	if req == nil {
+		return
+	}
+	select {
+	case req.msgs <- msg:
+	case <-req.done:
+	}
+}
+
+// do sends a request to p with send and passes the messages p sends to
+// collect until it reports the answer complete. Peers serve one request
+// at a time.
+func (c *Client) do(ctx context.Context, p *network.Peer, send func() error, collect func(msg any) (bool, error)) error {
+	req := &request{msgs: make(chan any), done: make(chan struct{})}
+	c.mu.Lock()
+	if c.requests[p] != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("request to %s already in progress", p.Addr())
+	}
+	c.requests[p] = req
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.requests, p)
+		c.mu.Unlock()
+		close(req.done)
+	}()
+
+	if err := send(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	for {
+		select {
+		case msg := <-req.msgs:
+			complete, err := collect(msg)
+			if err != nil || complete {
+				return err
+			}
+		case <-p.Done():
+			return p.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// GetCheckpoints asks p for the filter headers at every
+// cfilter.CheckpointInterval heights up to stop.
+func (c *Client) GetCheckpoints(ctx context.Context, p *network.Peer, stop *chain.Node) ([]utils.Hash, error) {
+	var checkpoints []utils.Hash
+	err := c.do(ctx, p,
+		func() error {
+			return p.GetCFCheckpt(cfilter.CheckptRequest{FilterType: cfilter.BasicFilterType, StopHash: stop.Hash})
+		},
+		func(msg any) (bool, error) {
+			cp, ok := msg.(*cfilter.CFCheckpt)
+			if !ok || cp.FilterType != cfilter.BasicFilterType || cp.StopHash != stop.Hash {
+				return false, nil
+			}
+			if want := int(stop.Height) / cfilter.CheckpointInterval; len(cp.Headers) != want {
+				return false, fmt.Errorf("%s sent %d checkpoints instead of %d", p.Addr(), len(cp.Headers), want)
+			}
+			checkpoints = cp.Headers
+			return true, nil
+		})
+	return checkpoints, err
+}
+
+// GetFilterHeaders asks p for the filter hashes of the blocks from height
+// start up to stop.
+func (c *Client) GetFilterHeaders(ctx context.Context, p *network.Peer, start int32, stop *chain.Node) (*cfilter.CFHeaders, error) {
+	var headers *cfilter.CFHeaders
+	err := c.do(ctx, p,
+		func() error {
+			return p.GetCFHeaders(cfilter.Request{FilterType: cfilter.BasicFilterType, StartHeight: uint32(start), StopHash: stop.Hash})
+		},
+		func(msg any) (bool, error) {
+			h, ok := msg.(*cfilter.CFHeaders)
+			if !ok || h.FilterType != cfilter.BasicFilterType || h.StopHash != stop.Hash {
+				return false, nil
+			}
+			if want := int(stop.Height - start + 1); len(h.FilterHashes) != want {
+				return false, fmt.Errorf("%s sent %d filter hashes instead of %d", p.Addr(), len(h.FilterHashes), want)
+			}
+			headers = h
+			return true, nil
+		})
+	return headers, err
+}
+
+// GetFilters asks p for the basic filters of the blocks from height start
+// up to stop. The filters are not checked against the filter headers.
+func (c *Client) GetFilters(ctx context.Context, p *network.Peer, start int32, stop *chain.Node) ([]*cfilter.CFilter, error) {
+	filters := make([]*cfilter.CFilter, 0, stop.Height-start+1)
+	err := c.do(ctx, p,
+		func() error {
+			return p.GetCFilters(cfilter.Request{FilterType: cfilter.BasicFilterType, StartHeight: uint32(start), StopHash: stop.Hash})
+		},
+		func(msg any) (bool, error) {
+			f, ok := msg.(*cfilter.CFilter)
+			if !ok || f.FilterType != cfilter.BasicFilterType {
+				return false, nil
+			}
+			height := start + int32(len(filters))
+			if want := stop.Ancestor(height).Hash; f.BlockHash != want {
+				return false, fmt.Errorf("%s sent the filter of block %s instead of %s at height %d", p.Addr(), f.BlockHash, want, height)
+			}
+			filters = append(filters, f)
+			return height == stop.Height, nil
+		})
+	return filters, err
+}
+
+// SyncHeaders downloads the filter headers of the chain up to its tip. The
+// checkpoints of every peer must agree, the headers are fetched in
+// batches and checked against them, and the headers past the last
+// checkpoint are compared with every peer at the tip.
+func (c *Client) SyncHeaders(ctx context.Context) error {
+	peers := c.Peers()
+	if len(peers) < c.cfg.MinPeers {
+		return fmt.Errorf("%w: %d of %d", ErrNotEnoughPeers, len(peers), c.cfg.MinPeers)
+	}
+	tip := c.cfg.Chain.Tip()
+
+	var checkpoints []utils.Hash
+	for i, p := range peers {
+		cp, err := c.GetCheckpoints(ctx, p, tip)
+		if err != nil {
+			return fmt.Errorf("checkpoints from %s: %w", p.Addr(), err)
+		}
+		if i == 0 {
+			checkpoints = cp
+		} else if !slices.Equal(cp, checkpoints) {
+			return fmt.Errorf("%w: checkpoints of %s and %s", ErrHeaderMismatch, peers[0].Addr(), p.Addr())
+		}
+	}
+
+	// Headers already checked on the active chain are kept.
+	c.mu.Lock()
+	headers := c.headers
+	if c.tip == nil || !c.cfg.Chain.Contains(c.tip) || c.tip.Height > tip.Height {
+		headers = nil
+	}
+	c.mu.Unlock()
+	headers = slices.Clip(headers)
+
+	for batch := 0; int32(len(headers)) <= tip.Height; batch++ {
+		start := int32(len(headers))
+		stop := tip.Ancestor(min(start+cfilter.MaxGetCFHeaders-1, tip.Height))
+		p := peers[batch%len(peers)]
+		h, err := c.GetFilterHeaders(ctx, p, start, stop)
+		if err != nil {
+			return fmt.Errorf("filter headers from %s: %w", p.Addr(), err)
+		}
+		prev := utils.Hash{}
+		if start > 0 {
+			prev = headers[start-1]
+		}
+		if h.PrevHeader != prev {
+			return fmt.Errorf("%w: headers of %s do not connect at height %d", ErrHeaderMismatch, p.Addr(), start)
+		}
+		headers = append(headers, h.Headers()...)
+		for i, cp := range checkpoints {
+			height := (i + 1) * cfilter.CheckpointInterval
+			if height >= int(start) && height <= int(stop.Height) && headers[height] != cp {
+				return fmt.Errorf("%w: header of %s at height %d is not the checkpoint", ErrHeaderMismatch, p.Addr(), height)
+			}
+		}
+		log.Debugf("Synced filter headers up to height %d", stop.Height)
+	}
+
+	if tip.Height%cfilter.CheckpointInterval != 0 {
+		for _, p := range peers {
+			h, err := c.GetFilterHeaders(ctx, p, tip.Height, tip)
+			if err != nil {
+				return fmt.Errorf("tip filter header from %s: %w", p.Addr(), err)
+			}
+			if h.Headers()[0] != headers[tip.Height] {
+				return fmt.Errorf("%w: tip header of %s", ErrHeaderMismatch, p.Addr())
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.headers = headers
+	c.tip = tip
+	c.mu.Unlock()
+	log.Infof("Filter headers synced with %d peers up to height %d", len(peers), tip.Height)
+	return nil
+}
+
+// FilterHeader returns the checked filter header of the block at height.
+func (c *Client) FilterHeader(height int32) (utils.Hash, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if height < 0 || int(height) >= len(c.headers) {
+		return utils.Hash{}, false
+	}
+	return c.headers[height], true
+}
+
+// Scan downloads the filters of the blocks from height start up to the tip
+// of the synced filter headers, spreading the requests over the peers, and
+// returns the blocks whose filter matches any of scripts.
+func (c *Client) Scan(ctx context.Context, start int32, scripts [][]byte) ([]Match, error) {
+	c.mu.Lock()
+	headers, tip := c.headers, c.tip
+	c.mu.Unlock()
+	if tip == nil {
+		return nil, ErrNotSynced
+	}
+	start = max(start, 0)
+	peers := c.Peers()
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%w: none connected", ErrNotEnoughPeers)
+	}
+
+	var matches []Match
+	for batch := 0; start <= tip.Height; batch++ {
+		stop := tip.Ancestor(min(start+cfilter.MaxGetCFilters-1, tip.Height))
+		p := peers[batch%len(peers)]
+		filters, err := c.GetFilters(ctx, p, start, stop)
+		if err != nil {
+			return matches, fmt.Errorf("filters from %s: %w", p.Addr(), err)
+		}
+		for i, f := range filters {
+			height := start + int32(i)
+			prev := utils.Hash{}
+			if height > 0 {
+				prev = headers[height-1]
+			}
+			if cfilter.FilterHeader(utils.DoubleSHA256(f.Filter), prev) != headers[height] {
+				return matches, fmt.Errorf("%w: block %s from %s", ErrBadFilter, f.BlockHash, p.Addr())
+			}
+			filter, err := cfilter.ParseBasicFilter(f.BlockHash, f.Filter)
+			if err != nil {
+				return matches, fmt.Errorf("filter of block %s from %s: %w", f.BlockHash, p.Addr(), err)
+			}
+			if filter.MatchAny(scripts) {
+				matches = append(matches, Match{Height: height, Hash: f.BlockHash})
+			}
+		}
+		start = stop.Height + 1
+	}
+	return matches, nil
+}
@@ -0,0 +1,208 @@
+package filterclient
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// script returns the output script of the coinbase of the block at height.
+func script(height int) []byte {
+	return []byte{0x51, byte(height), byte(height >> 8)}
+}
+
+// testChain returns a regtest header chain of n blocks and the basic
+// filter of every block, genesis included.
+func testChain(t *testing.T, n int) (*chain.Chain, [][]byte) {
+	t.Helper()
+	c, err := chain.New(&config.RegTestParams)
+	require.NoError(t, err)
+	genesis, err := block.DecodeBlockMessage(config.RegTestParams.GenesisBlock)
+	require.NoError(t, err)
+	filters := [][]byte{cfilter.BasicFilter(genesis, nil).Bytes()}
+
+	headers := make([]block.Header, 0, n)
+	prev := genesis.Header
+	for i := 1; i <= n; i++ {
+		b := &block.Block{Transactions: []*transaction.Tx{{
+			Version: 2,
+			TxIn:    []transaction.TxIn{{PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff}}},
+			TxOut:   []transaction.TxOut{{Value: 50e8, PkScript: script(i)}},
+		}}}
+		b.Header = block.Header{
+			Version:   4,
+			PrevBlock: prev.Hash(),
+			Timestamp: prev.Timestamp + chain.TargetSpacing,
+			Bits:      prev.Bits,
+		}
+		b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+		for !b.Header.CheckProofOfWork() {
+			b.Header.Nonce++
+		}
+		headers = append(headers, b.Header)
+		filters = append(filters, cfilter.BasicFilter(b, nil).Bytes())
+		prev = b.Header
+	}
+	_, err = c.AddHeaders(headers)
+	require.NoError(t, err)
+	return c, filters
+}
+
+// server is a peer serving the filters of a chain.
+type server struct {
+	*network.Peer
+	chain   *chain.Chain
+	filters [][]byte
+	// lies replaces the filters sent, not the filter headers.
+	lies map[int32][]byte
+}
+
+func (s *server) headers() []utils.Hash {
+	headers := make([]utils.Hash, len(s.filters))
+	prev := utils.Hash{}
+	for i, f := range s.filters {
+		headers[i] = cfilter.FilterHeader(utils.DoubleSHA256(f), prev)
+		prev = headers[i]
+	}
+	return headers
+}
+
+func (s *server) setup() {
+	s.Handle("getcfcheckpt", func(p *network.Peer, payload []byte) error {
+		req, err := cfilter.DecodeCheckptRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		headers := s.headers()
+		cp := &cfilter.CFCheckpt{StopHash: req.StopHash}
+		for h := cfilter.CheckpointInterval; h <= int(s.chain.Lookup(req.StopHash).Height); h += cfilter.CheckpointInterval {
+			cp.Headers = append(cp.Headers, headers[h])
+		}
+		return p.SendCFCheckpt(cp)
+	})
+	s.Handle("getcfheaders", func(p *network.Peer, payload []byte) error {
+		req, err := cfilter.DecodeRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		headers := s.headers()
+		stop := s.chain.Lookup(req.StopHash).Height
+		resp := &cfilter.CFHeaders{StopHash: req.StopHash}
+		if req.StartHeight > 0 {
+			resp.PrevHeader = headers[req.StartHeight-1]
+		}
+		for h := int32(req.StartHeight); h <= stop; h++ {
+			resp.FilterHashes = append(resp.FilterHashes, utils.DoubleSHA256(s.filters[h]))
+		}
+		return p.SendCFHeaders(resp)
+	})
+	s.Handle("getcfilters", func(p *network.Peer, payload []byte) error {
+		req, err := cfilter.DecodeRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		stop := s.chain.Lookup(req.StopHash)
+		for h := int32(req.StartHeight); h <= stop.Height; h++ {
+			f := &cfilter.CFilter{BlockHash: stop.Ancestor(h).Hash, Filter: s.filters[h]}
+			if lie, ok := s.lies[h]; ok {
+				f.Filter = lie
+			}
+			if err := p.SendCFilter(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func connect(t *testing.T, c *Client, addr string, hc *chain.Chain, filters [][]byte) *server {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	local := network.NewPeer(c1, addr, network.PeerConfig{Magic: config.RegTestParams.Magic})
+	s := &server{
+		Peer: network.NewPeer(c2, "local", network.PeerConfig{
+			Magic:    config.RegTestParams.Magic,
+			Services: func() uint64 { return config.NodeCompactFilters },
+		}),
+		chain:   hc,
+		filters: append([][]byte(nil), filters...),
+	}
+	c.SetupPeer(local)
+	s.setup()
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- s.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+	c.AddPeer(local)
+	return s
+}
+
+func TestClient(t *testing.T) {
+	hc, filters := testChain(t, 1500)
+	c := New(Config{Chain: hc})
+	ctx := context.Background()
+
+	a := connect(t, c, "a", hc, filters)
+	assert.ErrorIs(t, c.SyncHeaders(ctx), ErrNotEnoughPeers)
+	_, err := c.Scan(ctx, 0, nil)
+	assert.ErrorIs(t, err, ErrNotSynced)
+	connect(t, c, "b", hc, filters)
+
+	require.NoError(t, c.SyncHeaders(ctx))
+	header, ok := c.FilterHeader(1500)
+	require.True(t, ok)
+	assert.Equal(t, a.headers()[1500], header)
+
+	matches, err := c.Scan(ctx, 0, [][]byte{script(7), script(1234), {0x6a}})
+	require.NoError(t, err)
+	assert.Equal(t, []Match{
+		{Height: 7, Hash: hc.NodeAtHeight(7).Hash},
+		{Height: 1234, Hash: hc.NodeAtHeight(1234).Hash},
+	}, matches)
+
+	matches, err = c.Scan(ctx, 1000, [][]byte{script(7)})
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestClientRejectsLies(t *testing.T) {
+	hc, filters := testChain(t, 1200)
+	ctx := context.Background()
+
+	// A peer lying about a filter before the last checkpoint.
+	c := New(Config{Chain: hc})
+	connect(t, c, "honest", hc, filters)
+	liar := connect(t, c, "liar", hc, filters)
+	liar.filters[500] = []byte{0}
+	assert.ErrorIs(t, c.SyncHeaders(ctx), ErrHeaderMismatch)
+
+	// And one lying after it, caught at the tip.
+	c = New(Config{Chain: hc})
+	connect(t, c, "honest", hc, filters)
+	liar = connect(t, c, "liar", hc, filters)
+	liar.filters[1100] = []byte{0}
+	assert.ErrorIs(t, c.SyncHeaders(ctx), ErrHeaderMismatch)
+
+	// A filter not matching the agreed headers. The second batch of
+	// filters is requested from the liar.
+	c = New(Config{Chain: hc})
+	connect(t, c, "honest", hc, filters)
+	liar = connect(t, c, "liar", hc, filters)
+	require.NoError(t, c.SyncHeaders(ctx))
+	liar.lies = map[int32][]byte{1100: {0}}
+	_, err := c.Scan(ctx, 0, [][]byte{script(1)})
+	assert.ErrorIs(t, err, ErrBadFilter)
+}
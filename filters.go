@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/connmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/filterclient"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// runFilters syncs the header chain, checks the compact filter headers of
+// several peers and lists the blocks whose filters match watched scripts.
+func runFilters(args []string) {
+	flags := flag.NewFlagSet("filters", flag.ExitOnError)
+	addnode := flags.String("addnode", net.JoinHostPort(config.BTCNodeHost, strconv.Itoa(config.BTCNodePort)), "comma separated list of host:port addresses to connect to")
+	outbound := flags.Int("outbound", 8, "number of outbound peers")
+	minPeers := flags.Int("minpeers", filterclient.DefaultMinPeers, "number of filter-serving peers whose filter headers must agree")
+	watch := flags.String("watch", "", "comma separated list of hex output scripts to look for")
+	start := flags.Int("start", 0, "height of the first block to scan")
+	wait := flags.Duration("wait", 10*time.Minute, "time allowed to sync the headers and connect to the filter peers")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	chainName := flags.String("chain", config.MainNetParams.Name, "network to scan: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "query the chain's DNS seeds for addresses of peers serving filters")
+	dnsServer := flags.String("dnsserver", "", "DNS server host:port used for the seed lookups (system resolver when empty)")
+	dataDir := flags.String("datadir", "data", "directory holding the header database")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	flags.Parse(args)
+
+	var scripts [][]byte
+	for _, s := range strings.Split(*watch, ",") {
+		script, err := hex.DecodeString(strings.TrimSpace(s))
+		if err != nil || len(script) == 0 {
+			log.Fatalf("Invalid script %q in -watch", s)
+		}
+		scripts = append(scripts, script)
+	}
+
+	params := chainParams(*chainName)
+	if err := os.MkdirAll(*dataDir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dataDir, err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	addrs := addrmgr.New()
+	addNodes := parseAddNodes(*addnode)
+	if *dnsSeed {
+		resolver := dnsseed.Resolver{Server: *dnsServer}
+		added, err := resolver.Seed(ctx, addrs, params, config.NodeNetwork|config.NodeWitness|config.NodeCompactFilters)
+		if err != nil {
+			log.Errorf("DNS seeding failed: %v", err)
+		}
+		log.Infof("Added %d addresses from DNS seeds", added)
+	}
+
+	headers, err := chain.Open(params, filepath.Join(*dataDir, params.Name+"-headers.db"))
+	if err != nil {
+		log.Fatalf("Failed to open the header database: %v", err)
+	}
+	defer headers.Close()
+	syncer := chain.NewSyncer(headers)
+	client := filterclient.New(filterclient.Config{Chain: headers, MinPeers: *minPeers})
+
+	manager := connmgr.New(connmgr.Config{
+		TargetOutbound:    *outbound,
+		DisableOutbound:   *outbound == 0,
+		DisableBlockRelay: true,
+		AddrManager:       addrs,
+		AddNodes:          addNodes,
+		Dialer:            newDialer(*proxy, true),
+		PeerConfig:        network.PeerConfig{Magic: params.Magic, StartHeight: headers.Height},
+		SetupPeer:         forEach([]func(*network.Peer){syncer.SetupPeer, client.SetupPeer}),
+		PeerConnected:     forEach([]func(*network.Peer){syncer.AddPeer, client.AddPeer}),
+	})
+	go manager.Run(ctx)
+
+	waitForFilterPeers(ctx, syncer, client, *minPeers, *wait)
+	if err := client.SyncHeaders(ctx); err != nil {
+		log.Fatalf("Failed to sync the filter headers: %v", err)
+	}
+	matches, err := client.Scan(ctx, int32(*start), scripts)
+	if err != nil {
+		log.Fatalf("Scan failed: %v", err)
+	}
+
+	if *asJSON {
+		printJSON(matches)
+		return
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+	fmt.Fprintln(out, "HEIGHT\tBLOCK")
+	for _, m := range matches {
+		fmt.Fprintf(out, "%d\t%s\n", m.Height, m.Hash)
+	}
+}
+
+// waitForFilterPeers waits until the header sync has completed and want
+// peers serving filters are connected, or for at most timeout.
+func waitForFilterPeers(ctx context.Context, syncer *chain.Syncer, client *filterclient.Client, want int, timeout time.Duration) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		peers := len(client.Peers())
+		if syncer.Synced() && peers >= want {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			log.Warnf("Header sync completed: %t, %d of %d filter peers connected after %s", syncer.Synced(), peers, want, timeout)
+			return
+		case <-ctx.Done():
+			log.Fatal(ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package geoip
+
+import (
+	"errors"
+	"math/bits"
+	"net"
+	"os"
+)
+
+// ASMap maps IP addresses to AS numbers using the compressed trie format of
+// Bitcoin Core's -asmap files.
+type ASMap struct {
+	bits []bool
+}
+
+const invalid = 0xffffffff
+
+// Opcodes of the asmap program.
+const (
+	opReturn  = 0
+	opJump    = 1
+	opMatch   = 2
+	opDefault = 3
+)
+
+var (
+	typeBitSizes  = []uint8{0, 0, 1}
+	asnBitSizes   = []uint8{15, 16, 17, 18, 19, 20, 21, 22, 23, 24}
+	matchBitSizes = []uint8{1, 2, 3, 4, 5, 6, 7, 8}
+	jumpBitSizes  = []uint8{5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30}
+)
+
+// LoadASMap reads an asmap file.
+func LoadASMap(path string) (*ASMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewASMap(data)
+}
+
+// NewASMap decodes an asmap. Bits are read least significant first within
+// each byte, as Bitcoin Core does.
+func NewASMap(data []byte) (*ASMap, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty asmap")
+	}
+	m := &ASMap{bits: make([]bool, 0, len(data)*8)}
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			m.bits = append(m.bits, b>>i&1 == 1)
+		}
+	}
+	return m, nil
+}
+
+// Lookup returns the AS number of ip, or 0 if it is unknown or the asmap is
+// malformed.
+func (m *ASMap) Lookup(ip net.IP) uint32 {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return 0
+	}
+	// IPv4 addresses are looked up in their IPv4-mapped IPv6 form.
+	ipBits := make([]bool, 0, 128)
+	for _, b := range ip16 {
+		for i := 7; i >= 0; i-- {
+			ipBits = append(ipBits, b>>i&1 == 1)
+		}
+	}
+	return m.interpret(ipBits)
+}
+
+// interpret runs the asmap program on the bits of an address, following
+// Interpret in Bitcoin Core's util/asmap.cpp.
+func (m *ASMap) interpret(ip []bool) uint32 {
+	r := bitReader{bits: m.bits}
+	remaining := len(ip)
+	var defaultASN uint32
+	for r.pos < len(r.bits) {
+		switch r.decode(0, typeBitSizes) {
+		case opReturn:
+			asn := r.decode(1, asnBitSizes)
+			if asn == invalid {
+				return 0
+			}
+			return asn
+		case opJump:
+			jump := r.decode(17, jumpBitSizes)
+			if jump == invalid || remaining == 0 || int(jump) >= len(r.bits)-r.pos {
+				return 0
+			}
+			if ip[len(ip)-remaining] {
+				r.pos += int(jump)
+			}
+			remaining--
+		case opMatch:
+			match := r.decode(2, matchBitSizes)
+			if match == invalid {
+				return 0
+			}
+			matchLen := bits.Len32(match) - 1
+			if remaining < matchLen {
+				return 0
+			}
+			for i := 0; i < matchLen; i++ {
+				if ip[len(ip)-remaining] != (match>>(matchLen-1-i)&1 == 1) {
+					return defaultASN
+				}
+				remaining--
+			}
+		case opDefault:
+			defaultASN = r.decode(1, asnBitSizes)
+			if defaultASN == invalid {
+				return 0
+			}
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+type bitReader struct {
+	bits []bool
+	pos  int
+}
+
+func (r *bitReader) next() (bool, bool) {
+	if r.pos == len(r.bits) {
+		return false, false
+	}
+	b := r.bits[r.pos]
+	r.pos++
+	return b, true
+}
+
+// decode reads a variable-length integer: a unary exponent selecting one of
+// sizes followed by a mantissa of that many bits, added to minVal.
+func (r *bitReader) decode(minVal uint32, sizes []uint8) uint32 {
+	val := minVal
+	for i, size := range sizes {
+		bit := false
+		if i+1 != len(sizes) {
+			var ok bool
+			if bit, ok = r.next(); !ok {
+				return invalid
+			}
+		}
+		if bit {
+			val += 1 << size
+			continue
+		}
+		for j := 0; j < int(size); j++ {
+			b, ok := r.next()
+			if !ok {
+				return invalid
+			}
+			if b {
+				val += 1 << (int(size) - 1 - j)
+			}
+		}
+		return val
+	}
+	return invalid
+}
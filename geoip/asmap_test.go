@@ -0,0 +1,117 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// asmapWriter assembles asmap programs, the inverse of bitReader.
+type asmapWriter struct {
+	bits []bool
+}
+
+func (w *asmapWriter) encode(val, minVal uint32, sizes []uint8) {
+	val -= minVal
+	for i, size := range sizes {
+		last := i+1 == len(sizes)
+		if !last && val >= 1<<size {
+			w.bits = append(w.bits, true)
+			val -= 1 << size
+			continue
+		}
+		if !last {
+			w.bits = append(w.bits, false)
+		}
+		for j := int(size) - 1; j >= 0; j-- {
+			w.bits = append(w.bits, val>>j&1 == 1)
+		}
+		return
+	}
+}
+
+func (w *asmapWriter) ret(asn uint32) {
+	w.encode(opReturn, 0, typeBitSizes)
+	w.encode(asn, 1, asnBitSizes)
+}
+
+func (w *asmapWriter) defaultASN(asn uint32) {
+	w.encode(opDefault, 0, typeBitSizes)
+	w.encode(asn, 1, asnBitSizes)
+}
+
+func (w *asmapWriter) jump(offset int) {
+	w.encode(opJump, 0, typeBitSizes)
+	w.encode(uint32(offset), 17, jumpBitSizes)
+}
+
+// matchPrefix matches the given bytes, 8 bits per instruction.
+func (w *asmapWriter) matchPrefix(prefix []byte) {
+	for _, b := range prefix {
+		w.encode(opMatch, 0, typeBitSizes)
+		w.encode(0x100|uint32(b), 2, matchBitSizes)
+	}
+}
+
+func (w *asmapWriter) bytes() []byte {
+	out := make([]byte, (len(w.bits)+7)/8)
+	for i, bit := range w.bits {
+		if bit {
+			out[i/8] |= 1 << (i % 8)
+		}
+	}
+	return out
+}
+
+// testASMap maps 1.2.0.0/17 to AS64500, 1.2.128.0/17 to AS64501 and
+// everything else to AS13335.
+func testASMap(t *testing.T) []byte {
+	t.Helper()
+	var left asmapWriter
+	left.ret(64500)
+
+	var w asmapWriter
+	w.defaultASN(13335)
+	w.matchPrefix(net.ParseIP("1.2.0.0").To16()[:14])
+	w.jump(len(left.bits))
+	w.bits = append(w.bits, left.bits...)
+	w.ret(64501)
+	return w.bytes()
+}
+
+func TestASMapLookup(t *testing.T) {
+	m, err := NewASMap(testASMap(t))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(64500), m.Lookup(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, uint32(64500), m.Lookup(net.ParseIP("1.2.127.255")))
+	assert.Equal(t, uint32(64501), m.Lookup(net.ParseIP("1.2.128.0")))
+	assert.Equal(t, uint32(13335), m.Lookup(net.ParseIP("1.3.0.1")))
+	assert.Equal(t, uint32(13335), m.Lookup(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, uint32(0), m.Lookup(nil))
+}
+
+func TestASMapMalformed(t *testing.T) {
+	_, err := NewASMap(nil)
+	assert.Error(t, err)
+
+	data := testASMap(t)
+	m, err := NewASMap(data[:len(data)/2])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), m.Lookup(net.ParseIP("1.2.3.4")), "truncated programs never return an ASN")
+}
+
+func TestLoadASMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip_asn.map")
+	require.NoError(t, os.WriteFile(path, testASMap(t), 0o644))
+	m, err := LoadASMap(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(64501), m.Lookup(net.ParseIP("1.2.200.1")))
+
+	_, err = LoadASMap(filepath.Join(t.TempDir(), "missing.map"))
+	assert.Error(t, err)
+}
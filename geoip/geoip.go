@@ -0,0 +1,110 @@
+// Package geoip annotates addresses with their country and AS number, looked
+// up offline from MaxMind-format .mmdb files and Bitcoin Core asmap files.
+package geoip
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+)
+
+// Info is what the databases know about an address.
+type Info struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// record holds the fields we read, in the layout of the GeoLite2 Country,
+// City and ASN databases.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint32 `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Resolver looks addresses up in any number of .mmdb files and an optional
+// asmap.
+type Resolver struct {
+	dbs   []*maxminddb.Reader
+	asmap *ASMap
+}
+
+// Open opens the given .mmdb files, typically a country and an ASN database,
+// and the asmap file when asmapPath is not empty.
+func Open(asmapPath string, mmdbPaths ...string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, path := range mmdbPaths {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.dbs = append(r.dbs, db)
+	}
+	if asmapPath != "" {
+		asmap, err := LoadASMap(asmapPath)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.asmap = asmap
+	}
+	return r, nil
+}
+
+// Close closes the .mmdb files.
+func (r *Resolver) Close() error {
+	var errs []error
+	for _, db := range r.dbs {
+		errs = append(errs, db.Close())
+	}
+	r.dbs = nil
+	return errors.Join(errs...)
+}
+
+// Lookup returns what the databases know about ip. Each field is taken from
+// the first database that has it; the asmap takes precedence for the ASN.
+func (r *Resolver) Lookup(ip net.IP) Info {
+	var info Info
+	for _, db := range r.dbs {
+		var rec record
+		if err := db.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = rec.Country.ISOCode
+		}
+		if info.ASN == 0 {
+			info.ASN, info.ASOrg = rec.ASN, rec.ASOrg
+		}
+	}
+	if r.asmap != nil {
+		if asn := r.asmap.Lookup(ip); asn != 0 {
+			if asn != info.ASN {
+				info.ASOrg = ""
+			}
+			info.ASN = asn
+		}
+	}
+	return info
+}
+
+// ASN returns the AS number of ip, or 0 if it is unknown.
+func (r *Resolver) ASN(ip net.IP) uint32 {
+	return r.Lookup(ip).ASN
+}
+
+// Group is an addrmgr.GroupFunc bucketing addresses by AS number. Addresses
+// without a known AS fall back to their NetGroup.
+func (r *Resolver) Group(addr netaddr.NetAddr) string {
+	if asn := r.ASN(net.IP(addr.IP[:])); asn != 0 {
+		return "AS" + strconv.FormatUint(uint64(asn), 10)
+	}
+	return addr.NetGroup()
+}
@@ -0,0 +1,96 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeMMDB(t *testing.T, dbType string, records map[string]mmdbtype.Map) string {
+	t.Helper()
+	w, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	for cidr, rec := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, w.Insert(network, rec))
+	}
+
+	path := filepath.Join(t.TempDir(), dbType+".mmdb")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = w.WriteTo(f)
+	require.NoError(t, err)
+	return path
+}
+
+func country(code string) mmdbtype.Map {
+	return mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+}
+
+func as(number uint32, org string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(number),
+		"autonomous_system_organization": mmdbtype.String(org),
+	}
+}
+
+func testResolver(t *testing.T, withASMap bool) *Resolver {
+	t.Helper()
+	countries := writeMMDB(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"1.2.0.0/16":    country("DE"),
+		"2001:db8::/32": country("CH"),
+	})
+	asns := writeMMDB(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"1.2.0.0/16":    as(3320, "Deutsche Telekom AG"),
+		"2001:db8::/32": as(13030, "Init7 (Switzerland) Ltd."),
+	})
+
+	asmapPath := ""
+	if withASMap {
+		asmapPath = filepath.Join(t.TempDir(), "ip_asn.map")
+		require.NoError(t, os.WriteFile(asmapPath, testASMap(t), 0o644))
+	}
+	r, err := Open(asmapPath, countries, asns)
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	r := testResolver(t, false)
+
+	assert.Equal(t, Info{Country: "DE", ASN: 3320, ASOrg: "Deutsche Telekom AG"}, r.Lookup(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, Info{Country: "CH", ASN: 13030, ASOrg: "Init7 (Switzerland) Ltd."}, r.Lookup(net.ParseIP("2001:db8::1")))
+	assert.Equal(t, Info{}, r.Lookup(net.ParseIP("9.9.9.9")))
+}
+
+func TestASMapTakesPrecedence(t *testing.T) {
+	r := testResolver(t, true)
+
+	info := r.Lookup(net.ParseIP("1.2.200.1"))
+	assert.Equal(t, Info{Country: "DE", ASN: 64501}, info, "the mmdb organisation belongs to another AS")
+	assert.Equal(t, uint32(13335), r.ASN(net.ParseIP("9.9.9.9")))
+}
+
+func TestGroup(t *testing.T) {
+	r := testResolver(t, false)
+	assert.Equal(t, "AS3320", r.Group(netaddr.NewNetAddr("1.2.3.4", 8333, 0)))
+	assert.Equal(t, "AS3320", r.Group(netaddr.NewNetAddr("1.2.200.4", 8333, 0)))
+	assert.Equal(t, "9.9", r.Group(netaddr.NewNetAddr("9.9.9.9", 8333, 0)), "unknown addresses fall back to the netgroup")
+}
+
+func TestOpenErrors(t *testing.T) {
+	_, err := Open("", filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+	_, err = Open(filepath.Join(t.TempDir(), "missing.map"))
+	assert.Error(t, err)
+}
@@ -7,11 +7,24 @@ require (
 	github.com/stretchr/testify v1.9.0
 )
 
+require golang.org/x/crypto v0.26.0
+
+require golang.org/x/net v0.28.0
+
+require go.etcd.io/bbolt v1.3.11
+
+require (
+	github.com/maxmind/mmdbwriter v1.0.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+)
+
+require go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.2 // indirect
 	golang.org/x/sync v0.7.0
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	golang.org/x/sys v0.23.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
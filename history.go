@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/crawldb"
+	log "github.com/sirupsen/logrus"
+)
+
+const historyUsage = `usage: history [flags] snapshots
+       history [flags] node <host:port>
+       history [flags] diff <from> <to>`
+
+// runHistory queries the crawl database: the list of snapshots, the uptime
+// and upgrades of a node, or the diff between two snapshots.
+func runHistory(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	dbPath := flags.String("db", "crawl/crawl.db", "crawl database to query")
+	since := flags.Duration("since", 0, "only count the node's uptime over this period (whole history when 0)")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		log.Fatal(historyUsage)
+	}
+
+	db, err := crawldb.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open crawl database: %v", err)
+	}
+	defer db.Close()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer out.Flush()
+
+	switch {
+	case args[0] == "snapshots" && len(args) == 1:
+		snapshots, err := db.Snapshots()
+		if err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+		if *asJSON {
+			printJSON(snapshots)
+			return
+		}
+		fmt.Fprintln(out, "ID\tCHAIN\tSTARTED\tFINISHED\tNODES\tREACHABLE")
+		for _, s := range snapshots {
+			fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%d\t%d\n", s.ID, s.Chain, formatTime(s.Started), formatTime(s.Finished), s.Nodes, s.Reachable)
+		}
+
+	case args[0] == "node" && len(args) == 2:
+		var from time.Time
+		if *since > 0 {
+			from = time.Now().Add(-*since)
+		}
+		uptime, err := db.Uptime(args[1], from)
+		if err != nil {
+			log.Fatalf("Failed to compute uptime: %v", err)
+		}
+		history, err := db.History(args[1])
+		if err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		changes, err := db.Changes(args[1])
+		if err != nil {
+			log.Fatalf("Failed to read changes: %v", err)
+		}
+		if *asJSON {
+			printJSON(map[string]any{"uptime": uptime, "history": history, "changes": changes})
+			return
+		}
+		fmt.Fprintf(out, "Uptime:\t%.1f%% (%d/%d snapshots)\n", uptime.Ratio*100, uptime.Successes, uptime.Observations)
+		fmt.Fprintf(out, "First seen:\t%s\n", formatTime(uptime.FirstSeen))
+		fmt.Fprintf(out, "Last seen:\t%s\n\n", formatTime(uptime.LastSeen))
+		fmt.Fprintln(out, "SNAPSHOT\tTIME\tUP\tVERSION\tUSER AGENT")
+		for _, o := range history {
+			fmt.Fprintf(out, "%d\t%s\t%t\t%d\t%s\n", o.Snapshot, formatTime(o.Time), o.Success, o.Version, o.UserAgent)
+		}
+		for _, c := range changes {
+			fmt.Fprintf(out, "\nSnapshot %d:\t%s (%d) -> %s (%d)\n", c.Snapshot, c.OldUserAgent, c.OldVersion, c.NewUserAgent, c.NewVersion)
+		}
+
+	case args[0] == "diff" && len(args) == 3:
+		from, err1 := strconv.ParseUint(args[1], 10, 64)
+		to, err2 := strconv.ParseUint(args[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			log.Fatal(historyUsage)
+		}
+		diff, err := db.Diff(from, to)
+		if err != nil {
+			log.Fatalf("Failed to diff snapshots: %v", err)
+		}
+		if *asJSON {
+			printJSON(diff)
+			return
+		}
+		for _, addr := range diff.Added {
+			fmt.Fprintf(out, "+\t%s\n", addr)
+		}
+		for _, addr := range diff.Removed {
+			fmt.Fprintf(out, "-\t%s\n", addr)
+		}
+		for _, c := range diff.Upgraded {
+			fmt.Fprintf(out, "~\t%s\t%s (%d) -> %s (%d)\n", c.Addr, c.OldUserAgent, c.OldVersion, c.NewUserAgent, c.NewVersion)
+		}
+		fmt.Fprintf(out, "%d added, %d removed, %d upgraded\n", len(diff.Added), len(diff.Removed), len(diff.Upgraded))
+
+	default:
+		log.Fatal(historyUsage)
+	}
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Fatalf("Failed to encode JSON: %v", err)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
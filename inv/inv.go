@@ -0,0 +1,142 @@
+// Package inv implements inventory vectors and the inv, getdata and notfound
+// messages that carry them.
+package inv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// MaxInvEntries is the largest number of entries an inv, getdata or
+// notfound message may carry.
+const MaxInvEntries = 50000
+
+// InvType identifies the kind of object an inventory vector refers to.
+type InvType uint32
+
+// WitnessFlag is set on the types that request witness data.
+const WitnessFlag InvType = 1 << 30
+
+// Inventory types.
+const (
+	InvTypeError                InvType = 0
+	InvTypeTx                   InvType = 1
+	InvTypeBlock                InvType = 2
+	InvTypeFilteredBlock        InvType = 3
+	InvTypeCompactBlock         InvType = 4
+	InvTypeWTx                  InvType = 5
+	InvTypeWitnessTx                    = InvTypeTx | WitnessFlag
+	InvTypeWitnessBlock                 = InvTypeBlock | WitnessFlag
+	InvTypeFilteredWitnessBlock         = InvTypeFilteredBlock | WitnessFlag
+)
+
+var invTypeNames = map[InvType]string{
+	InvTypeError:                "ERROR",
+	InvTypeTx:                   "MSG_TX",
+	InvTypeBlock:                "MSG_BLOCK",
+	InvTypeFilteredBlock:        "MSG_FILTERED_BLOCK",
+	InvTypeCompactBlock:         "MSG_CMPCT_BLOCK",
+	InvTypeWTx:                  "MSG_WTX",
+	InvTypeWitnessTx:            "MSG_WITNESS_TX",
+	InvTypeWitnessBlock:         "MSG_WITNESS_BLOCK",
+	InvTypeFilteredWitnessBlock: "MSG_FILTERED_WITNESS_BLOCK",
+}
+
+// String returns the name Bitcoin Core uses for the type.
+func (t InvType) String() string {
+	if name, ok := invTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%#x)", uint32(t))
+}
+
+// IsTx reports whether the type refers to a transaction.
+func (t InvType) IsTx() bool {
+	return t == InvTypeTx || t == InvTypeWitnessTx || t == InvTypeWTx
+}
+
+// IsBlock reports whether the type refers to a block in any form.
+func (t InvType) IsBlock() bool {
+	switch t &^ WitnessFlag {
+	case InvTypeBlock, InvTypeFilteredBlock, InvTypeCompactBlock:
+		return true
+	}
+	return false
+}
+
+// InvVect is an inventory vector: the type and hash of an object.
+type InvVect struct {
+	Type InvType
+	Hash utils.Hash
+}
+
+// String returns the type and hash of the vector.
+func (v InvVect) String() string {
+	return v.Type.String() + " " + v.Hash.String()
+}
+
+// WriteInvVect writes v in its 36-byte wire form.
+func WriteInvVect(w io.Writer, v InvVect) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(v.Type)); err != nil {
+		return err
+	}
+	_, err := w.Write(v.Hash[:])
+	return err
+}
+
+// ReadInvVect reads an inventory vector.
+func ReadInvVect(r io.Reader) (InvVect, error) {
+	var v InvVect
+	var invType uint32
+	if err := binary.Read(r, binary.LittleEndian, &invType); err != nil {
+		return v, err
+	}
+	v.Type = InvType(invType)
+	_, err := io.ReadFull(r, v.Hash[:])
+	return v, err
+}
+
+// EncodeInvMessage returns the payload of an inv, getdata or notfound
+// message, which all share the same layout.
+func EncodeInvMessage(vects []InvVect) ([]byte, error) {
+	if len(vects) > MaxInvEntries {
+		return nil, fmt.Errorf("too many inventory vectors: %d", len(vects))
+	}
+	var buf bytes.Buffer
+	if err := utils.WriteVarInt(&buf, uint64(len(vects))); err != nil {
+		return nil, err
+	}
+	for _, v := range vects {
+		if err := WriteInvVect(&buf, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeInvMessage parses the payload of an inv, getdata or notfound
+// message.
+func DecodeInvMessage(payload []byte) ([]InvVect, error) {
+	r := bytes.NewReader(payload)
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxInvEntries {
+		return nil, fmt.Errorf("too many inventory vectors: %d", count)
+	}
+
+	vects := make([]InvVect, 0, count)
+	for i := uint64(0); i < count; i++ {
+		v, err := ReadInvVect(r)
+		if err != nil {
+			return nil, err
+		}
+		vects = append(vects, v)
+	}
+	return vects, nil
+}
@@ -0,0 +1,90 @@
+package inv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHash(t *testing.T, s string) utils.Hash {
+	t.Helper()
+	h, err := utils.NewHashFromString(s)
+	require.NoError(t, err)
+	return h
+}
+
+func TestInvTypes(t *testing.T) {
+	assert.Equal(t, InvType(0x40000001), InvTypeWitnessTx)
+	assert.Equal(t, InvType(0x40000002), InvTypeWitnessBlock)
+	assert.Equal(t, InvType(0x40000003), InvTypeFilteredWitnessBlock)
+
+	assert.Equal(t, "MSG_WITNESS_BLOCK", InvTypeWitnessBlock.String())
+	assert.Equal(t, "MSG_WTX", InvTypeWTx.String())
+	assert.Equal(t, "UNKNOWN(0x7)", InvType(7).String())
+
+	for _, typ := range []InvType{InvTypeTx, InvTypeWitnessTx, InvTypeWTx} {
+		assert.True(t, typ.IsTx(), typ.String())
+		assert.False(t, typ.IsBlock(), typ.String())
+	}
+	for _, typ := range []InvType{InvTypeBlock, InvTypeWitnessBlock, InvTypeFilteredBlock, InvTypeFilteredWitnessBlock, InvTypeCompactBlock} {
+		assert.True(t, typ.IsBlock(), typ.String())
+		assert.False(t, typ.IsTx(), typ.String())
+	}
+}
+
+func TestInvVectWireFormat(t *testing.T) {
+	genesis := mustHash(t, "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
+	v := InvVect{Type: InvTypeWitnessBlock, Hash: genesis}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteInvVect(&buf, v))
+	assert.Equal(t, "02000040"+"6fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000", hex.EncodeToString(buf.Bytes()))
+
+	decoded, err := ReadInvVect(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, v, decoded)
+	assert.Equal(t, "MSG_WITNESS_BLOCK 000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f", v.String())
+}
+
+func TestInvMessageRoundTrip(t *testing.T) {
+	vects := []InvVect{
+		{Type: InvTypeTx, Hash: utils.DoubleSHA256([]byte("a"))},
+		{Type: InvTypeWTx, Hash: utils.DoubleSHA256([]byte("b"))},
+		{Type: InvTypeCompactBlock, Hash: utils.DoubleSHA256([]byte("c"))},
+	}
+	payload, err := EncodeInvMessage(vects)
+	require.NoError(t, err)
+	assert.Len(t, payload, 1+3*36)
+
+	decoded, err := DecodeInvMessage(payload)
+	require.NoError(t, err)
+	assert.Equal(t, vects, decoded)
+
+	empty, err := EncodeInvMessage(nil)
+	require.NoError(t, err)
+	decoded, err = DecodeInvMessage(empty)
+	require.NoError(t, err)
+	assert.Empty(t, decoded)
+}
+
+func TestInvMessageLimits(t *testing.T) {
+	_, err := EncodeInvMessage(make([]InvVect, MaxInvEntries+1))
+	assert.Error(t, err)
+
+	payload, err := EncodeInvMessage(make([]InvVect, MaxInvEntries))
+	require.NoError(t, err)
+	_, err = DecodeInvMessage(payload)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, utils.WriteVarInt(&buf, MaxInvEntries+1))
+	_, err = DecodeInvMessage(buf.Bytes())
+	assert.ErrorContains(t, err, "too many")
+
+	_, err = DecodeInvMessage(payload[:len(payload)-1])
+	assert.Error(t, err, "truncated payload")
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"github.com/safwentrabelsi/bitcoin-handshake/config"
@@ -11,6 +13,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const dialTimeout = 10 * time.Second
+
 func main() {
 	log.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
@@ -18,8 +22,39 @@ func main() {
 
 	log.SetLevel(logrus.DebugLevel)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "node":
+			runNode(os.Args[2:])
+			return
+		case "crawl":
+			runCrawl(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "seeder":
+			runSeeder(os.Args[2:])
+			return
+		case "broadcast":
+			runBroadcast(os.Args[2:])
+			return
+		case "propagation":
+			runPropagation(os.Args[2:])
+			return
+		case "filters":
+			runFilters(os.Args[2:])
+			return
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+	}
+
 	address := net.JoinHostPort(config.BTCNodeHost, fmt.Sprint(config.BTCNodePort))
-	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	conn, err := newDialer(os.Getenv("BTC_PROXY"), true).Dial(context.Background(), address)
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -0,0 +1,218 @@
+package mempool
+
+import (
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// requestTimeout is how long a peer has to answer our getdata for a
+	// transaction before we ask the next peer that announced it. It
+	// matches GETDATA_TX_INTERVAL in Bitcoin Core.
+	requestTimeout = 60 * time.Second
+	// retryInterval is how often Run looks for requests that timed out.
+	retryInterval = time.Second
+)
+
+// request tracks a transaction we have seen announced and asked for.
+type request struct {
+	// peer is the peer asked, nil when no announcer is left to ask.
+	peer *network.Peer
+	sent time.Time
+	// candidates are the other peers that announced the transaction, in
+	// announcement order, which are asked in turn if peer does not deliver
+	// it, as Bitcoin Core's txrequest does.
+	candidates []candidate
+	// announced and announcer record the first announcement, which is
+	// when the transaction was first seen even if another peer delivers
+	// it.
+	announced time.Time
+	announcer string
+}
+
+// candidate is a peer that announced a transaction, with the type to
+// request it with.
+type candidate struct {
+	peer    *network.Peer
+	invType inv.InvType
+}
+
+// addCandidate records that p announced the transaction too.
+func (req *request) addCandidate(p *network.Peer, invType inv.InvType) {
+	if p == req.peer {
+		return
+	}
+	for _, c := range req.candidates {
+		if c.peer == p {
+			return
+		}
+	}
+	req.candidates = append(req.candidates, candidate{p, invType})
+}
+
+// next moves the request to the next connected candidate, if any, and
+// returns it.
+func (req *request) next(now time.Time) (candidate, bool) {
+	req.peer, req.sent = nil, time.Time{}
+	for len(req.candidates) > 0 {
+		c := req.candidates[0]
+		req.candidates = req.candidates[1:]
+		if disconnected(c.peer) {
+			continue
+		}
+		req.peer, req.sent = c.peer, now
+		return c, true
+	}
+	return candidate{}, false
+}
+
+func disconnected(p *network.Peer) bool {
+	select {
+	case <-p.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// SetupPeer registers the pool's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer; peers only announce
+// transactions if we set network.PeerConfig.Relay.
+func (m *Pool) SetupPeer(p *network.Peer) {
+	p.OnInv(m.handleInv)
+	p.OnTx(m.handleTx)
+	p.OnNotFound(m.handleNotFound)
+}
+
+// handleInv requests the announced transactions we neither have nor
+// already asked another peer for, and records p as a candidate for the
+// others. Announcements from peers we did not ask to relay transactions,
+// such as block-relay-only ones, are ignored.
+func (m *Pool) handleInv(p *network.Peer, vects []inv.InvVect) error {
+	if !p.AcceptsTxs() {
+		return nil
+	}
+	now := time.Now()
+	var want []inv.InvVect
+	m.mu.Lock()
+	for _, v := range vects {
+		if !v.Type.IsTx() || m.has(v.Hash) {
+			continue
+		}
+		invType := txInvType(p, v.Type)
+		req, ok := m.requests[v.Hash]
+		if !ok {
+			req = &request{announced: now, announcer: p.Addr()}
+			m.requests[v.Hash] = req
+		} else if req.peer != nil && now.Sub(req.sent) < requestTimeout {
+			req.addCandidate(p, invType)
+			continue
+		}
+		req.peer, req.sent = p, now
+		want = append(want, inv.InvVect{Type: invType, Hash: v.Hash})
+	}
+	m.mu.Unlock()
+
+	if len(want) == 0 {
+		return nil
+	}
+	return p.GetData(want...)
+}
+
+// txInvType returns the type to request an announced transaction with:
+// by wtxid if it was announced by wtxid, with witness data if the peer has
+// it.
+func txInvType(p *network.Peer, announced inv.InvType) inv.InvType {
+	if announced == inv.InvTypeWTx {
+		return inv.InvTypeWTx
+	}
+	if p.Version().Services&config.NodeWitness != 0 {
+		return inv.InvTypeWitnessTx
+	}
+	return inv.InvTypeTx
+}
+
+func (m *Pool) handleTx(p *network.Peer, tx *transaction.Tx) error {
+	txid, wtxid := tx.TxID(), tx.WTxID()
+	firstSeen, firstPeer := time.Now(), p.Addr()
+
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	for _, hash := range []utils.Hash{txid, wtxid} {
+		if req, ok := m.requests[hash]; ok {
+			firstSeen, firstPeer = req.announced, req.announcer
+			delete(m.requests, hash)
+		}
+	}
+	events, added := m.add(tx, firstSeen, firstPeer)
+	m.mu.Unlock()
+
+	if added {
+		log.Debugf("Transaction %s first seen from %s", txid, firstPeer)
+	}
+	m.notify(events)
+	return nil
+}
+
+// handleNotFound asks the next peer that announced the transactions p does
+// not have for them.
+func (m *Pool) handleNotFound(p *network.Peer, vects []inv.InvVect) error {
+	now := time.Now()
+	retries := make(map[*network.Peer][]inv.InvVect)
+	m.mu.Lock()
+	for _, v := range vects {
+		if req, ok := m.requests[v.Hash]; ok && v.Type.IsTx() && req.peer == p {
+			if c, ok := req.next(now); ok {
+				retries[c.peer] = append(retries[c.peer], inv.InvVect{Type: c.invType, Hash: v.Hash})
+			}
+		}
+	}
+	m.mu.Unlock()
+	sendRequests(retries)
+	return nil
+}
+
+// retryRequests asks the next announcer for the transactions whose peer
+// did not deliver them within requestTimeout or disconnected.
+func (m *Pool) retryRequests(now time.Time) {
+	retries := make(map[*network.Peer][]inv.InvVect)
+	m.mu.Lock()
+	for hash, req := range m.requests {
+		if req.peer == nil || (now.Sub(req.sent) < requestTimeout && !disconnected(req.peer)) {
+			continue
+		}
+		if c, ok := req.next(now); ok {
+			retries[c.peer] = append(retries[c.peer], inv.InvVect{Type: c.invType, Hash: hash})
+		}
+	}
+	m.mu.Unlock()
+	sendRequests(retries)
+}
+
+// sendRequests sends the getdata messages of retries. A failure only
+// concerns its peer, whose request times out in turn.
+func sendRequests(retries map[*network.Peer][]inv.InvVect) {
+	for p, vects := range retries {
+		if err := p.GetData(vects...); err != nil {
+			log.Debugf("Failed to request %d transactions from %s: %v", len(vects), p.Addr(), err)
+		}
+	}
+}
+
+// expireRequests forgets announcements that no peer delivered. It must be
+// called with m.mu held.
+func (m *Pool) expireRequests(now time.Time) {
+	for hash, req := range m.requests {
+		if now.Sub(req.announced) > 10*requestTimeout {
+			delete(m.requests, hash)
+		}
+	}
+}
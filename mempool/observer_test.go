@@ -0,0 +1,199 @@
+package mempool
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// relayer is a remote peer that announces transactions and serves them,
+// unless it is told it does not have them. A silent relayer does not
+// answer.
+type relayer struct {
+	*network.Peer
+	mu        sync.Mutex
+	txs       map[utils.Hash]*transaction.Tx
+	requested []inv.InvVect
+	silent    bool
+}
+
+func (r *relayer) handleGetData(p *network.Peer, vects []inv.InvVect) error {
+	r.mu.Lock()
+	r.requested = append(r.requested, vects...)
+	if r.silent {
+		r.mu.Unlock()
+		return nil
+	}
+	var missing []inv.InvVect
+	var found []*transaction.Tx
+	for _, v := range vects {
+		if tx, ok := r.txs[v.Hash]; ok {
+			found = append(found, tx)
+		} else {
+			missing = append(missing, v)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, tx := range found {
+		if err := p.SendTx(tx); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		return p.SendNotFound(missing...)
+	}
+	return nil
+}
+
+func (r *relayer) requests() []inv.InvVect {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]inv.InvVect(nil), r.requested...)
+}
+
+func (r *relayer) announce(t *testing.T, tx *transaction.Tx) {
+	t.Helper()
+	require.NoError(t, r.SendInv(inv.InvVect{Type: inv.InvTypeTx, Hash: tx.TxID()}))
+}
+
+func connect(t *testing.T, m *Pool, addr string, txs ...*transaction.Tx) *relayer {
+	t.Helper()
+	a, b := net.Pipe()
+	local := network.NewPeer(a, addr, network.PeerConfig{Relay: true})
+	r := &relayer{Peer: network.NewPeer(b, "local", network.PeerConfig{}), txs: make(map[utils.Hash]*transaction.Tx)}
+	for _, tx := range txs {
+		r.txs[tx.TxID()] = tx
+	}
+	m.SetupPeer(local)
+	r.OnGetData(r.handleGetData)
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- r.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.True(t, r.Version().Relay, "we ask peers to relay transactions")
+	t.Cleanup(local.Disconnect)
+	return r
+}
+
+func TestObserver(t *testing.T) {
+	m := New(Config{})
+	added := make(chan Event, 10)
+	m.Subscribe(func(e Event) {
+		if e.Type == TxAdded {
+			added <- e
+		}
+	})
+	tx := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+
+	a := connect(t, m, "a", tx)
+	b := connect(t, m, "b", tx)
+	start := time.Now()
+	a.announce(t, tx)
+
+	var e Event
+	select {
+	case e = <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("announced transaction was not fetched")
+	}
+	assert.Equal(t, tx.TxID(), e.Entry.TxID)
+	assert.Equal(t, "a", e.Entry.FirstPeer)
+	assert.WithinDuration(t, start, e.Entry.FirstSeen, time.Second)
+	assert.Equal(t, []inv.InvVect{{Type: inv.InvTypeTx, Hash: tx.TxID()}}, a.requests())
+
+	// Another announcement of a transaction we have is not fetched again;
+	// that of a new one, handled after it, is.
+	b.announce(t, tx)
+	other := spend([]transaction.OutPoint{confirmed(2)}, 1000)
+	b.announce(t, other)
+	require.Eventually(t, func() bool { return len(b.requests()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, other.TxID(), b.requests()[0].Hash)
+}
+
+func TestObserverAsksNextPeerAfterNotFound(t *testing.T) {
+	m := New(Config{})
+	tx := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	a := connect(t, m, "a")
+	b := connect(t, m, "b", tx)
+
+	a.announce(t, tx)
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		req := m.requests[tx.TxID()]
+		return req != nil && req.peer == nil
+	}, 5*time.Second, 10*time.Millisecond, "notfound frees the request")
+
+	b.announce(t, tx)
+	require.Eventually(t, func() bool { return m.Has(tx.TxID()) }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, a.requests(), 1)
+	assert.Len(t, b.requests(), 1)
+
+	e, _ := m.Get(tx.TxID())
+	assert.Equal(t, "a", e.FirstPeer, "first seen is the first announcement")
+}
+
+// waitCandidates waits until the request for hash records n other
+// announcers.
+func waitCandidates(t *testing.T, m *Pool, hash utils.Hash, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		req := m.requests[hash]
+		return req != nil && len(req.candidates) == n
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestObserverAsksOtherAnnouncers(t *testing.T) {
+	m := New(Config{})
+	tx := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	vect := inv.InvVect{Type: inv.InvTypeTx, Hash: tx.TxID()}
+	a := connect(t, m, "a")
+	a.silent = true
+	b := connect(t, m, "b", tx)
+
+	// b announces while a is asked; b is only asked once a answers
+	// notfound, without announcing again.
+	a.announce(t, tx)
+	require.Eventually(t, func() bool { return len(a.requests()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	b.announce(t, tx)
+	waitCandidates(t, m, tx.TxID(), 1)
+	assert.Empty(t, b.requests())
+	require.NoError(t, a.SendNotFound(vect))
+	require.Eventually(t, func() bool { return m.Has(tx.TxID()) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []inv.InvVect{vect}, b.requests())
+}
+
+func TestObserverRetriesAfterTimeout(t *testing.T) {
+	m := New(Config{})
+	tx := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	a := connect(t, m, "a", tx)
+	a.silent = true
+	b := connect(t, m, "b", tx)
+
+	a.announce(t, tx)
+	require.Eventually(t, func() bool { return len(a.requests()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	b.announce(t, tx)
+	waitCandidates(t, m, tx.TxID(), 1)
+
+	m.retryRequests(time.Now())
+	assert.Empty(t, b.requests(), "a still has time to answer")
+	m.retryRequests(time.Now().Add(requestTimeout))
+	require.Eventually(t, func() bool { return m.Has(tx.TxID()) }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, b.requests(), 1)
+	e, _ := m.Get(tx.TxID())
+	assert.Equal(t, "a", e.FirstPeer)
+}
@@ -0,0 +1,467 @@
+// Package mempool watches the transactions our peers relay and keeps them
+// in an in-memory pool. It does not validate scripts or check inputs
+// against a UTXO set: it records what the network relays, not what a full
+// node would accept.
+package mempool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// Defaults from Bitcoin Core's -maxmempool and -mempoolexpiry.
+const (
+	DefaultMaxSize = 300 << 20
+	DefaultExpiry  = 336 * time.Hour
+
+	// expiryInterval is how often Run looks for expired transactions.
+	expiryInterval = time.Minute
+	// trimLowWater is the share of the maximum size, in percent, that a
+	// full pool is trimmed down to. Evicting a batch at a time ranks the
+	// pool once per batch instead of on every add.
+	trimLowWater = 95
+)
+
+// Entry is a transaction of the pool.
+type Entry struct {
+	Tx    *transaction.Tx
+	TxID  utils.Hash
+	WTxID utils.Hash
+	Size  int
+	VSize int
+	// FirstSeen is when the transaction was first announced to us, and
+	// FirstPeer the address of the peer that did.
+	FirstSeen time.Time
+	FirstPeer string
+	// Fee is in satoshis. It is only known, and FeeKnown set, once every
+	// input spends an output of a transaction we have seen in the pool.
+	Fee      int64
+	FeeKnown bool
+}
+
+// FeeRate returns the fee in satoshis per virtual byte, or 0 when the fee
+// is not known.
+func (e *Entry) FeeRate() float64 {
+	if !e.FeeKnown || e.VSize == 0 {
+		return 0
+	}
+	return float64(e.Fee) / float64(e.VSize)
+}
+
+// EventType is the kind of change to the pool an Event describes.
+type EventType int
+
+// Event types.
+const (
+	// TxAdded is emitted for every transaction entering the pool.
+	TxAdded EventType = iota
+	// TxRemoved is emitted for every transaction leaving it.
+	TxRemoved
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case TxAdded:
+		return "TxAdded"
+	case TxRemoved:
+		return "TxRemoved"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// RemovalReason tells why a transaction left the pool.
+type RemovalReason int
+
+// Removal reasons, named after Bitcoin Core's MemPoolRemovalReason.
+const (
+	// Expired transactions stayed in the pool longer than the expiry.
+	Expired RemovalReason = iota
+	// SizeLimit evicts the lowest feerate transactions when the pool is
+	// full.
+	SizeLimit
+	// Confirmed transactions were included in a block.
+	Confirmed
+	// Conflict transactions spend an output a block spent differently.
+	Conflict
+	// Replaced transactions spend an output a newer transaction spends.
+	Replaced
+)
+
+// String returns the name of the reason.
+func (r RemovalReason) String() string {
+	switch r {
+	case Expired:
+		return "expiry"
+	case SizeLimit:
+		return "sizelimit"
+	case Confirmed:
+		return "block"
+	case Conflict:
+		return "conflict"
+	case Replaced:
+		return "replaced"
+	}
+	return fmt.Sprintf("RemovalReason(%d)", int(r))
+}
+
+// Event is a change to the pool.
+type Event struct {
+	Type  EventType
+	Entry Entry
+	// Reason is set for TxRemoved events.
+	Reason RemovalReason
+}
+
+// EventHandler receives pool events.
+type EventHandler func(Event)
+
+// Config configures a Pool.
+type Config struct {
+	// MaxSize bounds the total serialized size of the pool in bytes. It
+	// defaults to DefaultMaxSize. Once exceeded, the pool is trimmed to
+	// trimLowWater percent of it.
+	MaxSize int
+	// Expiry is how long a transaction may stay in the pool. It defaults to
+	// DefaultExpiry.
+	Expiry time.Duration
+}
+
+// Pool holds the transactions relayed by our peers.
+type Pool struct {
+	cfg Config
+
+	mu      sync.Mutex
+	entries map[utils.Hash]*Entry
+	byWTxID map[utils.Hash]*Entry
+	// spends maps every outpoint spent by a pool transaction to its txid.
+	spends   map[transaction.OutPoint]utils.Hash
+	size     int
+	requests map[utils.Hash]*request
+
+	notifyMu sync.Mutex
+	handlers []EventHandler
+}
+
+// New returns an empty pool.
+func New(cfg Config) *Pool {
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.Expiry == 0 {
+		cfg.Expiry = DefaultExpiry
+	}
+	return &Pool{
+		cfg:      cfg,
+		entries:  make(map[utils.Hash]*Entry),
+		byWTxID:  make(map[utils.Hash]*Entry),
+		spends:   make(map[transaction.OutPoint]utils.Hash),
+		requests: make(map[utils.Hash]*request),
+	}
+}
+
+// Subscribe registers h for the events of every later change. Handlers are
+// called in registration order, synchronously and outside the pool's lock,
+// so they may read the pool but must not change it.
+func (m *Pool) Subscribe(h EventHandler) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.handlers = append(m.handlers, h)
+}
+
+func (m *Pool) notify(events []Event) {
+	for _, e := range events {
+		for _, h := range m.handlers {
+			h(e)
+		}
+	}
+}
+
+// Get returns the entry of the transaction with the given txid.
+func (m *Pool) Get(txid utils.Hash) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[txid]
+	if !ok {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Txs returns the transactions of the pool in no particular order.
+func (m *Pool) Txs() []*transaction.Tx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txs := make([]*transaction.Tx, 0, len(m.entries))
+	for _, e := range m.entries {
+		txs = append(txs, e.Tx)
+	}
+	return txs
+}
+
+// Has reports whether the pool holds the transaction with the given txid
+// or wtxid.
+func (m *Pool) Has(hash utils.Hash) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.has(hash)
+}
+
+func (m *Pool) has(hash utils.Hash) bool {
+	_, ok := m.entries[hash]
+	if !ok {
+		_, ok = m.byWTxID[hash]
+	}
+	return ok
+}
+
+// Len returns the number of transactions in the pool.
+func (m *Pool) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Size returns the total serialized size of the pool in bytes.
+func (m *Pool) Size() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// Add puts tx in the pool as first seen from peer at the given time,
+// evicting what no longer fits. It reports whether tx was new.
+func (m *Pool) Add(tx *transaction.Tx, firstSeen time.Time, peer string) bool {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	events, added := m.add(tx, firstSeen, peer)
+	m.mu.Unlock()
+
+	m.notify(events)
+	return added
+}
+
+func (m *Pool) add(tx *transaction.Tx, firstSeen time.Time, peer string) ([]Event, bool) {
+	txid := tx.TxID()
+	if _, ok := m.entries[txid]; ok {
+		return nil, false
+	}
+	e := &Entry{
+		Tx:        tx,
+		TxID:      txid,
+		WTxID:     tx.WTxID(),
+		Size:      tx.TotalSize(),
+		VSize:     tx.VSize(),
+		FirstSeen: firstSeen,
+		FirstPeer: peer,
+	}
+
+	// Without validation we cannot tell which of two transactions spending
+	// the same output the network will keep; like a replacement, the newer
+	// one wins.
+	var events []Event
+	for _, in := range tx.TxIn {
+		if other, ok := m.spends[in.PreviousOutPoint]; ok {
+			events = m.removeWithDescendants(other, Replaced, events)
+		}
+	}
+
+	m.entries[txid] = e
+	m.byWTxID[e.WTxID] = e
+	m.size += e.Size
+	for _, in := range tx.TxIn {
+		m.spends[in.PreviousOutPoint] = txid
+	}
+	m.computeFee(e)
+	// Children that arrived first now have all their inputs.
+	for i := range tx.TxOut {
+		if child, ok := m.spends[transaction.OutPoint{Hash: txid, Index: uint32(i)}]; ok {
+			m.computeFee(m.entries[child])
+		}
+	}
+	events = append(events, Event{Type: TxAdded, Entry: *e})
+	return m.trim(events), true
+}
+
+// computeFee sets the fee of e if all its inputs are outputs of pool
+// transactions.
+func (m *Pool) computeFee(e *Entry) {
+	if e.FeeKnown {
+		return
+	}
+	var in, out int64
+	for _, txIn := range e.Tx.TxIn {
+		parent, ok := m.entries[txIn.PreviousOutPoint.Hash]
+		if !ok || int(txIn.PreviousOutPoint.Index) >= len(parent.Tx.TxOut) {
+			return
+		}
+		in += parent.Tx.TxOut[txIn.PreviousOutPoint.Index].Value
+	}
+	for _, txOut := range e.Tx.TxOut {
+		out += txOut.Value
+	}
+	e.Fee, e.FeeKnown = in-out, true
+}
+
+// trim evicts transactions with their descendants, lowest descendant
+// feerate first like Bitcoin Core, once the pool exceeds its maximum size
+// and until it is back to the low-water mark. Unknown fees count as zero.
+func (m *Pool) trim(events []Event) []Event {
+	if m.size <= m.cfg.MaxSize {
+		return events
+	}
+	target := m.cfg.MaxSize * trimLowWater / 100
+	type candidate struct {
+		e       *Entry
+		feeRate float64
+	}
+	candidates := make([]candidate, 0, len(m.entries))
+	for _, e := range m.entries {
+		candidates = append(candidates, candidate{e, m.descendantFeeRate(e)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].feeRate != candidates[j].feeRate {
+			return candidates[i].feeRate < candidates[j].feeRate
+		}
+		return candidates[i].e.FirstSeen.Before(candidates[j].e.FirstSeen)
+	})
+	for _, c := range candidates {
+		if m.size <= target {
+			break
+		}
+		events = m.removeWithDescendants(c.e.TxID, SizeLimit, events)
+	}
+	return events
+}
+
+// descendantFeeRate returns the feerate of e and all its descendants
+// together, the price of evicting them.
+func (m *Pool) descendantFeeRate(e *Entry) float64 {
+	var fee int64
+	var vsize int
+	seen := make(map[utils.Hash]bool)
+	var walk func(e *Entry)
+	walk = func(e *Entry) {
+		if seen[e.TxID] {
+			return
+		}
+		seen[e.TxID] = true
+		if e.FeeKnown {
+			fee += e.Fee
+		}
+		vsize += e.VSize
+		for i := range e.Tx.TxOut {
+			if child, ok := m.spends[transaction.OutPoint{Hash: e.TxID, Index: uint32(i)}]; ok {
+				walk(m.entries[child])
+			}
+		}
+	}
+	walk(e)
+	return float64(fee) / float64(vsize)
+}
+
+// remove takes the transaction with the given txid out of the pool and
+// appends its removal event to events.
+func (m *Pool) remove(txid utils.Hash, reason RemovalReason, events []Event) []Event {
+	e, ok := m.entries[txid]
+	if !ok {
+		return events
+	}
+	delete(m.entries, txid)
+	delete(m.byWTxID, e.WTxID)
+	m.size -= e.Size
+	for _, in := range e.Tx.TxIn {
+		if m.spends[in.PreviousOutPoint] == txid {
+			delete(m.spends, in.PreviousOutPoint)
+		}
+	}
+	return append(events, Event{Type: TxRemoved, Entry: *e, Reason: reason})
+}
+
+// removeWithDescendants removes the transaction and everything that spends
+// its outputs, children first.
+func (m *Pool) removeWithDescendants(txid utils.Hash, reason RemovalReason, events []Event) []Event {
+	e, ok := m.entries[txid]
+	if !ok {
+		return events
+	}
+	for i := range e.Tx.TxOut {
+		if child, ok := m.spends[transaction.OutPoint{Hash: txid, Index: uint32(i)}]; ok {
+			events = m.removeWithDescendants(child, reason, events)
+		}
+	}
+	return m.remove(txid, reason, events)
+}
+
+// ConnectBlock removes the transactions b confirms and those that conflict
+// with it.
+func (m *Pool) ConnectBlock(b *block.Block) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var events []Event
+	for _, tx := range b.Transactions {
+		txid := tx.TxID()
+		events = m.remove(txid, Confirmed, events)
+		delete(m.requests, txid)
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.TxIn {
+			if other, ok := m.spends[in.PreviousOutPoint]; ok && other != txid {
+				events = m.removeWithDescendants(other, Conflict, events)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	m.notify(events)
+}
+
+// Expire removes the transactions first seen longer than the expiry before
+// now, with their descendants.
+func (m *Pool) Expire(now time.Time) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+
+	m.mu.Lock()
+	var events []Event
+	for txid, e := range m.entries {
+		if now.Sub(e.FirstSeen) > m.cfg.Expiry {
+			events = m.removeWithDescendants(txid, Expired, events)
+		}
+	}
+	m.expireRequests(now)
+	m.mu.Unlock()
+
+	m.notify(events)
+}
+
+// Run expires transactions and retries the requests that timed out
+// periodically until ctx is done.
+func (m *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	retry := time.NewTicker(retryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.Expire(now)
+		case now := <-retry.C:
+			m.retryRequests(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
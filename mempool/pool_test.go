@@ -0,0 +1,200 @@
+package mempool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// spend returns a transaction spending prevs and paying values.
+func spend(prevs []transaction.OutPoint, values ...int64) *transaction.Tx {
+	tx := &transaction.Tx{Version: 2}
+	for _, prev := range prevs {
+		tx.TxIn = append(tx.TxIn, transaction.TxIn{PreviousOutPoint: prev, SignatureScript: []byte{0x51}, Sequence: 0xfffffffd})
+	}
+	for _, v := range values {
+		tx.TxOut = append(tx.TxOut, transaction.TxOut{Value: v, PkScript: []byte{0x51}})
+	}
+	return tx
+}
+
+func out(tx *transaction.Tx, index uint32) transaction.OutPoint {
+	return transaction.OutPoint{Hash: tx.TxID(), Index: index}
+}
+
+// confirmed is an outpoint outside the pool.
+func confirmed(n byte) transaction.OutPoint {
+	return transaction.OutPoint{Hash: utils.Hash{n}}
+}
+
+// recorder collects pool events.
+type recorder []Event
+
+func (r *recorder) handle(e Event) { *r = append(*r, e) }
+
+func (r *recorder) removed() map[utils.Hash]RemovalReason {
+	removed := make(map[utils.Hash]RemovalReason)
+	for _, e := range *r {
+		if e.Type == TxRemoved {
+			removed[e.Entry.TxID] = e.Reason
+		}
+	}
+	return removed
+}
+
+func TestFees(t *testing.T) {
+	m := New(Config{})
+	now := time.Now()
+	parent := spend([]transaction.OutPoint{confirmed(1)}, 5000, 3000)
+	child := spend([]transaction.OutPoint{out(parent, 0), out(parent, 1)}, 7000)
+	grandchild := spend([]transaction.OutPoint{out(child, 0)}, 6500)
+
+	// The grandchild arrives before its parent.
+	require.True(t, m.Add(parent, now, "a"))
+	require.True(t, m.Add(grandchild, now, "a"))
+	e, ok := m.Get(grandchild.TxID())
+	require.True(t, ok)
+	assert.False(t, e.FeeKnown)
+	assert.Zero(t, e.FeeRate())
+
+	require.True(t, m.Add(child, now, "b"))
+	assert.False(t, m.Add(child, now, "c"), "known transactions are not added twice")
+
+	e, _ = m.Get(parent.TxID())
+	assert.False(t, e.FeeKnown, "the inputs of parent are not in the pool")
+	e, _ = m.Get(child.TxID())
+	assert.True(t, e.FeeKnown)
+	assert.Equal(t, int64(1000), e.Fee)
+	assert.Equal(t, "b", e.FirstPeer)
+	assert.InDelta(t, 1000/float64(child.VSize()), e.FeeRate(), 1e-9)
+	e, _ = m.Get(grandchild.TxID())
+	assert.True(t, e.FeeKnown)
+	assert.Equal(t, int64(500), e.Fee)
+
+	assert.Equal(t, 3, m.Len())
+	assert.Equal(t, parent.TotalSize()+child.TotalSize()+grandchild.TotalSize(), m.Size())
+	assert.True(t, m.Has(child.WTxID()))
+}
+
+func TestConnectBlock(t *testing.T) {
+	m := New(Config{})
+	var events recorder
+	m.Subscribe(events.handle)
+	now := time.Now()
+
+	a := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	aChild := spend([]transaction.OutPoint{out(a, 0)}, 900)
+	b := spend([]transaction.OutPoint{confirmed(2)}, 1000)
+	bChild := spend([]transaction.OutPoint{out(b, 0)}, 900)
+	for _, tx := range []*transaction.Tx{a, aChild, b, bChild} {
+		m.Add(tx, now, "peer")
+	}
+
+	// The block confirms a and spends b's input differently.
+	doubleSpend := spend([]transaction.OutPoint{confirmed(2)}, 990)
+	coinbase := spend([]transaction.OutPoint{{Index: 0xffffffff}}, 50e8)
+	m.ConnectBlock(&block.Block{Transactions: []*transaction.Tx{coinbase, a, doubleSpend}})
+
+	assert.Equal(t, map[utils.Hash]RemovalReason{
+		a.TxID():      Confirmed,
+		b.TxID():      Conflict,
+		bChild.TxID(): Conflict,
+	}, events.removed())
+	assert.Equal(t, 1, m.Len())
+	assert.Equal(t, []*transaction.Tx{aChild}, m.Txs())
+	e, ok := m.Get(aChild.TxID())
+	require.True(t, ok)
+	assert.True(t, e.FeeKnown, "the fee stays known once the parent confirms")
+	assert.Equal(t, aChild.TotalSize(), m.Size())
+}
+
+func TestReplaced(t *testing.T) {
+	m := New(Config{})
+	var events recorder
+	m.Subscribe(events.handle)
+	now := time.Now()
+
+	original := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	child := spend([]transaction.OutPoint{out(original, 0)}, 900)
+	replacement := spend([]transaction.OutPoint{confirmed(1)}, 800)
+	m.Add(original, now, "a")
+	m.Add(child, now, "a")
+	m.Add(replacement, now, "b")
+
+	assert.Equal(t, map[utils.Hash]RemovalReason{original.TxID(): Replaced, child.TxID(): Replaced}, events.removed())
+	assert.True(t, m.Has(replacement.TxID()))
+	assert.Equal(t, TxAdded, events[len(events)-1].Type)
+	assert.Equal(t, replacement.TxID(), events[len(events)-1].Entry.TxID)
+}
+
+func TestSizeLimit(t *testing.T) {
+	now := time.Now()
+	funding := spend([]transaction.OutPoint{confirmed(1)}, 10000, 10000, 10000)
+	cheap := spend([]transaction.OutPoint{out(funding, 0)}, 9900)
+	rich := spend([]transaction.OutPoint{out(funding, 1)}, 5000)
+	medium := spend([]transaction.OutPoint{out(funding, 2)}, 9000)
+
+	// Room for the funding transaction and two of its children.
+	m := New(Config{MaxSize: funding.TotalSize() + 2*cheap.TotalSize()})
+	var events recorder
+	m.Subscribe(events.handle)
+	m.Add(funding, now, "peer")
+	m.Add(cheap, now, "peer")
+	m.Add(rich, now, "peer")
+	m.Add(medium, now, "peer")
+
+	// The funding transaction has an unknown fee, but evicting it would
+	// take its well paying children with it; the cheapest child goes first.
+	assert.Contains(t, events.removed(), cheap.TxID())
+	assert.Equal(t, SizeLimit, events.removed()[cheap.TxID()])
+	assert.True(t, m.Has(rich.TxID()))
+	assert.LessOrEqual(t, m.Size(), funding.TotalSize()+2*cheap.TotalSize())
+}
+
+func TestSizeLimitLowWater(t *testing.T) {
+	now := time.Now()
+	var txs []*transaction.Tx
+	for i := byte(1); i <= 22; i++ {
+		txs = append(txs, spend([]transaction.OutPoint{confirmed(i)}, 1000))
+	}
+	size := txs[0].TotalSize()
+	m := New(Config{MaxSize: 20 * size})
+	var events recorder
+	m.Subscribe(events.handle)
+	for i, tx := range txs[:21] {
+		m.Add(tx, now.Add(time.Duration(i)*time.Second), "peer")
+	}
+
+	// Going over the limit evicts down to 95% of it, oldest first as no
+	// fee is known.
+	assert.Equal(t, map[utils.Hash]RemovalReason{txs[0].TxID(): SizeLimit, txs[1].TxID(): SizeLimit}, events.removed())
+	assert.Equal(t, 19*size, m.Size())
+
+	// The next transaction fits without evicting anything.
+	m.Add(txs[21], now.Add(21*time.Second), "peer")
+	assert.Len(t, events.removed(), 2)
+	assert.Equal(t, 20, m.Len())
+}
+
+func TestExpire(t *testing.T) {
+	m := New(Config{Expiry: time.Hour})
+	var events recorder
+	m.Subscribe(events.handle)
+	now := time.Now()
+
+	old := spend([]transaction.OutPoint{confirmed(1)}, 1000)
+	oldChild := spend([]transaction.OutPoint{out(old, 0)}, 900)
+	recent := spend([]transaction.OutPoint{confirmed(2)}, 1000)
+	m.Add(old, now.Add(-2*time.Hour), "peer")
+	m.Add(oldChild, now, "peer")
+	m.Add(recent, now.Add(-time.Minute), "peer")
+
+	m.Expire(now)
+	assert.Equal(t, map[utils.Hash]RemovalReason{old.TxID(): Expired, oldChild.TxID(): Expired}, events.removed())
+	assert.Equal(t, 1, m.Len())
+}
@@ -0,0 +1,67 @@
+package netaddr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// EncodeAddrMessage returns the payload of an addr message. Only IPv4 and
+// IPv6 addresses can be sent this way; others are skipped.
+func EncodeAddrMessage(addrs []AddrV2) ([]byte, error) {
+	entries := make([]NetAddr, 0, len(addrs))
+	times := make([]uint32, 0, len(addrs))
+	for _, a := range addrs {
+		if addr, ok := a.NetAddr(); ok {
+			entries = append(entries, addr)
+			times = append(times, a.Time)
+		}
+	}
+	if len(entries) > MaxAddrEntries {
+		return nil, fmt.Errorf("too many addresses: %d", len(entries))
+	}
+
+	var buf bytes.Buffer
+	if err := utils.WriteVarInt(&buf, uint64(len(entries))); err != nil {
+		return nil, err
+	}
+	for i, addr := range entries {
+		if err := binary.Write(&buf, binary.LittleEndian, times[i]); err != nil {
+			return nil, err
+		}
+		if err := WriteNetAddr(&buf, addr); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeAddrMessage parses the payload of an addr message. The entries are
+// returned in their BIP155 form so that addr and addrv2 can be handled
+// alike.
+func DecodeAddrMessage(payload []byte) ([]AddrV2, error) {
+	r := bytes.NewReader(payload)
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxAddrEntries {
+		return nil, fmt.Errorf("too many addresses: %d", count)
+	}
+
+	addrs := make([]AddrV2, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var timestamp uint32
+		if err := binary.Read(r, binary.LittleEndian, &timestamp); err != nil {
+			return nil, err
+		}
+		var addr NetAddr
+		if err := ParseNetAddr(r, &addr); err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, NewAddrV2(addr, timestamp))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,211 @@
+package netaddr
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"golang.org/x/crypto/sha3"
+)
+
+// Network IDs of BIP155 addresses.
+const (
+	NetworkIPv4  = 1
+	NetworkIPv6  = 2
+	NetworkTorV2 = 3
+	NetworkTorV3 = 4
+	NetworkI2P   = 5
+	NetworkCJDNS = 6
+)
+
+// MaxAddrEntries is the largest number of entries an addr or addrv2 message
+// may carry.
+const MaxAddrEntries = 1000
+
+const maxAddrV2Length = 512
+
+var addrV2Lengths = map[byte]int{
+	NetworkIPv4:  4,
+	NetworkIPv6:  16,
+	NetworkTorV2: 10,
+	NetworkTorV3: 32,
+	NetworkI2P:   32,
+	NetworkCJDNS: 16,
+}
+
+var onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// AddrV2 is an address as relayed in the addrv2 message (BIP155). Unlike
+// NetAddr it can hold Tor v3, I2P and CJDNS addresses.
+type AddrV2 struct {
+	Time     uint32
+	Services uint64
+	Network  byte
+	Addr     []byte
+	Port     uint16
+}
+
+// NewTorV3AddrV2 returns the address of the Tor v3 onion service with the
+// given service ID (the host name without ".onion").
+func NewTorV3AddrV2(serviceID string, port uint16, services uint64) (AddrV2, error) {
+	decoded, err := onionEncoding.DecodeString(strings.ToUpper(strings.TrimSuffix(serviceID, ".onion")))
+	if err != nil {
+		return AddrV2{}, fmt.Errorf("invalid onion address %s: %w", serviceID, err)
+	}
+	if len(decoded) != 35 || decoded[34] != 3 {
+		return AddrV2{}, fmt.Errorf("invalid onion address %s: not a v3 address", serviceID)
+	}
+	pubkey := decoded[:32]
+	if checksum := onionChecksum(pubkey); !bytes.Equal(checksum[:], decoded[32:34]) {
+		return AddrV2{}, fmt.Errorf("invalid onion address %s: bad checksum", serviceID)
+	}
+	return AddrV2{Services: services, Network: NetworkTorV3, Addr: pubkey, Port: port}, nil
+}
+
+// NewAddrV2 converts a NetAddr to its BIP155 form.
+func NewAddrV2(addr NetAddr, timestamp uint32) AddrV2 {
+	ip := net.IP(addr.IP[:])
+	a := AddrV2{Time: timestamp, Services: addr.Services, Port: addr.Port}
+	if ip4 := ip.To4(); ip4 != nil {
+		a.Network, a.Addr = NetworkIPv4, ip4
+	} else {
+		a.Network, a.Addr = NetworkIPv6, ip.To16()
+	}
+	return a
+}
+
+// NetAddr returns the address as a NetAddr. It fails for networks that do
+// not fit in 16 bytes.
+func (a AddrV2) NetAddr() (NetAddr, bool) {
+	addr := NetAddr{Services: a.Services, Port: a.Port}
+	switch a.Network {
+	case NetworkIPv4:
+		copy(addr.IP[:], net.IP(a.Addr).To16())
+	case NetworkIPv6:
+		copy(addr.IP[:], a.Addr)
+	default:
+		return NetAddr{}, false
+	}
+	return addr, true
+}
+
+// Host returns the host part of the address: an IP or an onion name.
+func (a AddrV2) Host() string {
+	switch a.Network {
+	case NetworkIPv4, NetworkIPv6, NetworkCJDNS:
+		return net.IP(a.Addr).String()
+	case NetworkTorV2:
+		return strings.ToLower(onionEncoding.EncodeToString(a.Addr)) + ".onion"
+	case NetworkTorV3:
+		checksum := onionChecksum(a.Addr)
+		data := append(append(append([]byte{}, a.Addr...), checksum[:]...), 3)
+		return strings.ToLower(onionEncoding.EncodeToString(data)) + ".onion"
+	case NetworkI2P:
+		return strings.ToLower(onionEncoding.EncodeToString(a.Addr)) + ".b32.i2p"
+	default:
+		return fmt.Sprintf("unknown-%d-%x", a.Network, a.Addr)
+	}
+}
+
+// String returns the address in host:port form.
+func (a AddrV2) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(int(a.Port)))
+}
+
+func onionChecksum(pubkey []byte) [2]byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pubkey)
+	h.Write([]byte{3})
+	var checksum [2]byte
+	copy(checksum[:], h.Sum(nil))
+	return checksum
+}
+
+// WriteAddrV2 writes a single addrv2 entry.
+func WriteAddrV2(w io.Writer, a AddrV2) error {
+	if err := binary.Write(w, binary.LittleEndian, a.Time); err != nil {
+		return err
+	}
+	if err := utils.WriteVarInt(w, a.Services); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{a.Network}); err != nil {
+		return err
+	}
+	if err := utils.WriteVarBytes(w, a.Addr); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, a.Port)
+}
+
+// ParseAddrV2 reads a single addrv2 entry. Addresses of a known network
+// with the wrong length are rejected; unknown networks are kept as is.
+func ParseAddrV2(r io.Reader) (AddrV2, error) {
+	var a AddrV2
+	if err := binary.Read(r, binary.LittleEndian, &a.Time); err != nil {
+		return a, err
+	}
+	services, err := utils.ReadVarInt(r)
+	if err != nil {
+		return a, err
+	}
+	a.Services = services
+	var network [1]byte
+	if _, err := io.ReadFull(r, network[:]); err != nil {
+		return a, err
+	}
+	a.Network = network[0]
+	if a.Addr, err = utils.ReadVarBytes(r, maxAddrV2Length); err != nil {
+		return a, err
+	}
+	if length, ok := addrV2Lengths[a.Network]; ok && len(a.Addr) != length {
+		return a, fmt.Errorf("invalid length %d for network %d", len(a.Addr), a.Network)
+	}
+	err = binary.Read(r, binary.BigEndian, &a.Port)
+	return a, err
+}
+
+// EncodeAddrV2Message returns the payload of an addrv2 message.
+func EncodeAddrV2Message(addrs []AddrV2) ([]byte, error) {
+	if len(addrs) > MaxAddrEntries {
+		return nil, fmt.Errorf("too many addresses: %d", len(addrs))
+	}
+	var buf bytes.Buffer
+	if err := utils.WriteVarInt(&buf, uint64(len(addrs))); err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if err := WriteAddrV2(&buf, a); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeAddrV2Message parses the payload of an addrv2 message.
+func DecodeAddrV2Message(payload []byte) ([]AddrV2, error) {
+	r := bytes.NewReader(payload)
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > MaxAddrEntries {
+		return nil, fmt.Errorf("too many addresses: %d", count)
+	}
+	addrs := make([]AddrV2, 0, count)
+	for i := uint64(0); i < count; i++ {
+		a, err := ParseAddrV2(r)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
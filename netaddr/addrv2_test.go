@@ -0,0 +1,108 @@
+package netaddr
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testOnion = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd.onion"
+
+func TestNewTorV3AddrV2(t *testing.T) {
+	addr, err := NewTorV3AddrV2(testOnion, 8333, 1)
+	if err != nil {
+		t.Fatalf("Failed to parse onion address: %v", err)
+	}
+	if addr.Network != NetworkTorV3 || len(addr.Addr) != 32 {
+		t.Errorf("Expected a 32 byte Tor v3 address, got network %d with %d bytes", addr.Network, len(addr.Addr))
+	}
+	if got := addr.String(); got != testOnion+":8333" {
+		t.Errorf("Expected %s:8333, got %s", testOnion, got)
+	}
+
+	if _, err := NewTorV3AddrV2("pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscrya.onion", 8333, 1); err == nil {
+		t.Error("Expected an error for a bad checksum")
+	}
+	if _, err := NewTorV3AddrV2("expyuzz4wqqyqhjn.onion", 8333, 1); err == nil {
+		t.Error("Expected an error for a v2 onion address")
+	}
+}
+
+func TestAddrV2MessageRoundTrip(t *testing.T) {
+	onion, err := NewTorV3AddrV2(testOnion, 8333, 1)
+	if err != nil {
+		t.Fatalf("Failed to parse onion address: %v", err)
+	}
+	onion.Time = 1700000000
+	addrs := []AddrV2{
+		NewAddrV2(NewNetAddr("1.2.3.4", 8333, 1033), 1700000001),
+		NewAddrV2(NewNetAddr("2001:db8::1", 18333, 1), 1700000002),
+		onion,
+	}
+
+	payload, err := EncodeAddrV2Message(addrs)
+	if err != nil {
+		t.Fatalf("Failed to encode addrv2: %v", err)
+	}
+	decoded, err := DecodeAddrV2Message(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode addrv2: %v", err)
+	}
+	if len(decoded) != len(addrs) {
+		t.Fatalf("Expected %d addresses, got %d", len(addrs), len(decoded))
+	}
+	for i := range addrs {
+		if decoded[i].String() != addrs[i].String() || decoded[i].Time != addrs[i].Time || decoded[i].Services != addrs[i].Services {
+			t.Errorf("Expected %+v, got %+v", addrs[i], decoded[i])
+		}
+	}
+
+	netAddr, ok := decoded[0].NetAddr()
+	if !ok || netAddr.String() != "1.2.3.4:8333" {
+		t.Errorf("Expected 1.2.3.4:8333, got %s", netAddr)
+	}
+	if _, ok := decoded[2].NetAddr(); ok {
+		t.Error("Onion address should not convert to NetAddr")
+	}
+}
+
+func TestParseAddrV2InvalidLength(t *testing.T) {
+	var buf bytes.Buffer
+	bad := AddrV2{Network: NetworkIPv4, Addr: []byte{1, 2, 3}, Port: 8333}
+	if err := WriteAddrV2(&buf, bad); err != nil {
+		t.Fatalf("Failed to write addrv2: %v", err)
+	}
+	if _, err := ParseAddrV2(&buf); err == nil {
+		t.Error("Expected an error for a 3 byte IPv4 address")
+	}
+}
+
+func TestAddrMessageRoundTrip(t *testing.T) {
+	onion, _ := NewTorV3AddrV2(testOnion, 8333, 1)
+	addrs := []AddrV2{
+		NewAddrV2(NewNetAddr("1.2.3.4", 8333, 1033), 1700000001),
+		onion,
+		NewAddrV2(NewNetAddr("2001:db8::1", 18333, 1), 1700000002),
+	}
+
+	payload, err := EncodeAddrMessage(addrs)
+	if err != nil {
+		t.Fatalf("Failed to encode addr: %v", err)
+	}
+	if len(payload) != 1+2*30 {
+		t.Errorf("Expected %d bytes, got %d", 1+2*30, len(payload))
+	}
+
+	decoded, err := DecodeAddrMessage(payload)
+	if err != nil {
+		t.Fatalf("Failed to decode addr: %v", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Expected 2 addresses, got %d", len(decoded))
+	}
+	if decoded[0].String() != "1.2.3.4:8333" || decoded[0].Time != 1700000001 || decoded[0].Services != 1033 {
+		t.Errorf("Unexpected first address %+v", decoded[0])
+	}
+	if decoded[1].String() != "[2001:db8::1]:18333" || decoded[1].Network != NetworkIPv6 {
+		t.Errorf("Unexpected second address %+v", decoded[1])
+	}
+}
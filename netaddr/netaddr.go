@@ -3,7 +3,9 @@ package netaddr
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"net"
+	"strconv"
 )
 
 type NetAddr struct {
@@ -50,3 +52,19 @@ func ParseNetAddr(reader *bytes.Reader, addr *NetAddr) error {
 	}
 	return nil
 }
+
+// String returns the address in host:port form.
+func (n NetAddr) String() string {
+	return net.JoinHostPort(net.IP(n.IP[:]).String(), strconv.Itoa(int(n.Port)))
+}
+
+// NetGroup returns the network group of the address: the /16 for IPv4 and
+// the /32 for IPv6. Peers in the same group are likely run by the same
+// operator, so we only keep one outbound connection per group.
+func (n NetAddr) NetGroup() string {
+	ip := net.IP(n.IP[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d", ip4[0], ip4[1])
+	}
+	return fmt.Sprintf("%x:%x", n.IP[0:2], n.IP[2:4])
+}
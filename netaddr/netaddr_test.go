@@ -102,3 +102,31 @@ func TestParseNetAddr(t *testing.T) {
 		t.Errorf("Expected port %d, got %d", port, parsedAddr.Port)
 	}
 }
+
+func TestNetGroup(t *testing.T) {
+	tests := []struct {
+		ip    string
+		group string
+	}{
+		{"1.2.3.4", "1.2"},
+		{"1.2.200.7", "1.2"},
+		{"8.8.8.8", "8.8"},
+		{"2001:0db8:85a3::8a2e:0370:7334", "2001:0db8"},
+		{"2001:0db8:ffff::1", "2001:0db8"},
+	}
+	for _, tt := range tests {
+		addr := NewNetAddr(tt.ip, 8333, 1)
+		if got := addr.NetGroup(); got != tt.group {
+			t.Errorf("NetGroup(%s): expected %s, got %s", tt.ip, tt.group, got)
+		}
+	}
+}
+
+func TestNetAddrString(t *testing.T) {
+	if got := NewNetAddr("1.2.3.4", 8333, 1).String(); got != "1.2.3.4:8333" {
+		t.Errorf("Expected 1.2.3.4:8333, got %s", got)
+	}
+	if got := NewNetAddr("2001:db8::1", 8333, 1).String(); got != "[2001:db8::1]:8333" {
+		t.Errorf("Expected [2001:db8::1]:8333, got %s", got)
+	}
+}
@@ -0,0 +1,90 @@
+package network
+
+import "github.com/safwentrabelsi/bitcoin-handshake/block"
+
+// BlockHandler is called with every block a peer sends. Returning an error
+// disconnects the peer.
+type BlockHandler func(p *Peer, b *block.Block) error
+
+// HeadersHandler is called with the headers of a headers message.
+type HeadersHandler func(p *Peer, headers []block.Header) error
+
+// LocatorHandler is called with the locator of a getheaders or getblocks
+// message.
+type LocatorHandler func(p *Peer, l block.Locator) error
+
+// OnBlock registers h for block messages.
+func (p *Peer) OnBlock(h BlockHandler) {
+	p.Handle("block", func(p *Peer, payload []byte) error {
+		b, err := block.DecodeBlockMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, b)
+	})
+}
+
+// OnHeaders registers h for headers messages.
+func (p *Peer) OnHeaders(h HeadersHandler) {
+	p.Handle("headers", func(p *Peer, payload []byte) error {
+		headers, err := block.DecodeHeadersMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, headers)
+	})
+}
+
+// OnGetHeaders registers h for the getheaders messages requesting headers
+// from us.
+func (p *Peer) OnGetHeaders(h LocatorHandler) {
+	p.Handle("getheaders", locatorHandler(h))
+}
+
+// OnGetBlocks registers h for the getblocks messages requesting block
+// inventory from us.
+func (p *Peer) OnGetBlocks(h LocatorHandler) {
+	p.Handle("getblocks", locatorHandler(h))
+}
+
+func locatorHandler(h LocatorHandler) MessageHandler {
+	return func(p *Peer, payload []byte) error {
+		l, err := block.DecodeLocatorMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, l)
+	}
+}
+
+// SendBlock sends b to the peer.
+func (p *Peer) SendBlock(b *block.Block) error {
+	return p.Send(Message{Command: "block", Payload: block.EncodeBlockMessage(b)})
+}
+
+// SendHeaders sends headers to the peer in a single headers message.
+func (p *Peer) SendHeaders(headers []block.Header) error {
+	payload, err := block.EncodeHeadersMessage(headers)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "headers", Payload: payload})
+}
+
+// GetHeaders asks the peer for the headers following the locator.
+func (p *Peer) GetHeaders(l block.Locator) error {
+	return p.sendLocatorMessage("getheaders", l)
+}
+
+// GetBlocks asks the peer for an inv of the blocks following the locator.
+func (p *Peer) GetBlocks(l block.Locator) error {
+	return p.sendLocatorMessage("getblocks", l)
+}
+
+func (p *Peer) sendLocatorMessage(command string, l block.Locator) error {
+	payload, err := block.EncodeLocatorMessage(l)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: command, Payload: payload})
+}
@@ -0,0 +1,137 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerHeadersAndBlocks(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	genesis, err := block.DecodeBlockMessage(config.RegTestParams.GenesisBlock)
+	require.NoError(t, err)
+
+	// The remote answers getheaders with the genesis header and getblocks
+	// with the genesis block itself.
+	remote.OnGetHeaders(func(p *Peer, l block.Locator) error {
+		return p.SendHeaders([]block.Header{genesis.Header})
+	})
+	remote.OnGetBlocks(func(p *Peer, l block.Locator) error {
+		return p.SendBlock(genesis)
+	})
+	headers := make(chan []block.Header, 1)
+	blocks := make(chan *block.Block, 1)
+	local.OnHeaders(func(p *Peer, h []block.Header) error {
+		headers <- h
+		return nil
+	})
+	local.OnBlock(func(p *Peer, b *block.Block) error {
+		blocks <- b
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.NoError(t, local.GetHeaders(block.Locator{ProtocolVersion: config.ProtocolVersion}))
+	select {
+	case h := <-headers:
+		require.Len(t, h, 1)
+		assert.Equal(t, config.RegTestParams.GenesisHash, h[0].Hash())
+	case <-time.After(time.Second):
+		t.Fatal("headers were not received")
+	}
+
+	require.NoError(t, local.GetBlocks(block.Locator{ProtocolVersion: config.ProtocolVersion}))
+	select {
+	case b := <-blocks:
+		assert.Equal(t, config.RegTestParams.GenesisHash, b.Hash())
+		assert.NoError(t, b.CheckMerkleRoot())
+	case <-time.After(time.Second):
+		t.Fatal("block was not received")
+	}
+}
+
+func TestPeerCompactBlocks(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	genesis, err := block.DecodeBlockMessage(config.RegTestParams.GenesisBlock)
+	require.NoError(t, err)
+
+	sendCmpct := make(chan []byte, 1)
+	remote.Handle("sendcmpct", func(p *Peer, payload []byte) error {
+		sendCmpct <- payload
+		return p.SendCmpctBlock(&block.CompactBlock{
+			Header:    genesis.Header,
+			Prefilled: []block.PrefilledTx{{Index: 0, Tx: genesis.Transactions[0]}},
+		})
+	})
+	compact := make(chan *block.CompactBlock, 1)
+	local.OnCmpctBlock(func(p *Peer, cb *block.CompactBlock) error {
+		compact <- cb
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	assert.False(t, remote.CompactBlocks())
+	require.NoError(t, local.SendCmpct(true))
+	select {
+	case payload := <-sendCmpct:
+		assert.Equal(t, []byte{1, 2, 0, 0, 0, 0, 0, 0, 0}, payload)
+		assert.True(t, remote.CompactBlocks())
+		assert.True(t, remote.CompactBlocksHighBandwidth())
+	case <-time.After(time.Second):
+		t.Fatal("sendcmpct was not received")
+	}
+	select {
+	case cb := <-compact:
+		assert.Equal(t, config.RegTestParams.GenesisHash, cb.Header.Hash())
+		assert.Equal(t, 1, cb.TxCount())
+	case <-time.After(time.Second):
+		t.Fatal("cmpctblock was not received")
+	}
+}
+
+func TestPeerBlockTxn(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	genesis, err := block.DecodeBlockMessage(config.RegTestParams.GenesisBlock)
+	require.NoError(t, err)
+
+	remote.OnGetBlockTxn(func(p *Peer, req *block.BlockTxnRequest) error {
+		bt := &block.BlockTxns{BlockHash: req.BlockHash}
+		for _, i := range req.Indexes {
+			bt.Transactions = append(bt.Transactions, genesis.Transactions[i])
+		}
+		return p.SendBlockTxn(bt)
+	})
+	txs := make(chan *block.BlockTxns, 1)
+	local.OnBlockTxn(func(p *Peer, bt *block.BlockTxns) error {
+		txs <- bt
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.NoError(t, local.GetBlockTxn(&block.BlockTxnRequest{BlockHash: genesis.Hash(), Indexes: []uint32{0}}))
+	select {
+	case bt := <-txs:
+		assert.Equal(t, genesis.Hash(), bt.BlockHash)
+		require.Len(t, bt.Transactions, 1)
+		assert.Equal(t, genesis.Transactions[0].TxID(), bt.Transactions[0].TxID())
+	case <-time.After(time.Second):
+		t.Fatal("blocktxn was not received")
+	}
+}
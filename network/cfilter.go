@@ -0,0 +1,133 @@
+package network
+
+import (
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+)
+
+// CFilterHandler is called with every cfilter message a peer sends.
+// Returning an error disconnects the peer.
+type CFilterHandler func(p *Peer, f *cfilter.CFilter) error
+
+// CFHeadersHandler is called with every cfheaders message a peer sends.
+type CFHeadersHandler func(p *Peer, h *cfilter.CFHeaders) error
+
+// CFCheckptHandler is called with every cfcheckpt message a peer sends.
+type CFCheckptHandler func(p *Peer, c *cfilter.CFCheckpt) error
+
+// CFRequestHandler is called with the request of a getcfilters or
+// getcfheaders message.
+type CFRequestHandler func(p *Peer, req cfilter.Request) error
+
+// CFCheckptRequestHandler is called with the request of a getcfcheckpt
+// message.
+type CFCheckptRequestHandler func(p *Peer, req cfilter.CheckptRequest) error
+
+// ServesCompactFilters reports whether the peer advertised
+// NODE_COMPACT_FILTERS, serving the BIP157 messages.
+func (p *Peer) ServesCompactFilters() bool {
+	return p.version.Services&config.NodeCompactFilters != 0
+}
+
+// OnCFilter registers h for cfilter messages.
+func (p *Peer) OnCFilter(h CFilterHandler) {
+	p.Handle("cfilter", func(p *Peer, payload []byte) error {
+		f, err := cfilter.DecodeCFilterMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, f)
+	})
+}
+
+// OnCFHeaders registers h for cfheaders messages.
+func (p *Peer) OnCFHeaders(h CFHeadersHandler) {
+	p.Handle("cfheaders", func(p *Peer, payload []byte) error {
+		headers, err := cfilter.DecodeCFHeadersMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, headers)
+	})
+}
+
+// OnCFCheckpt registers h for cfcheckpt messages.
+func (p *Peer) OnCFCheckpt(h CFCheckptHandler) {
+	p.Handle("cfcheckpt", func(p *Peer, payload []byte) error {
+		c, err := cfilter.DecodeCFCheckptMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, c)
+	})
+}
+
+// OnGetCFilters registers h for the getcfilters messages requesting
+// filters from us.
+func (p *Peer) OnGetCFilters(h CFRequestHandler) {
+	p.Handle("getcfilters", cfRequestHandler(h))
+}
+
+// OnGetCFHeaders registers h for the getcfheaders messages requesting
+// filter hashes from us.
+func (p *Peer) OnGetCFHeaders(h CFRequestHandler) {
+	p.Handle("getcfheaders", cfRequestHandler(h))
+}
+
+func cfRequestHandler(h CFRequestHandler) MessageHandler {
+	return func(p *Peer, payload []byte) error {
+		req, err := cfilter.DecodeRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, req)
+	}
+}
+
+// OnGetCFCheckpt registers h for the getcfcheckpt messages requesting
+// filter header checkpoints from us.
+func (p *Peer) OnGetCFCheckpt(h CFCheckptRequestHandler) {
+	p.Handle("getcfcheckpt", func(p *Peer, payload []byte) error {
+		req, err := cfilter.DecodeCheckptRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, req)
+	})
+}
+
+// GetCFilters asks the peer for the filters of a range of blocks, which it
+// answers with one cfilter message per block.
+func (p *Peer) GetCFilters(req cfilter.Request) error {
+	return p.Send(Message{Command: "getcfilters", Payload: cfilter.EncodeRequestMessage(req)})
+}
+
+// GetCFHeaders asks the peer for the filter hashes of a range of blocks.
+func (p *Peer) GetCFHeaders(req cfilter.Request) error {
+	return p.Send(Message{Command: "getcfheaders", Payload: cfilter.EncodeRequestMessage(req)})
+}
+
+// GetCFCheckpt asks the peer for the filter headers at every
+// cfilter.CheckpointInterval heights up to a block.
+func (p *Peer) GetCFCheckpt(req cfilter.CheckptRequest) error {
+	return p.Send(Message{Command: "getcfcheckpt", Payload: cfilter.EncodeCheckptRequestMessage(req)})
+}
+
+// SendCFilter sends a filter to the peer.
+func (p *Peer) SendCFilter(f *cfilter.CFilter) error {
+	return p.Send(Message{Command: "cfilter", Payload: cfilter.EncodeCFilterMessage(f)})
+}
+
+// SendCFHeaders sends filter hashes to the peer.
+func (p *Peer) SendCFHeaders(h *cfilter.CFHeaders) error {
+	payload, err := cfilter.EncodeCFHeadersMessage(h)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "cfheaders", Payload: payload})
+}
+
+// SendCFCheckpt sends filter header checkpoints to the peer.
+func (p *Peer) SendCFCheckpt(c *cfilter.CFCheckpt) error {
+	return p.Send(Message{Command: "cfcheckpt", Payload: cfilter.EncodeCFCheckptMessage(c)})
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/cfilter"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerCompactFilters(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{Services: func() uint64 { return config.NodeCompactFilters }})
+
+	// The remote answers every request with a canned message.
+	remote.Handle("getcfcheckpt", func(p *Peer, payload []byte) error {
+		req, err := cfilter.DecodeCheckptRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		return p.SendCFCheckpt(&cfilter.CFCheckpt{StopHash: req.StopHash, Headers: []utils.Hash{{1}}})
+	})
+	remote.Handle("getcfheaders", func(p *Peer, payload []byte) error {
+		req, err := cfilter.DecodeRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		return p.SendCFHeaders(&cfilter.CFHeaders{StopHash: req.StopHash, FilterHashes: []utils.Hash{{2}}})
+	})
+	remote.Handle("getcfilters", func(p *Peer, payload []byte) error {
+		req, err := cfilter.DecodeRequestMessage(payload)
+		if err != nil {
+			return err
+		}
+		return p.SendCFilter(&cfilter.CFilter{BlockHash: req.StopHash, Filter: []byte{0}})
+	})
+	received := make(chan any, 3)
+	local.OnCFCheckpt(func(p *Peer, c *cfilter.CFCheckpt) error {
+		received <- c
+		return nil
+	})
+	local.OnCFHeaders(func(p *Peer, h *cfilter.CFHeaders) error {
+		received <- h
+		return nil
+	})
+	local.OnCFilter(func(p *Peer, f *cfilter.CFilter) error {
+		received <- f
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+	assert.True(t, local.ServesCompactFilters())
+	assert.False(t, remote.ServesCompactFilters())
+
+	stop := utils.Hash{9}
+	require.NoError(t, local.GetCFCheckpt(cfilter.CheckptRequest{StopHash: stop}))
+	require.NoError(t, local.GetCFHeaders(cfilter.Request{StopHash: stop}))
+	require.NoError(t, local.GetCFilters(cfilter.Request{StopHash: stop}))
+	for _, want := range []any{
+		&cfilter.CFCheckpt{StopHash: stop, Headers: []utils.Hash{{1}}},
+		&cfilter.CFHeaders{StopHash: stop, FilterHashes: []utils.Hash{{2}}},
+		&cfilter.CFilter{BlockHash: stop, Filter: []byte{0}},
+	} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, want, msg)
+		case <-time.After(time.Second):
+			t.Fatalf("%T was not received", want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+)
+
+// CompactBlocksVersion is the version of compact block relay we speak:
+// version 2 uses wtxids for the short IDs (BIP152).
+const CompactBlocksVersion = 2
+
+// compactBlocksMinVersion is the protocol version from which compact
+// blocks are understood (BIP152).
+const compactBlocksMinVersion = 70014
+
+// CompactBlockHandler is called with every compact block a peer sends.
+// Returning an error disconnects the peer.
+type CompactBlockHandler func(p *Peer, cb *block.CompactBlock) error
+
+// OnCmpctBlock registers h for cmpctblock messages.
+func (p *Peer) OnCmpctBlock(h CompactBlockHandler) {
+	p.Handle("cmpctblock", func(p *Peer, payload []byte) error {
+		cb, err := block.DecodeCompactBlockMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, cb)
+	})
+}
+
+// SendCmpctBlock sends cb to the peer.
+func (p *Peer) SendCmpctBlock(cb *block.CompactBlock) error {
+	payload, err := block.EncodeCompactBlockMessage(cb)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "cmpctblock", Payload: payload})
+}
+
+// BlockTxnRequestHandler is called with every getblocktxn request a peer
+// sends. Returning an error disconnects the peer.
+type BlockTxnRequestHandler func(p *Peer, req *block.BlockTxnRequest) error
+
+// BlockTxnHandler is called with every blocktxn message a peer sends.
+// Returning an error disconnects the peer.
+type BlockTxnHandler func(p *Peer, bt *block.BlockTxns) error
+
+// OnGetBlockTxn registers h for getblocktxn messages.
+func (p *Peer) OnGetBlockTxn(h BlockTxnRequestHandler) {
+	p.Handle("getblocktxn", func(p *Peer, payload []byte) error {
+		req, err := block.DecodeGetBlockTxnMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, req)
+	})
+}
+
+// OnBlockTxn registers h for blocktxn messages.
+func (p *Peer) OnBlockTxn(h BlockTxnHandler) {
+	p.Handle("blocktxn", func(p *Peer, payload []byte) error {
+		bt, err := block.DecodeBlockTxnMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, bt)
+	})
+}
+
+// GetBlockTxn asks the peer for the transactions of a compact block we
+// could not rebuild.
+func (p *Peer) GetBlockTxn(req *block.BlockTxnRequest) error {
+	payload, err := block.EncodeGetBlockTxnMessage(req)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "getblocktxn", Payload: payload})
+}
+
+// SendBlockTxn answers a getblocktxn request.
+func (p *Peer) SendBlockTxn(bt *block.BlockTxns) error {
+	payload, err := block.EncodeBlockTxnMessage(bt)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "blocktxn", Payload: payload})
+}
+
+// CompactBlocks reports whether the peer sent sendcmpct for our version of
+// compact blocks.
+func (p *Peer) CompactBlocks() bool {
+	return p.sendCmpct.Load()
+}
+
+// CompactBlocksHighBandwidth reports whether the peer asked us to announce
+// new blocks with cmpctblock messages.
+func (p *Peer) CompactBlocksHighBandwidth() bool {
+	return p.sendCmpct.Load() && p.cmpctHighBandwidth.Load()
+}
+
+// SendCmpct tells the peer we understand compact blocks. In high-bandwidth
+// mode it asks the peer to announce new blocks with cmpctblock messages
+// before it has fully validated them. Peers older than BIP152 do not
+// understand it and are skipped.
+func (p *Peer) SendCmpct(highBandwidth bool) error {
+	if p.version.Version < compactBlocksMinVersion {
+		return nil
+	}
+	payload := make([]byte, 9)
+	if highBandwidth {
+		payload[0] = 1
+	}
+	binary.LittleEndian.PutUint64(payload[1:], CompactBlocksVersion)
+	return p.Send(Message{Command: "sendcmpct", Payload: payload})
+}
+
+// handleSendCmpct records the compact block settings of a sendcmpct
+// message. Other versions than ours are ignored.
+func (p *Peer) handleSendCmpct(payload []byte) error {
+	if len(payload) < 9 {
+		return fmt.Errorf("invalid sendcmpct payload length: %d", len(payload))
+	}
+	if binary.LittleEndian.Uint64(payload[1:9]) != CompactBlocksVersion {
+		return nil
+	}
+	p.cmpctHighBandwidth.Store(payload[0] != 0)
+	p.sendCmpct.Store(true)
+	return nil
+}
@@ -0,0 +1,264 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Dialer opens outbound connections. Every outbound connection we make goes
+// through a Dialer so that it can be routed through a proxy or replaced in
+// tests.
+type Dialer interface {
+	Dial(ctx context.Context, addr string) (Conn, error)
+}
+
+// TCPDialer connects directly over TCP.
+type TCPDialer struct {
+	// Timeout bounds the connection attempt. Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Dial connects to addr.
+func (d TCPDialer) Dial(ctx context.Context, addr string) (Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+const (
+	socks5Version       = 0x05
+	socks5AuthNone      = 0x00
+	socks5AuthPassword  = 0x02
+	socks5AuthNoAccept  = 0xff
+	socks5CmdConnect    = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+	socks5ReplySuccess  = 0x00
+	socks5PasswordVer   = 0x01
+	socks5PasswordValid = 0x00
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer connects through a SOCKS5 proxy (RFC 1928), such as the
+// SOCKS port of a local Tor daemon. Host names, including .onion
+// addresses, are resolved by the proxy.
+type SOCKS5Dialer struct {
+	// ProxyAddr is the host:port of the proxy.
+	ProxyAddr string
+	// Username and Password authenticate with the proxy (RFC 1929).
+	Username string
+	Password string
+	// IsolateStreams sends fresh random credentials for every connection.
+	// Tor puts streams with different credentials on different circuits,
+	// so no two peers share a circuit.
+	IsolateStreams bool
+	// Forward reaches the proxy. It defaults to a TCPDialer.
+	Forward Dialer
+	// Timeout bounds the connection and the SOCKS negotiation.
+	Timeout time.Duration
+}
+
+// Dial connects to addr through the proxy.
+func (d SOCKS5Dialer) Dial(ctx context.Context, addr string) (Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = TCPDialer{}
+	}
+	conn, err := forward.Dial(ctx, d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", d.ProxyAddr, err)
+	}
+
+	// Abort the negotiation if ctx is done before it finishes.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	username, password := d.Username, d.Password
+	if d.IsolateStreams {
+		username, password = randomCredential(), randomCredential()
+	}
+	err = socks5Connect(conn, addr, username, password)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", d.ProxyAddr, err)
+	}
+	return conn, nil
+}
+
+func socks5Connect(conn Conn, addr, username, password string) error {
+	method := byte(socks5AuthNone)
+	if username != "" || password != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := socks5Authenticate(conn, username, password); err != nil {
+			return err
+		}
+	case socks5AuthNoAccept:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	request, err := socks5Request(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socks5ReplySuccess {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("connect failed with reply %d", header[1])
+	}
+
+	// Skip the bound address and port.
+	var boundLength int
+	switch header[3] {
+	case socks5AddrIPv4:
+		boundLength = net.IPv4len
+	case socks5AddrIPv6:
+		boundLength = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLength = int(length[0])
+	default:
+		return fmt.Errorf("unexpected bound address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLength+2))
+	return err
+}
+
+func socks5Authenticate(conn Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username or password too long")
+	}
+	request := []byte{socks5PasswordVer, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks5PasswordValid {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+func socks5Request(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socks5AddrIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socks5AddrIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
+
+func randomCredential() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// PipeDialer connects to in-memory endpoints and is meant for tests. Every
+// Dial creates a net.Pipe and passes the remote end to Accept.
+type PipeDialer struct {
+	Accept func(addr string, conn Conn)
+}
+
+// Dial returns the local end of a new pipe to addr.
+func (d PipeDialer) Dial(ctx context.Context, addr string) (Conn, error) {
+	if d.Accept == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	local, remote := net.Pipe()
+	go d.Accept(addr, remote)
+	return local, nil
+}
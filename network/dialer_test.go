@@ -0,0 +1,194 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type socksRequest struct {
+	username string
+	password string
+	target   string
+}
+
+// startSOCKS5Server runs a minimal SOCKS5 proxy that records each request
+// and echoes everything sent through it.
+func startSOCKS5Server(t *testing.T, requirePassword bool) (string, <-chan socksRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	requests := make(chan socksRequest, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, requirePassword, requests)
+		}
+	}()
+	return ln.Addr().String(), requests
+}
+
+func serveSOCKS5(conn net.Conn, requirePassword bool, requests chan<- socksRequest) {
+	defer conn.Close()
+	var req socksRequest
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5AuthNone)
+	if requirePassword {
+		method = socks5AuthNoAccept
+		for _, m := range methods {
+			if m == socks5AuthPassword {
+				method = socks5AuthPassword
+			}
+		}
+	}
+	conn.Write([]byte{socks5Version, method})
+	if method == socks5AuthNoAccept {
+		return
+	}
+	if method == socks5AuthPassword {
+		lengths := make([]byte, 2)
+		io.ReadFull(conn, lengths)
+		username := make([]byte, lengths[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, lengths[:1])
+		password := make([]byte, lengths[0])
+		io.ReadFull(conn, password)
+		req.username, req.password = string(username), string(password)
+		conn.Write([]byte{socks5PasswordVer, socks5PasswordValid})
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	req.target = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	requests <- req
+
+	if host == "refused.onion" {
+		conn.Write([]byte{socks5Version, 0x05, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5ReplySuccess, 0, socks5AddrIPv4, 127, 0, 0, 1, 0x20, 0x8d})
+	io.Copy(conn, conn)
+}
+
+func TestSOCKS5DialerDomain(t *testing.T) {
+	proxy, requests := startSOCKS5Server(t, false)
+	d := SOCKS5Dialer{ProxyAddr: proxy, Timeout: time.Second}
+
+	target := "vww6ybal4bd7szmgncyruucpgfkqahzddi37ktceo3ah7ngmcopnpyyd.onion:8333"
+	conn, err := d.Dial(context.Background(), target)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, socksRequest{target: target}, <-requests)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn.(net.Conn), reply)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+}
+
+func TestSOCKS5DialerIP(t *testing.T) {
+	proxy, requests := startSOCKS5Server(t, false)
+	d := SOCKS5Dialer{ProxyAddr: proxy}
+
+	for _, target := range []string{"1.2.3.4:8333", "[2001:db8::1]:18333"} {
+		conn, err := d.Dial(context.Background(), target)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, target, (<-requests).target)
+	}
+}
+
+func TestSOCKS5DialerPassword(t *testing.T) {
+	proxy, requests := startSOCKS5Server(t, true)
+
+	_, err := SOCKS5Dialer{ProxyAddr: proxy}.Dial(context.Background(), "1.2.3.4:8333")
+	assert.ErrorContains(t, err, "no acceptable authentication method")
+
+	conn, err := SOCKS5Dialer{ProxyAddr: proxy, Username: "alice", Password: "secret"}.Dial(context.Background(), "1.2.3.4:8333")
+	require.NoError(t, err)
+	conn.Close()
+	req := <-requests
+	assert.Equal(t, "alice", req.username)
+	assert.Equal(t, "secret", req.password)
+}
+
+func TestSOCKS5DialerStreamIsolation(t *testing.T) {
+	proxy, requests := startSOCKS5Server(t, true)
+	d := SOCKS5Dialer{ProxyAddr: proxy, IsolateStreams: true}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial(context.Background(), "1.2.3.4:8333")
+		require.NoError(t, err)
+		conn.Close()
+		req := <-requests
+		assert.NotEmpty(t, req.username)
+		assert.False(t, seen[req.username+":"+req.password], "credentials reused")
+		seen[req.username+":"+req.password] = true
+	}
+}
+
+func TestSOCKS5DialerRefused(t *testing.T) {
+	proxy, _ := startSOCKS5Server(t, false)
+	_, err := SOCKS5Dialer{ProxyAddr: proxy}.Dial(context.Background(), "refused.onion:8333")
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+func TestPipeDialer(t *testing.T) {
+	_, err := PipeDialer{}.Dial(context.Background(), "1.2.3.4:8333")
+	assert.Error(t, err)
+
+	d := PipeDialer{Accept: func(addr string, conn Conn) {
+		remote := NewPeer(conn, "local", PeerConfig{})
+		remote.Start(context.Background())
+	}}
+	conn, err := d.Dial(context.Background(), "1.2.3.4:8333")
+	require.NoError(t, err)
+
+	local := NewPeer(conn, "1.2.3.4:8333", PeerConfig{})
+	require.NoError(t, local.Start(context.Background()))
+	local.Disconnect()
+}
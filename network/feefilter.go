@@ -0,0 +1,70 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+)
+
+// feeFilterMinVersion is the protocol version from which feefilter is
+// understood (BIP133).
+const feeFilterMinVersion = 70013
+
+// maxMoney bounds the feerates accepted in a feefilter message, as
+// MoneyRange does in Bitcoin Core.
+const maxMoney = 21_000_000 * 100_000_000
+
+// SendFeeFilter tells the peer not to announce transactions paying less
+// than feeRate satoshis per 1000 virtual bytes. Peers older than BIP133 do
+// not understand it and are skipped.
+func (p *Peer) SendFeeFilter(feeRate int64) error {
+	if p.version.Version < feeFilterMinVersion {
+		return nil
+	}
+	payload := binary.LittleEndian.AppendUint64(nil, uint64(feeRate))
+	return p.Send(Message{Command: "feefilter", Payload: payload})
+}
+
+// FeeFilter returns the minimum feerate, in satoshis per 1000 virtual
+// bytes, of the transactions the peer wants announced. It is 0 until the
+// peer sends a feefilter message.
+func (p *Peer) FeeFilter() int64 {
+	return p.feeFilter.Load()
+}
+
+// WantsTxs reports whether the peer asked for transaction announcements
+// with the relay flag of its version message and the connection is not
+// block-relay-only.
+func (p *Peer) WantsTxs() bool {
+	return p.version.Relay && !p.cfg.BlockRelayOnly
+}
+
+// AnnounceTx announces a transaction paying feeRate satoshis per virtual
+// byte, unless the peer does not want transactions or only ones above its
+// feefilter. It reports whether the announcement was sent.
+func (p *Peer) AnnounceTx(v inv.InvVect, feeRate float64) (bool, error) {
+	if !p.WantsTxs() || feeRate*1000 < float64(p.FeeFilter()) {
+		return false, nil
+	}
+	return true, p.SendInv(v)
+}
+
+// AcceptsTxs reports whether we asked the peer to relay transactions to us.
+// Announcements from peers we did not ask should be ignored.
+func (p *Peer) AcceptsTxs() bool {
+	return p.cfg.Relay && !p.cfg.BlockRelayOnly
+}
+
+// handleFeeFilter records the feerate of a feefilter message. Values
+// outside the money range are ignored.
+func (p *Peer) handleFeeFilter(payload []byte) error {
+	if len(payload) != 8 {
+		return fmt.Errorf("invalid feefilter payload length: %d", len(payload))
+	}
+	feeRate := int64(binary.LittleEndian.Uint64(payload))
+	if feeRate >= 0 && feeRate <= maxMoney {
+		p.feeFilter.Store(feeRate)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeeFilter(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{Relay: true})
+	remote := NewPeer(b, "local", PeerConfig{Relay: true, FeeFilter: 2000})
+
+	announced := make(chan []inv.InvVect, 2)
+	remote.OnInv(func(p *Peer, vects []inv.InvVect) error {
+		announced <- vects
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.Eventually(t, func() bool { return local.FeeFilter() == 2000 }, time.Second, 10*time.Millisecond)
+	assert.Zero(t, remote.FeeFilter(), "we sent no feefilter")
+
+	cheap := inv.InvVect{Type: inv.InvTypeWTx, Hash: utils.Hash{1}}
+	sent, err := local.AnnounceTx(cheap, 1.5)
+	require.NoError(t, err)
+	assert.False(t, sent, "below the peer's feefilter")
+
+	rich := inv.InvVect{Type: inv.InvTypeWTx, Hash: utils.Hash{2}}
+	sent, err = local.AnnounceTx(rich, 2)
+	require.NoError(t, err)
+	assert.True(t, sent)
+
+	select {
+	case vects := <-announced:
+		assert.Equal(t, []inv.InvVect{rich}, vects)
+	case <-time.After(time.Second):
+		t.Fatal("transaction was not announced")
+	}
+}
+
+func TestFeeFilterIgnoresOutOfRange(t *testing.T) {
+	p := NewPeer(nil, "remote", PeerConfig{})
+	require.NoError(t, p.handleFeeFilter([]byte{0xe8, 0x03, 0, 0, 0, 0, 0, 0}))
+	assert.Equal(t, int64(1000), p.FeeFilter())
+	require.NoError(t, p.handleFeeFilter([]byte{0, 0, 0, 0, 0, 0, 0, 0x80}))
+	assert.Equal(t, int64(1000), p.FeeFilter(), "negative feerates are ignored")
+	assert.Error(t, p.handleFeeFilter([]byte{1, 2, 3}))
+}
+
+func TestAnnounceTxHonorsRelayFlag(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{Relay: true})
+	remote := NewPeer(b, "local", PeerConfig{})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	assert.False(t, local.WantsTxs())
+	assert.True(t, local.AcceptsTxs())
+	assert.False(t, remote.AcceptsTxs())
+	sent, err := local.AnnounceTx(inv.InvVect{Type: inv.InvTypeTx, Hash: utils.Hash{1}}, 100)
+	require.NoError(t, err)
+	assert.False(t, sent, "the peer asked for no transactions")
+}
@@ -0,0 +1,66 @@
+package network
+
+import "github.com/safwentrabelsi/bitcoin-handshake/inv"
+
+// InvHandler is called with the inventory vectors of an inv, getdata or
+// notfound message. Returning an error disconnects the peer.
+type InvHandler func(p *Peer, vects []inv.InvVect) error
+
+// OnInv registers h for the inv messages announcing new objects.
+func (p *Peer) OnInv(h InvHandler) {
+	p.Handle("inv", invHandler(h))
+}
+
+// OnGetData registers h for the getdata messages requesting objects from us.
+func (p *Peer) OnGetData(h InvHandler) {
+	p.Handle("getdata", invHandler(h))
+}
+
+// OnNotFound registers h for the notfound messages answering our getdata
+// requests for objects the peer does not have.
+func (p *Peer) OnNotFound(h InvHandler) {
+	p.Handle("notfound", invHandler(h))
+}
+
+func invHandler(h InvHandler) MessageHandler {
+	return func(p *Peer, payload []byte) error {
+		vects, err := inv.DecodeInvMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, vects)
+	}
+}
+
+// SendInv announces objects to the peer.
+func (p *Peer) SendInv(vects ...inv.InvVect) error {
+	return p.sendInvMessage("inv", vects)
+}
+
+// GetData requests objects from the peer. They arrive as the matching
+// messages (tx, block, ...) or in a notfound message.
+func (p *Peer) GetData(vects ...inv.InvVect) error {
+	return p.sendInvMessage("getdata", vects)
+}
+
+// SendNotFound tells the peer we do not have the objects it asked for.
+func (p *Peer) SendNotFound(vects ...inv.InvVect) error {
+	return p.sendInvMessage("notfound", vects)
+}
+
+// sendInvMessage sends vects, split into as many messages as needed to stay
+// within the entry limit.
+func (p *Peer) sendInvMessage(command string, vects []inv.InvVect) error {
+	for len(vects) > 0 {
+		n := min(len(vects), inv.MaxInvEntries)
+		payload, err := inv.EncodeInvMessage(vects[:n])
+		if err != nil {
+			return err
+		}
+		if err := p.Send(Message{Command: command, Payload: payload}); err != nil {
+			return err
+		}
+		vects = vects[n:]
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerInventory(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	have := inv.InvVect{Type: inv.InvTypeTx, Hash: utils.DoubleSHA256([]byte("have"))}
+	missing := inv.InvVect{Type: inv.InvTypeTx, Hash: utils.DoubleSHA256([]byte("missing"))}
+
+	announced := make(chan []inv.InvVect, 1)
+	notFound := make(chan []inv.InvVect, 1)
+	local.OnInv(func(p *Peer, vects []inv.InvVect) error {
+		announced <- vects
+		return nil
+	})
+	local.OnNotFound(func(p *Peer, vects []inv.InvVect) error {
+		notFound <- vects
+		return nil
+	})
+	remote.OnGetData(func(p *Peer, vects []inv.InvVect) error {
+		var unknown []inv.InvVect
+		for _, v := range vects {
+			if v != have {
+				unknown = append(unknown, v)
+			}
+		}
+		return p.SendNotFound(unknown...)
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.NoError(t, remote.SendInv(have))
+	select {
+	case vects := <-announced:
+		assert.Equal(t, []inv.InvVect{have}, vects)
+	case <-time.After(time.Second):
+		t.Fatal("inv was not received")
+	}
+
+	require.NoError(t, local.GetData(have, missing))
+	select {
+	case vects := <-notFound:
+		assert.Equal(t, []inv.InvVect{missing}, vects)
+	case <-time.After(time.Second):
+		t.Fatal("notfound was not received")
+	}
+}
+
+func TestPeerInventorySplitsLargeMessages(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	sizes := make(chan int, 2)
+	remote.OnGetData(func(p *Peer, vects []inv.InvVect) error {
+		sizes <- len(vects)
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.NoError(t, local.GetData(make([]inv.InvVect, inv.MaxInvEntries+10)...))
+	for _, want := range []int{inv.MaxInvEntries, 10} {
+		select {
+		case n := <-sizes:
+			assert.Equal(t, want, n)
+		case <-time.After(2 * time.Second):
+			t.Fatal("getdata was not received")
+		}
+	}
+}
+
+func TestPeerDisconnectsOnMalformedInv(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+	local.OnInv(func(p *Peer, vects []inv.InvVect) error { return nil })
+	startPeerPair(t, local, remote)
+	defer remote.Disconnect()
+
+	require.NoError(t, remote.Send(Message{Command: "inv", Payload: []byte{0x01, 0x02}}))
+	select {
+	case <-local.Done():
+		assert.Error(t, local.Err())
+	case <-time.After(time.Second):
+		t.Fatal("peer was not disconnected")
+	}
+}
+
+func TestPeerTx(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	received := make(chan *transaction.Tx, 1)
+	local.OnTx(func(p *Peer, tx *transaction.Tx) error {
+		received <- tx
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	tx := &transaction.Tx{
+		Version:  2,
+		TxIn:     []transaction.TxIn{{SignatureScript: []byte{0x51}, Sequence: 0xffffffff}},
+		TxOut:    []transaction.TxOut{{Value: 1000, PkScript: []byte{0x51}}},
+		LockTime: 0,
+	}
+	require.NoError(t, remote.SendTx(tx))
+	select {
+	case got := <-received:
+		assert.Equal(t, tx.TxID(), got.TxID())
+	case <-time.After(time.Second):
+		t.Fatal("tx was not received")
+	}
+}
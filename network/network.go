@@ -54,7 +54,7 @@ func ConnectAndHandshake(conn Conn) {
 	}()
 
 	// Send initial version message
-	sendChannel <- Message{Command: "version", Payload: createVersionPayload()}
+	sendChannel <- Message{Command: "version", Payload: createVersionPayload(config.Services, config.StartHeight, false)}
 
 	for {
 		select {
@@ -149,8 +149,36 @@ func sendMessages(ctx context.Context, conn Conn, sendChannel chan Message, vera
 }
 
 func parseMessage(data []byte, sendChannel chan<- Message, verackReceived *bool) error {
+	trimmedCommand, payload, err := decodeMessage(data, config.MainnetMagicBytes)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Received %s message. Checksum is valid.", trimmedCommand)
+	switch trimmedCommand {
+	case "version":
+		if _, err := parseVersionPayload(payload); err != nil {
+			return err
+		}
+		sendChannel <- Message{Command: "verack", Payload: []byte{}}
+	case "verack":
+		*verackReceived = true
+	case "wtxidrelay", "sendaddrv2":
+	default:
+		if !*verackReceived {
+			log.Errorf("Received unknown command: %s. Closing connection.", trimmedCommand)
+			return fmt.Errorf("unknown command received: %s", trimmedCommand)
+		}
+
+	}
+	return nil
+}
+
+// decodeMessage splits a raw message into its command and payload after
+// checking the magic bytes, length and checksum from the header.
+func decodeMessage(data []byte, expectedMagic [4]byte) (string, []byte, error) {
 	if len(data) < headerLength {
-		return fmt.Errorf("data too short: expected at least %d bytes, got %d", headerLength, len(data))
+		return "", nil, fmt.Errorf("data too short: expected at least %d bytes, got %d", headerLength, len(data))
 	}
 
 	header := data[:headerLength]
@@ -162,101 +190,82 @@ func parseMessage(data []byte, sendChannel chan<- Message, verackReceived *bool)
 
 	headerReader := bytes.NewReader(header)
 	if err := binary.Read(headerReader, binary.LittleEndian, &magic); err != nil {
-		return err
+		return "", nil, err
 	}
 	if err := binary.Read(headerReader, binary.LittleEndian, &command); err != nil {
-		return err
+		return "", nil, err
 	}
 	if err := binary.Read(headerReader, binary.LittleEndian, &length); err != nil {
-		return err
+		return "", nil, err
 	}
 	if err := binary.Read(headerReader, binary.LittleEndian, &checksum); err != nil {
-		return err
+		return "", nil, err
 	}
 
-	expectedMagic := config.MainnetMagicBytes
 	if magic != expectedMagic {
-		return fmt.Errorf("invalid magic bytes: expected %x, got %x", expectedMagic, magic)
-	}
-
-	calculatedChecksum := utils.CalculateChecksum(payload[:length])
-	if checksum != calculatedChecksum {
-		return fmt.Errorf("invalid checksum: expected %x, got %x", checksum, calculatedChecksum)
+		return "", nil, fmt.Errorf("invalid magic bytes: expected %x, got %x", expectedMagic, magic)
 	}
 
 	if uint32(len(payload)) != length {
-		return fmt.Errorf("invalid payload length: expected %d, got %d", length, len(payload))
+		return "", nil, fmt.Errorf("invalid payload length: expected %d, got %d", length, len(payload))
 	}
 
-	trimmedCommand := strings.TrimRight(string(command[:]), "\x00")
-	log.Infof("Received %s message. Checksum is valid.", trimmedCommand)
-	switch trimmedCommand {
-	case "version":
-		if err := parseVersionPayload(payload); err != nil {
-			return err
-		}
-		sendChannel <- Message{Command: "verack", Payload: []byte{}}
-	case "verack":
-		*verackReceived = true
-	case "wtxidrelay", "sendaddrv2":
-	default:
-		if !*verackReceived {
-			log.Errorf("Received unknown command: %s. Closing connection.", trimmedCommand)
-			return fmt.Errorf("unknown command received: %s", trimmedCommand)
-		}
-
+	calculatedChecksum := utils.CalculateChecksum(payload)
+	if checksum != calculatedChecksum {
+		return "", nil, fmt.Errorf("invalid checksum: expected %x, got %x", checksum, calculatedChecksum)
 	}
-	return nil
+
+	return strings.TrimRight(string(command[:]), "\x00"), payload, nil
 }
 
-func parseVersionPayload(payload []byte) error {
+func parseVersionPayload(payload []byte) (version.VersionMessage, error) {
 	payloadReader := bytes.NewReader(payload)
 	var versionMsg version.VersionMessage
 	if err := binary.Read(payloadReader, binary.LittleEndian, &versionMsg.Version); err != nil {
-		return err
+		return versionMsg, err
 	}
 	if err := binary.Read(payloadReader, binary.LittleEndian, &versionMsg.Services); err != nil {
-		return err
+		return versionMsg, err
 	}
 	if err := binary.Read(payloadReader, binary.LittleEndian, &versionMsg.Timestamp); err != nil {
-		return err
+		return versionMsg, err
 	}
 	var addrRecv netaddr.NetAddr
 	if err := netaddr.ParseNetAddr(payloadReader, &addrRecv); err != nil {
-		return err
+		return versionMsg, err
 	}
 	versionMsg.AddrRecv = addrRecv
 	var addrFrom netaddr.NetAddr
 	if err := netaddr.ParseNetAddr(payloadReader, &addrFrom); err != nil {
-		return err
+		return versionMsg, err
 	}
 	versionMsg.AddrFrom = addrFrom
 
 	if err := binary.Read(payloadReader, binary.LittleEndian, &versionMsg.Nonce); err != nil {
-		return err
+		return versionMsg, err
 	}
 
 	var userAgentLen uint8
 	if err := binary.Read(payloadReader, binary.LittleEndian, &userAgentLen); err != nil {
-		return err
+		return versionMsg, err
 	}
 	userAgent := make([]byte, userAgentLen)
 	if err := binary.Read(payloadReader, binary.LittleEndian, &userAgent); err != nil {
-		return err
+		return versionMsg, err
 	}
 	versionMsg.UserAgent = string(userAgent)
 
 	if strings.Contains(versionMsg.UserAgent, "satoshi") {
-		return fmt.Errorf("invalid user agent: expected %s, got %s", config.UserAgent, versionMsg.UserAgent)
+		return versionMsg, fmt.Errorf("invalid user agent: expected %s, got %s", config.UserAgent, versionMsg.UserAgent)
 	}
 
 	if err := binary.Read(payloadReader, binary.LittleEndian, &versionMsg.StartHeight); err != nil {
-		return err
+		return versionMsg, err
 	}
 
 	var relay uint8
 	if err := binary.Read(payloadReader, binary.LittleEndian, &relay); err != nil {
-		return err
+		return versionMsg, err
 	}
 	versionMsg.Relay = (relay != 0)
 
@@ -270,11 +279,11 @@ func parseVersionPayload(payload []byte) error {
 	log.Debugf("StartHeight: %d", versionMsg.StartHeight)
 	log.Debugf("Relay: %t", versionMsg.Relay)
 
-	return nil
+	return versionMsg, nil
 }
 
-func createVersionPayload() []byte {
-	payload, err := version.MakeVersionPayload()
+func createVersionPayload(services uint64, startHeight int32, relay bool) []byte {
+	payload, err := version.MakeVersionPayload(services, startHeight, relay)
 	if err != nil {
 		log.Fatalf("Failed to create version payload: %v", err)
 	}
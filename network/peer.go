@@ -0,0 +1,425 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/safwentrabelsi/bitcoin-handshake/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPayloadLength is the largest payload we accept from a peer. It matches
+// MAX_SIZE in Bitcoin Core.
+const maxPayloadLength = 0x02000000
+
+const defaultHandshakeTimeout = 30 * time.Second
+
+// addrV2MinVersion is the protocol version from which sendaddrv2 is
+// understood (BIP155).
+const addrV2MinVersion = 70016
+
+// wtxidRelayMinVersion is the protocol version from which wtxidrelay is
+// understood (BIP339).
+const wtxidRelayMinVersion = 70016
+
+// ErrDisconnected is returned by Err once a peer has been closed with
+// Disconnect.
+var ErrDisconnected = errors.New("peer disconnected")
+
+// MessageHandler is called for every message with a given command that a
+// peer receives after the handshake. Returning an error disconnects the peer.
+type MessageHandler func(p *Peer, payload []byte) error
+
+// PeerConfig holds the settings of a single peer connection.
+type PeerConfig struct {
+	// Magic frames every message. It defaults to config.MainnetMagicBytes.
+	Magic [4]byte
+	// BlockRelayOnly marks the connection as block-relay-only: we do not
+	// exchange addresses or transactions over it.
+	BlockRelayOnly bool
+	// HandshakeTimeout bounds the version handshake. It defaults to 30s.
+	HandshakeTimeout time.Duration
+	// Inbound marks connections accepted by our listener.
+	Inbound bool
+	// LocalAddrs are advertised in an addrv2 message to full-relay outbound
+	// peers that support it, once the handshake completes.
+	LocalAddrs []netaddr.AddrV2
+	// Services returns the service bits of our version message. It
+	// defaults to config.Services.
+	Services func() uint64
+	// StartHeight returns the height of our best chain for the version
+	// message. It defaults to config.StartHeight.
+	StartHeight func() int32
+	// Relay sets the relay flag of our version message, asking the peer to
+	// announce its transactions to us. It is ignored on block-relay-only
+	// connections.
+	Relay bool
+	// FeeFilter is sent to relaying peers in a feefilter message once the
+	// handshake completes (BIP133): the minimum feerate, in satoshis per
+	// 1000 virtual bytes, of the transactions they should announce to us.
+	// Zero sends none.
+	FeeFilter int64
+}
+
+// Peer is a connection to a remote node that stays open after the version
+// handshake. Incoming messages are passed to the handlers registered with
+// Handle; ping is answered and feefilter and sendcmpct recorded
+// automatically.
+type Peer struct {
+	conn Conn
+	addr string
+	cfg  PeerConfig
+
+	version     version.VersionMessage
+	wantsAddrV2 bool
+	wtxidRelay  bool
+	connectedAt time.Time
+	feeFilter   atomic.Int64
+	// sendCmpct and cmpctHighBandwidth record the peer's sendcmpct.
+	sendCmpct          atomic.Bool
+	cmpctHighBandwidth atomic.Bool
+
+	writeMu    sync.Mutex
+	handlersMu sync.RWMutex
+	handlers   map[string][]MessageHandler
+
+	incoming  chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// NewPeer wraps conn, which was opened to or accepted from addr. The peer
+// does nothing until Start is called.
+func NewPeer(conn Conn, addr string, cfg PeerConfig) *Peer {
+	if cfg.Magic == ([4]byte{}) {
+		cfg.Magic = config.MainnetMagicBytes
+	}
+	if cfg.HandshakeTimeout == 0 {
+		cfg.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	return &Peer{
+		conn:     conn,
+		addr:     addr,
+		cfg:      cfg,
+		handlers: make(map[string][]MessageHandler),
+		incoming: make(chan Message, 16),
+		done:     make(chan struct{}),
+	}
+}
+
+// Handle registers h for messages with the given command. Several handlers
+// may share a command: they are called in registration order until one
+// returns an error.
+func (p *Peer) Handle(command string, h MessageHandler) {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	p.handlers[command] = append(p.handlers[command], h)
+}
+
+// Start performs the version handshake and then dispatches incoming
+// messages in the background. The peer is disconnected when ctx is done.
+func (p *Peer) Start(ctx context.Context) error {
+	go p.readLoop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.disconnect(ctx.Err())
+		case <-p.done:
+		}
+	}()
+
+	if err := p.handshake(); err != nil {
+		p.disconnect(err)
+		return err
+	}
+	p.connectedAt = time.Now()
+	log.Infof("Handshake with %s completed (%s)", p.addr, p.version.UserAgent)
+
+	if err := p.advertiseLocalAddrs(); err != nil {
+		p.disconnect(err)
+		return err
+	}
+	if p.AcceptsTxs() && p.cfg.FeeFilter > 0 {
+		if err := p.SendFeeFilter(p.cfg.FeeFilter); err != nil {
+			p.disconnect(err)
+			return err
+		}
+	}
+
+	go p.dispatchLoop()
+	return nil
+}
+
+// Send writes msg to the peer.
+func (p *Peer) Send(msg Message) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	var buf bytes.Buffer
+	if err := encodeMessage(&buf, p.cfg.Magic, msg); err != nil {
+		return err
+	}
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		p.disconnect(err)
+		return err
+	}
+	log.Debugf("Sent %s message to %s", msg.Command, p.addr)
+	return nil
+}
+
+// Disconnect closes the connection. It is safe to call more than once.
+func (p *Peer) Disconnect() {
+	p.disconnect(ErrDisconnected)
+}
+
+// Done is closed once the peer is disconnected.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the peer was disconnected, or nil while it is connected.
+func (p *Peer) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Addr returns the remote address of the peer.
+func (p *Peer) Addr() string {
+	return p.addr
+}
+
+// Version returns the version message the peer sent during the handshake.
+func (p *Peer) Version() version.VersionMessage {
+	return p.version
+}
+
+// BlockRelayOnly reports whether the connection is block-relay-only.
+func (p *Peer) BlockRelayOnly() bool {
+	return p.cfg.BlockRelayOnly
+}
+
+// Inbound reports whether the peer connected to us.
+func (p *Peer) Inbound() bool {
+	return p.cfg.Inbound
+}
+
+// WantsAddrV2 reports whether the peer sent sendaddrv2 during the handshake.
+func (p *Peer) WantsAddrV2() bool {
+	return p.wantsAddrV2
+}
+
+// WTxIDRelay reports whether both sides sent wtxidrelay during the
+// handshake, so that transactions are announced by wtxid (BIP339).
+func (p *Peer) WTxIDRelay() bool {
+	return p.wtxidRelay
+}
+
+// ConnectedAt returns when the handshake completed.
+func (p *Peer) ConnectedAt() time.Time {
+	return p.connectedAt
+}
+
+func (p *Peer) disconnect(err error) {
+	p.closeOnce.Do(func() {
+		p.err = err
+		close(p.done)
+		p.conn.Close()
+		log.Debugf("Disconnected from %s: %v", p.addr, err)
+	})
+}
+
+func (p *Peer) handshake() error {
+	timer := time.NewTimer(p.cfg.HandshakeTimeout)
+	defer timer.Stop()
+
+	services, startHeight := uint64(config.Services), int32(config.StartHeight)
+	if p.cfg.Services != nil {
+		services = p.cfg.Services()
+	}
+	if p.cfg.StartHeight != nil {
+		startHeight = p.cfg.StartHeight()
+	}
+	if err := p.Send(Message{Command: "version", Payload: createVersionPayload(services, startHeight, p.cfg.Relay && !p.cfg.BlockRelayOnly)}); err != nil {
+		return err
+	}
+
+	versionReceived := false
+	verackReceived := false
+	for !versionReceived || !verackReceived {
+		select {
+		case msg := <-p.incoming:
+			switch msg.Command {
+			case "version":
+				versionMsg, err := parseVersionPayload(msg.Payload)
+				if err != nil {
+					return err
+				}
+				p.version = versionMsg
+				versionReceived = true
+				if versionMsg.Version >= wtxidRelayMinVersion && !p.cfg.BlockRelayOnly {
+					if err := p.Send(Message{Command: "wtxidrelay", Payload: []byte{}}); err != nil {
+						return err
+					}
+				}
+				if versionMsg.Version >= addrV2MinVersion {
+					if err := p.Send(Message{Command: "sendaddrv2", Payload: []byte{}}); err != nil {
+						return err
+					}
+				}
+				if err := p.Send(Message{Command: "verack", Payload: []byte{}}); err != nil {
+					return err
+				}
+			case "verack":
+				verackReceived = true
+			case "sendaddrv2":
+				p.wantsAddrV2 = true
+			case "wtxidrelay":
+				p.wtxidRelay = !p.cfg.BlockRelayOnly
+			default:
+				if !verackReceived {
+					return fmt.Errorf("unknown command received: %s", msg.Command)
+				}
+			}
+		case <-p.done:
+			return p.err
+		case <-timer.C:
+			return fmt.Errorf("handshake with %s timed out after %s", p.addr, p.cfg.HandshakeTimeout)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) advertiseLocalAddrs() error {
+	if len(p.cfg.LocalAddrs) == 0 || p.cfg.Inbound || p.cfg.BlockRelayOnly || !p.wantsAddrV2 {
+		return nil
+	}
+	addrs := make([]netaddr.AddrV2, len(p.cfg.LocalAddrs))
+	for i, addr := range p.cfg.LocalAddrs {
+		addr.Time = uint32(time.Now().Unix())
+		addrs[i] = addr
+	}
+	payload, err := netaddr.EncodeAddrV2Message(addrs)
+	if err != nil {
+		return err
+	}
+	return p.Send(Message{Command: "addrv2", Payload: payload})
+}
+
+func (p *Peer) readLoop() {
+	for {
+		msg, err := readMessage(p.conn, p.cfg.Magic)
+		if err != nil {
+			p.disconnect(err)
+			return
+		}
+		select {
+		case p.incoming <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Peer) dispatchLoop() {
+	for {
+		select {
+		case msg := <-p.incoming:
+			if err := p.dispatch(msg); err != nil {
+				log.Errorf("Failed to handle %s message from %s: %v", msg.Command, p.addr, err)
+				p.disconnect(err)
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *Peer) dispatch(msg Message) error {
+	log.Debugf("Received %s message from %s", msg.Command, p.addr)
+	switch msg.Command {
+	case "ping":
+		return p.Send(Message{Command: "pong", Payload: msg.Payload})
+	case "feefilter":
+		return p.handleFeeFilter(msg.Payload)
+	case "sendcmpct":
+		// Recorded, and still passed to the handlers.
+		if err := p.handleSendCmpct(msg.Payload); err != nil {
+			return err
+		}
+	}
+
+	p.handlersMu.RLock()
+	handlers := p.handlers[msg.Command]
+	p.handlersMu.RUnlock()
+	for _, h := range handlers {
+		if err := h(p, msg.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessage reads one complete message from r and checks it against magic.
+func readMessage(r io.Reader, magic [4]byte) (Message, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Message{}, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[16:20])
+	if length > maxPayloadLength {
+		return Message{}, fmt.Errorf("payload too large: %d bytes", length)
+	}
+
+	data := make([]byte, headerLength+int(length))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[headerLength:]); err != nil {
+		return Message{}, err
+	}
+
+	command, payload, err := decodeMessage(data, magic)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Command: command, Payload: payload}, nil
+}
+
+// encodeMessage writes msg with its header to buf.
+func encodeMessage(buf *bytes.Buffer, magic [4]byte, msg Message) error {
+	if len(msg.Command) > 12 {
+		return fmt.Errorf("command too long: %s", msg.Command)
+	}
+	if _, err := buf.Write(magic[:]); err != nil {
+		return err
+	}
+	commandBytes := make([]byte, 12)
+	copy(commandBytes, msg.Command)
+	if _, err := buf.Write(commandBytes); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, uint32(len(msg.Payload))); err != nil {
+		return err
+	}
+	checksum := utils.CalculateChecksum(msg.Payload)
+	if _, err := buf.Write(checksum[:]); err != nil {
+		return err
+	}
+	_, err := buf.Write(msg.Payload)
+	return err
+}
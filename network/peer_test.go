@@ -0,0 +1,161 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startPeerPair connects two peers over an in-memory pipe and runs the
+// handshake on both sides.
+func startPeerPair(t *testing.T, local, remote *Peer) {
+	t.Helper()
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+}
+
+func TestPeerHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	assert.Equal(t, config.UserAgent, local.Version().UserAgent)
+	assert.Equal(t, int32(config.ProtocolVersion), remote.Version().Version)
+	assert.False(t, local.ConnectedAt().IsZero())
+	assert.True(t, local.WTxIDRelay())
+	assert.NoError(t, local.Err())
+}
+
+func TestPeerHandlers(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	received := make(chan []byte, 1)
+	local.Handle("pong", func(p *Peer, payload []byte) error {
+		received <- payload
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	require.NoError(t, local.Send(Message{Command: "ping", Payload: nonce}))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, nonce, payload)
+	case <-time.After(time.Second):
+		t.Fatal("pong was not received")
+	}
+}
+
+func TestPeerHandlersShareCommand(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+
+	var calls []string
+	done := make(chan struct{})
+	local.Handle("pong", func(p *Peer, payload []byte) error {
+		calls = append(calls, "first")
+		return nil
+	})
+	local.Handle("pong", func(p *Peer, payload []byte) error {
+		calls = append(calls, "second")
+		close(done)
+		return nil
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	require.NoError(t, local.Send(Message{Command: "ping", Payload: make([]byte, 8)}))
+	select {
+	case <-done:
+		assert.Equal(t, []string{"first", "second"}, calls)
+	case <-time.After(time.Second):
+		t.Fatal("pong was not received")
+	}
+}
+
+func TestPeerRelayFlag(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{Relay: true})
+	remote := NewPeer(b, "local", PeerConfig{Relay: true, BlockRelayOnly: true})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	assert.True(t, remote.Version().Relay)
+	assert.False(t, local.Version().Relay, "block-relay-only connections do not ask for transactions")
+	assert.False(t, local.WTxIDRelay())
+	assert.False(t, remote.WTxIDRelay())
+}
+
+func TestPeerDisconnect(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{})
+	remote := NewPeer(b, "local", PeerConfig{})
+	startPeerPair(t, local, remote)
+
+	local.Disconnect()
+	assert.ErrorIs(t, local.Err(), ErrDisconnected)
+
+	select {
+	case <-remote.Done():
+		assert.Error(t, remote.Err())
+	case <-time.After(time.Second):
+		t.Fatal("remote peer was not disconnected")
+	}
+}
+
+func TestPeerWrongMagic(t *testing.T) {
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{HandshakeTimeout: time.Second})
+	remote := NewPeer(b, "local", PeerConfig{Magic: [4]byte{0x0a, 0x03, 0xcf, 0x40}, HandshakeTimeout: time.Second})
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	assert.Error(t, <-errs)
+	assert.Error(t, <-errs)
+}
+
+func TestPeerAdvertisesLocalAddrs(t *testing.T) {
+	onion, err := netaddr.NewTorV3AddrV2("pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd", 8333, 1)
+	require.NoError(t, err)
+
+	a, b := net.Pipe()
+	local := NewPeer(a, "remote", PeerConfig{LocalAddrs: []netaddr.AddrV2{onion}})
+	remote := NewPeer(b, "local", PeerConfig{Inbound: true})
+
+	received := make(chan []netaddr.AddrV2, 1)
+	remote.Handle("addrv2", func(p *Peer, payload []byte) error {
+		addrs, err := netaddr.DecodeAddrV2Message(payload)
+		received <- addrs
+		return err
+	})
+	startPeerPair(t, local, remote)
+	defer local.Disconnect()
+
+	assert.True(t, local.WantsAddrV2())
+	assert.True(t, remote.Inbound())
+	select {
+	case addrs := <-received:
+		require.Len(t, addrs, 1)
+		assert.Equal(t, onion.String(), addrs[0].String())
+		assert.NotZero(t, addrs[0].Time)
+	case <-time.After(time.Second):
+		t.Fatal("addrv2 was not received")
+	}
+}
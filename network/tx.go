@@ -0,0 +1,23 @@
+package network
+
+import "github.com/safwentrabelsi/bitcoin-handshake/transaction"
+
+// TxHandler is called with every transaction a peer sends. Returning an
+// error disconnects the peer.
+type TxHandler func(p *Peer, tx *transaction.Tx) error
+
+// OnTx registers h for tx messages.
+func (p *Peer) OnTx(h TxHandler) {
+	p.Handle("tx", func(p *Peer, payload []byte) error {
+		tx, err := transaction.DecodeTxMessage(payload)
+		if err != nil {
+			return err
+		}
+		return h(p, tx)
+	})
+}
+
+// SendTx sends tx to the peer.
+func (p *Peer) SendTx(tx *transaction.Tx) error {
+	return p.Send(Message{Command: "tx", Payload: transaction.EncodeTxMessage(tx)})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockmon"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/cfindex"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/compact"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/connmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/download"
+	"github.com/safwentrabelsi/bitcoin-handshake/geoip"
+	"github.com/safwentrabelsi/bitcoin-handshake/mempool"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/server"
+	"github.com/safwentrabelsi/bitcoin-handshake/tor"
+	log "github.com/sirupsen/logrus"
+)
+
+// runNode keeps a set of peers connected until interrupted.
+func runNode(args []string) {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	addnode := flags.String("addnode", net.JoinHostPort(config.BTCNodeHost, strconv.Itoa(config.BTCNodePort)), "comma separated list of host:port addresses to connect to")
+	outbound := flags.Int("outbound", connmgr.DefaultTargetOutbound, "number of full-relay outbound peers")
+	blockRelay := flags.Int("blockrelay", connmgr.DefaultTargetBlockRelay, "number of block-relay-only outbound peers")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	isolate := flags.Bool("proxyrandomize", true, "use separate proxy credentials for every connection (Tor stream isolation)")
+	listen := flags.String("listen", "", "accept inbound connections on host:port")
+	torControl := flags.String("torcontrol", "", "Tor control port host:port used to reach .onion peers and create an onion service")
+	torPassword := flags.String("torpassword", "", "Tor control port password (cookie authentication is used when empty)")
+	onionKeyFile := flags.String("onionkey", "onion_v3_private_key", "file holding the private key of our onion service")
+	chainName := flags.String("chain", config.MainNetParams.Name, "network to join: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "query the chain's DNS seeds for peer addresses")
+	dnsServer := flags.String("dnsserver", "", "DNS server host:port used for the seed lookups (system resolver when empty)")
+	asmap := flags.String("asmap", "", "asmap file used to bucket peer addresses by AS number instead of /16")
+	mmdb := flags.String("mmdb", "", "comma separated list of .mmdb ASN databases used to bucket peer addresses by AS number")
+	dataDir := flags.String("datadir", "data", "directory holding the header and block databases")
+	coreDataDir := flags.String("coredatadir", "", "Bitcoin Core data directory whose blocks are served instead of our own")
+	downloadBlocks := flags.Bool("downloadblocks", false, "download the blocks of the header chain into the block store")
+	observeMempool := flags.Bool("mempool", false, "ask peers to relay transactions and keep them in an in-memory pool")
+	maxMempool := flags.Int("maxmempool", mempool.DefaultMaxSize>>20, "maximum size of the transaction pool in megabytes")
+	feeFilter := flags.Int64("feefilter", 1000, "minimum feerate in satoshis per 1000 vbytes of the transactions peers should announce to us (0 to send no feefilter)")
+	compactBlocks := flags.Bool("compactblocks", false, "rebuild new blocks from compact blocks and the transactions of -mempool (BIP152)")
+	blockFilters := flags.Bool("blockfilters", false, "build the basic filters of the stored blocks, serve them to peers and advertise NODE_COMPACT_FILTERS once they are indexed (BIP157/158)")
+	monitorBlocks := flags.Bool("blockmonitor", false, "time the block announcements of every peer and report forks, stale blocks and late announcements")
+	longDelay := flags.Duration("longdelay", blockmon.DefaultLongDelay, "delay behind the first announcement of a block reported by -blockmonitor")
+	flags.Parse(args)
+
+	params := chainParams(*chainName)
+	if *coreDataDir != "" && *downloadBlocks {
+		log.Fatal("-downloadblocks cannot write to the blocks of -coredatadir")
+	}
+	if *compactBlocks && !*observeMempool {
+		log.Fatal("-compactblocks rebuilds blocks from the transactions of -mempool")
+	}
+	if err := os.MkdirAll(*dataDir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dataDir, err)
+	}
+
+	addrs := addrmgr.New()
+	if geo := openGeoIP(*asmap, *mmdb); geo != nil {
+		defer geo.Close()
+		addrs = addrmgr.NewWithGroups(geo.Group)
+	}
+	addNodes := parseAddNodes(*addnode)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *dnsSeed {
+		resolver := dnsseed.Resolver{Server: *dnsServer}
+		added, err := resolver.Seed(ctx, addrs, params, config.Services)
+		if err != nil {
+			log.Errorf("DNS seeding failed: %v", err)
+		}
+		log.Infof("Added %d addresses from DNS seeds", added)
+	}
+
+	var ln net.Listener
+	if *listen != "" {
+		var err error
+		if ln, err = net.Listen("tcp", *listen); err != nil {
+			log.Fatalf("Failed to listen on %s: %v", *listen, err)
+		}
+		log.Infof("Listening for inbound connections on %s", ln.Addr())
+	}
+
+	dialer := newDialer(*proxy, *isolate)
+	peerCfg := network.PeerConfig{Magic: params.Magic}
+	if *torControl != "" {
+		controller, err := tor.Dial(ctx, network.TCPDialer{Timeout: dialTimeout}, *torControl)
+		if err != nil {
+			log.Fatalf("Failed to connect to Tor: %v", err)
+		}
+		defer controller.Close()
+		if err := controller.Authenticate(*torPassword); err != nil {
+			log.Fatalf("Failed to authenticate with Tor: %v", err)
+		}
+
+		socksAddr, err := controller.SOCKSAddr()
+		if err != nil {
+			log.Fatalf("Failed to get the Tor SOCKS port: %v", err)
+		}
+		dialer = tor.Dialer{
+			SOCKS:    network.SOCKS5Dialer{ProxyAddr: socksAddr, IsolateStreams: *isolate, Timeout: dialTimeout},
+			Clearnet: dialer,
+		}
+
+		if ln != nil {
+			onionAddr, err := createOnionService(controller, params, *onionKeyFile, ln.Addr().String())
+			if err != nil {
+				log.Fatalf("Failed to create onion service: %v", err)
+			}
+			peerCfg.LocalAddrs = append(peerCfg.LocalAddrs, onionAddr)
+		}
+	}
+
+	headers, err := chain.Open(params, filepath.Join(*dataDir, params.Name+"-headers.db"))
+	if err != nil {
+		log.Fatalf("Failed to open the header database: %v", err)
+	}
+	defer headers.Close()
+	log.Infof("Loaded %d headers, tip %s at height %d", headers.Len(), headers.Tip().Hash, headers.Height())
+	syncer := chain.NewSyncer(headers)
+
+	blocks := openBlockStore(params, *dataDir, *coreDataDir)
+	defer blocks.Close()
+	log.Infof("Block store holds %d blocks", blocks.Len())
+	blockServer := server.New(headers, blocks)
+	peerCfg.Services = blockServer.Services
+	peerCfg.StartHeight = headers.Height
+
+	setupPeer := []func(*network.Peer){syncer.SetupPeer, blockServer.SetupPeer}
+	peerConnected := []func(*network.Peer){syncer.AddPeer}
+	if *blockFilters {
+		index, err := cfindex.Open(cfindex.Config{
+			Path:          filepath.Join(*dataDir, params.Name+"-filters.db"),
+			Chain:         headers,
+			Blocks:        blocks,
+			HeadersSynced: syncer.Synced,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open the filter index: %v", err)
+		}
+		defer index.Close()
+		peerCfg.Services = func() uint64 {
+			services := blockServer.Services()
+			if index.Synced() {
+				services |= config.NodeCompactFilters
+			}
+			return services
+		}
+		setupPeer = append(setupPeer, index.SetupPeer)
+		go func() {
+			if err := index.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("Filter indexing stopped: %v", err)
+			}
+		}()
+	}
+	if *monitorBlocks {
+		// The compact block relay picks its own high-bandwidth peers.
+		monitor := blockmon.New(blockmon.Config{Chain: headers, LongDelay: *longDelay, HighBandwidth: !*compactBlocks})
+		setupPeer = append(setupPeer, monitor.SetupPeer)
+		peerConnected = append(peerConnected, monitor.AddPeer)
+	}
+	var pool *mempool.Pool
+	if *observeMempool {
+		pool = mempool.New(mempool.Config{MaxSize: *maxMempool << 20})
+		peerCfg.Relay = true
+		peerCfg.FeeFilter = *feeFilter
+		setupPeer = append(setupPeer, pool.SetupPeer)
+		go pool.Run(ctx)
+	}
+	var relay *compact.Relay
+	var scheduler *download.Scheduler
+	// announce pushes a block that became our tip to the peers that asked
+	// for high-bandwidth compact blocks.
+	announce := func(b *block.Block) {
+		if relay != nil && headers.Tip().Hash == b.Hash() {
+			relay.Announce(b)
+		}
+	}
+	if *compactBlocks {
+		relay = compact.New(compact.Config{
+			Pool:   pool,
+			Blocks: blocks,
+			Deliver: func(p *network.Peer, b *block.Block) {
+				// The scheduler stores the block in order instead of
+				// downloading it again.
+				if scheduler != nil {
+					scheduler.Add(b)
+					return
+				}
+				// Only the merkle root of a rebuilt block was checked: its
+				// header must be on the active chain before it confirms
+				// anything.
+				if node := headers.Lookup(b.Hash()); node == nil || !headers.Contains(node) {
+					log.Debugf("Ignoring block %s from %s: not on the active header chain", b.Hash(), p.Addr())
+					return
+				}
+				pool.ConnectBlock(b)
+				if _, err := blocks.Put(b); err != nil {
+					if !errors.Is(err, blockstore.ErrReadOnly) {
+						log.Errorf("Failed to store block %s: %v", b.Hash(), err)
+					}
+					return
+				}
+				announce(b)
+			},
+		})
+		setupPeer = append(setupPeer, relay.SetupPeer)
+		peerConnected = append(peerConnected, relay.AddPeer)
+	}
+	if *downloadBlocks {
+		scheduler = download.New(download.Config{
+			Chain:       headers,
+			StartHeight: firstMissingBlock(headers, blocks),
+			Deliver: func(node *chain.Node, b *block.Block) error {
+				if pool != nil {
+					pool.ConnectBlock(b)
+				}
+				if _, err := blocks.Put(b); err != nil {
+					return err
+				}
+				announce(b)
+				return nil
+			},
+		})
+		setupPeer = append(setupPeer, scheduler.SetupPeer)
+		peerConnected = append(peerConnected, scheduler.AddPeer)
+		go func() {
+			if err := scheduler.Run(ctx); err != nil && ctx.Err() == nil {
+				log.Errorf("Block download stopped: %v", err)
+			}
+		}()
+	}
+
+	manager := connmgr.New(connmgr.Config{
+		TargetOutbound:    *outbound,
+		TargetBlockRelay:  *blockRelay,
+		DisableOutbound:   *outbound == 0,
+		DisableBlockRelay: *blockRelay == 0,
+		AddrManager:       addrs,
+		AddNodes:          addNodes,
+		Dialer:            dialer,
+		PeerConfig:        peerCfg,
+		SetupPeer:         forEach(setupPeer),
+		PeerConnected:     forEach(peerConnected),
+	})
+
+	if ln != nil {
+		go func() {
+			if err := manager.Accept(ctx, ln); err != nil {
+				log.Errorf("Inbound listener failed: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tip := headers.Tip()
+				log.Infof("Connected to %d peers, header tip %s at height %d", len(manager.Peers()), tip.Hash, tip.Height)
+				if pool != nil {
+					log.Infof("Mempool holds %d transactions (%d bytes)", pool.Len(), pool.Size())
+				}
+				if relay != nil {
+					stats := relay.Stats()
+					log.Infof("Rebuilt %d compact blocks, %d without a round trip, %d downloaded in full; %.1f%% of their transactions were in the mempool",
+						stats.Blocks, stats.FromPool, stats.Failed, 100*stats.HitRate())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	manager.Run(ctx)
+}
+
+// chainParams returns the parameters of the named network or exits.
+func chainParams(name string) *config.ChainParams {
+	params, err := config.ParamsByName(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return params
+}
+
+// forEach returns a peer callback that calls each of fns in turn.
+func forEach(fns []func(*network.Peer)) func(*network.Peer) {
+	return func(p *network.Peer) {
+		for _, fn := range fns {
+			fn(p)
+		}
+	}
+}
+
+// openBlockStore opens our block store in dataDir or, when coreDataDir is
+// set, indexes the blocks of that Bitcoin Core data directory without
+// writing to it.
+func openBlockStore(params *config.ChainParams, dataDir, coreDataDir string) *blockstore.Store {
+	cfg := blockstore.Config{Dir: filepath.Join(dataDir, params.Name+"-blocks"), Magic: params.Magic}
+	if coreDataDir != "" {
+		cfg.Dir = blockstore.CoreBlocksDir(coreDataDir, params)
+		cfg.Index = filepath.Join(dataDir, params.Name+"-core-blocks.db")
+		cfg.ReadOnly = true
+	}
+	store, err := blockstore.Open(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open the block store: %v", err)
+	}
+	if coreDataDir != "" {
+		added, err := store.Reindex()
+		if err != nil {
+			log.Fatalf("Failed to index the blocks in %s: %v", cfg.Dir, err)
+		}
+		log.Infof("Indexed %d new blocks from %s", added, cfg.Dir)
+	}
+	return store
+}
+
+// firstMissingBlock returns the height of the first block of the header
+// chain that is not stored.
+func firstMissingBlock(headers *chain.Chain, blocks *blockstore.Store) int32 {
+	height := int32(1)
+	for node := headers.NodeAtHeight(height); node != nil && blocks.Has(node.Hash); node = headers.NodeAtHeight(height) {
+		height++
+	}
+	return height
+}
+
+// openGeoIP opens the given asmap and .mmdb files, or returns nil if there
+// are none.
+func openGeoIP(asmap, mmdb string) *geoip.Resolver {
+	if asmap == "" && mmdb == "" {
+		return nil
+	}
+	var mmdbPaths []string
+	if mmdb != "" {
+		mmdbPaths = strings.Split(mmdb, ",")
+	}
+	resolver, err := geoip.Open(asmap, mmdbPaths...)
+	if err != nil {
+		log.Fatalf("Failed to open GeoIP databases: %v", err)
+	}
+	return resolver
+}
+
+// createOnionService maps an onion service on the default port of params to
+// our inbound listener at target and returns its address. The private key
+// is kept in keyFile so the address stays the same across restarts.
+func createOnionService(controller *tor.Controller, params *config.ChainParams, keyFile, target string) (netaddr.AddrV2, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return netaddr.AddrV2{}, err
+	}
+
+	service, err := controller.AddOnion(strings.TrimSpace(string(key)), params.DefaultPort, target)
+	if err != nil {
+		return netaddr.AddrV2{}, err
+	}
+	if len(key) == 0 {
+		if err := os.WriteFile(keyFile, []byte(service.PrivateKey), 0o600); err != nil {
+			return netaddr.AddrV2{}, err
+		}
+	}
+	log.Infof("Onion service %s:%d forwards to %s", service.Hostname(), service.VirtualPort, target)
+	return service.Addr(config.Services)
+}
+
+// newDialer returns the dialer for outbound connections: a SOCKS5 dialer
+// when proxy is set and a direct TCP dialer otherwise.
+func newDialer(proxy string, isolate bool) network.Dialer {
+	if proxy == "" {
+		return network.TCPDialer{Timeout: dialTimeout}
+	}
+	return network.SOCKS5Dialer{ProxyAddr: proxy, IsolateStreams: isolate, Timeout: dialTimeout}
+}
+
+// parseAddNodes returns the comma separated host:port addresses of list,
+// which the connection manager stays connected to, or exits.
+func parseAddNodes(list string) []string {
+	var addrs []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(address)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil {
+			log.Fatalf("Invalid address %q: %v", address, err)
+		}
+		addrs = append(addrs, address)
+	}
+	return addrs
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/addrmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/connmgr"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/mempool"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/propagation"
+	log "github.com/sirupsen/logrus"
+)
+
+// runPropagation connects to many peers at once, records when each of them
+// first announces every transaction and writes the resulting propagation
+// statistics as CSV files.
+func runPropagation(args []string) {
+	flags := flag.NewFlagSet("propagation", flag.ExitOnError)
+	addnode := flags.String("addnode", net.JoinHostPort(config.BTCNodeHost, strconv.Itoa(config.BTCNodePort)), "comma separated list of host:port addresses to connect to")
+	outbound := flags.Int("outbound", 32, "number of peers whose announcements are recorded")
+	duration := flags.Duration("duration", 10*time.Minute, "how long to record announcements")
+	dir := flags.String("dir", "propagation", "directory receiving transactions.csv, curves.csv and peers.csv")
+	link := flags.Bool("link", true, "fetch the announced transactions to count announcements by txid and wtxid together")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	chainName := flags.String("chain", config.MainNetParams.Name, "network to measure: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "query the chain's DNS seeds for peer addresses")
+	dnsServer := flags.String("dnsserver", "", "DNS server host:port used for the seed lookups (system resolver when empty)")
+	flags.Parse(args)
+
+	params := chainParams(*chainName)
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dir, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	addrs := addrmgr.New()
+	addNodes := parseAddNodes(*addnode)
+	if *dnsSeed {
+		resolver := dnsseed.Resolver{Server: *dnsServer}
+		added, err := resolver.Seed(ctx, addrs, params, config.Services)
+		if err != nil {
+			log.Errorf("DNS seeding failed: %v", err)
+		}
+		log.Infof("Added %d addresses from DNS seeds", added)
+	}
+
+	recorder := propagation.NewRecorder()
+	setupPeer := []func(*network.Peer){recorder.SetupPeer}
+	if *link {
+		pool := mempool.New(mempool.Config{})
+		pool.Subscribe(func(e mempool.Event) {
+			if e.Type == mempool.TxAdded {
+				recorder.Link(e.Entry.TxID, e.Entry.WTxID)
+			}
+		})
+		setupPeer = append(setupPeer, pool.SetupPeer)
+		go pool.Run(ctx)
+	}
+
+	manager := connmgr.New(connmgr.Config{
+		TargetOutbound:    *outbound,
+		DisableOutbound:   *outbound == 0,
+		DisableBlockRelay: true,
+		AddrManager:       addrs,
+		AddNodes:          addNodes,
+		Dialer:            newDialer(*proxy, true),
+		PeerConfig:        network.PeerConfig{Magic: params.Magic, Relay: true},
+		SetupPeer:         forEach(setupPeer),
+	})
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Infof("Connected to %d peers, recorded %d transactions", len(manager.Peers()), recorder.Len())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	manager.Run(ctx)
+
+	txs := recorder.Transactions()
+	writeCSV(filepath.Join(*dir, "transactions.csv"), func(w io.Writer) error { return propagation.WriteTransactionsCSV(w, txs) })
+	writeCSV(filepath.Join(*dir, "curves.csv"), func(w io.Writer) error { return propagation.WriteCurvesCSV(w, txs) })
+	writeCSV(filepath.Join(*dir, "peers.csv"), func(w io.Writer) error { return propagation.WritePeersCSV(w, recorder.Peers()) })
+	log.Infof("Wrote the propagation of %d transactions to %s", len(txs), *dir)
+}
+
+// writeCSV creates path and fills it with write, or exits.
+func writeCSV(path string, write func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", path, err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package propagation measures how fast transactions spread through the
+// network from the times our peers first announce them.
+package propagation
+
+import (
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// txRecord holds the first announcement of a transaction by every peer.
+type txRecord struct {
+	hash utils.Hash
+	// wtxid is set when the announcements by wtxid were merged in by Link.
+	wtxid utils.Hash
+	first map[string]time.Time
+}
+
+// peerRecord holds the inv messages announcing transactions we received
+// from a peer.
+type peerRecord struct {
+	addr string
+	// invs is the number of those messages and gaps the total time
+	// between consecutive ones.
+	invs int
+	last time.Time
+	gaps time.Duration
+}
+
+// Recorder records the announcements of the peers it is set up on.
+type Recorder struct {
+	mu  sync.Mutex
+	txs map[utils.Hash]*txRecord
+	// aliases maps the wtxids merged by Link to their txid.
+	aliases map[utils.Hash]utils.Hash
+	peers   map[string]*peerRecord
+}
+
+// NewRecorder returns an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		txs:     make(map[utils.Hash]*txRecord),
+		aliases: make(map[utils.Hash]utils.Hash),
+		peers:   make(map[string]*peerRecord),
+	}
+}
+
+// SetupPeer registers the recorder's inv handler on p before its handshake.
+// It fits connmgr.Config.SetupPeer; peers only announce transactions if we
+// set network.PeerConfig.Relay.
+func (r *Recorder) SetupPeer(p *network.Peer) {
+	p.OnInv(func(p *network.Peer, vects []inv.InvVect) error {
+		r.record(p.Addr(), vects, time.Now())
+		return nil
+	})
+}
+
+// record notes the transactions announced by peer in one inv message at t.
+func (r *Recorder) record(peer string, vects []inv.InvVect, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	announced := false
+	for _, v := range vects {
+		if !v.Type.IsTx() {
+			continue
+		}
+		announced = true
+		hash := v.Hash
+		if txid, ok := r.aliases[hash]; ok {
+			hash = txid
+		}
+		rec, ok := r.txs[hash]
+		if !ok {
+			rec = &txRecord{hash: hash, first: make(map[string]time.Time)}
+			r.txs[hash] = rec
+		}
+		if _, ok := rec.first[peer]; !ok {
+			rec.first[peer] = t
+		}
+	}
+	if !announced {
+		return
+	}
+
+	pr, ok := r.peers[peer]
+	if !ok {
+		pr = &peerRecord{addr: peer}
+		r.peers[peer] = pr
+	}
+	if pr.invs > 0 {
+		pr.gaps += t.Sub(pr.last)
+	}
+	pr.invs++
+	pr.last = t
+}
+
+// Link tells the recorder that txid and wtxid identify the same recorded
+// transaction, so that its announcements by either are counted together.
+// The mempool learns it when the transaction arrives.
+func (r *Recorder) Link(txid, wtxid utils.Hash) {
+	if txid == wtxid {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, haveTxID := r.txs[txid]
+	byWTxID, haveWTxID := r.txs[wtxid]
+	if !haveTxID && !haveWTxID {
+		return
+	}
+	if !haveTxID {
+		rec = &txRecord{hash: txid, first: make(map[string]time.Time)}
+		r.txs[txid] = rec
+	}
+	rec.wtxid = wtxid
+	r.aliases[wtxid] = txid
+	if !haveWTxID {
+		return
+	}
+	delete(r.txs, wtxid)
+	for peer, t := range byWTxID.first {
+		if first, ok := rec.first[peer]; !ok || t.Before(first) {
+			rec.first[peer] = t
+		}
+	}
+}
+
+// Len returns the number of transactions recorded.
+func (r *Recorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.txs)
+}
+
+// Forget drops the transactions first announced before t, so that a long
+// measurement does not grow without bound.
+func (r *Recorder) Forget(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for hash, rec := range r.txs {
+		if first, _ := rec.firstAnnouncement(); first.Before(t) {
+			delete(r.txs, hash)
+			if rec.wtxid != (utils.Hash{}) {
+				delete(r.aliases, rec.wtxid)
+			}
+		}
+	}
+}
+
+// firstAnnouncement returns the earliest announcement of the transaction
+// and the peer that made it.
+func (rec *txRecord) firstAnnouncement() (time.Time, string) {
+	var first time.Time
+	var firstPeer string
+	for peer, t := range rec.first {
+		if firstPeer == "" || t.Before(first) || (t.Equal(first) && peer < firstPeer) {
+			first, firstPeer = t, peer
+		}
+	}
+	return first, firstPeer
+}
@@ -0,0 +1,98 @@
+package propagation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tx(n byte) inv.InvVect {
+	return inv.InvVect{Type: inv.InvTypeTx, Hash: utils.Hash{n}}
+}
+
+func wtx(n byte) inv.InvVect {
+	return inv.InvVect{Type: inv.InvTypeWTx, Hash: utils.Hash{0xff, n}}
+}
+
+func TestRecorder(t *testing.T) {
+	a, b := net.Pipe()
+	local := network.NewPeer(a, "remote", network.PeerConfig{Relay: true})
+	remote := network.NewPeer(b, "local", network.PeerConfig{})
+	r := NewRecorder()
+	r.SetupPeer(local)
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	defer local.Disconnect()
+
+	block := inv.InvVect{Type: inv.InvTypeBlock, Hash: utils.Hash{9}}
+	require.NoError(t, remote.SendInv(block))
+	require.NoError(t, remote.SendInv(tx(1), wtx(2)))
+	require.Eventually(t, func() bool { return r.Len() == 2 }, time.Second, 10*time.Millisecond)
+
+	peers := r.Peers()
+	require.Len(t, peers, 1)
+	assert.Equal(t, "remote", peers[0].Addr)
+	assert.Equal(t, 1, peers[0].Invs, "block announcements are not counted")
+	assert.Equal(t, 2, peers[0].Announced)
+}
+
+func TestRecorderKeepsFirstAnnouncement(t *testing.T) {
+	r := NewRecorder()
+	start := time.Now()
+	r.record("a", []inv.InvVect{tx(1)}, start)
+	r.record("a", []inv.InvVect{tx(1)}, start.Add(time.Second))
+	r.record("b", []inv.InvVect{tx(1)}, start.Add(2*time.Second))
+
+	txs := r.Transactions()
+	require.Len(t, txs, 1)
+	assert.Equal(t, []time.Duration{0, 2 * time.Second}, txs[0].Delays)
+	assert.Equal(t, "a", txs[0].FirstPeer)
+}
+
+func TestRecorderLink(t *testing.T) {
+	r := NewRecorder()
+	start := time.Now()
+	txid, wtxid := tx(1).Hash, wtx(1).Hash
+	r.record("a", []inv.InvVect{wtx(1)}, start)
+	r.record("b", []inv.InvVect{tx(1)}, start.Add(time.Second))
+	r.record("c", []inv.InvVect{wtx(1)}, start.Add(2*time.Second))
+	require.Equal(t, 2, r.Len())
+
+	r.Link(txid, wtxid)
+	r.record("d", []inv.InvVect{wtx(1)}, start.Add(3*time.Second))
+	txs := r.Transactions()
+	require.Len(t, txs, 1)
+	assert.Equal(t, txid, txs[0].TxID)
+	assert.Equal(t, wtxid, txs[0].WTxID)
+	assert.Equal(t, "a", txs[0].FirstPeer)
+	assert.Equal(t, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}, txs[0].Delays)
+
+	// Unknown transactions are not linked.
+	r.Link(tx(2).Hash, wtx(2).Hash)
+	assert.Equal(t, 1, r.Len())
+}
+
+func TestRecorderForget(t *testing.T) {
+	r := NewRecorder()
+	start := time.Now()
+	r.record("a", []inv.InvVect{tx(1)}, start)
+	r.record("a", []inv.InvVect{tx(2)}, start.Add(time.Minute))
+	r.Link(tx(1).Hash, wtx(1).Hash)
+
+	r.Forget(start.Add(time.Second))
+	txs := r.Transactions()
+	require.Len(t, txs, 1)
+	assert.Equal(t, tx(2).Hash, txs[0].TxID)
+	assert.Empty(t, r.aliases)
+}
@@ -0,0 +1,223 @@
+package propagation
+
+import (
+	"cmp"
+	"encoding/csv"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+// minPeers is the number of peers that must announce a transaction for it
+// to count towards the delays of PeerStats: the only announcer of a
+// transaction is always first.
+const minPeers = 2
+
+// TxStats is the propagation of one transaction.
+type TxStats struct {
+	// TxID is the hash the transaction was announced with, its wtxid when
+	// all announcements were by wtxid and it was never linked.
+	TxID utils.Hash
+	// WTxID is set when the announcements by wtxid were linked to TxID.
+	WTxID     utils.Hash
+	FirstSeen time.Time
+	FirstPeer string
+	// Delays is the propagation curve: how long after FirstSeen each peer
+	// announced the transaction, in increasing order. After Delays[i],
+	// i+1 peers had announced it; Delays[0] is 0.
+	Delays []time.Duration
+}
+
+// Peers returns the number of peers that announced the transaction.
+func (s TxStats) Peers() int {
+	return len(s.Delays)
+}
+
+// Quantile returns the delay after which a fraction q of the announcing
+// peers had announced the transaction.
+func (s TxStats) Quantile(q float64) time.Duration {
+	if len(s.Delays) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(s.Delays)))) - 1
+	return s.Delays[max(0, min(i, len(s.Delays)-1))]
+}
+
+// PeerStats is the announcement behaviour of one peer.
+type PeerStats struct {
+	Addr string
+	// Announced is the number of transactions the peer announced, and
+	// First how many of them it announced before every other peer.
+	Announced int
+	First     int
+	// MeanDelay and MedianDelay are how long after the first announcement
+	// the peer announced transactions, over those announced by at least
+	// two peers.
+	MeanDelay   time.Duration
+	MedianDelay time.Duration
+	// Invs is the number of inv messages announcing transactions.
+	Invs int
+	// TrickleInterval estimates the mean time between those messages.
+	// Bitcoin Core sends them at Poisson-distributed intervals, on average
+	// every 5s to inbound peers and 2s to outbound ones; the maximum
+	// likelihood estimate of that mean is the average gap.
+	TrickleInterval time.Duration
+	// NetworkDelay is what remains of MeanDelay once the expected wait for
+	// the peer's next trickle, TrickleInterval since the intervals are
+	// memoryless, is taken out: how much later than the first announcer
+	// the transactions reached the peer.
+	NetworkDelay time.Duration
+}
+
+// Transactions returns the propagation of every recorded transaction,
+// ordered by first announcement.
+func (r *Recorder) Transactions() []TxStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make([]TxStats, 0, len(r.txs))
+	for _, rec := range r.txs {
+		stats = append(stats, rec.stats())
+	}
+	slices.SortFunc(stats, func(a, b TxStats) int {
+		if c := a.FirstSeen.Compare(b.FirstSeen); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.TxID.String(), b.TxID.String())
+	})
+	return stats
+}
+
+func (rec *txRecord) stats() TxStats {
+	first, firstPeer := rec.firstAnnouncement()
+	s := TxStats{TxID: rec.hash, WTxID: rec.wtxid, FirstSeen: first, FirstPeer: firstPeer}
+	for _, t := range rec.first {
+		s.Delays = append(s.Delays, t.Sub(first))
+	}
+	slices.Sort(s.Delays)
+	return s
+}
+
+// Peers returns the announcement behaviour of every peer that announced
+// transactions, ordered by address.
+func (r *Recorder) Peers() []PeerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delays := make(map[string][]time.Duration)
+	stats := make(map[string]*PeerStats)
+	for addr, pr := range r.peers {
+		s := &PeerStats{Addr: addr, Invs: pr.invs}
+		if pr.invs > 1 {
+			s.TrickleInterval = pr.gaps / time.Duration(pr.invs-1)
+		}
+		stats[addr] = s
+	}
+	for _, rec := range r.txs {
+		first, firstPeer := rec.firstAnnouncement()
+		for peer, t := range rec.first {
+			s := stats[peer]
+			s.Announced++
+			if peer == firstPeer {
+				s.First++
+			}
+			if len(rec.first) >= minPeers {
+				delays[peer] = append(delays[peer], t.Sub(first))
+			}
+		}
+	}
+
+	result := make([]PeerStats, 0, len(stats))
+	for addr, s := range stats {
+		if d := delays[addr]; len(d) > 0 {
+			slices.Sort(d)
+			var total time.Duration
+			for _, delay := range d {
+				total += delay
+			}
+			s.MeanDelay = total / time.Duration(len(d))
+			s.MedianDelay = d[len(d)/2]
+			s.NetworkDelay = max(0, s.MeanDelay-s.TrickleInterval)
+		}
+		result = append(result, *s)
+	}
+	slices.SortFunc(result, func(a, b PeerStats) int { return cmp.Compare(a.Addr, b.Addr) })
+	return result
+}
+
+// WriteTransactionsCSV writes one row per transaction with the delays
+// after which 10%, 50%, 90% and all of its announcers had announced it.
+func WriteTransactionsCSV(w io.Writer, txs []TxStats) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"txid", "wtxid", "first_seen", "first_peer", "peers", "p10_ms", "p50_ms", "p90_ms", "last_ms"})
+	for _, s := range txs {
+		cw.Write([]string{
+			s.TxID.String(),
+			formatWTxID(s.WTxID),
+			s.FirstSeen.UTC().Format(time.RFC3339Nano),
+			s.FirstPeer,
+			strconv.Itoa(s.Peers()),
+			formatMillis(s.Quantile(0.1)),
+			formatMillis(s.Quantile(0.5)),
+			formatMillis(s.Quantile(0.9)),
+			formatMillis(s.Quantile(1)),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteCurvesCSV writes the propagation curve of every transaction: one
+// row per announcing peer, with the share of announcers reached and the
+// delay.
+func WriteCurvesCSV(w io.Writer, txs []TxStats) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"txid", "peers", "fraction", "delay_ms"})
+	for _, s := range txs {
+		for i, delay := range s.Delays {
+			cw.Write([]string{
+				s.TxID.String(),
+				strconv.Itoa(i + 1),
+				strconv.FormatFloat(float64(i+1)/float64(len(s.Delays)), 'f', 4, 64),
+				formatMillis(delay),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WritePeersCSV writes one row per peer.
+func WritePeersCSV(w io.Writer, peers []PeerStats) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"peer", "announced", "first", "mean_delay_ms", "median_delay_ms", "invs", "trickle_interval_ms", "network_delay_ms"})
+	for _, s := range peers {
+		cw.Write([]string{
+			s.Addr,
+			strconv.Itoa(s.Announced),
+			strconv.Itoa(s.First),
+			formatMillis(s.MeanDelay),
+			formatMillis(s.MedianDelay),
+			strconv.Itoa(s.Invs),
+			formatMillis(s.TrickleInterval),
+			formatMillis(s.NetworkDelay),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+func formatWTxID(wtxid utils.Hash) string {
+	if wtxid == (utils.Hash{}) {
+		return ""
+	}
+	return wtxid.String()
+}
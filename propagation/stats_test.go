@@ -0,0 +1,96 @@
+package propagation
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorded returns a recorder where peer a announces every transaction
+// first, in inv messages 2s apart, b 1s and c 3s after it.
+func recorded() (*Recorder, time.Time) {
+	r := NewRecorder()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := byte(0); i < 4; i++ {
+		at := start.Add(time.Duration(i) * 2 * time.Second)
+		r.record("a", []inv.InvVect{tx(i)}, at)
+		r.record("b", []inv.InvVect{tx(i)}, at.Add(time.Second))
+		r.record("c", []inv.InvVect{tx(i)}, at.Add(3*time.Second))
+	}
+	// Only c announces this one.
+	r.record("c", []inv.InvVect{tx(9)}, start.Add(time.Minute))
+	return r, start
+}
+
+func TestTransactions(t *testing.T) {
+	r, start := recorded()
+	txs := r.Transactions()
+	require.Len(t, txs, 5)
+	assert.Equal(t, tx(0).Hash, txs[0].TxID)
+	assert.Equal(t, start, txs[0].FirstSeen)
+	assert.Equal(t, 3, txs[0].Peers())
+	assert.Equal(t, []time.Duration{0, time.Second, 3 * time.Second}, txs[0].Delays)
+	assert.Equal(t, time.Duration(0), txs[0].Quantile(0.1))
+	assert.Equal(t, time.Second, txs[0].Quantile(0.5))
+	assert.Equal(t, 3*time.Second, txs[0].Quantile(1))
+	assert.Equal(t, tx(9).Hash, txs[4].TxID)
+	assert.Zero(t, TxStats{}.Quantile(0.5))
+}
+
+func TestPeers(t *testing.T) {
+	r, _ := recorded()
+	peers := r.Peers()
+	require.Len(t, peers, 3)
+
+	a, b, c := peers[0], peers[1], peers[2]
+	assert.Equal(t, "a", a.Addr)
+	assert.Equal(t, 4, a.First)
+	assert.Zero(t, a.MeanDelay)
+	assert.Equal(t, 2*time.Second, a.TrickleInterval)
+
+	assert.Equal(t, time.Second, b.MeanDelay)
+	assert.Equal(t, time.Second, b.MedianDelay)
+	assert.Zero(t, b.NetworkDelay, "b's delay is explained by its trickle")
+
+	assert.Equal(t, 5, c.Announced)
+	assert.Equal(t, 1, c.First, "c is the only announcer of one transaction")
+	assert.Equal(t, 3*time.Second, c.MeanDelay, "transactions only c announced do not count")
+	assert.Equal(t, 5, c.Invs)
+	assert.Equal(t, (6*time.Second+51*time.Second)/4, c.TrickleInterval)
+}
+
+func TestWriteCSV(t *testing.T) {
+	r, _ := recorded()
+	txs := r.Transactions()
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteTransactionsCSV(&buf, txs))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 6)
+	assert.Equal(t, []string{"txid", "wtxid", "first_seen", "first_peer", "peers", "p10_ms", "p50_ms", "p90_ms", "last_ms"}, rows[0])
+	assert.Equal(t, []string{tx(0).Hash.String(), "", "2024-05-01T12:00:00Z", "a", "3", "0.000", "1000.000", "3000.000", "3000.000"}, rows[1])
+
+	buf.Reset()
+	require.NoError(t, WriteCurvesCSV(&buf, txs[:1]))
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"txid", "peers", "fraction", "delay_ms"},
+		{tx(0).Hash.String(), "1", "0.3333", "0.000"},
+		{tx(0).Hash.String(), "2", "0.6667", "1000.000"},
+		{tx(0).Hash.String(), "3", "1.0000", "3000.000"},
+	}, rows)
+
+	buf.Reset()
+	require.NoError(t, WritePeersCSV(&buf, r.Peers()))
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"b", "4", "0", "1000.000", "1000.000", "4", "2000.000", "0.000"}, rows[2])
+}
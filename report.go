@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/crawldb"
+	"github.com/safwentrabelsi/bitcoin-handshake/report"
+	log "github.com/sirupsen/logrus"
+)
+
+// runReport prints the census of a crawl snapshot: user agents, versions,
+// service flags, networks, start heights and ports of the reachable nodes.
+func runReport(args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	dbPath := flags.String("db", "crawl/crawl.db", "crawl database to read")
+	snapshotID := flags.Uint64("snapshot", 0, "snapshot to report on (latest when 0)")
+	format := flags.String("format", report.FormatText, "output format: text, json or csv")
+	flags.Parse(args)
+
+	db, err := crawldb.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open crawl database: %v", err)
+	}
+	defer db.Close()
+
+	id := *snapshotID
+	if id == 0 {
+		snapshots, err := db.Snapshots()
+		if err != nil {
+			log.Fatalf("Failed to list snapshots: %v", err)
+		}
+		if len(snapshots) == 0 {
+			log.Fatal("The crawl database has no snapshot: run crawl first")
+		}
+		id = snapshots[len(snapshots)-1].ID
+	}
+
+	results, err := db.Results(id)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot %d: %v", id, err)
+	}
+	if err := report.Build(results).Write(os.Stdout, *format); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Formats accepted by Write.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+type section struct {
+	name   string
+	title  string
+	counts []Count
+}
+
+func (r Report) sections() []section {
+	sections := []section{
+		{"user_agents", "User agents", r.UserAgents},
+		{"versions", "Protocol versions", r.Versions},
+		{"services", "Service flags", r.Services},
+		{"networks", "Networks", r.Networks},
+		{"heights", "Start heights", r.Heights},
+		{"ports", "Ports", r.Ports},
+	}
+	if r.Countries != nil {
+		sections = append(sections,
+			section{"countries", "Countries", r.Countries},
+			section{"asns", "Autonomous systems", r.ASNs},
+		)
+	}
+	return sections
+}
+
+// Write writes the report to w in the given format.
+func (r Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatText:
+		return r.WriteText(w)
+	case FormatJSON:
+		return r.WriteJSON(w)
+	case FormatCSV:
+		return r.WriteCSV(w)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// WriteText writes the report as text tables.
+func (r Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Nodes:\t%d\n", r.Nodes)
+	fmt.Fprintf(tw, "Reachable:\t%d\n", r.Reachable)
+	fmt.Fprintf(tw, "Tip height:\t%d\n", r.TipHeight)
+	for _, s := range r.sections() {
+		fmt.Fprintf(tw, "\n%s\tNODES\t%%\n", s.title)
+		for _, c := range s.counts {
+			fmt.Fprintf(tw, "%s\t%d\t%.1f\n", c.Key, c.Count, c.Percent)
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as an indented JSON object.
+func (r Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes one section,key,count,percent row per entry. The totals
+// are in the summary section.
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"section", "key", "count", "percent"})
+	cw.Write([]string{"summary", "nodes", strconv.Itoa(r.Nodes), ""})
+	cw.Write([]string{"summary", "reachable", strconv.Itoa(r.Reachable), ""})
+	cw.Write([]string{"summary", "tip_height", strconv.Itoa(int(r.TipHeight)), ""})
+	for _, s := range r.sections() {
+		for _, c := range s.counts {
+			cw.Write([]string{s.name, c.Key, strconv.Itoa(c.Count), strconv.FormatFloat(c.Percent, 'f', 2, 64)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,179 @@
+// Package report aggregates crawl results into a census of the network.
+package report
+
+import (
+	"cmp"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+)
+
+// Count is one row of a distribution.
+type Count struct {
+	Key     string  `json:"key"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// Report is the census of the reachable nodes of a crawl.
+type Report struct {
+	Nodes      int     `json:"nodes"`
+	Reachable  int     `json:"reachable"`
+	TipHeight  int32   `json:"tip_height"`
+	UserAgents []Count `json:"user_agents"`
+	Versions   []Count `json:"versions"`
+	Services   []Count `json:"services"`
+	Networks   []Count `json:"networks"`
+	Heights    []Count `json:"heights"`
+	Ports      []Count `json:"ports"`
+	// Countries and ASNs are only filled for results annotated with GeoIP
+	// data.
+	Countries []Count `json:"countries,omitempty"`
+	ASNs      []Count `json:"asns,omitempty"`
+}
+
+// serviceNames lists the service flags whose adoption is reported.
+var serviceNames = []struct {
+	flag uint64
+	name string
+}{
+	{config.NodeNetwork, "NODE_NETWORK"},
+	{config.NodeBloom, "NODE_BLOOM"},
+	{config.NodeWitness, "NODE_WITNESS"},
+	{config.NodeCompactFilters, "NODE_COMPACT_FILTERS"},
+	{config.NodeNetworkLimited, "NODE_NETWORK_LIMITED"},
+	{config.NodeP2PV2, "NODE_P2P_V2"},
+}
+
+var networkNames = map[byte]string{
+	netaddr.NetworkIPv4:  "ipv4",
+	netaddr.NetworkIPv6:  "ipv6",
+	netaddr.NetworkTorV2: "onion",
+	netaddr.NetworkTorV3: "onion",
+	netaddr.NetworkI2P:   "i2p",
+	netaddr.NetworkCJDNS: "cjdns",
+}
+
+// heightBuckets group nodes by how many blocks they are behind the highest
+// start height seen, in the order they are reported.
+var heightBuckets = []struct {
+	name   string
+	behind int32
+}{
+	{"at tip", 0},
+	{"1-6 behind", 6},
+	{"7-144 behind", 144},
+	{"145-2016 behind", 2016},
+	{">2016 behind", -1},
+}
+
+// Build aggregates the version messages of the successful results. Every
+// distribution counts reachable nodes and its percentages are relative to
+// them. The tip is the highest start height reported.
+func Build(results []crawler.Result) Report {
+	r := Report{Nodes: len(results)}
+
+	userAgents := make(map[string]int)
+	versions := make(map[string]int)
+	services := make(map[string]int)
+	networks := make(map[string]int)
+	heights := make(map[string]int)
+	ports := make(map[string]int)
+	countries := make(map[string]int)
+	asns := make(map[string]int)
+
+	var reachable []crawler.Result
+	for _, result := range results {
+		if result.Success && result.Version != nil {
+			reachable = append(reachable, result)
+			r.TipHeight = max(r.TipHeight, result.Version.StartHeight)
+		}
+	}
+	r.Reachable = len(reachable)
+
+	for _, result := range reachable {
+		v := result.Version
+		userAgents[v.UserAgent]++
+		versions[strconv.Itoa(int(v.Version))]++
+		for _, s := range serviceNames {
+			if v.Services&s.flag != 0 {
+				services[s.name]++
+			}
+		}
+		if name, ok := networkNames[result.Network]; ok {
+			networks[name]++
+		} else {
+			networks["unknown"]++
+		}
+		heights[heightBucket(r.TipHeight-v.StartHeight)]++
+		if _, port, err := net.SplitHostPort(result.Addr); err == nil {
+			ports[port]++
+		}
+		if geo := result.Geo; geo != nil {
+			countries[cmp.Or(geo.Country, "unknown")]++
+			asns[asName(geo.ASN, geo.ASOrg)]++
+		}
+	}
+
+	r.UserAgents = byCount(userAgents, r.Reachable)
+	r.Versions = byCount(versions, r.Reachable)
+	r.Networks = byCount(networks, r.Reachable)
+	r.Ports = byCount(ports, r.Reachable)
+	if len(countries) > 0 {
+		r.Countries = byCount(countries, r.Reachable)
+		r.ASNs = byCount(asns, r.Reachable)
+	}
+	for _, s := range serviceNames {
+		r.Services = append(r.Services, count(s.name, services[s.name], r.Reachable))
+	}
+	for _, b := range heightBuckets {
+		r.Heights = append(r.Heights, count(b.name, heights[b.name], r.Reachable))
+	}
+	return r
+}
+
+func asName(asn uint32, org string) string {
+	switch {
+	case asn == 0:
+		return "unknown"
+	case org == "":
+		return "AS" + strconv.FormatUint(uint64(asn), 10)
+	}
+	return "AS" + strconv.FormatUint(uint64(asn), 10) + " " + org
+}
+
+func heightBucket(behind int32) string {
+	for _, b := range heightBuckets {
+		if b.behind < 0 || behind <= b.behind {
+			return b.name
+		}
+	}
+	return ""
+}
+
+// byCount returns the distribution sorted by decreasing count, then key.
+func byCount(counts map[string]int, total int) []Count {
+	out := make([]Count, 0, len(counts))
+	for key, n := range counts {
+		out = append(out, count(key, n, total))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+func count(key string, n, total int) Count {
+	c := Count{Key: key, Count: n}
+	if total > 0 {
+		c.Percent = 100 * float64(n) / float64(total)
+	}
+	return c
+}
@@ -0,0 +1,137 @@
+package report
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/geoip"
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func node(addr string, network byte, userAgent string, services uint64, height int32) crawler.Result {
+	return crawler.Result{
+		Addr:    addr,
+		Network: network,
+		Success: true,
+		Version: &version.VersionMessage{Version: 70016, UserAgent: userAgent, Services: services, StartHeight: height},
+	}
+}
+
+var results = []crawler.Result{
+	node("1.0.0.1:8333", netaddr.NetworkIPv4, "/Satoshi:27.0.0/", config.NodeNetwork|config.NodeWitness|config.NodeP2PV2, 850000),
+	node("1.0.0.2:8333", netaddr.NetworkIPv4, "/Satoshi:27.0.0/", config.NodeNetwork|config.NodeWitness|config.NodeCompactFilters, 849998),
+	node("[2001:db8::1]:8333", netaddr.NetworkIPv6, "/Satoshi:26.0.0/", config.NodeNetwork|config.NodeWitness, 849000),
+	node("abc.onion:8333", netaddr.NetworkTorV3, "/Satoshi:27.0.0/", config.NodeNetworkLimited|config.NodeWitness, 800000),
+	node("def.i2p:0", netaddr.NetworkI2P, "/btcwire:0.5.0/btcd:0.24.2/", config.NodeNetwork, 850000),
+	node("1.0.0.3:18444", netaddr.NetworkIPv4, "/Satoshi:27.0.0/", config.NodeNetwork, 849900),
+	{Addr: "9.9.9.9:8333", Network: netaddr.NetworkIPv4, Error: "connection refused"},
+}
+
+func find(t *testing.T, counts []Count, key string) Count {
+	t.Helper()
+	for _, c := range counts {
+		if c.Key == key {
+			return c
+		}
+	}
+	t.Fatalf("%q not found in %v", key, counts)
+	return Count{}
+}
+
+func TestBuild(t *testing.T) {
+	r := Build(results)
+	assert.Equal(t, 7, r.Nodes)
+	assert.Equal(t, 6, r.Reachable)
+	assert.Equal(t, int32(850000), r.TipHeight)
+
+	require.NotEmpty(t, r.UserAgents)
+	assert.Equal(t, Count{"/Satoshi:27.0.0/", 4, 100 * 4.0 / 6}, r.UserAgents[0], "sorted by count")
+	assert.Equal(t, []Count{{"70016", 6, 100}}, r.Versions)
+
+	assert.Equal(t, 4, find(t, r.Services, "NODE_WITNESS").Count)
+	assert.Equal(t, 1, find(t, r.Services, "NODE_COMPACT_FILTERS").Count)
+	assert.Equal(t, 1, find(t, r.Services, "NODE_P2P_V2").Count)
+	assert.Equal(t, 0, find(t, r.Services, "NODE_BLOOM").Count, "every flag is listed")
+
+	assert.Equal(t, 3, find(t, r.Networks, "ipv4").Count)
+	assert.Equal(t, 1, find(t, r.Networks, "ipv6").Count)
+	assert.Equal(t, 1, find(t, r.Networks, "onion").Count)
+	assert.Equal(t, 1, find(t, r.Networks, "i2p").Count)
+
+	assert.Equal(t, []Count{
+		{"at tip", 2, 100 * 2.0 / 6},
+		{"1-6 behind", 1, 100 * 1.0 / 6},
+		{"7-144 behind", 1, 100 * 1.0 / 6},
+		{"145-2016 behind", 1, 100 * 1.0 / 6},
+		{">2016 behind", 1, 100 * 1.0 / 6},
+	}, r.Heights)
+
+	assert.Equal(t, 4, find(t, r.Ports, "8333").Count)
+	assert.Equal(t, 1, find(t, r.Ports, "18444").Count)
+}
+
+func TestBuildGeo(t *testing.T) {
+	assert.Nil(t, Build(results).Countries, "no geo section without GeoIP data")
+
+	annotated := make([]crawler.Result, len(results))
+	copy(annotated, results)
+	annotated[0].Geo = &geoip.Info{Country: "DE", ASN: 3320, ASOrg: "Deutsche Telekom AG"}
+	annotated[1].Geo = &geoip.Info{Country: "DE", ASN: 3320, ASOrg: "Deutsche Telekom AG"}
+	annotated[2].Geo = &geoip.Info{Country: "CH", ASN: 13030}
+	annotated[5].Geo = &geoip.Info{}
+
+	r := Build(annotated)
+	assert.Equal(t, 2, find(t, r.Countries, "DE").Count)
+	assert.Equal(t, 1, find(t, r.Countries, "CH").Count)
+	assert.Equal(t, 1, find(t, r.Countries, "unknown").Count)
+	assert.Equal(t, Count{"AS3320 Deutsche Telekom AG", 2, 100 * 2.0 / 6}, r.ASNs[0])
+	assert.Equal(t, 1, find(t, r.ASNs, "AS13030").Count)
+
+	var text bytes.Buffer
+	require.NoError(t, r.WriteText(&text))
+	assert.Contains(t, text.String(), "Autonomous systems")
+}
+
+func TestBuildEmpty(t *testing.T) {
+	r := Build(nil)
+	assert.Zero(t, r.Reachable)
+	assert.Empty(t, r.UserAgents)
+	assert.Len(t, r.Heights, len(heightBuckets))
+	for _, c := range r.Services {
+		assert.Zero(t, c.Percent)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	r := Build(results)
+
+	var text bytes.Buffer
+	require.NoError(t, r.Write(&text, FormatText))
+	assert.Contains(t, text.String(), "Reachable:")
+	assert.Contains(t, text.String(), "/btcwire:0.5.0/btcd:0.24.2/")
+	assert.Contains(t, text.String(), "NODE_P2P_V2")
+
+	var js bytes.Buffer
+	require.NoError(t, r.Write(&js, FormatJSON))
+	var decoded Report
+	require.NoError(t, json.Unmarshal(js.Bytes(), &decoded))
+	assert.Equal(t, r, decoded)
+
+	var csvOut bytes.Buffer
+	require.NoError(t, r.Write(&csvOut, FormatCSV))
+	rows, err := csv.NewReader(strings.NewReader(csvOut.String())).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"section", "key", "count", "percent"}, rows[0])
+	assert.Contains(t, rows, []string{"summary", "reachable", "6", ""})
+	assert.Contains(t, rows, []string{"networks", "ipv6", "1", "16.67"})
+
+	assert.Error(t, r.Write(&text, "xml"))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/seeder"
+	log "github.com/sirupsen/logrus"
+)
+
+// runSeeder serves the zone given with -host from an authoritative DNS
+// server while crawling the network in rounds to keep the node statistics
+// current.
+func runSeeder(args []string) {
+	flags := flag.NewFlagSet("seeder", flag.ExitOnError)
+	host := flags.String("host", "", "zone served by the seeder, e.g. seed.signet.example.com")
+	ns := flags.String("ns", "", "host name of this name server")
+	mbox := flags.String("mbox", "", "contact e-mail address for the SOA record")
+	listen := flags.String("listen", ":53", "UDP address the DNS server listens on")
+	dir := flags.String("dir", "seeder", "directory holding the node database")
+	importResults := flags.String("import", "", "crawl results file (results.jsonl) to load into the database")
+	seeds := flags.String("seeds", "", "comma separated list of host:port addresses to start from")
+	chain := flags.String("chain", config.MainNetParams.Name, "network to seed: mainnet, testnet3, testnet4, signet or regtest")
+	dnsSeed := flags.Bool("dnsseed", false, "bootstrap from the chain's other DNS seeds")
+	interval := flags.Duration("interval", 15*time.Minute, "time between two crawl rounds")
+	concurrency := flags.Int("concurrency", 32, "number of nodes visited at the same time")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for a single node")
+	proxy := flags.String("proxy", "", "connect through the SOCKS5 proxy at host:port")
+	flags.Parse(args)
+
+	if *host == "" || *ns == "" {
+		log.Fatal("-host and -ns are required")
+	}
+	params := chainParams(*chain)
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dir, err)
+	}
+	dbPath := filepath.Join(*dir, "nodes.json")
+	db, err := seeder.LoadDB(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to load node database: %v", err)
+	}
+	if *importResults != "" {
+		f, err := os.Open(*importResults)
+		if err != nil {
+			log.Fatalf("Failed to open crawl results: %v", err)
+		}
+		count, err := db.Import(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to import crawl results: %v", err)
+		}
+		log.Infof("Imported %d crawl results", count)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &seeder.Server{
+		Host:            strings.ToLower(*host),
+		NS:              *ns,
+		Mbox:            *mbox,
+		DB:              db,
+		Port:            params.DefaultPort,
+		DefaultServices: config.NodeNetwork,
+	}
+	go func() {
+		if err := server.ListenAndServe(ctx, *listen); err != nil {
+			log.Fatalf("DNS server failed: %v", err)
+		}
+	}()
+	log.Infof("Serving %s on %s", *host, *listen)
+
+	for ctx.Err() == nil {
+		queue, err := newRoundQueue(filepath.Join(*dir, "queue.json"))
+		if err != nil {
+			log.Fatalf("Failed to open crawl queue: %v", err)
+		}
+		queue.Push(db.Addrs()...)
+		if *seeds != "" {
+			queue.Push(strings.Split(*seeds, ",")...)
+		}
+		if *dnsSeed {
+			resolver := dnsseed.Resolver{}
+			found, err := resolver.Lookup(ctx, params, 0)
+			if err != nil {
+				log.Errorf("DNS seeding failed: %v", err)
+			}
+			for _, addr := range found {
+				queue.Push(addr.String())
+			}
+		}
+
+		c := crawler.New(crawler.Config{
+			Queue:       queue,
+			Dialer:      newDialer(*proxy, true),
+			PeerConfig:  network.PeerConfig{Magic: params.Magic, HandshakeTimeout: *timeout},
+			Concurrency: *concurrency,
+			Timeout:     *timeout,
+			OnResult:    db.Record,
+		})
+		if err := c.Run(ctx); err != nil && !errors.Is(err, crawler.ErrInterrupted) {
+			log.Errorf("Crawl round failed: %v", err)
+		}
+		if err := db.Save(dbPath); err != nil {
+			log.Errorf("Failed to save node database: %v", err)
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// newRoundQueue opens an empty queue: every round visits all known nodes
+// again, so a queue left by an interrupted round is discarded.
+func newRoundQueue(path string) (*crawler.Queue, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return crawler.OpenQueue(path)
+}
@@ -0,0 +1,268 @@
+package seeder
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+)
+
+// minVersion is the oldest protocol version we hand out.
+const minVersion = 70001
+
+// Stat is a decaying average of handshake results over a time window, as
+// kept by sipa's bitcoin-seeder.
+type Stat struct {
+	Weight      float64 `json:"weight"`
+	Count       float64 `json:"count"`
+	Reliability float64 `json:"reliability"`
+}
+
+func (s *Stat) update(good bool, age, tau time.Duration) {
+	f := math.Exp(-age.Seconds() / tau.Seconds())
+	s.Reliability = s.Reliability * f
+	if good {
+		s.Reliability += 1 - f
+	}
+	s.Count = s.Count*f + 1
+	s.Weight = s.Weight*f + 1 - f
+}
+
+// Node is what the seeder knows about a crawled node.
+type Node struct {
+	Addr        string    `json:"addr"`
+	Services    uint64    `json:"services"`
+	Version     int32     `json:"version"`
+	UserAgent   string    `json:"user_agent"`
+	StartHeight int32     `json:"start_height"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastTry     time.Time `json:"last_try"`
+	LastSuccess time.Time `json:"last_success"`
+	Total       int       `json:"total"`
+	Success     int       `json:"success"`
+	Stat2H      Stat      `json:"stat_2h"`
+	Stat8H      Stat      `json:"stat_8h"`
+	Stat1D      Stat      `json:"stat_1d"`
+	Stat1W      Stat      `json:"stat_1w"`
+	Stat1M      Stat      `json:"stat_1m"`
+}
+
+// good applies the bitcoin-seeder rules: a node is handed out while it has
+// been reliable enough over one of the windows, or while it is new and
+// mostly answered.
+func (n *Node) good() bool {
+	if n.Services&config.NodeNetwork == 0 || n.Version < minVersion {
+		return false
+	}
+	switch {
+	case n.Total <= 3 && n.Success*2 >= n.Total:
+		return true
+	case n.Stat2H.Reliability > 0.85 && n.Stat2H.Count > 2:
+		return true
+	case n.Stat8H.Reliability > 0.70 && n.Stat8H.Count > 4:
+		return true
+	case n.Stat1D.Reliability > 0.55 && n.Stat1D.Count > 8:
+		return true
+	case n.Stat1W.Reliability > 0.45 && n.Stat1W.Count > 16:
+		return true
+	case n.Stat1M.Reliability > 0.35 && n.Stat1M.Count > 32:
+		return true
+	}
+	return false
+}
+
+// score ranks good nodes: long-term uptime, weighted down the longer ago
+// the last successful handshake was.
+func (n *Node) score(now time.Time) float64 {
+	uptime := (n.Stat1D.Reliability + n.Stat1W.Reliability + n.Stat1M.Reliability) / 3
+	if n.Total <= 3 {
+		uptime = float64(n.Success) / float64(max(n.Total, 1))
+	}
+	recency := math.Exp(-now.Sub(n.LastSuccess).Hours() / 8)
+	return max(uptime*recency, 1e-6)
+}
+
+// DB keeps the crawl history of every node.
+type DB struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	rand  *rand.Rand
+}
+
+// NewDB returns an empty database.
+func NewDB() *DB {
+	return &DB{
+		nodes: make(map[string]*Node),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// LoadDB reads a database saved with Save, or returns an empty one if path
+// does not exist.
+func LoadDB(path string) (*DB, error) {
+	db := NewDB()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		db.nodes[n.Addr] = n
+	}
+	return db, nil
+}
+
+// Save writes the database to path.
+func (db *DB) Save(path string) error {
+	db.mu.Lock()
+	nodes := make([]*Node, 0, len(db.nodes))
+	for _, n := range db.nodes {
+		nodes = append(nodes, n)
+	}
+	data, err := json.Marshal(nodes)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Record adds the outcome of a crawler visit.
+func (db *DB) Record(r crawler.Result) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	n, ok := db.nodes[r.Addr]
+	if !ok {
+		n = &Node{Addr: r.Addr, FirstSeen: r.Time}
+		db.nodes[r.Addr] = n
+	}
+
+	age := r.Time.Sub(n.LastTry)
+	if n.LastTry.IsZero() || age < 0 {
+		age = 0
+	}
+	n.Stat2H.update(r.Success, age, 2*time.Hour)
+	n.Stat8H.update(r.Success, age, 8*time.Hour)
+	n.Stat1D.update(r.Success, age, 24*time.Hour)
+	n.Stat1W.update(r.Success, age, 7*24*time.Hour)
+	n.Stat1M.update(r.Success, age, 30*24*time.Hour)
+
+	n.LastTry = r.Time
+	n.Total++
+	if r.Success && r.Version != nil {
+		n.Success++
+		n.LastSuccess = r.Time
+		n.Services = r.Version.Services
+		n.Version = r.Version.Version
+		n.UserAgent = r.Version.UserAgent
+		n.StartHeight = r.Version.StartHeight
+	}
+}
+
+// Addrs returns the address of every known node.
+func (db *DB) Addrs() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	addrs := make([]string, 0, len(db.nodes))
+	for addr := range db.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Node returns a copy of what we know about addr.
+func (db *DB) Node(addr string) (Node, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n, ok := db.nodes[addr]
+	if !ok {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// Select returns up to max IPs of good nodes listening on port that signal
+// all of services, either IPv4 or IPv6 ones. Nodes are drawn at random,
+// weighted by their score, so answers rotate while favouring nodes with a
+// high uptime and a recent successful handshake.
+func (db *DB) Select(services uint64, ipv6 bool, port uint16, max int) []net.IP {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	type candidate struct {
+		ip  net.IP
+		key float64
+	}
+	now := time.Now()
+	var candidates []candidate
+	for _, n := range db.nodes {
+		if !n.good() || n.Services&services != services {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(n.Addr)
+		if err != nil || portStr != strconv.Itoa(int(port)) {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || (ip.To4() == nil) != ipv6 {
+			continue
+		}
+		// Weighted sampling without replacement (Efraimidis-Spirakis).
+		key := math.Pow(db.rand.Float64(), 1/n.score(now))
+		candidates = append(candidates, candidate{ip: ip, key: key})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].key > candidates[j].key })
+	if len(candidates) > max {
+		candidates = candidates[:max]
+	}
+	ips := make([]net.IP, len(candidates))
+	for i, c := range candidates {
+		ips[i] = c.ip
+	}
+	return ips
+}
+
+// Import records the results written by the crawl command, one JSON object
+// per line, and returns how many were read.
+func (db *DB) Import(r io.Reader) (int, error) {
+	decoder := json.NewDecoder(r)
+	count := 0
+	for {
+		var result crawler.Result
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		db.Record(result)
+		count++
+	}
+}
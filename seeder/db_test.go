@@ -0,0 +1,108 @@
+package seeder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/crawler"
+	"github.com/safwentrabelsi/bitcoin-handshake/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func visit(db *DB, addr string, success bool, services uint64, at time.Time) {
+	r := crawler.Result{Addr: addr, Time: at, Success: success}
+	if success {
+		r.Version = &version.VersionMessage{Version: 70016, Services: services, UserAgent: "/Satoshi:27.0.0/"}
+	}
+	db.Record(r)
+}
+
+func ipStrings(db *DB, services uint64, ipv6 bool) []string {
+	var out []string
+	for _, ip := range db.Select(services, ipv6, 38333, 100) {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+func TestGoodNodes(t *testing.T) {
+	db := NewDB()
+	now := time.Now()
+	visit(db, "1.0.0.1:38333", true, 1, now)
+	visit(db, "1.0.0.2:38333", true, 0x409, now)
+	visit(db, "1.0.0.3:38333", false, 0, now)
+	visit(db, "1.0.0.4:18333", true, 1, now)
+	visit(db, "1.0.0.5:38333", true, 0x400, now)
+	visit(db, "[2001:db8::1]:38333", true, 9, now)
+
+	assert.ElementsMatch(t, []string{"1.0.0.1", "1.0.0.2"}, ipStrings(db, 1, false),
+		"failed, non default port and pruned-only nodes are not handed out")
+	assert.Equal(t, []string{"1.0.0.2"}, ipStrings(db, 9, false))
+	assert.Equal(t, []string{"2001:db8::1"}, ipStrings(db, 1, true))
+}
+
+func TestUnreliableNodeIsDropped(t *testing.T) {
+	db := NewDB()
+	start := time.Now().Add(-10 * time.Hour)
+	for i := 0; i < 20; i++ {
+		at := start.Add(time.Duration(i) * 30 * time.Minute)
+		visit(db, "1.0.0.1:38333", true, 1, at)
+		// Up once every four tries.
+		visit(db, "1.0.0.2:38333", i%4 == 0, 1, at)
+	}
+	assert.Equal(t, []string{"1.0.0.1"}, ipStrings(db, 1, false))
+
+	n, ok := db.Node("1.0.0.2:38333")
+	require.True(t, ok)
+	assert.Equal(t, 20, n.Total)
+	assert.Equal(t, 5, n.Success)
+}
+
+func TestSelectRotatesAndFavoursRecentNodes(t *testing.T) {
+	db := NewDB()
+	now := time.Now()
+	visit(db, "1.0.0.1:38333", true, 1, now)
+	visit(db, "1.0.0.2:38333", true, 1, now)
+	visit(db, "1.0.0.3:38333", true, 1, now)
+	// Still good, but its last handshake was a day ago.
+	visit(db, "1.0.0.9:38333", true, 1, now.Add(-24*time.Hour))
+
+	firsts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		ips := db.Select(1, false, 38333, 1)
+		require.Len(t, ips, 1)
+		firsts[ips[0].String()]++
+	}
+	assert.Positive(t, firsts["1.0.0.1"])
+	assert.Positive(t, firsts["1.0.0.2"])
+	assert.Positive(t, firsts["1.0.0.3"])
+	assert.Less(t, firsts["1.0.0.9"], firsts["1.0.0.1"])
+}
+
+func TestSaveLoadImport(t *testing.T) {
+	results := `{"addr":"1.0.0.1:38333","time":"2024-08-01T10:00:00Z","success":true,"version":{"Version":70016,"Services":9},"addr_count":0}
+{"addr":"1.0.0.2:38333","time":"2024-08-01T10:00:01Z","success":false,"error":"connection refused","addr_count":0}
+`
+	db := NewDB()
+	count, err := db.Import(strings.NewReader(results))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	require.NoError(t, db.Save(path))
+
+	loaded, err := LoadDB(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0.0.1:38333", "1.0.0.2:38333"}, loaded.Addrs())
+	n, ok := loaded.Node("1.0.0.1:38333")
+	require.True(t, ok)
+	assert.Equal(t, uint64(9), n.Services)
+	assert.Equal(t, 1, n.Success)
+
+	empty, err := LoadDB(filepath.Join(t.TempDir(), "missing.json"))
+	require.NoError(t, err)
+	assert.Empty(t, empty.Addrs())
+}
@@ -0,0 +1,202 @@
+package seeder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTTL        = 60
+	defaultMaxAnswers = 20
+	maxUDPSize        = 512
+)
+
+// Server is an authoritative DNS server for the seed zone. It answers A and
+// AAAA queries for Host with good nodes from DB, and x<hex>.Host with only
+// the nodes that signal the given service bits.
+type Server struct {
+	// Host is the zone we are authoritative for, e.g. seed.signet.example.com.
+	Host string
+	// NS is the host name of this name server, returned for NS and SOA.
+	NS string
+	// Mbox is the contact address in the SOA record.
+	Mbox string
+	// DB provides the nodes.
+	DB *DB
+	// Port is the default port of the chain. DNS cannot carry ports, so
+	// only nodes on this port are returned.
+	Port uint16
+	// DefaultServices are required when the query has no x<hex> prefix.
+	DefaultServices uint64
+	// MaxAnswers caps the number of addresses per reply.
+	MaxAnswers int
+	// TTL of the answers in seconds.
+	TTL uint32
+}
+
+// ListenAndServe answers queries on the UDP address addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers queries on conn until ctx is done.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		reply, err := s.Handle(buf[:n])
+		if err != nil {
+			log.Debugf("Dropping DNS query from %s: %v", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			log.Debugf("Failed to answer %s: %v", addr, err)
+		}
+	}
+}
+
+// Handle builds the reply to a single DNS query.
+func (s *Server) Handle(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			Authoritative:    true,
+			RecursionDesired: header.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+	services, ok := s.servicesFor(name)
+	switch {
+	case question.Class != dnsmessage.ClassINET:
+		reply.RCode = dnsmessage.RCodeRefused
+	case !ok && !strings.HasSuffix(name, "."+s.Host):
+		reply.Authoritative = false
+		reply.RCode = dnsmessage.RCodeRefused
+	case !ok:
+		reply.RCode = dnsmessage.RCodeNameError
+		reply.Authorities = []dnsmessage.Resource{s.soa()}
+	default:
+		s.answer(&reply, question, name, services)
+	}
+
+	// Like bitcoin-seeder, drop answers rather than exceed the UDP limit:
+	// 20 AAAA records alone take 560 bytes.
+	packed, err := reply.AppendPack(make([]byte, 0, maxUDPSize))
+	for err == nil && len(packed) > maxUDPSize && len(reply.Answers) > 0 {
+		reply.Answers = reply.Answers[:len(reply.Answers)-1]
+		packed, err = reply.AppendPack(packed[:0])
+	}
+	return packed, err
+}
+
+func (s *Server) answer(reply *dnsmessage.Message, question dnsmessage.Question, name string, services uint64) {
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: s.ttl()}
+	maxAnswers := s.MaxAnswers
+	if maxAnswers == 0 {
+		maxAnswers = defaultMaxAnswers
+	}
+
+	switch question.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range s.DB.Select(services, false, s.Port, maxAnswers) {
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: [4]byte(ip.To4())}})
+		}
+	case dnsmessage.TypeAAAA:
+		for _, ip := range s.DB.Select(services, true, s.Port, maxAnswers) {
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+		}
+	case dnsmessage.TypeNS:
+		if name == s.Host {
+			ns, err := dnsmessage.NewName(s.NS + ".")
+			if err == nil {
+				reply.Answers = append(reply.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.NSResource{NS: ns}})
+			}
+		}
+	case dnsmessage.TypeSOA:
+		if name == s.Host {
+			reply.Answers = append(reply.Answers, s.soa())
+		}
+	}
+	if len(reply.Answers) == 0 {
+		reply.Authorities = []dnsmessage.Resource{s.soa()}
+	}
+}
+
+// servicesFor returns the service bits requested by name: the default ones
+// for the zone itself and the hex value of x<hex>.<zone>.
+func (s *Server) servicesFor(name string) (uint64, bool) {
+	if name == s.Host {
+		return s.DefaultServices, true
+	}
+	label, ok := strings.CutSuffix(name, "."+s.Host)
+	if !ok || strings.Contains(label, ".") || !strings.HasPrefix(label, "x") {
+		return 0, false
+	}
+	services, err := strconv.ParseUint(label[1:], 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return services, true
+}
+
+func (s *Server) soa() dnsmessage.Resource {
+	zone, _ := dnsmessage.NewName(s.Host + ".")
+	ns, _ := dnsmessage.NewName(s.NS + ".")
+	mbox, _ := dnsmessage.NewName(strings.Replace(s.Mbox, "@", ".", 1) + ".")
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: s.ttl()},
+		Body: &dnsmessage.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  1,
+			Refresh: 604800,
+			Retry:   86400,
+			Expire:  2592000,
+			MinTTL:  s.ttl(),
+		},
+	}
+}
+
+func (s *Server) ttl() uint32 {
+	if s.TTL == 0 {
+		return defaultTTL
+	}
+	return s.TTL
+}
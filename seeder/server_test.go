@@ -0,0 +1,131 @@
+package seeder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/dnsseed"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testParams = config.ChainParams{
+	Name:        "test",
+	DefaultPort: 38333,
+	DNSSeeds:    []string{"seed.example.org"},
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	db := NewDB()
+	now := time.Now()
+	visit(db, "1.0.0.1:38333", true, 1, now)
+	visit(db, "1.0.0.2:38333", true, 9, now)
+	visit(db, "[2001:db8::1]:38333", true, 9, now)
+
+	server := &Server{
+		Host:            "seed.example.org",
+		NS:              "ns.example.org",
+		Mbox:            "admin@example.org",
+		DB:              db,
+		Port:            38333,
+		DefaultServices: 1,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.Serve(ctx, conn)
+	return server, conn.LocalAddr().String()
+}
+
+func TestServerAnswersSeedLookups(t *testing.T) {
+	_, addr := startServer(t)
+	r := &dnsseed.Resolver{Server: addr, Timeout: time.Second}
+
+	lookup := func(services uint64) []string {
+		addrs, err := r.Lookup(context.Background(), &testParams, services)
+		require.NoError(t, err)
+		var out []string
+		for _, a := range addrs {
+			out = append(out, a.String())
+		}
+		sort.Strings(out)
+		return out
+	}
+	assert.Equal(t, []string{"1.0.0.1:38333", "1.0.0.2:38333", "[2001:db8::1]:38333"}, lookup(0))
+	assert.Equal(t, []string{"1.0.0.2:38333", "[2001:db8::1]:38333"}, lookup(9))
+}
+
+func query(t *testing.T, s *Server, name string, qtype dnsmessage.Type) dnsmessage.Message {
+	t.Helper()
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	require.NoError(t, err)
+	reply, err := s.Handle(packed)
+	require.NoError(t, err)
+
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(reply))
+	assert.Equal(t, uint16(42), msg.ID)
+	assert.True(t, msg.Response)
+	return msg
+}
+
+func TestServerZone(t *testing.T) {
+	s, _ := startServer(t)
+
+	msg := query(t, s, "x400.seed.example.org.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	assert.Empty(t, msg.Answers)
+	require.Len(t, msg.Authorities, 1, "empty answers carry the SOA")
+
+	msg = query(t, s, "SEED.example.org.", dnsmessage.TypeNS)
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, "ns.example.org.", msg.Answers[0].Body.(*dnsmessage.NSResource).NS.String())
+
+	msg = query(t, s, "seed.example.org.", dnsmessage.TypeSOA)
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, "admin.example.org.", msg.Answers[0].Body.(*dnsmessage.SOAResource).MBox.String())
+
+	msg = query(t, s, "www.seed.example.org.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+
+	msg = query(t, s, "example.com.", dnsmessage.TypeA)
+	assert.Equal(t, dnsmessage.RCodeRefused, msg.RCode)
+	assert.False(t, msg.Authoritative)
+}
+
+func TestServerFitsUDP(t *testing.T) {
+	s, _ := startServer(t)
+	now := time.Now()
+	for i := 2; i <= defaultMaxAnswers+1; i++ {
+		visit(s.DB, net.JoinHostPort(fmt.Sprintf("2001:db8::%x", i), "38333"), true, 1, now)
+	}
+	require.Len(t, s.DB.Select(1, true, s.Port, defaultMaxAnswers), defaultMaxAnswers)
+
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("seed.example.org."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := q.Pack()
+	require.NoError(t, err)
+	reply, err := s.Handle(packed)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(reply), maxUDPSize)
+
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(reply))
+	assert.False(t, msg.Truncated)
+	assert.Less(t, len(msg.Answers), defaultMaxAnswers, "20 AAAA records do not fit")
+	assert.NotEmpty(t, msg.Answers)
+}
@@ -0,0 +1,308 @@
+// Package server answers the header and block requests of our peers from
+// the local header chain and block store.
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxBlocksResults is the most blocks announced in answer to one
+	// getblocks message.
+	MaxBlocksResults = 500
+	// LimitedBlocks is how many of the most recent blocks a
+	// NODE_NETWORK_LIMITED node serves (BIP159).
+	LimitedBlocks = 288
+	// MaxCompactBlockDepth is how far below the tip a block may be to be
+	// sent as a compact block when requested as one; deeper blocks are
+	// sent in full (MAX_CMPCTBLOCK_DEPTH in Bitcoin Core).
+	MaxCompactBlockDepth = 5
+)
+
+// Server serves headers from a chain and blocks from a block store.
+type Server struct {
+	chain  *chain.Chain
+	blocks *blockstore.Store
+
+	mu sync.Mutex
+	// complete is the height up to which every block of the active chain
+	// is stored.
+	complete int32
+	// continueAt holds, per peer, the last block announced in answer to a
+	// getblocks that hit MaxBlocksResults. When the peer requests it, we
+	// announce our tip so that it asks for the next batch.
+	continueAt map[*network.Peer]utils.Hash
+}
+
+// New returns a server for the headers of c and the blocks in blocks.
+func New(c *chain.Chain, blocks *blockstore.Store) *Server {
+	s := &Server{chain: c, blocks: blocks, continueAt: make(map[*network.Peer]utils.Hash)}
+	c.Subscribe(s.handleChainEvent)
+	return s
+}
+
+// SetupPeer registers the server's message handlers on p before its
+// handshake. It fits connmgr.Config.SetupPeer.
+func (s *Server) SetupPeer(p *network.Peer) {
+	p.OnGetHeaders(s.handleGetHeaders)
+	p.OnGetBlocks(s.handleGetBlocks)
+	p.OnGetData(s.handleGetData)
+}
+
+// Services returns the service bits we can honestly advertise: NODE_NETWORK
+// when every block of the active chain is stored, NODE_NETWORK_LIMITED when
+// at least the last LimitedBlocks are. A chain still at its genesis block
+// has not synced its headers yet and serves neither. It fits
+// network.PeerConfig.Services.
+func (s *Server) Services() uint64 {
+	services := uint64(config.Services) &^ (config.NodeNetwork | config.NodeNetworkLimited)
+	tip := s.chain.Tip()
+	switch {
+	case tip.Height == 0:
+	case s.full(tip):
+		services |= config.NodeNetwork | config.NodeNetworkLimited
+	case s.haveRecent(tip):
+		services |= config.NodeNetworkLimited
+	}
+	return services
+}
+
+// full reports whether every block up to tip is stored.
+func (s *Server) full(tip *chain.Node) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.complete < tip.Height {
+		node := s.chain.NodeAtHeight(s.complete + 1)
+		if node == nil || !s.blocks.Has(node.Hash) {
+			return false
+		}
+		s.complete++
+	}
+	return true
+}
+
+// haveRecent reports whether the last LimitedBlocks blocks up to tip are
+// stored.
+func (s *Server) haveRecent(tip *chain.Node) bool {
+	for node := tip; node.Height > 0 && node.Height > tip.Height-LimitedBlocks; node = node.Parent {
+		if !s.blocks.Has(node.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// servable reports whether we hand out the block of node: it must be on
+// the active chain and, unless we have all blocks, recent enough for a
+// NODE_NETWORK_LIMITED node to serve.
+func (s *Server) servable(node *chain.Node) bool {
+	if !s.chain.Contains(node) {
+		return false
+	}
+	tip := s.chain.Tip()
+	return node.Height > tip.Height-LimitedBlocks || s.full(tip)
+}
+
+func (s *Server) handleChainEvent(e chain.Event) {
+	if e.Type != chain.BlockDisconnected {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Node.Height <= s.complete {
+		s.complete = e.Node.Height - 1
+	}
+}
+
+func (s *Server) handleGetHeaders(p *network.Peer, l block.Locator) error {
+	// Without a locator the peer asks for the header of hashStop alone.
+	if len(l.Hashes) == 0 {
+		node := s.chain.Lookup(l.HashStop)
+		if node == nil {
+			return nil
+		}
+		return p.SendHeaders([]block.Header{node.Header})
+	}
+
+	fork := s.chain.FindFork(l.Hashes)
+	var headers []block.Header
+	for height := fork.Height + 1; len(headers) < block.MaxHeadersResults; height++ {
+		node := s.chain.NodeAtHeight(height)
+		if node == nil {
+			break
+		}
+		headers = append(headers, node.Header)
+		if node.Hash == l.HashStop {
+			break
+		}
+	}
+	return p.SendHeaders(headers)
+}
+
+func (s *Server) handleGetBlocks(p *network.Peer, l block.Locator) error {
+	fork := s.chain.FindFork(l.Hashes)
+	var vects []inv.InvVect
+	for height := fork.Height + 1; ; height++ {
+		node := s.chain.NodeAtHeight(height)
+		if node == nil || node.Hash == l.HashStop {
+			break
+		}
+		if !s.servable(node) || !s.blocks.Has(node.Hash) {
+			break
+		}
+		vects = append(vects, inv.InvVect{Type: inv.InvTypeBlock, Hash: node.Hash})
+		if len(vects) == MaxBlocksResults {
+			s.setContinue(p, node.Hash)
+			break
+		}
+	}
+	if len(vects) == 0 {
+		return nil
+	}
+	return p.SendInv(vects...)
+}
+
+func (s *Server) setContinue(p *network.Peer, hash utils.Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.continueAt[p]; !ok {
+		go func() {
+			<-p.Done()
+			s.mu.Lock()
+			delete(s.continueAt, p)
+			s.mu.Unlock()
+		}()
+	}
+	s.continueAt[p] = hash
+}
+
+// takeContinue reports whether hash is where p's getblocks stopped, and
+// forgets it if so.
+func (s *Server) takeContinue(p *network.Peer, hash utils.Hash) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if at, ok := s.continueAt[p]; ok && at == hash {
+		s.continueAt[p] = utils.Hash{}
+		return true
+	}
+	return false
+}
+
+func (s *Server) handleGetData(p *network.Peer, vects []inv.InvVect) error {
+	var missing []inv.InvVect
+	for _, v := range vects {
+		var sent bool
+		var err error
+		switch v.Type {
+		case inv.InvTypeBlock, inv.InvTypeWitnessBlock:
+			sent, err = s.sendBlock(p, v.Hash, v.Type == inv.InvTypeWitnessBlock)
+		case inv.InvTypeCompactBlock:
+			sent, err = s.sendCompactBlock(p, v.Hash)
+		}
+		if err != nil {
+			return err
+		}
+		if !sent {
+			missing = append(missing, v)
+			continue
+		}
+		if s.takeContinue(p, v.Hash) {
+			tip := s.chain.Tip()
+			if err := p.SendInv(inv.InvVect{Type: inv.InvTypeBlock, Hash: tip.Hash}); err != nil {
+				return err
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return p.SendNotFound(missing...)
+}
+
+// sendBlock sends the block with the given hash, with or without its
+// witness data, and reports whether we serve it.
+func (s *Server) sendBlock(p *network.Peer, hash utils.Hash, witness bool) (bool, error) {
+	payload, ok := s.blockPayload(hash, witness)
+	if !ok {
+		return false, nil
+	}
+	return true, p.Send(network.Message{Command: "block", Payload: payload})
+}
+
+// sendCompactBlock answers a getdata for MSG_CMPCT_BLOCK: blocks within
+// MaxCompactBlockDepth of the tip are sent as compact blocks, older ones in
+// full with their witness data.
+func (s *Server) sendCompactBlock(p *network.Peer, hash utils.Hash) (bool, error) {
+	node := s.chain.Lookup(hash)
+	if node == nil {
+		return false, nil
+	}
+	if node.Height < s.chain.Height()-MaxCompactBlockDepth {
+		return s.sendBlock(p, hash, true)
+	}
+	raw, ok := s.rawBlock(node)
+	if !ok {
+		return false, nil
+	}
+	b, err := block.DecodeBlockMessage(raw)
+	if err != nil {
+		log.Errorf("Failed to decode stored block %s: %v", hash, err)
+		return false, nil
+	}
+	return true, p.SendCmpctBlock(block.NewCompactBlock(b, rand.Uint64()))
+}
+
+// rawBlock returns the serialized block of node, if we serve it.
+func (s *Server) rawBlock(node *chain.Node) ([]byte, bool) {
+	if !s.servable(node) {
+		return nil, false
+	}
+	if node.Height == 0 {
+		return s.chain.Params().GenesisBlock, true
+	}
+	raw, err := s.blocks.RawBlock(node.Hash)
+	if err != nil {
+		if !errors.Is(err, blockstore.ErrNotFound) {
+			log.Errorf("Failed to read block %s: %v", node.Hash, err)
+		}
+		return nil, false
+	}
+	return raw, true
+}
+
+// blockPayload returns the block message for hash, with or without its
+// witness data, if we serve that block.
+func (s *Server) blockPayload(hash utils.Hash, witness bool) ([]byte, bool) {
+	node := s.chain.Lookup(hash)
+	if node == nil {
+		return nil, false
+	}
+	raw, ok := s.rawBlock(node)
+	if !ok || witness {
+		return raw, ok
+	}
+
+	b, err := block.DecodeBlockMessage(raw)
+	if err != nil {
+		log.Errorf("Failed to decode stored block %s: %v", hash, err)
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := b.SerializeNoWitness(&buf); err != nil {
+		log.Errorf("Failed to serialize block %s: %v", hash, err)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
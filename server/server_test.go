@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/block"
+	"github.com/safwentrabelsi/bitcoin-handshake/blockstore"
+	"github.com/safwentrabelsi/bitcoin-handshake/chain"
+	"github.com/safwentrabelsi/bitcoin-handshake/config"
+	"github.com/safwentrabelsi/bitcoin-handshake/inv"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/safwentrabelsi/bitcoin-handshake/transaction"
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mineBlocks returns n regtest blocks on top of parent. Their coinbase
+// carries a witness so that witness and non-witness blocks differ.
+func mineBlocks(parent block.Header, n int) []*block.Block {
+	blocks := make([]*block.Block, n)
+	for i := range blocks {
+		coinbase := &transaction.Tx{
+			Version: 1,
+			TxIn: []transaction.TxIn{{
+				PreviousOutPoint: transaction.OutPoint{Index: 0xffffffff},
+				SignatureScript:  binary.LittleEndian.AppendUint32(nil, uint32(i+1)),
+				Witness:          [][]byte{make([]byte, 32)},
+				Sequence:         0xffffffff,
+			}},
+			TxOut: []transaction.TxOut{{Value: 50e8, PkScript: []byte{0x51}}},
+		}
+		b := &block.Block{
+			Header: block.Header{
+				Version:   4,
+				PrevBlock: parent.Hash(),
+				Timestamp: parent.Timestamp + chain.TargetSpacing,
+				Bits:      parent.Bits,
+			},
+			Transactions: []*transaction.Tx{coinbase},
+		}
+		b.Header.MerkleRoot, _ = block.MerkleRoot(b.TxHashes())
+		for !b.Header.CheckProofOfWork() {
+			b.Header.Nonce++
+		}
+		blocks[i] = b
+		parent = b.Header
+	}
+	return blocks
+}
+
+// setup returns a server for a regtest chain of n blocks of which those
+// from height stored on are in the block store.
+func setup(t *testing.T, n int, stored int) (*Server, *chain.Chain, []*block.Block) {
+	t.Helper()
+	c, err := chain.New(&config.RegTestParams)
+	require.NoError(t, err)
+	blocks := mineBlocks(c.Genesis().Header, n)
+	headers := make([]block.Header, n)
+	for i, b := range blocks {
+		headers[i] = b.Header
+	}
+	_, err = c.AddHeaders(headers)
+	require.NoError(t, err)
+
+	store, err := blockstore.Open(blockstore.Config{Dir: filepath.Join(t.TempDir(), "blocks"), Magic: config.RegTestParams.Magic})
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	for _, b := range blocks[stored-1:] {
+		_, err := store.Put(b)
+		require.NoError(t, err)
+	}
+	return New(c, store), c, blocks
+}
+
+// client is the remote end of a connection to the server, recording what
+// it receives.
+type client struct {
+	*network.Peer
+	headers  chan []block.Header
+	inv      chan []inv.InvVect
+	blocks   chan []byte
+	compact  chan *block.CompactBlock
+	notFound chan []inv.InvVect
+}
+
+func connect(t *testing.T, s *Server, c *chain.Chain) *client {
+	t.Helper()
+	a, b := net.Pipe()
+	local := network.NewPeer(a, "remote", network.PeerConfig{
+		Magic:       config.RegTestParams.Magic,
+		Inbound:     true,
+		Services:    s.Services,
+		StartHeight: c.Height,
+	})
+	remote := &client{
+		Peer:     network.NewPeer(b, "local", network.PeerConfig{Magic: config.RegTestParams.Magic}),
+		headers:  make(chan []block.Header, 10),
+		inv:      make(chan []inv.InvVect, 10),
+		blocks:   make(chan []byte, 10),
+		compact:  make(chan *block.CompactBlock, 10),
+		notFound: make(chan []inv.InvVect, 10),
+	}
+	s.SetupPeer(local)
+	remote.OnHeaders(func(_ *network.Peer, headers []block.Header) error {
+		remote.headers <- headers
+		return nil
+	})
+	remote.OnInv(func(_ *network.Peer, vects []inv.InvVect) error {
+		remote.inv <- vects
+		return nil
+	})
+	remote.Handle("block", func(_ *network.Peer, payload []byte) error {
+		remote.blocks <- payload
+		return nil
+	})
+	remote.OnCmpctBlock(func(_ *network.Peer, cb *block.CompactBlock) error {
+		remote.compact <- cb
+		return nil
+	})
+	remote.OnNotFound(func(_ *network.Peer, vects []inv.InvVect) error {
+		remote.notFound <- vects
+		return nil
+	})
+
+	errs := make(chan error, 2)
+	go func() { errs <- local.Start(context.Background()) }()
+	go func() { errs <- remote.Start(context.Background()) }()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	t.Cleanup(local.Disconnect)
+	return remote
+}
+
+func receive[T any](t *testing.T, ch chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	panic("unreachable")
+}
+
+func TestServices(t *testing.T) {
+	s, c, _ := setup(t, 300, 1)
+	assert.Equal(t, uint64(config.NodeNetwork|config.NodeNetworkLimited), s.Services()&(config.NodeNetwork|config.NodeNetworkLimited))
+
+	remote := connect(t, s, c)
+	assert.NotZero(t, remote.Version().Services&config.NodeNetwork, "advertised in the version message")
+	assert.Equal(t, int32(300), remote.Version().StartHeight)
+
+	limited, _, _ := setup(t, 300, 300-LimitedBlocks+1)
+	assert.Zero(t, limited.Services()&config.NodeNetwork)
+	assert.NotZero(t, limited.Services()&config.NodeNetworkLimited)
+
+	none, _, _ := setup(t, 300, 300-LimitedBlocks+2)
+	assert.Zero(t, none.Services()&(config.NodeNetwork|config.NodeNetworkLimited))
+
+	// Before the header sync, the genesis block is the whole chain.
+	fresh, _, _ := setup(t, 0, 1)
+	assert.Zero(t, fresh.Services()&(config.NodeNetwork|config.NodeNetworkLimited))
+}
+
+func TestGetHeaders(t *testing.T) {
+	s, c, blocks := setup(t, 30, 1)
+	remote := connect(t, s, c)
+
+	// The peer has the first ten blocks.
+	require.NoError(t, remote.GetHeaders(block.Locator{ProtocolVersion: config.ProtocolVersion, Hashes: c.NodeAtHeight(10).Locator()}))
+	headers := receive(t, remote.headers)
+	require.Len(t, headers, 20)
+	assert.Equal(t, blocks[10].Header, headers[0])
+	assert.Equal(t, blocks[29].Header, headers[19])
+
+	// hashStop ends the batch, inclusively.
+	require.NoError(t, remote.GetHeaders(block.Locator{Hashes: []utils.Hash{c.Genesis().Hash}, HashStop: blocks[4].Hash()}))
+	assert.Len(t, receive(t, remote.headers), 5)
+
+	// Without a locator only the hashStop header is returned.
+	require.NoError(t, remote.GetHeaders(block.Locator{HashStop: blocks[7].Hash()}))
+	assert.Equal(t, []block.Header{blocks[7].Header}, receive(t, remote.headers))
+
+	// A peer at our tip gets an empty answer.
+	require.NoError(t, remote.GetHeaders(block.Locator{Hashes: c.Locator()}))
+	assert.Empty(t, receive(t, remote.headers))
+}
+
+func TestGetBlocks(t *testing.T) {
+	s, c, blocks := setup(t, 600, 1)
+	remote := connect(t, s, c)
+
+	require.NoError(t, remote.GetBlocks(block.Locator{Hashes: []utils.Hash{c.Genesis().Hash}}))
+	vects := receive(t, remote.inv)
+	require.Len(t, vects, MaxBlocksResults)
+	assert.Equal(t, inv.InvVect{Type: inv.InvTypeBlock, Hash: blocks[0].Hash()}, vects[0])
+	last := vects[len(vects)-1]
+
+	// Requesting the last announced block makes us announce the tip, so
+	// the peer asks for the next batch.
+	require.NoError(t, remote.GetData(last))
+	receive(t, remote.blocks)
+	assert.Equal(t, []inv.InvVect{{Type: inv.InvTypeBlock, Hash: c.Tip().Hash}}, receive(t, remote.inv))
+
+	require.NoError(t, remote.GetBlocks(block.Locator{Hashes: []utils.Hash{last.Hash}}))
+	assert.Len(t, receive(t, remote.inv), 100)
+
+	// hashStop is not announced.
+	require.NoError(t, remote.GetBlocks(block.Locator{Hashes: []utils.Hash{blocks[9].Hash()}, HashStop: blocks[15].Hash()}))
+	assert.Len(t, receive(t, remote.inv), 5)
+}
+
+func TestGetData(t *testing.T) {
+	s, c, blocks := setup(t, 20, 1)
+	remote := connect(t, s, c)
+
+	b := blocks[4]
+	var noWitness bytes.Buffer
+	require.NoError(t, b.SerializeNoWitness(&noWitness))
+	require.NoError(t, remote.GetData(
+		inv.InvVect{Type: inv.InvTypeWitnessBlock, Hash: b.Hash()},
+		inv.InvVect{Type: inv.InvTypeBlock, Hash: b.Hash()},
+		inv.InvVect{Type: inv.InvTypeBlock, Hash: c.Genesis().Hash},
+	))
+	assert.Equal(t, b.Bytes(), receive(t, remote.blocks))
+	assert.Equal(t, noWitness.Bytes(), receive(t, remote.blocks))
+	assert.Equal(t, config.RegTestParams.GenesisBlock, receive(t, remote.blocks))
+
+	unknown := []inv.InvVect{
+		{Type: inv.InvTypeBlock, Hash: utils.Hash{1}},
+		{Type: inv.InvTypeTx, Hash: blocks[0].Transactions[0].TxID()},
+		{Type: inv.InvTypeCompactBlock, Hash: utils.Hash{1}},
+	}
+	require.NoError(t, remote.GetData(unknown...))
+	assert.Equal(t, unknown, receive(t, remote.notFound))
+}
+
+func TestGetDataCompactBlock(t *testing.T) {
+	s, c, blocks := setup(t, 20, 1)
+	remote := connect(t, s, c)
+
+	recent := blocks[19-MaxCompactBlockDepth]
+	old := blocks[18-MaxCompactBlockDepth]
+	require.NoError(t, remote.GetData(
+		inv.InvVect{Type: inv.InvTypeCompactBlock, Hash: recent.Hash()},
+		inv.InvVect{Type: inv.InvTypeCompactBlock, Hash: old.Hash()},
+	))
+	cb := receive(t, remote.compact)
+	assert.Equal(t, recent.Header, cb.Header)
+	require.Len(t, cb.Prefilled, 1)
+	assert.Equal(t, recent.Transactions[0].TxID(), cb.Prefilled[0].Tx.TxID())
+	assert.Equal(t, old.Bytes(), receive(t, remote.blocks), "deeper blocks are sent in full")
+}
+
+func TestGetDataLimited(t *testing.T) {
+	// Only the last LimitedBlocks blocks, and one older block, are stored.
+	s, c, blocks := setup(t, 300, 300-LimitedBlocks+1)
+	_, err := s.blocks.Put(blocks[0])
+	require.NoError(t, err)
+	remote := connect(t, s, c)
+	assert.Equal(t, uint64(config.NodeNetworkLimited), remote.Version().Services&(config.NodeNetwork|config.NodeNetworkLimited))
+
+	old := inv.InvVect{Type: inv.InvTypeWitnessBlock, Hash: blocks[0].Hash()}
+	recent := inv.InvVect{Type: inv.InvTypeWitnessBlock, Hash: blocks[300-LimitedBlocks].Hash()}
+	require.NoError(t, remote.GetData(old, recent))
+	assert.Equal(t, blocks[300-LimitedBlocks].Bytes(), receive(t, remote.blocks))
+	assert.Equal(t, []inv.InvVect{old}, receive(t, remote.notFound), "a limited node does not serve older blocks")
+}
@@ -0,0 +1,341 @@
+package tor
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+)
+
+const (
+	safeCookieServerKey = "Tor safe cookie authentication server-to-controller hash"
+	safeCookieClientKey = "Tor safe cookie authentication controller-to-server hash"
+	cookieLength        = 32
+)
+
+// Reply is a reply from the control port. Lines holds every line without its
+// status code, with the data of multi-line entries appended to the line
+// that announced them.
+type Reply struct {
+	Status int
+	Lines  []string
+}
+
+// ProtocolInfo is the answer to PROTOCOLINFO.
+type ProtocolInfo struct {
+	AuthMethods []string
+	CookieFile  string
+	TorVersion  string
+}
+
+// OnionService is an ephemeral onion service created with ADD_ONION.
+type OnionService struct {
+	ServiceID   string
+	PrivateKey  string
+	VirtualPort uint16
+}
+
+// Hostname returns the .onion host name of the service.
+func (s OnionService) Hostname() string {
+	return s.ServiceID + ".onion"
+}
+
+// Addr returns the addrv2 address to advertise for the service.
+func (s OnionService) Addr(services uint64) (netaddr.AddrV2, error) {
+	return netaddr.NewTorV3AddrV2(s.ServiceID, s.VirtualPort, services)
+}
+
+// Controller talks to a Tor daemon over its control port.
+type Controller struct {
+	mu     sync.Mutex
+	conn   network.Conn
+	reader *bufio.Reader
+}
+
+// Dial connects to the control port at addr.
+func Dial(ctx context.Context, dialer network.Dialer, addr string) (*Controller, error) {
+	conn, err := dialer.Dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Tor control port %s: %w", addr, err)
+	}
+	return NewController(conn), nil
+}
+
+// NewController speaks the control protocol over conn.
+func NewController(conn network.Conn) *Controller {
+	return &Controller{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Close closes the control connection. Ephemeral onion services created over
+// it are removed by Tor.
+func (c *Controller) Close() error {
+	return c.conn.Close()
+}
+
+// Command sends cmd and returns the reply. Replies other than 250 are
+// returned as errors.
+func (c *Controller) Command(cmd string) (Reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.conn.Write([]byte(cmd + "\r\n")); err != nil {
+		return Reply{}, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return Reply{}, err
+	}
+	if reply.Status != 250 {
+		verb, _, _ := strings.Cut(cmd, " ")
+		return reply, fmt.Errorf("%s failed: %d %s", verb, reply.Status, strings.Join(reply.Lines, " "))
+	}
+	return reply, nil
+}
+
+func (c *Controller) readReply() (Reply, error) {
+	var reply Reply
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return reply, err
+		}
+		if len(line) < 4 {
+			return reply, fmt.Errorf("malformed reply line %q", line)
+		}
+		status, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return reply, fmt.Errorf("malformed reply line %q", line)
+		}
+		reply.Status = status
+		text := line[4:]
+
+		switch line[3] {
+		case ' ':
+			reply.Lines = append(reply.Lines, text)
+			return reply, nil
+		case '-':
+			reply.Lines = append(reply.Lines, text)
+		case '+':
+			var data []string
+			for {
+				dataLine, err := c.readLine()
+				if err != nil {
+					return reply, err
+				}
+				if dataLine == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(dataLine, "."))
+			}
+			reply.Lines = append(reply.Lines, text+strings.Join(data, "\n"))
+		default:
+			return reply, fmt.Errorf("malformed reply line %q", line)
+		}
+	}
+}
+
+func (c *Controller) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// ProtocolInfo asks which authentication methods the daemon accepts.
+func (c *Controller) ProtocolInfo() (ProtocolInfo, error) {
+	reply, err := c.Command("PROTOCOLINFO 1")
+	if err != nil {
+		return ProtocolInfo{}, err
+	}
+
+	var info ProtocolInfo
+	for _, line := range reply.Lines {
+		keyword, rest, _ := strings.Cut(line, " ")
+		values := parseKeyValues(rest)
+		switch keyword {
+		case "AUTH":
+			info.AuthMethods = strings.Split(values["METHODS"], ",")
+			info.CookieFile = values["COOKIEFILE"]
+		case "VERSION":
+			info.TorVersion = values["Tor"]
+		}
+	}
+	return info, nil
+}
+
+// Authenticate logs in to the control port. With a password HASHEDPASSWORD
+// is used, otherwise SAFECOOKIE or COOKIE with the cookie file announced by
+// PROTOCOLINFO, or no authentication if the daemon allows it.
+func (c *Controller) Authenticate(password string) error {
+	info, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case password != "":
+		if !slices.Contains(info.AuthMethods, "HASHEDPASSWORD") {
+			return errors.New("tor control port does not accept password authentication")
+		}
+		_, err = c.Command("AUTHENTICATE " + strconv.Quote(password))
+	case slices.Contains(info.AuthMethods, "NULL"):
+		_, err = c.Command("AUTHENTICATE")
+	case slices.Contains(info.AuthMethods, "SAFECOOKIE"):
+		err = c.authenticateSafeCookie(info.CookieFile)
+	case slices.Contains(info.AuthMethods, "COOKIE"):
+		var cookie []byte
+		if cookie, err = readCookie(info.CookieFile); err == nil {
+			_, err = c.Command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		}
+	default:
+		return fmt.Errorf("no supported authentication method in %v", info.AuthMethods)
+	}
+	return err
+}
+
+func (c *Controller) authenticateSafeCookie(cookieFile string) error {
+	cookie, err := readCookie(cookieFile)
+	if err != nil {
+		return err
+	}
+	clientNonce := make([]byte, 32)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+
+	reply, err := c.Command("AUTHCHALLENGE SAFECOOKIE " + hex.EncodeToString(clientNonce))
+	if err != nil {
+		return err
+	}
+	_, rest, _ := strings.Cut(reply.Lines[0], " ")
+	values := parseKeyValues(rest)
+	serverHash, err := hex.DecodeString(values["SERVERHASH"])
+	if err != nil {
+		return fmt.Errorf("invalid SERVERHASH: %w", err)
+	}
+	serverNonce, err := hex.DecodeString(values["SERVERNONCE"])
+	if err != nil {
+		return fmt.Errorf("invalid SERVERNONCE: %w", err)
+	}
+
+	message := append(append(append([]byte{}, cookie...), clientNonce...), serverNonce...)
+	if !hmac.Equal(serverHash, safeCookieHash(safeCookieServerKey, message)) {
+		return errors.New("tor control port failed the SAFECOOKIE challenge")
+	}
+	_, err = c.Command("AUTHENTICATE " + hex.EncodeToString(safeCookieHash(safeCookieClientKey, message)))
+	return err
+}
+
+func safeCookieHash(key string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func readCookie(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("tor control port did not announce a cookie file")
+	}
+	cookie, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Tor auth cookie: %w", err)
+	}
+	if len(cookie) != cookieLength {
+		return nil, fmt.Errorf("invalid Tor auth cookie length %d", len(cookie))
+	}
+	return cookie, nil
+}
+
+// AddOnion creates an ephemeral v3 onion service that forwards virtualPort
+// to target, usually our inbound listener. If privateKey is empty a new key
+// is generated; it is returned so the same address can be reused later.
+func (c *Controller) AddOnion(privateKey string, virtualPort uint16, target string) (OnionService, error) {
+	if privateKey == "" {
+		privateKey = "NEW:ED25519-V3"
+	}
+	reply, err := c.Command(fmt.Sprintf("ADD_ONION %s Port=%d,%s", privateKey, virtualPort, target))
+	if err != nil {
+		return OnionService{}, err
+	}
+
+	service := OnionService{VirtualPort: virtualPort, PrivateKey: privateKey}
+	for _, line := range reply.Lines {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "ServiceID":
+			service.ServiceID = value
+		case "PrivateKey":
+			service.PrivateKey = value
+		}
+	}
+	if service.ServiceID == "" {
+		return OnionService{}, errors.New("ADD_ONION reply did not contain a ServiceID")
+	}
+	return service, nil
+}
+
+// DelOnion removes the onion service with the given ID.
+func (c *Controller) DelOnion(serviceID string) error {
+	_, err := c.Command("DEL_ONION " + serviceID)
+	return err
+}
+
+// SOCKSAddr returns the first SOCKS listener of the daemon.
+func (c *Controller) SOCKSAddr() (string, error) {
+	reply, err := c.Command("GETINFO net/listeners/socks")
+	if err != nil {
+		return "", err
+	}
+	_, value, _ := strings.Cut(reply.Lines[0], "=")
+	listeners := strings.Fields(value)
+	if len(listeners) == 0 {
+		return "", errors.New("tor has no SOCKS listener")
+	}
+	addr, err := strconv.Unquote(listeners[0])
+	if err != nil {
+		return listeners[0], nil
+	}
+	return addr, nil
+}
+
+// parseKeyValues splits `A=1 B="x y"` into a map, unquoting quoted values.
+func parseKeyValues(s string) map[string]string {
+	values := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(rest))
+			value, _ = strconv.Unquote(rest[:end])
+			rest = rest[end:]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		values[key] = value
+		s = rest
+	}
+	return values
+}
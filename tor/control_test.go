@@ -0,0 +1,253 @@
+package tor
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/netaddr"
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testServiceID = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+// fakeControlPort is a minimal Tor control port listening on loopback.
+type fakeControlPort struct {
+	addr        string
+	methods     string
+	cookieFile  string
+	cookie      []byte
+	password    string
+	socksAddr   string
+	mu          sync.Mutex
+	commands    []string
+	serverNonce []byte
+}
+
+func startFakeControlPort(t *testing.T, methods string) *fakeControlPort {
+	t.Helper()
+	f := &fakeControlPort{
+		methods:     methods,
+		cookie:      []byte(strings.Repeat("c", cookieLength)),
+		password:    "hunter2",
+		socksAddr:   "127.0.0.1:9050",
+		serverNonce: []byte(strings.Repeat("s", 32)),
+	}
+	f.cookieFile = filepath.Join(t.TempDir(), "control_auth_cookie")
+	require.NoError(t, os.WriteFile(f.cookieFile, f.cookie, 0o600))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	f.addr = ln.Addr().String()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeControlPort) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	var clientNonce []byte
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb, args, _ := strings.Cut(line, " ")
+		if !authenticated && verb != "PROTOCOLINFO" && verb != "AUTHENTICATE" && verb != "AUTHCHALLENGE" {
+			fmt.Fprint(conn, "514 Authentication required.\r\n")
+			return
+		}
+
+		switch verb {
+		case "PROTOCOLINFO":
+			fmt.Fprintf(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=%s COOKIEFILE=%q\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n", f.methods, f.cookieFile)
+		case "AUTHCHALLENGE":
+			fields := strings.Fields(args)
+			clientNonce, _ = hex.DecodeString(fields[1])
+			message := append(append(append([]byte{}, f.cookie...), clientNonce...), f.serverNonce...)
+			fmt.Fprintf(conn, "250 AUTHCHALLENGE SERVERHASH=%X SERVERNONCE=%X\r\n", safeCookieHash(safeCookieServerKey, message), f.serverNonce)
+		case "AUTHENTICATE":
+			message := append(append(append([]byte{}, f.cookie...), clientNonce...), f.serverNonce...)
+			switch {
+			case strings.Contains(f.methods, "NULL") && args == "",
+				args == strconv.Quote(f.password),
+				args == hex.EncodeToString(f.cookie),
+				clientNonce != nil && args == hex.EncodeToString(safeCookieHash(safeCookieClientKey, message)):
+				authenticated = true
+				fmt.Fprint(conn, "250 OK\r\n")
+			default:
+				fmt.Fprint(conn, "515 Authentication failed: Wrong length on authentication cookie.\r\n")
+				return
+			}
+		case "ADD_ONION":
+			fmt.Fprintf(conn, "250-ServiceID=%s\r\n", testServiceID)
+			if strings.HasPrefix(args, "NEW:") {
+				fmt.Fprint(conn, "250-PrivateKey=ED25519-V3:c2VjcmV0\r\n")
+			}
+			fmt.Fprint(conn, "250 OK\r\n")
+		case "DEL_ONION":
+			fmt.Fprint(conn, "250 OK\r\n")
+		case "GETINFO":
+			fmt.Fprintf(conn, "250-net/listeners/socks=%q\r\n250 OK\r\n", f.socksAddr)
+		default:
+			fmt.Fprintf(conn, "510 Unrecognized command %q\r\n", verb)
+		}
+	}
+}
+
+func (f *fakeControlPort) lastCommand(prefix string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.commands) - 1; i >= 0; i-- {
+		if strings.HasPrefix(f.commands[i], prefix) {
+			return f.commands[i]
+		}
+	}
+	return ""
+}
+
+func dialFake(t *testing.T, f *fakeControlPort) *Controller {
+	t.Helper()
+	c, err := Dial(context.Background(), network.TCPDialer{Timeout: time.Second}, f.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestProtocolInfo(t *testing.T) {
+	f := startFakeControlPort(t, "COOKIE,SAFECOOKIE")
+	info, err := dialFake(t, f).ProtocolInfo()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"COOKIE", "SAFECOOKIE"}, info.AuthMethods)
+	assert.Equal(t, f.cookieFile, info.CookieFile)
+	assert.Equal(t, "0.4.8.9", info.TorVersion)
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		methods  string
+		password string
+		expected string
+	}{
+		{"null", "NULL", "", "AUTHENTICATE"},
+		{"password", "HASHEDPASSWORD", "hunter2", `AUTHENTICATE "hunter2"`},
+		{"cookie", "COOKIE", "", "AUTHENTICATE " + hex.EncodeToString([]byte(strings.Repeat("c", cookieLength)))},
+		{"safecookie", "COOKIE,SAFECOOKIE", "", "AUTHCHALLENGE SAFECOOKIE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := startFakeControlPort(t, tt.methods)
+			c := dialFake(t, f)
+			require.NoError(t, c.Authenticate(tt.password))
+			assert.NotEmpty(t, f.lastCommand(tt.expected))
+
+			// Authenticated commands are accepted.
+			_, err := c.SOCKSAddr()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	f := startFakeControlPort(t, "COOKIE,SAFECOOKIE")
+	assert.ErrorContains(t, dialFake(t, f).Authenticate("hunter2"), "does not accept password")
+
+	f = startFakeControlPort(t, "HASHEDPASSWORD")
+	assert.ErrorContains(t, dialFake(t, f).Authenticate("wrong"), "515")
+
+	f = startFakeControlPort(t, "HASHEDPASSWORD")
+	assert.ErrorContains(t, dialFake(t, f).Authenticate(""), "no supported authentication method")
+}
+
+func TestAddOnion(t *testing.T) {
+	f := startFakeControlPort(t, "NULL")
+	c := dialFake(t, f)
+	require.NoError(t, c.Authenticate(""))
+
+	service, err := c.AddOnion("", 8333, "127.0.0.1:8334")
+	require.NoError(t, err)
+	assert.Equal(t, "ADD_ONION NEW:ED25519-V3 Port=8333,127.0.0.1:8334", f.lastCommand("ADD_ONION"))
+	assert.Equal(t, testServiceID, service.ServiceID)
+	assert.Equal(t, "ED25519-V3:c2VjcmV0", service.PrivateKey)
+	assert.Equal(t, testServiceID+".onion", service.Hostname())
+
+	addr, err := service.Addr(1)
+	require.NoError(t, err)
+	assert.Equal(t, byte(netaddr.NetworkTorV3), addr.Network)
+	assert.Equal(t, testServiceID+".onion:8333", addr.String())
+
+	reused, err := c.AddOnion(service.PrivateKey, 8333, "127.0.0.1:8334")
+	require.NoError(t, err)
+	assert.Equal(t, "ADD_ONION ED25519-V3:c2VjcmV0 Port=8333,127.0.0.1:8334", f.lastCommand("ADD_ONION"))
+	assert.Equal(t, service.PrivateKey, reused.PrivateKey)
+
+	require.NoError(t, c.DelOnion(service.ServiceID))
+}
+
+func TestSOCKSAddr(t *testing.T) {
+	f := startFakeControlPort(t, "NULL")
+	c := dialFake(t, f)
+	require.NoError(t, c.Authenticate(""))
+
+	addr, err := c.SOCKSAddr()
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9050", addr)
+}
+
+func TestParseKeyValues(t *testing.T) {
+	values := parseKeyValues(`METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/var/run/tor/control \"auth\" cookie" Tor="0.4.8.9"`)
+	assert.Equal(t, "COOKIE,SAFECOOKIE", values["METHODS"])
+	assert.Equal(t, `/var/run/tor/control "auth" cookie`, values["COOKIEFILE"])
+	assert.Equal(t, "0.4.8.9", values["Tor"])
+}
+
+type recordingDialer struct {
+	name  string
+	dials *[]string
+}
+
+func (d recordingDialer) Dial(ctx context.Context, addr string) (network.Conn, error) {
+	*d.dials = append(*d.dials, d.name+" "+addr)
+	return nil, nil
+}
+
+func TestDialerRoutesOnion(t *testing.T) {
+	var dials []string
+	d := Dialer{SOCKS: recordingDialer{"socks", &dials}, Clearnet: recordingDialer{"direct", &dials}}
+	d.Dial(context.Background(), testServiceID+".onion:8333")
+	d.Dial(context.Background(), "1.2.3.4:8333")
+
+	torOnly := Dialer{SOCKS: recordingDialer{"socks", &dials}}
+	torOnly.Dial(context.Background(), "1.2.3.4:8333")
+
+	assert.Equal(t, []string{"socks " + testServiceID + ".onion:8333", "direct 1.2.3.4:8333", "socks 1.2.3.4:8333"}, dials)
+}
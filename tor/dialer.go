@@ -0,0 +1,28 @@
+package tor
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/network"
+)
+
+// Dialer sends .onion connections through Tor's SOCKS port and everything
+// else through Clearnet. Without Clearnet every connection goes through Tor.
+type Dialer struct {
+	SOCKS    network.Dialer
+	Clearnet network.Dialer
+}
+
+// Dial connects to addr.
+func (d Dialer) Dial(ctx context.Context, addr string) (network.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.Clearnet == nil || strings.HasSuffix(strings.ToLower(host), ".onion") {
+		return d.SOCKS.Dial(ctx, addr)
+	}
+	return d.Clearnet.Dial(ctx, addr)
+}
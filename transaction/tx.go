@@ -0,0 +1,317 @@
+// Package transaction implements bitcoin transactions and their legacy and
+// BIP144 witness serializations.
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+)
+
+const (
+	// WitnessScaleFactor is the weight of a non-witness byte (BIP141).
+	WitnessScaleFactor = 4
+	// MaxTxSize bounds a serialized transaction: nothing larger fits in a
+	// block.
+	MaxTxSize = 4_000_000
+
+	witnessMarker = 0x00
+	witnessFlag   = 0x01
+
+	// minTxInSize and minTxOutSize are the smallest serialized inputs and
+	// outputs, used to reject absurd counts before allocating.
+	minTxInSize  = 41
+	minTxOutSize = 9
+)
+
+var (
+	// ErrSuperfluousWitness is returned for a witness serialization whose
+	// witnesses are all empty.
+	ErrSuperfluousWitness = errors.New("superfluous witness record")
+	// ErrUnknownFlags is returned for a witness flag other than 0x01.
+	ErrUnknownFlags = errors.New("unknown optional data in transaction")
+)
+
+// OutPoint identifies the output spent by an input.
+type OutPoint struct {
+	Hash  utils.Hash
+	Index uint32
+}
+
+// String returns the outpoint as txid:index.
+func (o OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", o.Hash, o.Index)
+}
+
+// TxIn is a transaction input.
+type TxIn struct {
+	PreviousOutPoint OutPoint
+	SignatureScript  []byte
+	Witness          [][]byte
+	Sequence         uint32
+}
+
+// TxOut is a transaction output.
+type TxOut struct {
+	Value    int64
+	PkScript []byte
+}
+
+// Tx is a bitcoin transaction.
+type Tx struct {
+	Version  int32
+	TxIn     []TxIn
+	TxOut    []TxOut
+	LockTime uint32
+}
+
+// HasWitness reports whether any input carries witness data, in which case
+// the transaction is serialized in the BIP144 format.
+func (tx *Tx) HasWitness() bool {
+	for _, in := range tx.TxIn {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCoinBase reports whether tx is a coinbase transaction.
+func (tx *Tx) IsCoinBase() bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutPoint.Index == 0xffffffff &&
+		tx.TxIn[0].PreviousOutPoint.Hash == utils.Hash{}
+}
+
+// TxID returns the hash of the legacy serialization.
+func (tx *Tx) TxID() utils.Hash {
+	var buf bytes.Buffer
+	tx.serialize(&buf, false)
+	return utils.DoubleSHA256(buf.Bytes())
+}
+
+// WTxID returns the hash of the witness serialization. It equals the txid
+// for transactions without witness data.
+func (tx *Tx) WTxID() utils.Hash {
+	return utils.DoubleSHA256(tx.Bytes())
+}
+
+// Bytes returns the serialization of tx, with witness data if it has any.
+func (tx *Tx) Bytes() []byte {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	return buf.Bytes()
+}
+
+// Serialize writes tx in the witness format if it has witness data and in
+// the legacy format otherwise.
+func (tx *Tx) Serialize(w io.Writer) error {
+	return tx.serialize(w, tx.HasWitness())
+}
+
+// SerializeNoWitness writes tx in the legacy format.
+func (tx *Tx) SerializeNoWitness(w io.Writer) error {
+	return tx.serialize(w, false)
+}
+
+func (tx *Tx) serialize(w io.Writer, witness bool) error {
+	if err := binary.Write(w, binary.LittleEndian, tx.Version); err != nil {
+		return err
+	}
+	if witness {
+		if _, err := w.Write([]byte{witnessMarker, witnessFlag}); err != nil {
+			return err
+		}
+	}
+
+	if err := utils.WriteVarInt(w, uint64(len(tx.TxIn))); err != nil {
+		return err
+	}
+	for _, in := range tx.TxIn {
+		if _, err := w.Write(in.PreviousOutPoint.Hash[:]); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, in.PreviousOutPoint.Index); err != nil {
+			return err
+		}
+		if err := utils.WriteVarBytes(w, in.SignatureScript); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, in.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if err := utils.WriteVarInt(w, uint64(len(tx.TxOut))); err != nil {
+		return err
+	}
+	for _, out := range tx.TxOut {
+		if err := binary.Write(w, binary.LittleEndian, out.Value); err != nil {
+			return err
+		}
+		if err := utils.WriteVarBytes(w, out.PkScript); err != nil {
+			return err
+		}
+	}
+
+	if witness {
+		for _, in := range tx.TxIn {
+			if err := utils.WriteVarInt(w, uint64(len(in.Witness))); err != nil {
+				return err
+			}
+			for _, item := range in.Witness {
+				if err := utils.WriteVarBytes(w, item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, tx.LockTime)
+}
+
+// BaseSize returns the size of the legacy serialization.
+func (tx *Tx) BaseSize() int {
+	var buf bytes.Buffer
+	tx.serialize(&buf, false)
+	return buf.Len()
+}
+
+// TotalSize returns the size of the serialization including witness data.
+func (tx *Tx) TotalSize() int {
+	return len(tx.Bytes())
+}
+
+// Weight returns the BIP141 weight: three times the base size plus the
+// total size.
+func (tx *Tx) Weight() int {
+	return tx.BaseSize()*(WitnessScaleFactor-1) + tx.TotalSize()
+}
+
+// VSize returns the virtual size, the weight divided by four rounded up.
+func (tx *Tx) VSize() int {
+	return (tx.Weight() + WitnessScaleFactor - 1) / WitnessScaleFactor
+}
+
+// ReadTx reads a transaction in either format. A zero input count followed
+// by the 0x01 flag marks the witness format, as Bitcoin Core detects it.
+func ReadTx(r io.Reader) (*Tx, error) {
+	tx := &Tx{}
+	if err := binary.Read(r, binary.LittleEndian, &tx.Version); err != nil {
+		return nil, err
+	}
+
+	inCount, err := readCount(r, minTxInSize)
+	if err != nil {
+		return nil, err
+	}
+	var flag byte
+	if inCount == 0 {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		flag = b[0]
+		if flag == 0 {
+			// An empty legacy transaction: no inputs and no outputs.
+			return tx, readLockTime(r, tx)
+		}
+		if inCount, err = readCount(r, minTxInSize); err != nil {
+			return nil, err
+		}
+	}
+	if flag != 0 && flag != witnessFlag {
+		return nil, ErrUnknownFlags
+	}
+
+	tx.TxIn = make([]TxIn, inCount)
+	for i := range tx.TxIn {
+		in := &tx.TxIn[i]
+		if _, err := io.ReadFull(r, in.PreviousOutPoint.Hash[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.PreviousOutPoint.Index); err != nil {
+			return nil, err
+		}
+		if in.SignatureScript, err = utils.ReadVarBytes(r, MaxTxSize); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &in.Sequence); err != nil {
+			return nil, err
+		}
+	}
+
+	outCount, err := readCount(r, minTxOutSize)
+	if err != nil {
+		return nil, err
+	}
+	tx.TxOut = make([]TxOut, outCount)
+	for i := range tx.TxOut {
+		out := &tx.TxOut[i]
+		if err := binary.Read(r, binary.LittleEndian, &out.Value); err != nil {
+			return nil, err
+		}
+		if out.PkScript, err = utils.ReadVarBytes(r, MaxTxSize); err != nil {
+			return nil, err
+		}
+	}
+
+	if flag == witnessFlag {
+		for i := range tx.TxIn {
+			items, err := readCount(r, 1)
+			if err != nil {
+				return nil, err
+			}
+			// The witness grows as its items are read: the count alone
+			// could make a few bytes allocate megabytes.
+			for j := uint64(0); j < items; j++ {
+				item, err := utils.ReadVarBytes(r, MaxTxSize)
+				if err != nil {
+					return nil, err
+				}
+				tx.TxIn[i].Witness = append(tx.TxIn[i].Witness, item)
+			}
+		}
+		if !tx.HasWitness() {
+			return nil, ErrSuperfluousWitness
+		}
+	}
+	return tx, readLockTime(r, tx)
+}
+
+func readLockTime(r io.Reader, tx *Tx) error {
+	return binary.Read(r, binary.LittleEndian, &tx.LockTime)
+}
+
+// readCount reads a count of items that take at least minSize bytes each,
+// rejecting counts that cannot fit in a transaction.
+func readCount(r io.Reader, minSize uint64) (uint64, error) {
+	count, err := utils.ReadVarInt(r)
+	if err != nil {
+		return 0, err
+	}
+	if count > MaxTxSize/minSize {
+		return 0, fmt.Errorf("too many items in transaction: %d", count)
+	}
+	return count, nil
+}
+
+// EncodeTxMessage returns the payload of a tx message.
+func EncodeTxMessage(tx *Tx) []byte {
+	return tx.Bytes()
+}
+
+// DecodeTxMessage parses the payload of a tx message.
+func DecodeTxMessage(payload []byte) (*Tx, error) {
+	r := bytes.NewReader(payload)
+	tx, err := ReadTx(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after transaction", r.Len())
+	}
+	return tx, nil
+}
@@ -0,0 +1,176 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/hex"
+	"runtime"
+	"testing"
+
+	"github.com/safwentrabelsi/bitcoin-handshake/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Mainnet transactions. The expected sizes and hashes were checked against
+// the merkle roots and witness commitments of the blocks they come from.
+var mainnetTxs = []struct {
+	name                          string
+	hex                           string
+	txid, wtxid                   string
+	size, baseSize, weight, vsize int
+	inputs, outputs               int
+}{
+	{
+		name:  "block 170, first bitcoin payment",
+		hex:   "0100000001c997a5e56e104102fa209c6a852dd90660a20b2d9c352423edce25857fcd3704000000004847304402204e45e16932b8af514961a1d3a1a25fdf3f4f7732e9d624c6c61548ab5fb8cd410220181522ec8eca07de4860a4acdd12909d831cc56cbbac4622082221a8768d1d0901ffffffff0200ca9a3b00000000434104ae1a62fe09c5f51b13905f07f06b99a2f7159b2225f374cd378d71302fa28414e7aab37397f554a7df5f142c21c1b7303b8a0626f1baded5c72a704f7e6cd84cac00286bee0000000043410411db93e1dcdb8a016b49840f8c53bc1eb68a382e97b1482ecad7b148a6909a5cb2e0eaddfb84ccf9744464f82e160bfa9b8b64f9d4c03f999b8643f656b412a3ac00000000",
+		txid:  "f4184fc596403b9d638783cf57adfe4c75c605f6356fbc91338530e9831e9e16",
+		wtxid: "f4184fc596403b9d638783cf57adfe4c75c605f6356fbc91338530e9831e9e16",
+		size:  275, baseSize: 275, weight: 1100, vsize: 275,
+		inputs: 1, outputs: 2,
+	},
+	{
+		name:  "legacy P2PKH spend with two inputs",
+		hex:   "010000000282304d3d90fef720c739b21ef231680d54956761d53385155b7d19f211aa87e8010000006b483045022100c0e0646102bf43cbd5267fea68a0ebbbcfbb71b0906926ff1cdb750cca5fd5690220728bde9a00b8f3dfa20f677d35e45bc3dbc7faf9d64b626e84542824b112ff4d012103f7fb1ad15f37ebfde6d086a8cc54e0764960c3304f9f23f0ef7fd9baf4745476feffffff8f29b21b5821297b4f2db6ae1ba7b81a7fa57a1ff99026d230dee5e90c71abe8010000006b483045022100f619a39acb34a6258a77472a3bac2d3d0454b5d1b5760cab4266417c37b5da7402200676239b4ee85083fff919853b4895323a424c41ea34f16aa5a7bb557a9830d701210382f1b42cccad0418ef14b09e98d6a8890feea225096f18e72856afbdbd0adadafeffffff02345e0707000000001976a9140c0cd66f69f261944705bd2db9c9920dce4798e688ac496c0000000000001976a9146f2a8bd74688a13b2e7d49df2bd770e9ae7b506788acf7c20800",
+		txid:  "3a37a383368d85d46589746ffc77c966a79f6d2dc0a6530d5f1bcaa1f45c3a92",
+		wtxid: "3a37a383368d85d46589746ffc77c966a79f6d2dc0a6530d5f1bcaa1f45c3a92",
+		size:  374, baseSize: 374, weight: 1496, vsize: 374,
+		inputs: 2, outputs: 2,
+	},
+	{
+		name:  "P2SH-P2WPKH spend with two inputs",
+		hex:   "02000000000102fd57e0032bb500a3150b5b76eac0bc5b58134112feed5fa46fde9b2c71ad88df0200000017160014d45601173dbb29b9abdc1a7aa2603433b0972089fefffffff0b6d3c00b48811436b81ce24a7a3566602ebc8b1201e3fe9aa70762459c51820000000017160014a13cef51fa68891534d05ee0c8310baac24a2a87feffffff014fd273000000000017a91470359a40ba56af1fb7c9e6446e96136e25bce43f870247304402205686474a7f19cf8b446777504bfca3ecf857066ddeaf3ba39ab832f2f444136e02204fa545d3db75079b31313e9c16d26be072fd31a7670e65b1fdde34b85862d8a90121024fdea9bb7d3f66e54c99e7a57beddf3ad3b4494a17690195a3001bf6a1c4d8a80247304402201f479276ffa977629df7469f7449887a015cffa938e0f86f0ac2d626dc44dd8102206b34258151abf88266fd31d4e26c80f9b25a79ae7a8a87d33e6c74b38237c1a4012103991809d8d402e6d5ebec6df4c58a4064775618a58f06eb48a901b5d8de559c69f7c20800",
+		txid:  "93df35c97dbbf729291001ca79a0d5e94a5dcdb44319d9d134024b9b62dfa969",
+		wtxid: "4de216587d46039f6c61a1d336483be0ea1d07d53ae273a5acfd6526e57f6109",
+		size:  386, baseSize: 170, weight: 896, vsize: 224,
+		inputs: 2, outputs: 1,
+	},
+	{
+		name:  "segwit coinbase of block 00000000000000000021868c2cefc52a480d173c849412fe81c4e5ab806f94ab",
+		hex:   "020000000001010000000000000000000000000000000000000000000000000000000000000000ffffffff4b03cb3d08042467905b642f4254432e434f4d2ffabe6d6d61ea3fdfc3d238e128fb27c97f95d4bd49881fcf8784fc34ae86bcb827505eba0100000000000000300f894eba58000000000000ffffffff03b203c64a0000000016001497cfc76442fe717f2a3f0cc9c175f7561b6619970000000000000000266a24aa21a9ed7c6e421f55cf406e383b46d829600dee545f127de76bb3ec4dc8fea7ea96d70900000000000000002952534b424c4f434b3ae3fc068128effed4a212959a1f8fde5d7caa01226071d40c530b99f90e099ed50120000000000000000000000000000000000000000000000000000000000000000000000000",
+		txid:  "5301a7831d21d8395e511ba4786ddcd71b630148bd6bb902f4b1c71b7df563ed",
+		wtxid: "3666706b91ecca3405e929eaf40a2c3b2b13f2d82da724c579c00a692feec268",
+		size:  290, baseSize: 254, weight: 1052, vsize: 263,
+		inputs: 1, outputs: 3,
+	},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestMainnetTransactions(t *testing.T) {
+	for _, tt := range mainnetTxs {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := decodeHex(t, tt.hex)
+			tx, err := DecodeTxMessage(raw)
+			require.NoError(t, err)
+
+			assert.Len(t, tx.TxIn, tt.inputs)
+			assert.Len(t, tx.TxOut, tt.outputs)
+			assert.Equal(t, tt.txid, tx.TxID().String())
+			assert.Equal(t, tt.wtxid, tx.WTxID().String())
+			assert.Equal(t, tt.txid != tt.wtxid, tx.HasWitness())
+			assert.Equal(t, tt.size, tx.TotalSize())
+			assert.Equal(t, tt.baseSize, tx.BaseSize())
+			assert.Equal(t, tt.weight, tx.Weight())
+			assert.Equal(t, tt.vsize, tx.VSize())
+
+			assert.Equal(t, raw, EncodeTxMessage(tx), "re-serialization must be byte-identical")
+
+			var legacy bytes.Buffer
+			require.NoError(t, tx.SerializeNoWitness(&legacy))
+			assert.Equal(t, tt.txid, utils.DoubleSHA256(legacy.Bytes()).String())
+		})
+	}
+}
+
+func TestTransactionFields(t *testing.T) {
+	tx, err := DecodeTxMessage(decodeHex(t, mainnetTxs[0].hex))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), tx.Version)
+	assert.Equal(t, "0437cd7f8525ceed2324359c2d0ba26006d92d856a9c20fa0241106ee5a597c9:0", tx.TxIn[0].PreviousOutPoint.String())
+	assert.Equal(t, uint32(0xffffffff), tx.TxIn[0].Sequence)
+	assert.Equal(t, int64(10*100_000_000), tx.TxOut[0].Value)
+	assert.Equal(t, int64(40*100_000_000), tx.TxOut[1].Value)
+	assert.False(t, tx.IsCoinBase())
+
+	coinbase, err := DecodeTxMessage(decodeHex(t, mainnetTxs[3].hex))
+	require.NoError(t, err)
+	assert.True(t, coinbase.IsCoinBase())
+	require.Len(t, coinbase.TxIn[0].Witness, 1)
+	assert.Len(t, coinbase.TxIn[0].Witness[0], 32, "witness reserved value")
+
+	segwit, err := DecodeTxMessage(decodeHex(t, mainnetTxs[2].hex))
+	require.NoError(t, err)
+	for _, in := range segwit.TxIn {
+		assert.Len(t, in.Witness, 2, "signature and public key")
+	}
+	assert.Equal(t, uint32(0x0008c2f7), segwit.LockTime)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	legacy := decodeHex(t, mainnetTxs[0].hex)
+	segwit := decodeHex(t, mainnetTxs[2].hex)
+
+	_, err := DecodeTxMessage(legacy[:len(legacy)-1])
+	assert.Error(t, err, "truncated")
+
+	_, err = DecodeTxMessage(append(legacy, 0x00))
+	assert.ErrorContains(t, err, "trailing")
+
+	badFlag := bytes.Clone(segwit)
+	badFlag[5] = 0x02
+	_, err = DecodeTxMessage(badFlag)
+	assert.ErrorIs(t, err, ErrUnknownFlags)
+
+	// Witness format with every witness empty.
+	tx, err := DecodeTxMessage(segwit)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, tx.SerializeNoWitness(&buf))
+	noWitness := buf.Bytes()
+	superfluous := append([]byte{}, noWitness[:4]...)
+	superfluous = append(superfluous, 0x00, 0x01)
+	superfluous = append(superfluous, noWitness[4:len(noWitness)-4]...)
+	superfluous = append(superfluous, 0x00, 0x00)
+	superfluous = append(superfluous, noWitness[len(noWitness)-4:]...)
+	_, err = DecodeTxMessage(superfluous)
+	assert.ErrorIs(t, err, ErrSuperfluousWitness)
+
+	// A witness claiming the maximum number of items is cut short without
+	// allocating room for all of them.
+	manyItems := append([]byte{}, superfluous[:len(superfluous)-6]...)
+	manyItems = append(manyItems, 0xfe, 0x00, 0x09, 0x3d, 0x00)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = DecodeTxMessage(manyItems)
+	runtime.ReadMemStats(&after)
+	assert.Error(t, err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	huge := []byte{0x01, 0x00, 0x00, 0x00, 0xfe, 0xff, 0xff, 0xff, 0x00}
+	_, err = DecodeTxMessage(huge)
+	assert.ErrorContains(t, err, "too many")
+}
+
+func TestBuildTransaction(t *testing.T) {
+	tx := &Tx{
+		Version: 2,
+		TxIn: []TxIn{{
+			PreviousOutPoint: OutPoint{Hash: utils.DoubleSHA256([]byte("prev")), Index: 1},
+			SignatureScript:  []byte{},
+			Sequence:         0xfffffffd,
+			Witness:          [][]byte{{0x01, 0x02}, {0x03}},
+		}},
+		TxOut:    []TxOut{{Value: 5000, PkScript: []byte{0x00, 0x14}}},
+		LockTime: 800000,
+	}
+	decoded, err := DecodeTxMessage(EncodeTxMessage(tx))
+	require.NoError(t, err)
+	assert.Equal(t, tx, decoded)
+	assert.NotEqual(t, tx.TxID(), tx.WTxID())
+	assert.Equal(t, tx.BaseSize()*3+tx.TotalSize(), tx.Weight())
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// HashSize is the size of a double-SHA256 hash.
+const HashSize = 32
+
+// Hash is a double-SHA256 hash, such as a txid or a block hash, in the byte
+// order used on the wire.
+type Hash [HashSize]byte
+
+// DoubleSHA256 returns SHA256(SHA256(data)).
+func DoubleSHA256(data []byte) Hash {
+	first := sha256.Sum256(data)
+	return Hash(sha256.Sum256(first[:]))
+}
+
+// String returns the hash in the byte-reversed hex form shown by Bitcoin
+// Core and block explorers.
+func (h Hash) String() string {
+	reversed := h
+	for i := 0; i < HashSize/2; i++ {
+		reversed[i], reversed[HashSize-1-i] = reversed[HashSize-1-i], reversed[i]
+	}
+	return hex.EncodeToString(reversed[:])
+}
+
+// NewHashFromString parses a hash in the byte-reversed hex form.
+func NewHashFromString(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != HashSize {
+		return h, fmt.Errorf("invalid hash length: %d", len(b))
+	}
+	for i := range b {
+		h[HashSize-1-i] = b[i]
+	}
+	return h, nil
+}
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoubleSHA256(t *testing.T) {
+	h := DoubleSHA256(nil)
+	assert.Equal(t, "5df6e0e2761359d30a8275058e299fcc0381534545f55cf43e41983f5d4c9456", hex.EncodeToString(h[:]))
+	assert.Equal(t, CalculateChecksum(nil), [4]byte(h[:4]))
+}
+
+func TestHashString(t *testing.T) {
+	const genesis = "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"
+	h, err := NewHashFromString(genesis)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x6f), h[0], "the wire order is reversed")
+	assert.Equal(t, genesis, h.String())
+
+	_, err = NewHashFromString("00ff")
+	assert.Error(t, err)
+	_, err = NewHashFromString("zz")
+	assert.Error(t, err)
+}
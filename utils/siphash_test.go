@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSipHash(t *testing.T) {
+	// Vectors of the SipHash paper: the key is 00 01 ... 0f and the message
+	// the first n bytes of 00 01 02 ...
+	const k0, k1 = 0x0706050403020100, 0x0f0e0d0c0b0a0908
+	msg := make([]byte, 16)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	assert.Equal(t, uint64(0x726fdb47dd0e0e31), SipHash(k0, k1, nil))
+	assert.Equal(t, uint64(0x74f839c593dc67fd), SipHash(k0, k1, msg[:1]))
+	assert.Equal(t, uint64(0x93f5f5799a932462), SipHash(k0, k1, msg[:8]))
+	assert.Equal(t, uint64(0xa129ca6149be45e5), SipHash(k0, k1, msg[:15]))
+}
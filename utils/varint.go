@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// WriteVarInt writes n as a CompactSize integer.
+func WriteVarInt(w io.Writer, n uint64) error {
+	var buf []byte
+	switch {
+	case n < 0xfd:
+		buf = []byte{byte(n)}
+	case n <= 0xffff:
+		buf = binary.LittleEndian.AppendUint16([]byte{0xfd}, uint16(n))
+	case n <= 0xffffffff:
+		buf = binary.LittleEndian.AppendUint32([]byte{0xfe}, uint32(n))
+	default:
+		buf = binary.LittleEndian.AppendUint64([]byte{0xff}, n)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadVarInt reads a CompactSize integer. Non-canonical encodings are
+// rejected.
+func ReadVarInt(r io.Reader) (uint64, error) {
+	var prefix [1]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, err
+	}
+
+	var n, min uint64
+	switch prefix[0] {
+	case 0xfd:
+		var v uint16
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return 0, err
+		}
+		n, min = uint64(v), 0xfd
+	case 0xfe:
+		var v uint32
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return 0, err
+		}
+		n, min = uint64(v), 0x10000
+	case 0xff:
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return 0, err
+		}
+		min = 0x100000000
+	default:
+		return uint64(prefix[0]), nil
+	}
+
+	if n < min {
+		return 0, fmt.Errorf("non-canonical varint %x", n)
+	}
+	return n, nil
+}
+
+// WriteVarBytes writes b prefixed with its length.
+func WriteVarBytes(w io.Writer, b []byte) error {
+	if err := WriteVarInt(w, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadVarBytes reads a length-prefixed byte slice of at most max bytes.
+func ReadVarBytes(r io.Reader, max uint64) ([]byte, error) {
+	n, err := ReadVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("byte array too long: %d > %d", n, max)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
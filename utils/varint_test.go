@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	tests := []struct {
+		n       uint64
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{0xfc, []byte{0xfc}},
+		{0xfd, []byte{0xfd, 0xfd, 0x00}},
+		{0xffff, []byte{0xfd, 0xff, 0xff}},
+		{0x10000, []byte{0xfe, 0x00, 0x00, 0x01, 0x00}},
+		{0x100000000, []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		require.NoError(t, WriteVarInt(&buf, tt.n))
+		assert.Equal(t, tt.encoded, buf.Bytes())
+
+		n, err := ReadVarInt(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, tt.n, n)
+	}
+}
+
+func TestReadVarIntNonCanonical(t *testing.T) {
+	_, err := ReadVarInt(bytes.NewReader([]byte{0xfd, 0x10, 0x00}))
+	assert.Error(t, err)
+	_, err = ReadVarInt(bytes.NewReader([]byte{0xfe, 0xff, 0xff, 0x00, 0x00}))
+	assert.Error(t, err)
+}
+
+func TestReadVarBytes(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteVarBytes(&buf, []byte("satoshi")))
+	b, err := ReadVarBytes(bytes.NewReader(buf.Bytes()), 10)
+	require.NoError(t, err)
+	assert.Equal(t, "satoshi", string(b))
+
+	_, err = ReadVarBytes(bytes.NewReader(buf.Bytes()), 3)
+	assert.Error(t, err)
+}
@@ -22,22 +22,25 @@ type VersionMessage struct {
 	Relay       bool
 }
 
-func MakeVersionPayload() ([]byte, error) {
+// MakeVersionPayload returns the payload of our version message,
+// advertising services and the height of our best chain. relay asks the
+// peer to announce transactions to us (BIP37).
+func MakeVersionPayload(services uint64, startHeight int32, relay bool) ([]byte, error) {
 	var buf bytes.Buffer
 
 	if err := binary.Write(&buf, binary.LittleEndian, int32(config.ProtocolVersion)); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(&buf, binary.LittleEndian, uint64(config.Services)); err != nil {
+	if err := binary.Write(&buf, binary.LittleEndian, services); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(&buf, binary.LittleEndian, uint64(time.Now().Unix())); err != nil {
 		return nil, err
 	}
-	if err := netaddr.WriteNetAddr(&buf, netaddr.NewNetAddr(config.BTCNodeHost, config.BTCNodePort, config.Services)); err != nil {
+	if err := netaddr.WriteNetAddr(&buf, netaddr.NewNetAddr(config.BTCNodeHost, config.BTCNodePort, services)); err != nil {
 		return nil, err
 	}
-	if err := netaddr.WriteNetAddr(&buf, netaddr.NewNetAddr(config.Host, config.Port, config.Services)); err != nil {
+	if err := netaddr.WriteNetAddr(&buf, netaddr.NewNetAddr(config.Host, config.Port, services)); err != nil {
 		return nil, err
 	}
 	if err := binary.Write(&buf, binary.LittleEndian, uint64(config.NodeID)); err != nil {
@@ -49,10 +52,14 @@ func MakeVersionPayload() ([]byte, error) {
 	if _, err := buf.WriteString(config.UserAgent); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(&buf, binary.LittleEndian, int32(config.StartHeight)); err != nil {
+	if err := binary.Write(&buf, binary.LittleEndian, startHeight); err != nil {
 		return nil, err
 	}
-	if err := buf.WriteByte(0); err != nil {
+	var relayByte byte
+	if relay {
+		relayByte = 1
+	}
+	if err := buf.WriteByte(relayByte); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
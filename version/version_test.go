@@ -15,7 +15,7 @@ import (
 func TestMakeVersionPayload(t *testing.T) {
 	// Setup test config
 
-	payload, err := MakeVersionPayload()
+	payload, err := MakeVersionPayload(config.Services, config.StartHeight, false)
 	assert.NoError(t, err, "MakeVersionPayload should not return an error")
 
 	var versionMsg VersionMessage
@@ -51,6 +51,26 @@ func TestMakeVersionPayload(t *testing.T) {
 	assert.Equal(t, uint8(0), relay, "Relay should be 0")
 }
 
+func TestMakeVersionPayloadServices(t *testing.T) {
+	services := uint64(config.NodeNetworkLimited | config.NodeWitness)
+	payload, err := MakeVersionPayload(services, 840000, true)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader(payload)
+	var msg VersionMessage
+	assert.NoError(t, binary.Read(reader, binary.LittleEndian, &msg.Version))
+	assert.NoError(t, binary.Read(reader, binary.LittleEndian, &msg.Services))
+	assert.Equal(t, services, msg.Services)
+	assert.NoError(t, binary.Read(reader, binary.LittleEndian, &msg.Timestamp))
+	assert.NoError(t, netaddr.ParseNetAddr(reader, &msg.AddrRecv))
+	assert.NoError(t, netaddr.ParseNetAddr(reader, &msg.AddrFrom))
+	assert.Equal(t, services, msg.AddrFrom.Services)
+
+	// The start height is followed by the relay flag.
+	assert.Equal(t, int32(840000), int32(binary.LittleEndian.Uint32(payload[len(payload)-5:])))
+	assert.Equal(t, byte(1), payload[len(payload)-1])
+}
+
 func TestWriteMessageHeader(t *testing.T) {
 	// Setup test data
 	command := "version"